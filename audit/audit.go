@@ -0,0 +1,207 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cantara/nerthus/job"
+	"gopkg.in/yaml.v3"
+)
+
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeFailed  Outcome = "failed"
+)
+
+// Entry is one call to Nerthus, who made it, what was sent and what it did in aws.
+type Entry struct {
+	Id         string          `json:"id"`
+	Time       time.Time       `json:"time"`
+	User       string          `json:"user"`
+	Method     string          `json:"method"`
+	Endpoint   string          `json:"endpoint"`
+	Scope      string          `json:"scope,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	Status     int             `json:"status"`
+	Outcome    Outcome         `json:"outcome"`
+	Error      string          `json:"error,omitempty"`
+	DurationMs int64           `json:"duration_ms"`
+	Job        string          `json:"job,omitempty"`
+	Resources  []job.Resource  `json:"resources,omitempty"`
+}
+
+// Filter selects entries in List, empty fields matches everything.
+type Filter struct {
+	Scope string
+	User  string
+	From  time.Time
+	To    time.Time
+	// Limit only returns the last entries that matches.
+	Limit int
+}
+
+func (f Filter) matches(e Entry) bool {
+	return (f.Scope == "" || e.Scope == f.Scope) &&
+		(f.User == "" || e.User == f.User) &&
+		(f.From.IsZero() || !e.Time.Before(f.From)) &&
+		(f.To.IsZero() || e.Time.Before(f.To))
+}
+
+type store struct {
+	file  string
+	out   *os.File
+	next  int
+	mutex sync.Mutex
+}
+
+var s store
+
+// Init opens the audit log for appending, it is a file with one json entry per line that is never rewritten.
+func Init(file string) (err error) {
+	err = os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return
+	}
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.out != nil {
+		s.out.Close()
+	}
+	s.file = file
+	s.out = out
+	return
+}
+
+// Record appends the entry to the audit log. Does nothing if the audit log is not initialized.
+func Record(e Entry) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.out == nil {
+		return
+	}
+	if e.Id == "" {
+		s.next++
+		e.Id = fmt.Sprintf("%d-%d", e.Time.UnixNano(), s.next)
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	_, err = s.out.Write(append(data, '\n'))
+	if err != nil {
+		return
+	}
+	return s.out.Sync()
+}
+
+// List returns the entries that matches the filter, oldest first.
+func List(f Filter) (entries []Entry, err error) {
+	entries = []Entry{}
+	s.mutex.Lock()
+	file := s.file
+	s.mutex.Unlock()
+	if file == "" {
+		return
+	}
+	in, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		err = json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return nil, fmt.Errorf("while reading audit log %s: %w", file, err)
+		}
+		if !f.matches(e) {
+			continue
+		}
+		entries = append(entries, e)
+		if f.Limit > 0 && len(entries) > f.Limit {
+			entries = entries[1:]
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// sensitive are the parts of field names that are redacted from bodies, like scope keys, passwords and service
+// properties, which often has credentials in them.
+var sensitive = []string{"key", "password", "secret", "token", "properties"}
+
+const redacted = "[redacted]"
+
+// Sanitize returns the body as json with every sensitive field redacted. Json, yaml and forms are understood, other
+// bodies are only recorded with their size.
+func Sanitize(body []byte, contentType string) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	var v any
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		values, err := url.ParseQuery(string(body))
+		if err == nil {
+			m := make(map[string]any)
+			for k, vs := range values {
+				m[k] = strings.Join(vs, ",")
+			}
+			v = m
+		}
+	} else if err := yaml.Unmarshal(body, &v); err != nil {
+		v = nil
+	}
+	if _, ok := v.(map[string]any); !ok {
+		if _, ok := v.([]any); !ok {
+			v = fmt.Sprintf("[%d bytes]", len(body))
+		}
+	}
+	data, err := json.Marshal(redact(v))
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprintf("[%d bytes]", len(body)))
+	}
+	return data
+}
+
+func redact(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k := range v {
+			if isSensitive(k) {
+				v[k] = redacted
+				continue
+			}
+			v[k] = redact(v[k])
+		}
+	case []any:
+		for i := range v {
+			v[i] = redact(v[i])
+		}
+	}
+	return v
+}
+
+func isSensitive(field string) bool {
+	field = strings.ToLower(field)
+	for _, s := range sensitive {
+		if strings.Contains(field, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cantara/nerthus/job"
+	"github.com/gin-gonic/gin"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+		expected    string
+	}{
+		{"json", `{"key":"crypt","service":{"artifact_id":"app","local_override_properties":"db.password=x"}}`, "application/json",
+			`{"key":"[redacted]","service":{"artifact_id":"app","local_override_properties":"[redacted]"}}`},
+		{"yaml", "scope: devtest\nkey: crypt\n", "application/yaml", `{"key":"[redacted]","scope":"devtest"}`},
+		{"form", "scope=devtest&password=x", "application/x-www-form-urlencoded", `{"password":"[redacted]","scope":"devtest"}`},
+		{"other", "just text", "text/plain", `"[9 bytes]"`},
+		{"empty", "", "application/json", ``},
+	}
+	for _, test := range tests {
+		got := string(Sanitize([]byte(test.body), test.contentType))
+		if got != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	err := Init(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	r := gin.New()
+	g := r.Group("", func(c *gin.Context) {
+		c.Set(gin.AuthUserKey, c.GetHeader("X-User"))
+	}, Middleware())
+	g.PUT("/scope/:scope", func(c *gin.Context) {
+		j, _ := job.Start("create "+c.Param("scope"), c.GetString(gin.AuthUserKey), c.Param("scope"), func(j *job.Job) (map[string]string, error) {
+			<-release
+			j.AddResource(job.ActionCreated, "security_group", "sg-1")
+			return nil, nil
+		})
+		SetJob(c, j)
+		c.Status(http.StatusAccepted)
+	})
+	g.POST("/apply", func(c *gin.Context) {
+		SetScope(c, "staging")
+		c.Status(http.StatusBadRequest)
+	})
+	g.GET("/inventory", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	g.GET("/secret", Always(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	do := func(method, path, user, body string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-User", user)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	do(http.MethodPut, "/scope/devtest", "alice", `{"key":"crypt"}`)
+	do(http.MethodPost, "/apply", "token:ci", `{"scope":"staging"}`)
+	do(http.MethodGet, "/inventory", "alice", "")
+	do(http.MethodGet, "/secret", "bob", "")
+
+	// The call that started a job is recorded when the job has finished
+	entries, err := List(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries before the job finished, got %d", len(entries))
+	}
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(entries) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		entries, err = List(Filter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err = List(Filter{User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry by alice, got %d", len(entries))
+	}
+	e := entries[0]
+	if e.Scope != "devtest" || e.Job == "" || e.Outcome != OutcomeSuccess || string(e.Body) != `{"key":"[redacted]"}` ||
+		len(e.Resources) != 1 || e.Resources[0].Id != "sg-1" {
+		data, _ := json.Marshal(e)
+		t.Errorf("unexpected entry %s", data)
+	}
+
+	entries, err = List(Filter{Scope: "staging"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].User != "token:ci" || entries[0].Outcome != OutcomeFailed {
+		t.Errorf("expected failed apply by token:ci, got %+v", entries)
+	}
+
+	entries, err = List(Filter{From: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no entries from the future, got %d", len(entries))
+	}
+	entries, err = List(Filter{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].User != "alice" {
+		t.Errorf("expected only the last entry, got %+v", entries)
+	}
+}
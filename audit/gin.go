@@ -0,0 +1,105 @@
+package audit
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/cantara/bragi"
+	"github.com/cantara/nerthus/job"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	scopeKey  = "audit_scope"
+	jobKey    = "audit_job"
+	alwaysKey = "audit_always"
+)
+
+// Middleware records every call that changes something to the audit log, with the identity from gin.AuthUserKey, so it
+// must come after the authentication. Calls that start a job are recorded when the job has finished, with the resources
+// the job created and deleted. GET requests are only recorded on routes with Always.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		var body []byte
+		if c.Request.Body != nil {
+			body, _ = io.ReadAll(c.Request.Body)
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		c.Next()
+		if c.Request.Method == http.MethodGet && !c.GetBool(alwaysKey) {
+			return
+		}
+		endpoint := c.Request.URL.Path
+		if c.Request.URL.RawQuery != "" {
+			endpoint += "?" + c.Request.URL.RawQuery
+		}
+		scope := Scope(c)
+		e := Entry{
+			Time:     start,
+			User:     c.GetString(gin.AuthUserKey),
+			Method:   c.Request.Method,
+			Endpoint: endpoint,
+			Scope:    scope,
+			Body:     Sanitize(body, c.ContentType()),
+			Status:   c.Writer.Status(),
+			Outcome:  OutcomeSuccess,
+		}
+		if e.Status >= http.StatusBadRequest {
+			e.Outcome = OutcomeFailed
+		}
+		if v, ok := c.Get(jobKey); ok {
+			j := v.(*job.Job)
+			e.Job = j.Id
+			go func() {
+				<-j.Done()
+				snapshot := j.Snapshot()
+				e.Resources = snapshot.Resources
+				e.Error = snapshot.Error
+				if snapshot.Status == job.StatusFailed {
+					e.Outcome = OutcomeFailed
+				}
+				e.DurationMs = time.Since(start).Milliseconds()
+				record(e)
+			}()
+			return
+		}
+		e.DurationMs = time.Since(start).Milliseconds()
+		record(e)
+	}
+}
+
+func record(e Entry) {
+	err := Record(e)
+	if err != nil {
+		log.AddError(err).Warning("While writing ", e.Method, " ", e.Endpoint, " by ", e.User, " to audit log")
+	}
+}
+
+// Always makes the route be recorded to the audit log even if it is a GET request, like fetching secrets.
+func Always() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(alwaysKey, true)
+	}
+}
+
+// SetScope records the scope of the call, for calls where the scope is not a route parameter.
+func SetScope(c *gin.Context, scope string) {
+	c.Set(scopeKey, scope)
+}
+
+// Scope returns the scope of the call, set with SetScope or from the route parameter.
+func Scope(c *gin.Context) string {
+	scope := c.GetString(scopeKey)
+	if scope == "" {
+		scope = c.Param("scope")
+	}
+	return scope
+}
+
+// SetJob links the call to the job it started, so that it is recorded when the job has finished.
+func SetJob(c *gin.Context, j *job.Job) {
+	c.Set(jobKey, j)
+}
@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrUnknownRole  = errors.New("unknown role")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+// Role is what an identity is allowed to do. Every role is allowed what the roles before it are.
+type Role string
+
+const (
+	// RoleViewer can read the inventory, dns, drift, journals and jobs.
+	RoleViewer Role = "viewer"
+	// RoleDeployer can also add and remove servers, services and databases, and resume and roll back journals.
+	RoleDeployer Role = "deployer"
+	// RoleAdmin can also create and delete scopes, change ssh access, manage crypt keys and tokens.
+	RoleAdmin Role = "admin"
+)
+
+var roles = []Role{RoleViewer, RoleDeployer, RoleAdmin}
+
+func CheckRole(r Role) error {
+	if !slices.Contains(roles, r) {
+		return fmt.Errorf("%w %q, use one of viewer, deployer or admin", ErrUnknownRole, r)
+	}
+	return nil
+}
+
+// Allows reports if the role is allowed what the required role is.
+func (r Role) Allows(required Role) bool {
+	return slices.Contains(roles, r) && slices.Index(roles, r) >= slices.Index(roles, required)
+}
+
+const (
+	KindUser  = "user"
+	KindToken = "token"
+)
+
+// Identity is who performed a call, a user or an api token. An identity without scopes is allowed into every scope.
+type Identity struct {
+	Name   string   `json:"name" yaml:"name"`
+	Kind   string   `json:"kind" yaml:"-"`
+	Role   Role     `json:"role" yaml:"role"`
+	Scopes []string `json:"scopes,omitempty" yaml:"scopes"`
+}
+
+// AllowsScope reports if the identity is allowed into the scope.
+func (i Identity) AllowsScope(scope string) bool {
+	return len(i.Scopes) == 0 || slices.Contains(i.Scopes, scope)
+}
+
+// Grants returns ErrForbidden unless the identity is allowed everything an identity with the role and scopes would be.
+// No identity can hand out more than it has itself, and a scoped identity can not hand out access to every scope.
+func (i Identity) Grants(role Role, scopes []string) error {
+	if !i.Role.Allows(role) {
+		return fmt.Errorf("%w: %s is %s and can not grant %s", ErrForbidden, i, i.Role, role)
+	}
+	if len(i.Scopes) == 0 {
+		return nil
+	}
+	if len(scopes) == 0 {
+		return fmt.Errorf("%w: %s is limited to scopes %s and can not grant every scope", ErrForbidden, i,
+			strings.Join(i.Scopes, ", "))
+	}
+	for _, scope := range scopes {
+		if !i.AllowsScope(scope) {
+			return fmt.Errorf("%w: %s is not allowed into scope %s", ErrForbidden, i, scope)
+		}
+	}
+	return nil
+}
+
+// String is how the identity is recorded in logs, statuses and jobs.
+func (i Identity) String() string {
+	switch i.Kind {
+	case KindToken, KindOIDC:
+		return i.Kind + ":" + i.Name
+	}
+	return i.Name
+}
+
+type user struct {
+	Identity `yaml:",inline"`
+	// Password is the bcrypt hash of the password.
+	Password string `yaml:"password"`
+}
+
+type userList struct {
+	Users []user `yaml:"users"`
+}
+
+// Provider authenticates bearer tokens that are not Nerthus api tokens, like the user tokens of a single sign on service.
+type Provider interface {
+	Authenticate(token string) (Identity, error)
+}
+
+// Authenticator checks the credentials of a request against the users, the api tokens and the providers.
+type Authenticator struct {
+	users     map[string]user
+	tokens    *tokenStore
+	providers []Provider
+	mutex     sync.Mutex
+}
+
+// New reads the users from usersFile, yaml with a list of users with name, bcrypt password hash, role and scopes, and
+// keeps the api tokens in tokensFile. Both files are optional.
+func New(usersFile, tokensFile string) (a *Authenticator, err error) {
+	a = &Authenticator{
+		users: make(map[string]user),
+	}
+	if usersFile != "" {
+		var data []byte
+		data, err = os.ReadFile(usersFile)
+		if err != nil {
+			return
+		}
+		var f userList
+		err = yaml.Unmarshal(data, &f)
+		if err != nil {
+			return nil, fmt.Errorf("while reading users from %s: %w", usersFile, err)
+		}
+		for _, u := range f.Users {
+			err = a.addUser(u)
+			if err != nil {
+				return nil, fmt.Errorf("while reading users from %s: %w", usersFile, err)
+			}
+		}
+	}
+	a.tokens, err = newTokenStore(tokensFile)
+	return
+}
+
+// AddUser adds a user with a plain text password, like the username and password from the env file.
+func (a *Authenticator) AddUser(name, password string, role Role, scopes []string) (err error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return
+	}
+	return a.addUser(user{
+		Identity: Identity{
+			Name:   name,
+			Role:   role,
+			Scopes: scopes,
+		},
+		Password: string(hash),
+	})
+}
+
+func (a *Authenticator) addUser(u user) error {
+	if u.Name == "" || u.Password == "" {
+		return errors.New("user without name or password")
+	}
+	err := CheckRole(u.Role)
+	if err != nil {
+		return fmt.Errorf("user %s: %w", u.Name, err)
+	}
+	u.Kind = KindUser
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.users[u.Name] = u
+	return nil
+}
+
+// AddProvider makes bearer tokens that are not api tokens be authenticated by the provider.
+func (a *Authenticator) AddProvider(p Provider) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.providers = append(a.providers, p)
+}
+
+// HasUsers reports if anyone is able to log in, with a password or through a provider.
+func (a *Authenticator) HasUsers() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return len(a.users) > 0 || len(a.providers) > 0
+}
+
+// Authenticate returns the identity of the basic auth user or the bearer token of the request.
+func (a *Authenticator) Authenticate(r *http.Request) (Identity, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return a.authenticateBearer(strings.TrimSpace(token))
+	}
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return Identity{}, ErrUnauthorized
+	}
+	a.mutex.Lock()
+	u, ok := a.users[name]
+	a.mutex.Unlock()
+	if !ok {
+		// Compare anyway so that unknown users takes as long as wrong passwords
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return Identity{}, ErrUnauthorized
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) != nil {
+		return Identity{}, ErrUnauthorized
+	}
+	return u.Identity, nil
+}
+
+func (a *Authenticator) authenticateBearer(token string) (Identity, error) {
+	if strings.HasPrefix(token, tokenPrefix) {
+		return a.tokens.authenticate(token)
+	}
+	a.mutex.Lock()
+	providers := a.providers
+	a.mutex.Unlock()
+	for _, p := range providers {
+		id, err := p.Authenticate(token)
+		if err == nil {
+			return id, nil
+		}
+	}
+	return Identity{}, ErrUnauthorized
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("nerthus"), bcrypt.DefaultCost)
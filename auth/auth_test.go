@@ -0,0 +1,411 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cantara/nerthus/whydah"
+	"github.com/gin-gonic/gin"
+)
+
+func newRouter(t *testing.T) (*Authenticator, *gin.Engine) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	a, err := New("", filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.AddUser("admin", "secret", RoleAdmin, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.AddUser("viewer", "secret", RoleViewer, []string{"devtest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	auth := r.Group("", a.Middleware())
+	ok := func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(gin.AuthUserKey))
+	}
+	auth.Group("", Require(RoleViewer)).GET("/scopes/:scope", ok)
+	auth.Group("", Require(RoleAdmin)).PUT("/scope/:scope", ok)
+	return a, r
+}
+
+func do(r *gin.Engine, method, path string, set func(*http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	set(req)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func basic(name, password string) func(*http.Request) {
+	return func(r *http.Request) {
+		r.SetBasicAuth(name, password)
+	}
+}
+
+func bearer(token string) func(*http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func TestRolesAndScopes(t *testing.T) {
+	_, r := newRouter(t)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		auth   func(*http.Request)
+		status int
+	}{
+		{"no credentials", http.MethodGet, "/scopes/devtest", func(*http.Request) {}, http.StatusUnauthorized},
+		{"wrong password", http.MethodGet, "/scopes/devtest", basic("admin", "wrong"), http.StatusUnauthorized},
+		{"unknown user", http.MethodGet, "/scopes/devtest", basic("nobody", "secret"), http.StatusUnauthorized},
+		{"viewer reads own scope", http.MethodGet, "/scopes/devtest", basic("viewer", "secret"), http.StatusOK},
+		{"viewer reads other scope", http.MethodGet, "/scopes/prod", basic("viewer", "secret"), http.StatusForbidden},
+		{"viewer creates scope", http.MethodPut, "/scope/devtest", basic("viewer", "secret"), http.StatusForbidden},
+		{"admin creates scope", http.MethodPut, "/scope/prod", basic("admin", "secret"), http.StatusOK},
+	}
+	for _, test := range tests {
+		w := do(r, test.method, test.path, test.auth)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, expected %d", test.name, w.Code, test.status)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	a, r := newRouter(t)
+	admin := Identity{Name: "admin", Kind: KindUser, Role: RoleAdmin}
+	token, info, err := a.CreateToken("ci", RoleDeployer, []string{"devtest"}, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Hash == token || info.CreatedBy != "admin" {
+		t.Errorf("unexpected token info %+v", info)
+	}
+	_, _, err = a.CreateToken("ci", RoleViewer, nil, admin)
+	if err == nil {
+		t.Error("expected error creating a token with a name that exists")
+	}
+	_, _, err = a.CreateToken("bad", Role("owner"), nil, admin)
+	if err == nil {
+		t.Error("expected error creating a token with an unknown role")
+	}
+	scoped := Identity{Name: "devtest-admin", Kind: KindUser, Role: RoleAdmin, Scopes: []string{"devtest"}}
+	deployer := Identity{Name: "deployer", Kind: KindUser, Role: RoleDeployer}
+	for _, test := range []struct {
+		name    string
+		creator Identity
+		role    Role
+		scopes  []string
+	}{
+		{"unscoped", scoped, RoleAdmin, nil},
+		{"other-scope", scoped, RoleDeployer, []string{"devtest", "prod"}},
+		{"above-role", deployer, RoleAdmin, nil},
+	} {
+		_, _, err = a.CreateToken(test.name, test.role, test.scopes, test.creator)
+		if !errors.Is(err, ErrForbidden) {
+			t.Errorf("%s: expected forbidden, got %v", test.name, err)
+		}
+	}
+	_, _, err = a.CreateToken("scoped", RoleViewer, []string{"devtest"}, scoped)
+	if err != nil {
+		t.Errorf("expected a scoped admin to create a token in its scope, got %v", err)
+	}
+	_, _, err = a.CreateToken("ops", RoleViewer, nil, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens := a.Tokens(scoped); len(tokens) != 2 {
+		t.Errorf("expected a scoped admin to only see the tokens in its scope, got %+v", tokens)
+	}
+	if tokens := a.Tokens(admin); len(tokens) != 3 {
+		t.Errorf("expected admin to see every token, got %+v", tokens)
+	}
+	err = a.RevokeToken("ops", scoped)
+	if !errors.Is(err, ErrForbidden) {
+		t.Errorf("expected a scoped admin revoking an unscoped token to be forbidden, got %v", err)
+	}
+
+	w := do(r, http.MethodGet, "/scopes/devtest", bearer(token))
+	if w.Code != http.StatusOK || w.Body.String() != "token:ci" {
+		t.Errorf("got %d %q, expected 200 token:ci", w.Code, w.Body.String())
+	}
+	w = do(r, http.MethodPut, "/scope/devtest", bearer(token))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("deployer token creating scope: got %d, expected 403", w.Code)
+	}
+
+	// The tokens are read back from the file on restart
+	reloaded, err := New("", a.tokens.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := reloaded.Authenticate(bearerRequest(token))
+	if err != nil || id.Name != "ci" || id.Kind != KindToken {
+		t.Errorf("got %+v %v after reload", id, err)
+	}
+
+	err = a.RevokeToken("ci", admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = do(r, http.MethodGet, "/scopes/devtest", bearer(token))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token: got %d, expected 401", w.Code)
+	}
+	err = a.RevokeToken("ci", admin)
+	if err == nil {
+		t.Error("expected error revoking a token that does not exist")
+	}
+}
+
+func bearerRequest(token string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	bearer(token)(req)
+	return req
+}
+
+func TestWhydah(t *testing.T) {
+	calls := 0
+	w := NewWhydah("nerthus-app")
+	w.getUserToken = func(userTokenId string) (whydah.UserToken, error) {
+		calls++
+		ut := whydah.UserToken{
+			Id:       userTokenId,
+			Username: userTokenId,
+			Applications: []whydah.Application{
+				{Id: "other-app", Roles: []whydah.Role{{Name: "admin"}}},
+			},
+		}
+		switch userTokenId {
+		case "alice":
+			ut.Applications = append(ut.Applications, whydah.Application{Id: "nerthus-app", Roles: []whydah.Role{
+				{Name: "viewer"},
+				{Name: "deployer", Value: "devtest, staging"},
+				{Name: "deployer", Value: "test"},
+			}})
+		case "bob":
+			ut.Applications = append(ut.Applications, whydah.Application{Id: "nerthus-app", Roles: []whydah.Role{
+				{Name: "admin", Value: "*"},
+				{Name: "deployer", Value: "devtest"},
+			}})
+		case "mallory":
+		default:
+			return ut, whydah.ErrInvalidUserToken
+		}
+		return ut, nil
+	}
+	a, err := New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.AddProvider(w)
+	if !a.HasUsers() {
+		t.Error("expected users when there is a provider")
+	}
+
+	id, err := a.Authenticate(bearerRequest("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Role != RoleDeployer || !slices.Equal(id.Scopes, []string{"devtest", "staging", "test"}) || id.Kind != KindWhydah {
+		t.Errorf("got %+v, expected deployer of devtest, staging and test", id)
+	}
+	id, err = a.Authenticate(bearerRequest("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Role != RoleAdmin || len(id.Scopes) != 0 {
+		t.Errorf("got %+v, expected admin of every scope", id)
+	}
+	_, err = a.Authenticate(bearerRequest("mallory"))
+	if err == nil {
+		t.Error("expected user without a nerthus role to be unauthorized")
+	}
+	_, err = a.Authenticate(bearerRequest("unknown"))
+	if err == nil {
+		t.Error("expected invalid user token to be unauthorized")
+	}
+
+	calls = 0
+	_, err = a.Authenticate(bearerRequest("alice"))
+	if err != nil || calls != 0 {
+		t.Errorf("expected validated user token to be cached, got %d calls and %v", calls, err)
+	}
+}
+
+type testIssuer struct {
+	*httptest.Server
+	rsaKey     *rsa.PrivateKey
+	ecKey      *ecdsa.PrivateKey
+	keyFetches int
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := &testIssuer{rsaKey: rsaKey, ecKey: ecKey}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": i.URL, "jwks_uri": i.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		i.keyFetches++
+		ecPoint, _ := ecKey.PublicKey.Bytes()
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecPoint[1:33]), "y": b64(ecPoint[33:])},
+		}})
+	})
+	i.Server = httptest.NewServer(mux)
+	t.Cleanup(i.Close)
+	return i
+}
+
+func (i *testIssuer) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(body)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, i.rsaKey, crypto.SHA256, digest[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, i.ecKey, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(signature)
+}
+
+// hmacToken signs the claims with the public key of the issuer as hmac secret, which must not be accepted.
+func hmacToken(t *testing.T, i *testIssuer, claims map[string]any) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "kid": "rsa", "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(body)
+	mac := hmac.New(sha256.New, x509.MarshalPKCS1PublicKey(&i.rsaKey.PublicKey))
+	mac.Write([]byte(signed))
+	return signed + "." + b64(mac.Sum(nil))
+}
+
+func unsignedToken(claims map[string]any) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": "none", "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	return b64(header) + "." + b64(body) + "."
+}
+
+func TestOIDC(t *testing.T) {
+	issuer := newTestIssuer(t)
+	o, err := NewOIDC(OIDCConfig{
+		Issuer:    issuer.URL,
+		Audience:  "nerthus",
+		NameClaim: "actor",
+		Roles: []ClaimRole{
+			{Claims: map[string]string{"repository": "Cantara/nerthus", "ref": "refs/heads/main"}, Role: RoleDeployer, Scopes: []string{"devtest"}},
+			{Claims: map[string]string{"repository": "Cantara/*"}, Role: RoleViewer},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.AddProvider(o)
+
+	claims := func(change map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":        issuer.URL,
+			"aud":        []string{"nerthus"},
+			"exp":        time.Now().Add(5 * time.Minute).Unix(),
+			"actor":      "octocat",
+			"repository": "Cantara/nerthus",
+			"ref":        "refs/heads/main",
+		}
+		for k, v := range change {
+			c[k] = v
+		}
+		return c
+	}
+
+	id, err := a.Authenticate(bearerRequest(issuer.sign(t, "RS256", "rsa", claims(nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.String() != "oidc:octocat" || id.Role != RoleDeployer || !slices.Equal(id.Scopes, []string{"devtest"}) {
+		t.Errorf("got %+v, expected deployer octocat in devtest", id)
+	}
+	id, err = a.Authenticate(bearerRequest(issuer.sign(t, "ES256", "ec", claims(map[string]any{"ref": "refs/heads/feature"}))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Role != RoleViewer {
+		t.Errorf("got %+v, expected viewer for a feature branch", id)
+	}
+	if issuer.keyFetches != 1 {
+		t.Errorf("expected the keys to be fetched once for valid tokens, got %d", issuer.keyFetches)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"expired", issuer.sign(t, "RS256", "rsa", claims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}))},
+		{"wrong audience", issuer.sign(t, "RS256", "rsa", claims(map[string]any{"aud": "other"}))},
+		{"other issuer", issuer.sign(t, "RS256", "rsa", claims(map[string]any{"iss": "https://example.com"}))},
+		{"no matching role", issuer.sign(t, "RS256", "rsa", claims(map[string]any{"repository": "Other/repo"}))},
+		{"unknown key", issuer.sign(t, "RS256", "other", claims(nil))},
+		{"key of wrong type", issuer.sign(t, "RS256", "ec", claims(nil))},
+		{"tampered", issuer.sign(t, "RS256", "rsa", claims(nil))[:20] + "x" + issuer.sign(t, "RS256", "rsa", claims(nil))[21:]},
+		{"not a jwt", "abc"},
+		{"hmac", hmacToken(t, issuer, claims(nil))},
+		{"unsigned", unsignedToken(claims(nil))},
+	}
+	for _, test := range tests {
+		_, err = a.Authenticate(bearerRequest(test.token))
+		if err == nil {
+			t.Errorf("%s: expected token to be unauthorized", test.name)
+		}
+	}
+}
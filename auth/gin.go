@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	log "github.com/cantara/bragi"
+	"github.com/gin-gonic/gin"
+)
+
+const identityKey = "nerthus_identity"
+
+// Middleware authenticates every request and logs every call with the identity that made it. The identity is set as
+// gin.AuthUserKey as well, like gin.BasicAuth does.
+func (a *Authenticator) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := a.Authenticate(c.Request)
+		if err != nil {
+			log.Info("Unauthorized ", c.Request.Method, " ", c.Request.URL.Path, " from ", c.ClientIP())
+			c.Header("WWW-Authenticate", `Basic realm="Nerthus"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"message": "Unauthorized",
+			})
+			return
+		}
+		c.Set(gin.AuthUserKey, id.String())
+		c.Set(identityKey, id)
+		c.Next()
+		log.Info(id, " ", c.Request.Method, " ", c.Request.URL.Path, " ", c.Writer.Status())
+	}
+}
+
+// Require only lets identities with the role through. When the route has a scope parameter the identity must also be
+// allowed into the scope.
+func Require(role Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := Get(c)
+		if !id.Role.Allows(role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"message": fmt.Sprintf("Requires the %s role, %s is %s", role, id, id.Role),
+			})
+			return
+		}
+		if scope := c.Param("scope"); scope != "" && !AllowScope(c, scope) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// Get returns the identity that made the request.
+func Get(c *gin.Context) Identity {
+	id, _ := c.Get(identityKey)
+	i, _ := id.(Identity)
+	return i
+}
+
+// AllowScope aborts the request with 403 Forbidden and returns false when the identity that made it is not allowed into
+// the scope. It is for handlers where the scope is not a route parameter, like in a body or a journal.
+func AllowScope(c *gin.Context, scope string) bool {
+	id := Get(c)
+	if id.AllowsScope(scope) {
+		return true
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+		"message": fmt.Sprintf("%s is not allowed into scope %s", id, scope),
+	})
+	return false
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"gopkg.in/yaml.v3"
+)
+
+const KindOIDC = "oidc"
+
+var ErrInvalidJWT = errors.New("invalid jwt")
+
+// signingAlgs are the algorithms tokens may be signed with, only asymmetric ones so that the public keys of the issuer
+// can not be used as hmac secrets.
+var signingAlgs = []string{oidc.RS256, oidc.RS384, oidc.RS512, oidc.ES256, oidc.ES384, oidc.ES512}
+
+// OIDCConfig is an issuer of OIDC tokens, like GitHub Actions or Jenkins, and how the claims of its tokens map to roles.
+type OIDCConfig struct {
+	Issuer string `yaml:"issuer"`
+	// Audience must be in the aud claim of the tokens.
+	Audience string `yaml:"audience"`
+	// JWKSURI is where the keys of the issuer are, it is read from the discovery document of the issuer if not set.
+	JWKSURI string `yaml:"jwks_uri"`
+	// NameClaim is the claim the identity is named after, default sub.
+	NameClaim string `yaml:"name_claim"`
+	// Roles are tried in order, the first one where every claim matches gives the role.
+	Roles []ClaimRole `yaml:"roles"`
+}
+
+// ClaimRole gives the role and scopes to tokens where every claim matches. The values are patterns like path.Match.
+type ClaimRole struct {
+	Claims map[string]string `yaml:"claims"`
+	Role   Role              `yaml:"role"`
+	Scopes []string          `yaml:"scopes"`
+}
+
+type oidcList struct {
+	Providers []OIDCConfig `yaml:"providers"`
+}
+
+// OIDC authenticates JWTs from an OIDC issuer, verified by go-oidc with the keys the issuer publishes.
+type OIDC struct {
+	config   OIDCConfig
+	client   *http.Client
+	verifier *oidc.IDTokenVerifier
+	mutex    sync.Mutex
+}
+
+// ReadOIDC reads the issuers from the yaml file, a list of providers with issuer, audience and roles.
+func ReadOIDC(file string) (providers []*OIDC, err error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return
+	}
+	var l oidcList
+	err = yaml.Unmarshal(data, &l)
+	if err != nil {
+		return nil, fmt.Errorf("while reading oidc providers from %s: %w", file, err)
+	}
+	for _, config := range l.Providers {
+		var o *OIDC
+		o, err = NewOIDC(config)
+		if err != nil {
+			return nil, fmt.Errorf("while reading oidc providers from %s: %w", file, err)
+		}
+		providers = append(providers, o)
+	}
+	return
+}
+
+func NewOIDC(config OIDCConfig) (*OIDC, error) {
+	if config.Issuer == "" || config.Audience == "" {
+		return nil, errors.New("oidc provider without issuer or audience")
+	}
+	if config.NameClaim == "" {
+		config.NameClaim = "sub"
+	}
+	for _, r := range config.Roles {
+		err := CheckRole(r.Role)
+		if err != nil {
+			return nil, fmt.Errorf("oidc provider %s: %w", config.Issuer, err)
+		}
+		for claim, pattern := range r.Claims {
+			_, err = path.Match(pattern, "")
+			if err != nil {
+				return nil, fmt.Errorf("oidc provider %s: claim %s: %w", config.Issuer, claim, err)
+			}
+		}
+	}
+	return &OIDC{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (o *OIDC) Authenticate(token string) (Identity, error) {
+	verifier, err := o.getVerifier()
+	if err != nil {
+		return Identity{}, err
+	}
+	idToken, err := verifier.Verify(o.context(), token)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %w", ErrInvalidJWT, err)
+	}
+	var claims map[string]any
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %w", ErrInvalidJWT, err)
+	}
+	return o.identity(claims)
+}
+
+// getVerifier returns the verifier of the issuer. It is created on first use, so that Nerthus starts when an issuer is
+// unreachable, and discovery is tried again on the next token if it fails.
+func (o *OIDC) getVerifier() (*oidc.IDTokenVerifier, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.verifier != nil {
+		return o.verifier, nil
+	}
+	config := &oidc.Config{
+		ClientID:             o.config.Audience,
+		SupportedSigningAlgs: signingAlgs,
+	}
+	if o.config.JWKSURI != "" {
+		o.verifier = oidc.NewVerifier(o.config.Issuer, oidc.NewRemoteKeySet(o.context(), o.config.JWKSURI), config)
+		return o.verifier, nil
+	}
+	provider, err := oidc.NewProvider(o.context(), o.config.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("while discovering oidc provider %s: %w", o.config.Issuer, err)
+	}
+	o.verifier = provider.Verifier(config)
+	return o.verifier, nil
+}
+
+// context makes go-oidc fetch the discovery document and keys with the client of the provider.
+func (o *OIDC) context() context.Context {
+	return oidc.ClientContext(context.Background(), o.client)
+}
+
+// identity maps the claims to the role of the first matching ClaimRole.
+func (o *OIDC) identity(claims map[string]any) (Identity, error) {
+	name := claimString(claims[o.config.NameClaim])
+	if name == "" {
+		return Identity{}, fmt.Errorf("%w: missing %s", ErrInvalidJWT, o.config.NameClaim)
+	}
+	for _, r := range o.config.Roles {
+		if !r.matches(claims) {
+			continue
+		}
+		return Identity{
+			Name:   name,
+			Kind:   KindOIDC,
+			Role:   r.Role,
+			Scopes: r.Scopes,
+		}, nil
+	}
+	return Identity{}, fmt.Errorf("%w: no role for %s from %s", ErrUnauthorized, name, o.config.Issuer)
+}
+
+func (r ClaimRole) matches(claims map[string]any) bool {
+	for claim, pattern := range r.Claims {
+		value, ok := claims[claim]
+		if !ok {
+			return false
+		}
+		match, _ := path.Match(pattern, claimString(value))
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+func claimString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTokenExists   = errors.New("token already exists")
+	ErrTokenNotFound = errors.New("token not found")
+)
+
+// tokenPrefix starts every api token, so that leaked tokens are easy to search for.
+const tokenPrefix = "nerthus_"
+
+// Token is a long lived api token, like for ci. Only the sha256 of the token is kept, the token itself is only returned
+// when it is created.
+type Token struct {
+	Identity
+	Hash      string    `json:"hash"`
+	CreatedBy string    `json:"created_by"`
+	Created   time.Time `json:"created"`
+}
+
+type tokenStore struct {
+	file   string
+	tokens map[string]Token
+	mutex  sync.Mutex
+}
+
+func newTokenStore(file string) (s *tokenStore, err error) {
+	s = &tokenStore{
+		file:   file,
+		tokens: make(map[string]Token),
+	}
+	if file == "" {
+		return
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return
+	}
+	var tokens []Token
+	err = json.Unmarshal(data, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("while reading tokens from %s: %w", file, err)
+	}
+	for _, t := range tokens {
+		t.Kind = KindToken
+		s.tokens[t.Name] = t
+	}
+	return
+}
+
+// save writes the tokens to a temporary file that is renamed over the old one, so that a crash does not leave a
+// partially written file. Must be called with the mutex held.
+func (s *tokenStore) save() (err error) {
+	if s.file == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := s.file + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp, s.file)
+}
+
+func (s *tokenStore) list() (tokens []Token) {
+	tokens = []Token{}
+	for _, t := range s.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Name < tokens[j].Name
+	})
+	return
+}
+
+func (s *tokenStore) authenticate(token string) (Identity, error) {
+	hash := hashToken(token)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			return t.Identity, nil
+		}
+	}
+	return Identity{}, ErrUnauthorized
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateToken creates an api token with the role and scopes for the creator. The token can not be allowed more than the
+// creator is, see Identity.Grants. The token is only returned here.
+func (a *Authenticator) CreateToken(name string, role Role, scopes []string, creator Identity) (token string, t Token, err error) {
+	if name == "" {
+		err = errors.New("token without name")
+		return
+	}
+	err = CheckRole(role)
+	if err != nil {
+		return
+	}
+	err = creator.Grants(role, scopes)
+	if err != nil {
+		return
+	}
+	random := make([]byte, 32)
+	_, err = rand.Read(random)
+	if err != nil {
+		return
+	}
+	token = tokenPrefix + base64.RawURLEncoding.EncodeToString(random)
+	t = Token{
+		Identity: Identity{
+			Name:   name,
+			Kind:   KindToken,
+			Role:   role,
+			Scopes: scopes,
+		},
+		Hash:      hashToken(token),
+		CreatedBy: creator.String(),
+		Created:   time.Now(),
+	}
+	s := a.tokens
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.tokens[name]; ok {
+		return "", Token{}, fmt.Errorf("%w: %s", ErrTokenExists, name)
+	}
+	s.tokens[name] = t
+	err = s.save()
+	if err != nil {
+		delete(s.tokens, name)
+		return "", Token{}, err
+	}
+	return
+}
+
+// RevokeToken removes the api token, requests with it are unauthorized from now on. Like creating tokens, the revoker
+// has to be allowed everything the token is.
+func (a *Authenticator) RevokeToken(name string, revoker Identity) (err error) {
+	s := a.tokens
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t, ok := s.tokens[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrTokenNotFound, name)
+	}
+	err = revoker.Grants(t.Role, t.Scopes)
+	if err != nil {
+		return
+	}
+	delete(s.tokens, name)
+	err = s.save()
+	if err != nil {
+		s.tokens[name] = t
+	}
+	return
+}
+
+// Tokens returns the api tokens the viewer is allowed everything of, without the tokens themselves.
+func (a *Authenticator) Tokens(viewer Identity) []Token {
+	a.tokens.mutex.Lock()
+	defer a.tokens.mutex.Unlock()
+	return slices.DeleteFunc(a.tokens.list(), func(t Token) bool {
+		return viewer.Grants(t.Role, t.Scopes) != nil
+	})
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cantara/nerthus/whydah"
+)
+
+const KindWhydah = "whydah"
+
+// whydahCacheTime is how long a validated user token is trusted before it is validated against Whydah again.
+const whydahCacheTime = 5 * time.Minute
+
+// Whydah authenticates Whydah user tokens. The roles of the user on the Nerthus application in Whydah are mapped to
+// Nerthus roles: a Whydah role named viewer, deployer or admin gives that role, and its value is a comma separated list of
+// the scopes it is for, empty or * for every scope. A user with more than one role gets the highest, with the scopes of
+// every Whydah role with that name.
+type Whydah struct {
+	applicationId string
+	getUserToken  func(userTokenId string) (whydah.UserToken, error)
+	cache         map[string]whydahEntry
+	mutex         sync.Mutex
+}
+
+type whydahEntry struct {
+	identity Identity
+	expires  time.Time
+}
+
+// NewWhydah returns a provider that validates user tokens against the Whydah token service. applicationId is the id of
+// Nerthus in Whydah, the application the roles are read from.
+func NewWhydah(applicationId string) *Whydah {
+	return &Whydah{
+		applicationId: applicationId,
+		getUserToken:  whydah.GetUserToken,
+		cache:         make(map[string]whydahEntry),
+	}
+}
+
+func (w *Whydah) Authenticate(token string) (Identity, error) {
+	now := time.Now()
+	w.mutex.Lock()
+	e, ok := w.cache[token]
+	w.mutex.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.identity, nil
+	}
+	ut, err := w.getUserToken(token)
+	if err != nil {
+		return Identity{}, err
+	}
+	id, err := w.identity(ut)
+	if err != nil {
+		return Identity{}, err
+	}
+	expires := now.Add(whydahCacheTime)
+	if ut.Lifespan > 0 && ut.Expires().Before(expires) {
+		expires = ut.Expires()
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for t, e := range w.cache {
+		if !now.Before(e.expires) {
+			delete(w.cache, t)
+		}
+	}
+	w.cache[token] = whydahEntry{
+		identity: id,
+		expires:  expires,
+	}
+	return id, nil
+}
+
+// identity maps the Whydah roles of the user to a Nerthus identity.
+func (w *Whydah) identity(ut whydah.UserToken) (id Identity, err error) {
+	id = Identity{
+		Name: ut.Username,
+		Kind: KindWhydah,
+	}
+	allScopes := false
+	for _, r := range ut.Roles(w.applicationId) {
+		role := Role(r.Name)
+		if CheckRole(role) != nil {
+			continue
+		}
+		if id.Role != "" && !role.Allows(id.Role) {
+			continue
+		}
+		if id.Role != role {
+			id.Role = role
+			id.Scopes = nil
+			allScopes = false
+		}
+		scopes := strings.Split(r.Value, ",")
+		for i := range scopes {
+			scopes[i] = strings.TrimSpace(scopes[i])
+		}
+		scopes = slices.DeleteFunc(scopes, func(scope string) bool {
+			return scope == ""
+		})
+		if len(scopes) == 0 || slices.Contains(scopes, "*") {
+			allScopes = true
+			continue
+		}
+		id.Scopes = append(id.Scopes, scopes...)
+	}
+	if id.Role == "" {
+		err = fmt.Errorf("%w: %s has no nerthus role in whydah", ErrUnauthorized, ut.Username)
+		return
+	}
+	if allScopes {
+		id.Scopes = nil
+	}
+	return
+}
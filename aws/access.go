@@ -0,0 +1,93 @@
+package aws
+
+import (
+	"fmt"
+	"strings"
+
+	securitylib "github.com/cantara/nerthus/aws/security"
+	"github.com/cantara/nerthus/job"
+)
+
+// SSHAccess is where ssh is allowed from to the servers in a scope.
+type SSHAccess struct {
+	Scope         string   `json:"scope"`
+	SecurityGroup string   `json:"security_group"`
+	Sources       []string `json:"sources"`
+}
+
+// GetSSHAccess returns the sources ssh is allowed from in the scope.
+func (c AWS) GetSSHAccess(scope string) (access SSHAccess, err error) {
+	g, err := c.scopeGroup(scope)
+	if err != nil {
+		return
+	}
+	return sshAccess(g), nil
+}
+
+// UpdateSSHAccess allows ssh from the sources in add and revokes ssh from the sources in revoke on the security group of
+// the scope. Every change is reported as a status with the user that made it. All sources are validated before anything
+// is changed, and sources that are in both lists are revoked.
+func (c AWS) UpdateSSHAccess(scope string, add, revoke []string, user string) (access SSHAccess, err error) {
+	for _, source := range append(append([]string{}, add...), revoke...) {
+		_, err = securitylib.NormalizeSource(source)
+		if err != nil {
+			return
+		}
+	}
+	g, err := c.scopeGroup(scope)
+	if err != nil {
+		return
+	}
+	added, err := g.AddSSHAccess(add)
+	for _, source := range added {
+		c.job.AddResource(job.ActionCreated, "ssh ingress", g.Id+" "+source)
+	}
+	if len(added) > 0 {
+		status(c.job, fmt.Sprintf("%s: %s added ssh access from %s to security group %s.", scope, user, strings.Join(added, ", "), g.Id))
+	}
+	if err != nil {
+		return
+	}
+	revoked, err := g.RevokeSSHAccess(revoke)
+	for _, source := range revoked {
+		c.job.AddResource(job.ActionDeleted, "ssh ingress", g.Id+" "+source)
+	}
+	if len(revoked) > 0 {
+		status(c.job, fmt.Sprintf("%s: %s revoked ssh access from %s to security group %s.", scope, user, strings.Join(revoked, ", "), g.Id))
+	}
+	if err != nil {
+		return
+	}
+	return sshAccess(g), nil
+}
+
+// scopeGroup returns the security group the servers in the scope are created with.
+func (c AWS) scopeGroup(scope string) (g securitylib.Group, err error) {
+	groups, err := securitylib.GetGroups(scope, c.ec2)
+	if err != nil {
+		return
+	}
+	for _, g := range groups {
+		if g.IsScopeGroup() {
+			return g, nil
+		}
+	}
+	err = fmt.Errorf("%w: no security group for %s", ErrScopeNotFound, scope)
+	return
+}
+
+func sshAccess(g securitylib.Group) SSHAccess {
+	access := SSHAccess{
+		Scope:         g.Scope,
+		SecurityGroup: g.Id,
+		Sources:       []string{},
+	}
+	for _, i := range g.ScopeIngress() {
+		if i.PrefixListId != "" {
+			access.Sources = append(access.Sources, i.PrefixListId)
+			continue
+		}
+		access.Sources = append(access.Sources, i.Cidr)
+	}
+	return access
+}
@@ -0,0 +1,83 @@
+package aws
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/cantara/bragi"
+	serverlib "github.com/cantara/nerthus/aws/server"
+)
+
+// StaleServer is a server running an ami that is older than allowed. LatestAMI is the ami the parameter the server was
+// created from has now, for servers that were created from one.
+type StaleServer struct {
+	Scope        string     `json:"scope"`
+	Name         string     `json:"name"`
+	Id           string     `json:"id"`
+	ImageId      string     `json:"image_id"`
+	ImageCreated *time.Time `json:"image_created,omitempty"`
+	AgeDays      int        `json:"age_days,omitempty"`
+	ImageMissing bool       `json:"image_missing,omitempty"`
+	AMIParameter string     `json:"ami_parameter,omitempty"`
+	LatestAMI    string     `json:"latest_ami,omitempty"`
+}
+
+// GetStaleServers returns the servers in the scopes that run amis created more than maxAge ago, oldest first. Servers
+// running amis that no longer exists are always stale, and listed first.
+func (c AWS) GetStaleServers(scopes []string, maxAge time.Duration) (stale []StaleServer, err error) {
+	stale = []StaleServer{}
+	var servers []serverlib.Server
+	images := make(map[string]bool)
+	for _, scope := range scopes {
+		live, err := serverlib.GetServers(scope, c.ec2)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range live {
+			servers = append(servers, s)
+			images[s.ImageId] = true
+		}
+	}
+	created, err := serverlib.ImageCreated(sortedKeys(images), c.ec2)
+	if err != nil {
+		return
+	}
+	latest := make(map[string]string)
+	now := time.Now()
+	for _, s := range servers {
+		t, exists := created[s.ImageId]
+		if exists && now.Sub(t) <= maxAge {
+			continue
+		}
+		server := StaleServer{
+			Scope:        s.Scope,
+			Name:         s.Name,
+			Id:           s.Id,
+			ImageId:      s.ImageId,
+			ImageMissing: !exists,
+			AMIParameter: s.AMIParameter,
+		}
+		if exists {
+			server.ImageCreated = &t
+			server.AgeDays = int(now.Sub(t).Hours() / 24)
+		}
+		if s.AMIParameter != "" {
+			if _, ok := latest[s.AMIParameter]; !ok {
+				latest[s.AMIParameter], err = serverlib.GetParameterAMI(s.AMIParameter, c.ssm)
+				if err != nil {
+					log.AddError(err).Warning("While getting latest ami from ", s.AMIParameter)
+					err = nil
+				}
+			}
+			server.LatestAMI = latest[s.AMIParameter]
+		}
+		stale = append(stale, server)
+	}
+	sort.SliceStable(stale, func(i, j int) bool {
+		if stale[i].ImageMissing || stale[j].ImageMissing {
+			return stale[i].ImageMissing && !stale[j].ImageMissing
+		}
+		return stale[i].ImageCreated.Before(*stale[j].ImageCreated)
+	})
+	return
+}
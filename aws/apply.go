@@ -0,0 +1,314 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	databaselib "github.com/cantara/nerthus/aws/database"
+	keylib "github.com/cantara/nerthus/aws/key"
+	loadbalancerlib "github.com/cantara/nerthus/aws/loadbalancer"
+	securitylib "github.com/cantara/nerthus/aws/security"
+	serverlib "github.com/cantara/nerthus/aws/server"
+	vpclib "github.com/cantara/nerthus/aws/vpc"
+	servershlib "github.com/cantara/nerthus/server"
+)
+
+var ErrMissingKey = errors.New("manifest has no key for the existing scope")
+
+const (
+	operationRemoveService = "remove_service"
+	operationRemoveServer  = "remove_server"
+)
+
+// ApplyAction is one call to a create or remove sequence needed to converge the scope to its manifest.
+type ApplyAction struct {
+	Operation string `json:"operation"`
+	Server    string `json:"server,omitempty"`
+	Service   string `json:"service,omitempty"`
+	Database  string `json:"database,omitempty"`
+	service   Service
+	sizing    serverlib.Sizing
+	placement serverlib.Placement
+}
+
+func (a ApplyAction) String() string {
+	switch {
+	case a.Service != "":
+		return fmt.Sprintf("%s %s on %s", a.Operation, a.Service, a.Server)
+	case a.Server != "":
+		return fmt.Sprintf("%s %s", a.Operation, a.Server)
+	case a.Database != "":
+		return fmt.Sprintf("%s %s", a.Operation, a.Database)
+	}
+	return a.Operation
+}
+
+// ApplyPlan is the difference between a manifest and what is running in the scope. Resources that are running but not
+// in the manifest are only removed when the manifest prunes, otherwise they are listed as unmanaged.
+// Databases are never removed as they might contain data.
+type ApplyPlan struct {
+	Scope     string        `json:"scope"`
+	Actions   []ApplyAction `json:"actions"`
+	Unmanaged []string      `json:"unmanaged,omitempty"`
+}
+
+// CreatesScope is true when applying the plan creates the scope.
+func (p ApplyPlan) CreatesScope() bool {
+	return len(p.Actions) > 0 && p.Actions[0].Operation == operationCreateScope
+}
+
+// PlanApply discovers the live state of the scope through its tags and diffs it against the manifest.
+func (c AWS) PlanApply(m Manifest) (p ApplyPlan, err error) {
+	p = ApplyPlan{
+		Scope:   m.Scope,
+		Actions: []ApplyAction{},
+	}
+	_, err = keylib.GetKey(m.Scope, c.ec2)
+	scopeExists := err == nil
+	if err != nil && !errors.Is(err, keylib.ErrNotFound) {
+		return
+	}
+	err = nil
+	if !scopeExists {
+		p.Actions = append(p.Actions, ApplyAction{Operation: operationCreateScope})
+	}
+
+	liveDatabases := make(map[string]bool)
+	liveServers := make(map[string]serverlib.Server)
+	if scopeExists {
+		databases, err := databaselib.GetDatabases(m.Scope, c.rds)
+		if err != nil {
+			return p, err
+		}
+		for _, d := range databases {
+			liveDatabases[d.Identifier] = true
+		}
+		servers, err := serverlib.GetServers(m.Scope, c.ec2)
+		if err != nil {
+			return p, err
+		}
+		for _, s := range servers {
+			liveServers[s.Name] = s
+		}
+	}
+
+	wantedDatabases := make(map[string]bool)
+	for _, database := range m.Databases {
+		identifier := fmt.Sprintf("%s-%s-db", m.Scope, servershlib.ToFriendlyName(database.ArtifactId))
+		wantedDatabases[identifier] = true
+		if liveDatabases[identifier] {
+			continue
+		}
+		p.Actions = append(p.Actions, ApplyAction{
+			Operation: operationCreateDatabase,
+			Database:  database.ArtifactId,
+		})
+	}
+	for _, identifier := range sortedKeys(liveDatabases) {
+		if !wantedDatabases[identifier] {
+			p.Unmanaged = append(p.Unmanaged, "database "+identifier)
+		}
+	}
+
+	var addServices, removeServices []ApplyAction
+	for _, server := range m.Servers {
+		live, exists := liveServers[server.Name]
+		if !exists {
+			p.Actions = append(p.Actions, ApplyAction{
+				Operation: operationAddServer,
+				Server:    server.Name,
+				sizing:    server.Sizing,
+				placement: server.placement(),
+			})
+		}
+		running := make(map[string]bool)
+		for _, service := range live.Services {
+			running[service] = true
+		}
+		wanted := make(map[string]bool)
+		for _, service := range server.Services {
+			wanted[service.ArtifactId] = true
+			if running[service.ArtifactId] {
+				continue
+			}
+			addServices = append(addServices, ApplyAction{
+				Operation: operationAddService,
+				Server:    server.Name,
+				Service:   service.ArtifactId,
+				service:   service,
+			})
+		}
+		for _, service := range live.Services {
+			if wanted[service] {
+				continue
+			}
+			if !m.Prune {
+				p.Unmanaged = append(p.Unmanaged, fmt.Sprintf("service %s on %s", service, server.Name))
+				continue
+			}
+			removeServices = append(removeServices, ApplyAction{
+				Operation: operationRemoveService,
+				Server:    server.Name,
+				Service:   service,
+			})
+		}
+	}
+	err = c.checkListenerVPCs(m, scopeExists, addServices)
+	if err != nil {
+		return
+	}
+	p.Actions = append(p.Actions, addServices...)
+	p.Actions = append(p.Actions, removeServices...)
+
+	wantedServers := make(map[string]bool)
+	for _, server := range m.Servers {
+		wantedServers[server.Name] = true
+	}
+	for _, name := range sortedKeys(liveServers) {
+		if wantedServers[name] {
+			continue
+		}
+		if !m.Prune {
+			p.Unmanaged = append(p.Unmanaged, "server "+name)
+			continue
+		}
+		p.Actions = append(p.Actions, ApplyAction{
+			Operation: operationRemoveServer,
+			Server:    name,
+		})
+	}
+	return
+}
+
+// checkListenerVPCs checks that the loadbalancers of the services that are added are in the vpc of the scope, or the vpc
+// the scope will be created in, so that the apply does not create servers for services that can not be reached.
+func (c AWS) checkListenerVPCs(m Manifest, scopeExists bool, addServices []ApplyAction) (err error) {
+	if len(addServices) == 0 {
+		return
+	}
+	var vpcId string
+	switch {
+	case scopeExists:
+		groups, err := securitylib.GetGroups(m.Scope, c.ec2)
+		if err != nil {
+			return err
+		}
+		for _, g := range groups {
+			if g.IsScopeGroup() {
+				vpcId = g.VPCId()
+			}
+		}
+	case m.VPCCIDR != "":
+		return fmt.Errorf("%w: services can not be added in the same apply as the vpc is provisioned, no loadbalancer is in it yet", ErrInvalidManifest)
+	default:
+		v, err := vpclib.GetScopeVPC(m.VPC, m.Subnets, c.ec2)
+		if err != nil {
+			return err
+		}
+		vpcId = v.Id
+	}
+	if vpcId == "" {
+		return
+	}
+	checked := make(map[string]bool)
+	for _, action := range addServices {
+		arn := action.service.ELBListenerArn
+		if checked[arn] {
+			continue
+		}
+		checked[arn] = true
+		listener, err := loadbalancerlib.GetListener(arn, c.elb)
+		if err != nil {
+			return err
+		}
+		err = listener.CheckVPC(vpcId)
+		if errors.Is(err, loadbalancerlib.ErrWrongVPC) {
+			return fmt.Errorf("%w: service %s on %s: %w", ErrInvalidManifest, action.Service, action.Server, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return
+}
+
+func sortedKeys[V any](m map[string]V) (keys []string) {
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// Apply converges the scope to the manifest by running the existing sequences for every action in the plan.
+// Every sequence cleans up after itself, so the apply stops at the first failing action and can simply be repeated.
+// The returned crypt key is the one from the manifest, or the new one when the scope was created.
+func (c AWS) Apply(m Manifest) (cryptData string, p ApplyPlan, err error) {
+	p, err = c.PlanApply(m)
+	if err != nil {
+		return
+	}
+	cryptData = m.Key
+	if len(p.Actions) == 0 {
+		status(c.job, fmt.Sprintf("%s: Scope is up to date with the manifest.", m.Scope))
+		return
+	}
+	status(c.job, fmt.Sprintf("%s: Applying manifest with %d actions.", m.Scope, len(p.Actions)))
+
+	var v vpclib.VPC
+	var k keylib.Key
+	var sg securitylib.Group
+	var slackId string
+	decrypted := false
+	for _, action := range p.Actions {
+		if action.Operation == operationCreateScope {
+			cryptData, err = c.CreateScope(m.Scope, ScopeOptions{
+				Executor:     m.Executor,
+				SSHSources:   m.SSHSources,
+				AMIParameter: m.AMIParameter,
+				VPC:          m.VPC,
+				Subnets:      m.Subnets,
+				VPCCIDR:      m.VPCCIDR,
+				Zones:        m.Zones,
+				NAT:          m.NAT,
+			})
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if !decrypted {
+			if cryptData == "" {
+				return cryptData, p, ErrMissingKey
+			}
+			var scope string
+			scope, v, k, sg, slackId, err = Decrypt(cryptData, &c)
+			if err != nil {
+				return
+			}
+			if scope != m.Scope {
+				return cryptData, p, fmt.Errorf("%w: key is for scope %s", ErrInvalidManifest, scope)
+			}
+			decrypted = true
+		}
+		status(c.job, fmt.Sprintf("%s: Apply %s.", m.Scope, action))
+		switch action.Operation {
+		case operationCreateDatabase:
+			_, err = c.CreateDatabase(m.Scope, action.Database, v, sg, slackId)
+		case operationAddServer:
+			_, err = c.AddServerToScope(m.Scope, action.Server, action.sizing, action.placement, v, k, sg, slackId)
+		case operationAddService:
+			_, err = c.AddServiceToServer(m.Scope, action.Server, v, k, sg, slackId, action.service)
+		case operationRemoveService:
+			err = c.RemoveServiceFromServer(m.Scope, action.Server, action.Service, k, sg)
+		case operationRemoveServer:
+			err = c.RemoveServerFromScope(m.Scope, action.Server, false)
+		}
+		if err != nil {
+			return
+		}
+	}
+	status(c.job, fmt.Sprintf("%s: Completed applying manifest.", m.Scope))
+	return
+}
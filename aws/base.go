@@ -7,6 +7,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
 	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	log "github.com/cantara/bragi"
 	"github.com/cantara/nerthus/aws/key"
 	"github.com/cantara/nerthus/aws/security"
@@ -14,7 +15,11 @@ import (
 	"github.com/cantara/nerthus/aws/util"
 	"github.com/cantara/nerthus/aws/vpc"
 	"github.com/cantara/nerthus/crypto"
+	"github.com/cantara/nerthus/job"
+	"github.com/cantara/nerthus/secret"
+	servershlib "github.com/cantara/nerthus/server"
 	"github.com/cantara/nerthus/slack"
+	"net"
 )
 
 func CheckNameLen(name string) error {
@@ -30,20 +35,80 @@ func CheckNameLen(name string) error {
 }
 
 type AWS struct {
-	ec2 *ec2.Client
-	elb *elbv2.Client
-	rds *rds.Client
+	ec2  util.EC2
+	elb  util.ELB
+	rds  util.RDS
+	ssm  util.SSM
+	job  *job.Job
+	dial servershlib.Dialer
+	// secrets keeps the private keys of the scopes and the database passwords.
+	secrets secret.Store
+	// nerthusIP is where ssh is allowed from in new scopes that are not given any ssh sources.
+	nerthusIP string
 }
 
-func (a AWS) GetEC2() *ec2.Client {
+// NewWithClients returns an AWS using the provided clients instead of ones created from an aws config, like the
+// in-memory fakes in aws/fake.
+func NewWithClients(e2 util.EC2, elb util.ELB, db util.RDS) AWS {
+	return AWS{
+		ec2: e2,
+		elb: elb,
+		rds: db,
+	}
+}
+
+// WithJob returns a copy of the clients that reports progress of the operations it runs to the job.
+func (a AWS) WithJob(j *job.Job) AWS {
+	a.job = j
+	return a
+}
+
+// WithDialer returns a copy of the clients that runs scripts on servers over the executors dial returns, like the
+// server.FakeExecutor in tests. Without it scripts are run over ssh.
+func (a AWS) WithDialer(dial servershlib.Dialer) AWS {
+	a.dial = dial
+	return a
+}
+
+// WithSSM returns a copy of the clients that uses p for ssm, like the in-memory fake in aws/fake.
+func (a AWS) WithSSM(p util.SSM) AWS {
+	a.ssm = p
+	return a
+}
+
+// WithSecrets returns a copy of the clients that keeps the secrets the sequences create in the store.
+func (a AWS) WithSecrets(store secret.Store) AWS {
+	a.secrets = store
+	return a
+}
+
+// GetSecret returns the value of a secret in the secret store.
+func (a AWS) GetSecret(name string) (value string, err error) {
+	if a.secrets == nil {
+		err = fmt.Errorf("No secret store found")
+		return
+	}
+	return a.secrets.Get(name)
+}
+
+// SetNerthusIP sets the outbound ip of nerthus, which new ssh scopes allows ssh from when they are not given any
+// other sources.
+func (a *AWS) SetNerthusIP(ip net.IP) {
+	if ip == nil {
+		return
+	}
+	a.nerthusIP, _ = security.NormalizeSource(ip.String())
+}
+
+func (a AWS) GetEC2() util.EC2 {
 	return a.ec2
 }
 
-func (a AWS) GetELB() *elbv2.Client {
+func (a AWS) GetELB() util.ELB {
 	return a.elb
 }
 
-func (a AWS) GetRDS() *rds.Client {
+func (a AWS) GetRDS() util.RDS {
 	return a.rds
 }
 
@@ -82,6 +147,13 @@ func (a *AWS) NewRDS(c aws.Config) {
 	a.rds = rds.NewFromConfig(c)
 }
 
+func (a *AWS) NewSSM(c aws.Config) {
+	if a.ssm != nil {
+		return
+	}
+	a.ssm = ssm.NewFromConfig(c)
+}
+
 func (a AWS) hasRDSSession() error {
 	if a.rds == nil {
 		return fmt.Errorf("No rds session found")
@@ -89,15 +161,22 @@ func (a AWS) hasRDSSession() error {
 	return nil
 }
 
-func cleanup(object, logMessage string, obj util.AWSObject) func() {
+// status reports progress to the log, slack and the job running the operation, if any.
+func status(j *job.Job, s string) {
+	log.Info(s)
+	slack.SendStatus(s)
+	j.AddLog(s)
+}
+
+func cleanup(object, logMessage string, obj deleter, j *job.Job, deleted func()) func() {
 	return func() {
-		s := fmt.Sprintf(" Cleaning up: %s", object)
-		log.Info(s)
-		slack.SendStatus(s)
+		status(j, fmt.Sprintf(" Cleaning up: %s", object))
 		err := obj.Delete()
 		if err != nil {
 			log.AddError(err).Crit(logMessage)
+			return
 		}
+		deleted()
 	}
 }
 
@@ -160,7 +239,6 @@ func Encrypt(scope string, v vpc.VPC, k key.Key, sg security.Group, slackId stri
 		SlackId:       slackId,
 		SecurityGroup: sg,
 	}
-	fmt.Println(data)
 	b, err := json.Marshal(data)
 	if err != nil {
 		return
@@ -186,7 +264,15 @@ func Decrypt(dataCrypt string, a *AWS) (scope string, v vpc.VPC, k key.Key, sg s
 	k.Scope = scope
 	sg = cd.SecurityGroup.WithEC2(a.ec2)
 	sg.Scope = scope
-	fmt.Println(cd)
+	// Crypt data from before the private key was kept in the secret store has the key in it.
+	var legacy struct {
+		Key struct {
+			Material string `json:"material"`
+		} `json:"key"`
+	}
+	if json.Unmarshal(data, &legacy) == nil {
+		k.Material = legacy.Key.Material
+	}
 	return
 }
 
@@ -5,22 +5,49 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/cantara/nerthus/aws/util"
 )
 
-func CheckIfServiceExcistsInScope(scope, service string, e *ec2.Client) (exists bool, err error) {
+func CheckIfServiceExcistsInScope(scope, service string, e util.EC2) (exists bool, err error) {
+	tags, err := describeServiceTags(scope, service, e)
+	if err != nil {
+		return
+	}
+	exists = len(tags) > 0
+	return
+}
+
+// GetServerIdsWithServiceInScope returns the ids of the instances that has the service tag for the scope.
+func GetServerIdsWithServiceInScope(scope, service string, e util.EC2) (ids []string, err error) {
+	tags, err := describeServiceTags(scope, service, e, ec2types.Filter{
+		Name: aws.String("resource-type"),
+		Values: []string{
+			string(ec2types.ResourceTypeInstance),
+		},
+	})
+	if err != nil {
+		return
+	}
+	for _, tag := range tags {
+		ids = append(ids, aws.ToString(tag.ResourceId))
+	}
+	return
+}
+
+func describeServiceTags(scope, service string, e util.EC2, filters ...ec2types.Filter) (tags []ec2types.TagDescription, err error) {
 	result, err := e.DescribeTags(context.Background(), &ec2.DescribeTagsInput{
-		Filters: []ec2types.Filter{
+		Filters: append([]ec2types.Filter{
 			{
 				Name: aws.String("tag:" + service),
 				Values: []string{
 					scope,
 				},
 			},
-		},
+		}, filters...),
 	})
 	if err != nil {
 		return
 	}
-	exists = len(result.Tags) > 0
+	tags = result.Tags
 	return
 }
@@ -14,30 +14,36 @@ import (
 )
 
 type Database struct {
-	Identifier string
-	Database   string
-	Password   string
-	Name       string
-	Scope      string
-	ARN        string
-	Endpoint   string
-	group      security.Group
-	rds        *rds.Client
-	created    bool
+	Identifier  string
+	Database    string
+	Password    string
+	Name        string
+	Scope       string
+	ARN         string
+	Endpoint    string
+	Status      string
+	group       security.Group
+	subnetGroup string
+	rds         util.RDS
+	created     bool
+	snapshot    bool
 }
 
-func NewDatabase(database, scope string, group security.Group, db *rds.Client) (d Database, err error) {
+// NewDatabase returns a database in the db security group, placed in the vpc of the scope by its db subnet group.
+func NewDatabase(database, scope string, group security.Group, subnetGroup string, db util.RDS) (d Database, err error) {
 	err = util.CheckRDSSession(db)
 	if err != nil {
 		return
 	}
 	d = Database{
-		Database: database,
-		Name:     fmt.Sprintf("%s-%s-db", scope, database),
-		Scope:    scope,
-		Password: crypto.GenRandBase32String(48),
-		group:    group,
-		rds:      db,
+		Database:    database,
+		Identifier:  fmt.Sprintf("%s-%s-db", scope, database),
+		Name:        fmt.Sprintf("%s-%s-db", scope, database),
+		Scope:       scope,
+		Password:    crypto.GenRandBase32String(48),
+		group:       group,
+		subnetGroup: subnetGroup,
+		rds:         db,
 	}
 	return
 }
@@ -58,6 +64,8 @@ func (d *Database) Create() (arn string, err error) {
 		AutoMinorVersionUpgrade: aws.Bool(true),
 		StorageEncrypted:        aws.Bool(true),
 		PubliclyAccessible:      aws.Bool(false),
+		DBSubnetGroupName:       aws.String(d.subnetGroup),
+		VpcSecurityGroupIds:     []string{d.group.Id},
 		Tags: []rdstypes.Tag{
 			{
 				Key:   aws.String("Name"),
@@ -87,6 +95,126 @@ func (d *Database) Create() (arn string, err error) {
 	return
 }
 
+// GetDatabase returns the database instance with the identifier.
+// It takes a final snapshot when deleted as it might contain data.
+func GetDatabase(identifier string, db util.RDS) (d Database, err error) {
+	err = util.CheckRDSSession(db)
+	if err != nil {
+		return
+	}
+	result, err := db.DescribeDBInstances(context.Background(), &rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(identifier),
+	})
+	if err != nil {
+		return
+	}
+	if len(result.DBInstances) < 1 {
+		err = fmt.Errorf("No database with identifier %s", identifier)
+		return
+	}
+	instance := result.DBInstances[0]
+	d = Database{
+		Identifier: aws.ToString(instance.DBInstanceIdentifier),
+		Database:   aws.ToString(instance.DBName),
+		Name:       aws.ToString(instance.DBInstanceIdentifier),
+		ARN:        aws.ToString(instance.DBInstanceArn),
+		rds:        db,
+		created:    true,
+		snapshot:   true,
+	}
+	for _, tag := range instance.TagList {
+		if aws.ToString(tag.Key) == "Scope" {
+			d.Scope = aws.ToString(tag.Value)
+		}
+	}
+	if instance.Endpoint != nil {
+		d.Endpoint = aws.ToString(instance.Endpoint.Address)
+	}
+	d.Status = aws.ToString(instance.DBInstanceStatus)
+	return
+}
+
+// GetDatabases returns all database instances tagged with the scope.
+// Databases found this way takes a final snapshot when deleted as they might contain data.
+func GetDatabases(scope string, db util.RDS) (databases []Database, err error) {
+	err = util.CheckRDSSession(db)
+	if err != nil {
+		return
+	}
+	first := true
+	var marker *string
+	for marker != nil || first {
+		first = false
+		result, err := db.DescribeDBInstances(context.Background(), &rds.DescribeDBInstancesInput{
+			Marker: marker,
+		})
+		if err != nil {
+			return nil, err
+		}
+		marker = result.Marker
+		for _, instance := range result.DBInstances {
+			if !hasScope(scope, instance.TagList) {
+				continue
+			}
+			d := Database{
+				Identifier: aws.ToString(instance.DBInstanceIdentifier),
+				Database:   aws.ToString(instance.DBName),
+				Name:       aws.ToString(instance.DBInstanceIdentifier),
+				Scope:      scope,
+				ARN:        aws.ToString(instance.DBInstanceArn),
+				rds:        db,
+				created:    true,
+				snapshot:   true,
+			}
+			if instance.Endpoint != nil {
+				d.Endpoint = aws.ToString(instance.Endpoint.Address)
+			}
+			d.Status = aws.ToString(instance.DBInstanceStatus)
+			databases = append(databases, d)
+		}
+	}
+	return
+}
+
+// GetDatabaseScopes returns the scopes in the Scope tag of the database instances.
+func GetDatabaseScopes(db util.RDS) (scopes []string, err error) {
+	err = util.CheckRDSSession(db)
+	if err != nil {
+		return
+	}
+	found := make(map[string]bool)
+	first := true
+	var marker *string
+	for marker != nil || first {
+		first = false
+		result, err := db.DescribeDBInstances(context.Background(), &rds.DescribeDBInstancesInput{
+			Marker: marker,
+		})
+		if err != nil {
+			return nil, err
+		}
+		marker = result.Marker
+		for _, instance := range result.DBInstances {
+			for _, tag := range instance.TagList {
+				if aws.ToString(tag.Key) == "Scope" && !found[aws.ToString(tag.Value)] {
+					found[aws.ToString(tag.Value)] = true
+					scopes = append(scopes, aws.ToString(tag.Value))
+				}
+			}
+		}
+	}
+	return
+}
+
+func hasScope(scope string, tags []rdstypes.Tag) bool {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == "Scope" && aws.ToString(tag.Value) == scope {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *Database) GetEndpoints(identifier string) (endpoint string, err error) {
 	result, err := d.rds.DescribeDBInstances(context.Background(), &rds.DescribeDBInstancesInput{
 		DBInstanceIdentifier: aws.String(identifier),
@@ -156,15 +284,27 @@ func (d *Database) Delete() (err error) {
 	if !d.created {
 		return
 	}
-	_, err = d.rds.DeleteDBCluster(context.Background(), &rds.DeleteDBClusterInput{
-		DBClusterIdentifier: aws.String(d.Identifier),
-	})
+	input := &rds.DeleteDBInstanceInput{
+		DBInstanceIdentifier: aws.String(d.Identifier),
+		SkipFinalSnapshot:    aws.Bool(!d.snapshot),
+	}
+	if d.snapshot {
+		input.FinalDBSnapshotIdentifier = aws.String(fmt.Sprintf("%s-final-%d", d.Identifier, time.Now().Unix()))
+	}
+	_, err = d.rds.DeleteDBInstance(context.Background(), input)
 	if err != nil {
 		return
 	}
 	return
 }
 
+func (d Database) WaitUntilDeleted() (err error) {
+	err = rds.NewDBInstanceDeletedWaiter(d.rds).Wait(context.Background(), &rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(d.Identifier),
+	}, 30*time.Minute)
+	return
+}
+
 /*
 result, err := svc.CreateDBCluster(input)
 if err != nil {
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	rdstypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/aws/smithy-go"
+	"github.com/cantara/nerthus/aws/util"
+	"github.com/cantara/nerthus/aws/vpc"
+)
+
+var ErrSubnetGroupNotFound = errors.New("db subnet group not found")
+
+// SubnetGroup is the db subnet group that places the databases of a scope in the vpc of the scope. There is one per
+// scope, shared by its databases, and it is deleted with the scope.
+type SubnetGroup struct {
+	Name      string
+	Scope     string
+	SubnetIds []string
+	rds       util.RDS
+	created   bool
+}
+
+func SubnetGroupName(scope string) string {
+	return scope + "-db-subnets"
+}
+
+func NewSubnetGroup(scope string, subnets []vpc.Subnet, db util.RDS) (g SubnetGroup, err error) {
+	err = util.CheckRDSSession(db)
+	if err != nil {
+		return
+	}
+	g = SubnetGroup{
+		Name:  SubnetGroupName(scope),
+		Scope: scope,
+		rds:   db,
+	}
+	for _, s := range subnets {
+		g.SubnetIds = append(g.SubnetIds, s.Id)
+	}
+	return
+}
+
+// GetSubnetGroup returns the db subnet group of the scope, ErrSubnetGroupNotFound is returned if the scope has none.
+func GetSubnetGroup(scope string, db util.RDS) (g SubnetGroup, err error) {
+	err = util.CheckRDSSession(db)
+	if err != nil {
+		return
+	}
+	name := SubnetGroupName(scope)
+	result, err := db.DescribeDBSubnetGroups(context.Background(), &rds.DescribeDBSubnetGroupsInput{
+		DBSubnetGroupName: aws.String(name),
+	})
+	if isErrorCode(err, "DBSubnetGroupNotFoundFault") || err == nil && len(result.DBSubnetGroups) < 1 {
+		err = fmt.Errorf("%w: %s", ErrSubnetGroupNotFound, name)
+		return
+	}
+	if err != nil {
+		return
+	}
+	g = SubnetGroup{
+		Name:    name,
+		Scope:   scope,
+		rds:     db,
+		created: true,
+	}
+	for _, s := range result.DBSubnetGroups[0].Subnets {
+		g.SubnetIds = append(g.SubnetIds, aws.ToString(s.SubnetIdentifier))
+	}
+	return
+}
+
+func (g *SubnetGroup) Create() (name string, err error) {
+	_, err = g.rds.CreateDBSubnetGroup(context.Background(), &rds.CreateDBSubnetGroupInput{
+		DBSubnetGroupName:        aws.String(g.Name),
+		DBSubnetGroupDescription: aws.String(fmt.Sprintf("Databases in scope %s", g.Scope)),
+		SubnetIds:                g.SubnetIds,
+		Tags: []rdstypes.Tag{
+			{
+				Key:   aws.String("Name"),
+				Value: aws.String(g.Name),
+			},
+			{
+				Key:   aws.String("Scope"),
+				Value: aws.String(g.Scope),
+			},
+		},
+	})
+	if err != nil {
+		err = util.CreateError{
+			Text: fmt.Sprintf("Could not create db subnet group with name %s.", g.Name),
+			Err:  err,
+		}
+		return
+	}
+	name = g.Name
+	g.created = true
+	return
+}
+
+// Delete removes the subnet group, the databases in it must be deleted first. A subnet group that is already gone is
+// not an error.
+func (g *SubnetGroup) Delete() (err error) {
+	if !g.created {
+		return
+	}
+	_, err = g.rds.DeleteDBSubnetGroup(context.Background(), &rds.DeleteDBSubnetGroupInput{
+		DBSubnetGroupName: aws.String(g.Name),
+	})
+	if isErrorCode(err, "DBSubnetGroupNotFoundFault") {
+		err = nil
+	}
+	return
+}
+
+func isErrorCode(err error, code string) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == code
+}
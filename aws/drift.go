@@ -0,0 +1,343 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	log "github.com/cantara/bragi"
+	loadbalancerlib "github.com/cantara/nerthus/aws/loadbalancer"
+	securitylib "github.com/cantara/nerthus/aws/security"
+	serverlib "github.com/cantara/nerthus/aws/server"
+	"github.com/cantara/nerthus/aws/util"
+	"github.com/cantara/nerthus/slack"
+)
+
+const (
+	DriftMissing = "missing"
+	DriftExtra   = "extra"
+	DriftChanged = "changed"
+)
+
+// Drift is a difference between what the tags Nerthus wrote says a scope should look like and what is in aws.
+type Drift struct {
+	Service  string `json:"service,omitempty"`
+	Resource string `json:"resource"`
+	Id       string `json:"id,omitempty"`
+	Kind     string `json:"kind"`
+	Message  string `json:"message"`
+}
+
+type DriftReport struct {
+	Scope   string    `json:"scope"`
+	Checked time.Time `json:"checked"`
+	Drift   []Drift   `json:"drift"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func (r *DriftReport) add(service, resource, id, kind, format string, a ...interface{}) {
+	r.Drift = append(r.Drift, Drift{
+		Service:  service,
+		Resource: resource,
+		Id:       id,
+		Kind:     kind,
+		Message:  fmt.Sprintf(format, a...),
+	})
+}
+
+// CheckDrift compares the resources every service in the scope has recorded in its tags with what is in aws.
+// Missing or extra targets, listener rules that are gone or re-prioritised and ingress rules added or removed by hand
+// are reported.
+func (c AWS) CheckDrift(scope string) (report DriftReport, err error) {
+	report = DriftReport{
+		Scope:   scope,
+		Checked: time.Now(),
+		Drift:   []Drift{},
+	}
+	servers, err := serverlib.GetServers(scope, c.ec2)
+	if err != nil {
+		return
+	}
+	serverNames := make(map[string]string)
+	for _, s := range servers {
+		serverNames[s.Id] = s.Name
+	}
+	groups, err := securitylib.GetGroups(scope, c.ec2)
+	if err != nil {
+		return
+	}
+	var scopeGroup securitylib.Group
+	for _, g := range groups {
+		if g.IsScopeGroup() {
+			scopeGroup = g
+		}
+	}
+	targetGroups, err := loadbalancerlib.GetTargetGroups(scope, c.elb)
+	if err != nil {
+		return
+	}
+	targetGroupsByName := make(map[string]loadbalancerlib.TargetGroup)
+	for _, tg := range targetGroups {
+		targetGroupsByName[tg.Name] = tg
+	}
+	tagged, err := c.serviceTags(scope)
+	if err != nil {
+		return
+	}
+
+	servicePorts := make(map[int]bool)
+	for _, service := range sortedKeys(tagged) {
+		taggedServers := make(map[string]bool)
+		for _, t := range tagged[service] {
+			id := aws.ToString(t.ResourceId)
+			switch t.ResourceType {
+			case ec2types.ResourceTypeInstance:
+				if _, live := serverNames[id]; live {
+					taggedServers[id] = true
+				}
+			case ec2types.ResourceTypeSecurityGroup:
+				if scopeGroup.Id != "" && id != scopeGroup.Id {
+					report.add(service, resourceSecurityGroup, id, DriftChanged,
+						"%s is tagged on security group %s, the scope security group is %s", service, id, scopeGroup.Id)
+				}
+			}
+		}
+
+		name, err := loadbalancerlib.TargetGroupName(scope, service)
+		if err != nil {
+			continue
+		}
+		tg, ok := targetGroupsByName[name]
+		if !ok {
+			report.add(service, resourceTargetGroup, name, DriftMissing, "Target group %s for %s is missing", name, service)
+			continue
+		}
+		servicePorts[tg.Port] = true
+
+		rules, err := tg.GetRules()
+		if err != nil {
+			return report, err
+		}
+		if len(rules) == 0 {
+			report.add(service, resourceRule, tg.ARN, DriftMissing, "No listener rule forwards to target group %s", tg.Name)
+		}
+		for _, rule := range rules {
+			recorded, ok, err := rule.RecordedPriority()
+			if err != nil {
+				return report, err
+			}
+			if ok && recorded != rule.Priority {
+				report.add(service, resourceRule, rule.ARN, DriftChanged,
+					"Listener rule for %s was created with priority %d, it now has priority %d", service, recorded, rule.Priority)
+			}
+		}
+
+		targets, err := tg.GetTargets()
+		if err != nil {
+			return report, err
+		}
+		registered := make(map[string]bool)
+		for _, target := range targets {
+			registered[target.ServerId] = true
+			if !taggedServers[target.ServerId] {
+				report.add(service, resourceTarget, target.ServerId, DriftExtra,
+					"%s is registered in target group %s but is not tagged with %s", target.ServerId, tg.Name, service)
+			}
+		}
+		for _, id := range sortedKeys(taggedServers) {
+			if !registered[id] {
+				report.add(service, resourceTarget, id, DriftMissing,
+					"%s (%s) runs %s but is not registered in target group %s", serverNames[id], id, service, tg.Name)
+			}
+		}
+	}
+
+	if scopeGroup.Id == "" {
+		report.add("", resourceSecurityGroup, securitylib.GroupName(scope), DriftMissing,
+			"Security group %s is missing", securitylib.GroupName(scope))
+		return
+	}
+	err = checkScopeGroupDrift(&report, scopeGroup, servicePorts)
+	if err != nil {
+		return
+	}
+	for _, g := range groups {
+		if g.Id == scopeGroup.Id {
+			continue
+		}
+		err = checkGroupDrift(&report, g, []securitylib.Ingress{securitylib.DatabaseIngress(scopeGroup.Id)}, nil)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// checkScopeGroupDrift checks that the scope group only has the ingress it was created with and ingress from the
+// loadbalancers on the ports of the services. The loadbalancer security groups are not recorded, so any group is accepted on those ports.
+func checkScopeGroupDrift(report *DriftReport, g securitylib.Group, servicePorts map[int]bool) error {
+	return checkGroupDrift(report, g, g.ScopeIngress(), func(i securitylib.Ingress) bool {
+		return i.GroupId != "" && i.ToPort == 0 && servicePorts[i.Port]
+	})
+}
+
+func checkGroupDrift(report *DriftReport, g securitylib.Group, expected []securitylib.Ingress, allowed func(securitylib.Ingress) bool) error {
+	rules, err := g.GetIngress()
+	if err != nil {
+		return err
+	}
+	found := make([]bool, len(expected))
+	for _, rule := range rules {
+		known := false
+		for i, e := range expected {
+			if sameIngress(rule, e) {
+				found[i] = true
+				known = true
+			}
+		}
+		if !known && (allowed == nil || !allowed(rule)) {
+			report.add("", resourceSecurityGroup, g.Id, DriftExtra, "Security group %s allows %s", g.Name, describeIngress(rule))
+		}
+	}
+	for i, e := range expected {
+		if !found[i] {
+			report.add("", resourceSecurityGroup, g.Id, DriftMissing, "Security group %s is missing %s", g.Name, describeIngress(e))
+		}
+	}
+	return nil
+}
+
+func sameIngress(a, b securitylib.Ingress) bool {
+	return a.Port == b.Port && a.ToPort == b.ToPort && a.Protocol == b.Protocol && a.Cidr == b.Cidr &&
+		a.PrefixListId == b.PrefixListId && a.GroupId == b.GroupId
+}
+
+func describeIngress(i securitylib.Ingress) string {
+	ports := fmt.Sprint(i.Port)
+	if i.ToPort != 0 {
+		ports = fmt.Sprintf("%d-%d", i.Port, i.ToPort)
+	}
+	from := i.Cidr
+	if i.PrefixListId != "" {
+		from = i.PrefixListId
+	}
+	if i.GroupId != "" {
+		from = i.GroupId
+	}
+	return fmt.Sprintf("%s %s from %s", i.Protocol, ports, from)
+}
+
+// serviceTags returns the ec2 resources tagged with each service in the scope. The services are tagged with the artifact
+// id as key and the scope as value.
+func (c AWS) serviceTags(scope string) (tagged map[string][]ec2types.TagDescription, err error) {
+	err = util.CheckEC2Session(c.ec2)
+	if err != nil {
+		return
+	}
+	tagged = make(map[string][]ec2types.TagDescription)
+	first := true
+	var nextToken *string
+	for nextToken != nil || first {
+		first = false
+		result, err := c.ec2.DescribeTags(context.Background(), &ec2.DescribeTagsInput{
+			Filters: []ec2types.Filter{
+				{
+					Name: aws.String("value"),
+					Values: []string{
+						scope,
+					},
+				},
+			},
+			NextToken: nextToken,
+		})
+		if err != nil {
+			return nil, err
+		}
+		nextToken = result.NextToken
+		for _, tag := range result.Tags {
+			key := aws.ToString(tag.Key)
+			if key == "Scope" || key == "Name" {
+				continue
+			}
+			tagged[key] = append(tagged[key], tag)
+		}
+	}
+	return
+}
+
+var driftMutex sync.Mutex
+var driftReports = []DriftReport{}
+var driftChecked time.Time
+
+// CheckAllDrift checks every scope and keeps the result as the latest drift. A scope that could not be checked is
+// reported with its error instead of stopping the check.
+func (c AWS) CheckAllDrift() (reports []DriftReport, err error) {
+	scopes, err := c.GetScopes()
+	if err != nil {
+		return
+	}
+	reports = []DriftReport{}
+	for _, scope := range scopes {
+		report, err := c.CheckDrift(scope)
+		if err != nil {
+			log.AddError(err).Warning("While checking drift in ", scope)
+			report.Error = err.Error()
+		}
+		reports = append(reports, report)
+	}
+	driftMutex.Lock()
+	driftReports = reports
+	driftChecked = time.Now()
+	driftMutex.Unlock()
+	return
+}
+
+// LatestDrift returns the result of the last drift check and when it was done.
+func LatestDrift() (reports []DriftReport, checked time.Time) {
+	driftMutex.Lock()
+	defer driftMutex.Unlock()
+	return driftReports, driftChecked
+}
+
+// StartDriftChecker checks all scopes for drift every interval and posts a summary to the Slack status channel when
+// drift is found, or when drift that was found earlier is gone.
+func (c AWS) StartDriftChecker(interval time.Duration) {
+	go func() {
+		hadDrift := false
+		for {
+			reports, err := c.CheckAllDrift()
+			if err != nil {
+				log.AddError(err).Warning("While checking drift")
+			} else {
+				summary, drift := driftSummary(reports)
+				if drift || hadDrift {
+					slack.SendStatus(summary)
+				}
+				hadDrift = drift
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func driftSummary(reports []DriftReport) (summary string, drift bool) {
+	var lines []string
+	for _, report := range reports {
+		if len(report.Drift) == 0 {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: %d differences", report.Scope, len(report.Drift)))
+		for _, d := range report.Drift {
+			lines = append(lines, fmt.Sprintf("  %s: %s", d.Kind, d.Message))
+		}
+	}
+	if len(lines) == 0 {
+		return ":white_check_mark: Drift check: every scope matches its tags.", false
+	}
+	return ":warning: Drift check found resources changed outside of Nerthus:\n" + strings.Join(lines, "\n"), true
+}
@@ -0,0 +1,44 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/cantara/bragi"
+	"github.com/cantara/nerthus/aws/util"
+)
+
+var ErrNameNotAvailable = errors.New("name is not available")
+
+// resourceSlack is used for steps that fails while sending to slack, it is not a resource recorded in journals.
+const resourceSlack = "slack"
+
+// StepError is returned by the sequences when a step fails. Resource is the kind of resource the step was working on.
+type StepError struct {
+	Step     string `json:"step"`
+	Resource string `json:"resource,omitempty"`
+	Cause    error  `json:"-"`
+}
+
+func (e *StepError) Error() string {
+	if e.Resource == "" {
+		return fmt.Sprintf("step %s failed: %v", e.Step, e.Cause)
+	}
+	return fmt.Sprintf("step %s failed on %s: %v", e.Step, e.Resource, e.Cause)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Cause
+}
+
+// fail logs the error and returns it as a StepError. The step name is filled in by the sequence running the step.
+func fail(resource string, err error, text string) error {
+	log.AddError(err).Crit(text)
+	return &StepError{
+		Resource: resource,
+		Cause: util.CreateError{
+			Text: text,
+			Err:  err,
+		},
+	}
+}
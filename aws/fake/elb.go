@@ -0,0 +1,543 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	elbv2types "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/cantara/nerthus/aws/util"
+)
+
+var _ util.ELB = (*ELB)(nil)
+
+// ELB is an in-memory elbv2. Nerthus does not create loadbalancers, they are added with AddLoadbalancer.
+type ELB struct {
+	failures
+	mutex         sync.Mutex
+	ids           ids
+	loadbalancers []*elbv2types.LoadBalancer
+	listeners     []*elbv2types.Listener
+	rules         []*elbv2types.Rule
+	ruleListener  map[string]string
+	targetGroups  []*elbv2types.TargetGroup
+	targets       map[string][]string
+	health        map[string]elbv2types.TargetHealthStateEnum
+	tags          map[string][]elbv2types.Tag
+}
+
+func NewELB() *ELB {
+	return &ELB{
+		ruleListener: make(map[string]string),
+		targets:      make(map[string][]string),
+		health:       make(map[string]elbv2types.TargetHealthStateEnum),
+		tags:         make(map[string][]elbv2types.Tag),
+	}
+}
+
+func (f *ELB) arn(kind, name string) string {
+	return fmt.Sprintf("arn:aws:elasticloadbalancing:%s:%s:%s/%s/%s", region, account, kind, name, f.ids.suffix())
+}
+
+// AddLoadbalancer adds an internet facing application loadbalancer in the vpc with a https listener on port 443, like
+// the ones services are added to. The listener only has its default rule.
+func (f *ELB) AddLoadbalancer(name, securityGroupId, vpcId string) (loadbalancerARN, listenerARN string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	loadbalancerARN = f.arn("loadbalancer", "app/"+name)
+	f.loadbalancers = append(f.loadbalancers, &elbv2types.LoadBalancer{
+		LoadBalancerArn:  aws.String(loadbalancerARN),
+		LoadBalancerName: aws.String(name),
+		DNSName:          aws.String(fmt.Sprintf("%s.%s.elb.amazonaws.com", name, region)),
+		Scheme:           elbv2types.LoadBalancerSchemeEnumInternetFacing,
+		Type:             elbv2types.LoadBalancerTypeEnumApplication,
+		SecurityGroups:   []string{securityGroupId},
+		VpcId:            aws.String(vpcId),
+	})
+	f.tags[loadbalancerARN] = nil
+	listenerARN = f.arn("listener", "app/"+name)
+	f.listeners = append(f.listeners, &elbv2types.Listener{
+		ListenerArn:     aws.String(listenerARN),
+		LoadBalancerArn: aws.String(loadbalancerARN),
+		Port:            aws.Int32(443),
+		Protocol:        elbv2types.ProtocolEnumHttps,
+	})
+	f.tags[listenerARN] = nil
+	ruleARN := f.arn("listener-rule", "app/"+name)
+	f.rules = append(f.rules, &elbv2types.Rule{
+		RuleArn:   aws.String(ruleARN),
+		Priority:  aws.String("default"),
+		IsDefault: aws.Bool(true),
+		Actions: []elbv2types.Action{
+			{
+				Type: elbv2types.ActionTypeEnumFixedResponse,
+			},
+		},
+	})
+	f.ruleListener[ruleARN] = listenerARN
+	f.tags[ruleARN] = nil
+	return
+}
+
+func (f *ELB) listener(arn string) *elbv2types.Listener {
+	for _, l := range f.listeners {
+		if aws.ToString(l.ListenerArn) == arn {
+			return l
+		}
+	}
+	return nil
+}
+
+func (f *ELB) loadbalancerVPC(arn string) string {
+	for _, lb := range f.loadbalancers {
+		if aws.ToString(lb.LoadBalancerArn) == arn {
+			return aws.ToString(lb.VpcId)
+		}
+	}
+	return ""
+}
+
+func (f *ELB) targetGroup(arn string) *elbv2types.TargetGroup {
+	for _, tg := range f.targetGroups {
+		if aws.ToString(tg.TargetGroupArn) == arn {
+			return tg
+		}
+	}
+	return nil
+}
+
+// updateLoadbalancerArns sets the loadbalancers of every target group to the ones with a rule forwarding to it.
+func (f *ELB) updateLoadbalancerArns() {
+	for _, tg := range f.targetGroups {
+		tg.LoadBalancerArns = nil
+		for _, r := range f.rules {
+			if !forwardsTo(r.Actions, aws.ToString(tg.TargetGroupArn)) {
+				continue
+			}
+			lb := aws.ToString(f.listener(f.ruleListener[aws.ToString(r.RuleArn)]).LoadBalancerArn)
+			if !slices.Contains(tg.LoadBalancerArns, lb) {
+				tg.LoadBalancerArns = append(tg.LoadBalancerArns, lb)
+			}
+		}
+	}
+}
+
+func forwardsTo(actions []elbv2types.Action, targetGroupARN string) bool {
+	for _, action := range actions {
+		if aws.ToString(action.TargetGroupArn) == targetGroupARN {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *ELB) setTags(arn string, tags []elbv2types.Tag) {
+	for _, tag := range tags {
+		i := slices.IndexFunc(f.tags[arn], func(t elbv2types.Tag) bool {
+			return aws.ToString(t.Key) == aws.ToString(tag.Key)
+		})
+		if i >= 0 {
+			f.tags[arn][i] = tag
+			continue
+		}
+		f.tags[arn] = append(f.tags[arn], tag)
+	}
+}
+
+func (f *ELB) AddTags(ctx context.Context, params *elbv2.AddTagsInput, optFns ...func(*elbv2.Options)) (*elbv2.AddTagsOutput, error) {
+	if err := f.call("AddTags"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, arn := range params.ResourceArns {
+		if _, ok := f.tags[arn]; !ok {
+			return nil, apiError("ValidationError", "Resource '%s' not found", arn)
+		}
+	}
+	for _, arn := range params.ResourceArns {
+		f.setTags(arn, params.Tags)
+	}
+	return &elbv2.AddTagsOutput{}, nil
+}
+
+func (f *ELB) CreateRule(ctx context.Context, params *elbv2.CreateRuleInput, optFns ...func(*elbv2.Options)) (*elbv2.CreateRuleOutput, error) {
+	if err := f.call("CreateRule"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	listenerARN := aws.ToString(params.ListenerArn)
+	if f.listener(listenerARN) == nil {
+		return nil, apiError("ListenerNotFound", "Listener '%s' not found", listenerARN)
+	}
+	priority := strconv.Itoa(int(aws.ToInt32(params.Priority)))
+	for _, r := range f.rules {
+		if f.ruleListener[aws.ToString(r.RuleArn)] == listenerARN && aws.ToString(r.Priority) == priority {
+			return nil, apiError("PriorityInUse", "Priority '%s' is currently in use", priority)
+		}
+	}
+	vpcId := f.loadbalancerVPC(aws.ToString(f.listener(listenerARN).LoadBalancerArn))
+	for _, action := range params.Actions {
+		if action.TargetGroupArn == nil {
+			continue
+		}
+		tg := f.targetGroup(aws.ToString(action.TargetGroupArn))
+		if tg == nil {
+			return nil, apiError("TargetGroupNotFound", "Target group '%s' not found", aws.ToString(action.TargetGroupArn))
+		}
+		if aws.ToString(tg.VpcId) != vpcId {
+			return nil, apiError("InvalidConfigurationRequest", "The target group '%s' does not have the same VPC as the load balancer", aws.ToString(tg.TargetGroupArn))
+		}
+	}
+	var conditions []elbv2types.RuleCondition
+	for _, c := range params.Conditions {
+		if aws.ToString(c.Field) == "path-pattern" && c.PathPatternConfig == nil {
+			c.PathPatternConfig = &elbv2types.PathPatternConditionConfig{
+				Values: c.Values,
+			}
+		}
+		conditions = append(conditions, c)
+	}
+	arn := f.arn("listener-rule", "app/rule")
+	rule := &elbv2types.Rule{
+		RuleArn:    aws.String(arn),
+		Priority:   aws.String(priority),
+		IsDefault:  aws.Bool(false),
+		Actions:    params.Actions,
+		Conditions: conditions,
+	}
+	f.rules = append(f.rules, rule)
+	f.ruleListener[arn] = listenerARN
+	f.tags[arn] = nil
+	f.setTags(arn, params.Tags)
+	f.updateLoadbalancerArns()
+	return &elbv2.CreateRuleOutput{
+		Rules: []elbv2types.Rule{*rule},
+	}, nil
+}
+
+func (f *ELB) CreateTargetGroup(ctx context.Context, params *elbv2.CreateTargetGroupInput, optFns ...func(*elbv2.Options)) (*elbv2.CreateTargetGroupOutput, error) {
+	if err := f.call("CreateTargetGroup"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name := aws.ToString(params.Name)
+	if len(name) > 32 {
+		return nil, apiError("ValidationError", "Target group name '%s' cannot be longer than '32' characters", name)
+	}
+	for _, tg := range f.targetGroups {
+		if aws.ToString(tg.TargetGroupName) == name {
+			return nil, apiError("DuplicateTargetGroupName", "A target group with the same name '%s' exists", name)
+		}
+	}
+	arn := f.arn("targetgroup", name)
+	tg := &elbv2types.TargetGroup{
+		TargetGroupArn:  aws.String(arn),
+		TargetGroupName: aws.String(name),
+		Port:            params.Port,
+		Protocol:        params.Protocol,
+		VpcId:           params.VpcId,
+		TargetType:      params.TargetType,
+		HealthCheckPath: params.HealthCheckPath,
+		HealthCheckPort: params.HealthCheckPort,
+	}
+	f.targetGroups = append(f.targetGroups, tg)
+	f.tags[arn] = nil
+	f.setTags(arn, params.Tags)
+	return &elbv2.CreateTargetGroupOutput{
+		TargetGroups: []elbv2types.TargetGroup{*tg},
+	}, nil
+}
+
+func (f *ELB) DeleteRule(ctx context.Context, params *elbv2.DeleteRuleInput, optFns ...func(*elbv2.Options)) (*elbv2.DeleteRuleOutput, error) {
+	if err := f.call("DeleteRule"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	arn := aws.ToString(params.RuleArn)
+	i := slices.IndexFunc(f.rules, func(r *elbv2types.Rule) bool {
+		return aws.ToString(r.RuleArn) == arn
+	})
+	if i < 0 {
+		return nil, apiError("RuleNotFound", "One or more rules not found")
+	}
+	if aws.ToBool(f.rules[i].IsDefault) {
+		return nil, apiError("OperationNotPermitted", "Default rule '%s' cannot be deleted", arn)
+	}
+	f.rules = slices.Delete(f.rules, i, i+1)
+	delete(f.ruleListener, arn)
+	delete(f.tags, arn)
+	f.updateLoadbalancerArns()
+	return &elbv2.DeleteRuleOutput{}, nil
+}
+
+func (f *ELB) DeleteTargetGroup(ctx context.Context, params *elbv2.DeleteTargetGroupInput, optFns ...func(*elbv2.Options)) (*elbv2.DeleteTargetGroupOutput, error) {
+	if err := f.call("DeleteTargetGroup"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	arn := aws.ToString(params.TargetGroupArn)
+	i := slices.IndexFunc(f.targetGroups, func(tg *elbv2types.TargetGroup) bool {
+		return aws.ToString(tg.TargetGroupArn) == arn
+	})
+	if i < 0 {
+		return nil, apiError("TargetGroupNotFound", "Target group '%s' not found", arn)
+	}
+	if len(f.targetGroups[i].LoadBalancerArns) > 0 {
+		return nil, apiError("ResourceInUse", "Target group '%s' is currently in use by a listener or a rule", arn)
+	}
+	f.targetGroups = slices.Delete(f.targetGroups, i, i+1)
+	delete(f.targets, arn)
+	delete(f.tags, arn)
+	return &elbv2.DeleteTargetGroupOutput{}, nil
+}
+
+func (f *ELB) DeregisterTargets(ctx context.Context, params *elbv2.DeregisterTargetsInput, optFns ...func(*elbv2.Options)) (*elbv2.DeregisterTargetsOutput, error) {
+	if err := f.call("DeregisterTargets"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	arn := aws.ToString(params.TargetGroupArn)
+	if f.targetGroup(arn) == nil {
+		return nil, apiError("TargetGroupNotFound", "Target group '%s' not found", arn)
+	}
+	for _, target := range params.Targets {
+		f.targets[arn] = slices.DeleteFunc(f.targets[arn], func(id string) bool {
+			return id == aws.ToString(target.Id)
+		})
+		delete(f.health, arn+"/"+aws.ToString(target.Id))
+	}
+	return &elbv2.DeregisterTargetsOutput{}, nil
+}
+
+func (f *ELB) DescribeListeners(ctx context.Context, params *elbv2.DescribeListenersInput, optFns ...func(*elbv2.Options)) (*elbv2.DescribeListenersOutput, error) {
+	if err := f.call("DescribeListeners"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, arn := range params.ListenerArns {
+		if f.listener(arn) == nil {
+			return nil, apiError("ListenerNotFound", "One or more listeners not found")
+		}
+	}
+	out := &elbv2.DescribeListenersOutput{}
+	for _, l := range f.listeners {
+		if len(params.ListenerArns) > 0 && !slices.Contains(params.ListenerArns, aws.ToString(l.ListenerArn)) {
+			continue
+		}
+		if params.LoadBalancerArn != nil && aws.ToString(params.LoadBalancerArn) != aws.ToString(l.LoadBalancerArn) {
+			continue
+		}
+		out.Listeners = append(out.Listeners, *l)
+	}
+	return out, nil
+}
+
+func (f *ELB) DescribeLoadBalancers(ctx context.Context, params *elbv2.DescribeLoadBalancersInput, optFns ...func(*elbv2.Options)) (*elbv2.DescribeLoadBalancersOutput, error) {
+	if err := f.call("DescribeLoadBalancers"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	out := &elbv2.DescribeLoadBalancersOutput{}
+	for _, lb := range f.loadbalancers {
+		if len(params.LoadBalancerArns) > 0 && !slices.Contains(params.LoadBalancerArns, aws.ToString(lb.LoadBalancerArn)) {
+			continue
+		}
+		if len(params.Names) > 0 && !slices.Contains(params.Names, aws.ToString(lb.LoadBalancerName)) {
+			continue
+		}
+		out.LoadBalancers = append(out.LoadBalancers, *lb)
+	}
+	if len(out.LoadBalancers) == 0 && (len(params.LoadBalancerArns) > 0 || len(params.Names) > 0) {
+		return nil, &elbv2types.LoadBalancerNotFoundException{
+			Message: aws.String("One or more load balancers not found"),
+		}
+	}
+	return out, nil
+}
+
+// DescribeRules returns the rules ordered by priority with the default rule last, like aws does.
+func (f *ELB) DescribeRules(ctx context.Context, params *elbv2.DescribeRulesInput, optFns ...func(*elbv2.Options)) (*elbv2.DescribeRulesOutput, error) {
+	if err := f.call("DescribeRules"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if params.ListenerArn != nil && f.listener(aws.ToString(params.ListenerArn)) == nil {
+		return nil, apiError("ListenerNotFound", "One or more listeners not found")
+	}
+	out := &elbv2.DescribeRulesOutput{}
+	for _, r := range f.rules {
+		arn := aws.ToString(r.RuleArn)
+		if len(params.RuleArns) > 0 && !slices.Contains(params.RuleArns, arn) {
+			continue
+		}
+		if params.ListenerArn != nil && f.ruleListener[arn] != aws.ToString(params.ListenerArn) {
+			continue
+		}
+		out.Rules = append(out.Rules, *r)
+	}
+	if len(out.Rules) < len(params.RuleArns) {
+		return nil, apiError("RuleNotFound", "One or more rules not found")
+	}
+	sort.SliceStable(out.Rules, func(i, j int) bool {
+		if aws.ToBool(out.Rules[j].IsDefault) {
+			return !aws.ToBool(out.Rules[i].IsDefault)
+		}
+		if aws.ToBool(out.Rules[i].IsDefault) {
+			return false
+		}
+		pi, _ := strconv.Atoi(aws.ToString(out.Rules[i].Priority))
+		pj, _ := strconv.Atoi(aws.ToString(out.Rules[j].Priority))
+		return pi < pj
+	})
+	return out, nil
+}
+
+func (f *ELB) DescribeTags(ctx context.Context, params *elbv2.DescribeTagsInput, optFns ...func(*elbv2.Options)) (*elbv2.DescribeTagsOutput, error) {
+	if err := f.call("DescribeTags"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(params.ResourceArns) > 20 {
+		return nil, apiError("ValidationError", "A maximum of 20 resources can be described")
+	}
+	out := &elbv2.DescribeTagsOutput{}
+	for _, arn := range params.ResourceArns {
+		tags, ok := f.tags[arn]
+		if !ok {
+			return nil, apiError("ValidationError", "Resource '%s' not found", arn)
+		}
+		out.TagDescriptions = append(out.TagDescriptions, elbv2types.TagDescription{
+			ResourceArn: aws.String(arn),
+			Tags:        slices.Clone(tags),
+		})
+	}
+	return out, nil
+}
+
+func (f *ELB) DescribeTargetGroups(ctx context.Context, params *elbv2.DescribeTargetGroupsInput, optFns ...func(*elbv2.Options)) (*elbv2.DescribeTargetGroupsOutput, error) {
+	if err := f.call("DescribeTargetGroups"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	out := &elbv2.DescribeTargetGroupsOutput{}
+	for _, tg := range f.targetGroups {
+		if len(params.TargetGroupArns) > 0 && !slices.Contains(params.TargetGroupArns, aws.ToString(tg.TargetGroupArn)) {
+			continue
+		}
+		if len(params.Names) > 0 && !slices.Contains(params.Names, aws.ToString(tg.TargetGroupName)) {
+			continue
+		}
+		if params.LoadBalancerArn != nil && !slices.Contains(tg.LoadBalancerArns, aws.ToString(params.LoadBalancerArn)) {
+			continue
+		}
+		group := *tg
+		group.LoadBalancerArns = slices.Clone(tg.LoadBalancerArns)
+		out.TargetGroups = append(out.TargetGroups, group)
+	}
+	if len(out.TargetGroups) < len(params.TargetGroupArns)+len(params.Names) {
+		return nil, apiError("TargetGroupNotFound", "One or more target groups not found")
+	}
+	return out, nil
+}
+
+// SetRulePriority changes the priority of a rule without touching its tags, like a rule re-prioritised in the console.
+func (f *ELB) SetRulePriority(ruleARN string, priority int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, r := range f.rules {
+		if aws.ToString(r.RuleArn) == ruleARN {
+			r.Priority = aws.String(strconv.Itoa(priority))
+		}
+	}
+}
+
+// SetTargetHealth sets the health DescribeTargetHealth reports for a target, targets are healthy until it is set.
+func (f *ELB) SetTargetHealth(targetGroupARN, id string, state elbv2types.TargetHealthStateEnum) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.health[targetGroupARN+"/"+id] = state
+}
+
+// DescribeTargetHealth reports every registered target as healthy, unless set otherwise with SetTargetHealth.
+func (f *ELB) DescribeTargetHealth(ctx context.Context, params *elbv2.DescribeTargetHealthInput, optFns ...func(*elbv2.Options)) (*elbv2.DescribeTargetHealthOutput, error) {
+	if err := f.call("DescribeTargetHealth"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	arn := aws.ToString(params.TargetGroupArn)
+	tg := f.targetGroup(arn)
+	if tg == nil {
+		return nil, apiError("TargetGroupNotFound", "Target group '%s' not found", arn)
+	}
+	out := &elbv2.DescribeTargetHealthOutput{}
+	for _, id := range f.targets[arn] {
+		state, ok := f.health[arn+"/"+id]
+		if !ok {
+			state = elbv2types.TargetHealthStateEnumHealthy
+		}
+		out.TargetHealthDescriptions = append(out.TargetHealthDescriptions, elbv2types.TargetHealthDescription{
+			Target: &elbv2types.TargetDescription{
+				Id:   aws.String(id),
+				Port: tg.Port,
+			},
+			TargetHealth: &elbv2types.TargetHealth{
+				State: state,
+			},
+		})
+	}
+	return out, nil
+}
+
+func (f *ELB) RegisterTargets(ctx context.Context, params *elbv2.RegisterTargetsInput, optFns ...func(*elbv2.Options)) (*elbv2.RegisterTargetsOutput, error) {
+	if err := f.call("RegisterTargets"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	arn := aws.ToString(params.TargetGroupArn)
+	if f.targetGroup(arn) == nil {
+		return nil, apiError("TargetGroupNotFound", "Target group '%s' not found", arn)
+	}
+	for _, target := range params.Targets {
+		if !slices.Contains(f.targets[arn], aws.ToString(target.Id)) {
+			f.targets[arn] = append(f.targets[arn], aws.ToString(target.Id))
+		}
+	}
+	return &elbv2.RegisterTargetsOutput{}, nil
+}
+
+func (f *ELB) RemoveTags(ctx context.Context, params *elbv2.RemoveTagsInput, optFns ...func(*elbv2.Options)) (*elbv2.RemoveTagsOutput, error) {
+	if err := f.call("RemoveTags"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, arn := range params.ResourceArns {
+		if _, ok := f.tags[arn]; !ok {
+			return nil, apiError("ValidationError", "Resource '%s' not found", arn)
+		}
+	}
+	for _, arn := range params.ResourceArns {
+		f.tags[arn] = slices.DeleteFunc(f.tags[arn], func(t elbv2types.Tag) bool {
+			return slices.Contains(params.TagKeys, aws.ToString(t.Key))
+		})
+	}
+	return &elbv2.RemoveTagsOutput{}, nil
+}
@@ -0,0 +1,75 @@
+// Package fake is an in-memory implementation of the parts of the ec2, elbv2, rds and ssm apis Nerthus uses. It makes
+// it possible to run the orchestration sequences without an aws account. Resources are ready as soon as they are
+// created, so waiters returns on their first attempt.
+package fake
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/aws/smithy-go"
+)
+
+const (
+	region  = "eu-west-1"
+	account = "000000000000"
+)
+
+// failures makes operations fail on demand, so that the error handling and rollback of the sequences can be tested.
+type failures struct {
+	mutex sync.Mutex
+	errs  map[string]error
+	calls []string
+}
+
+// Fail makes every following call to the operation fail with err. The operation is the name of the api method, like
+// RunInstances. A nil err makes the operation succeed again.
+func (f *failures) Fail(operation string, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.errs == nil {
+		f.errs = make(map[string]error)
+	}
+	if err == nil {
+		delete(f.errs, operation)
+		return
+	}
+	f.errs[operation] = err
+}
+
+// Calls returns the operations that has been called, in the order they were called.
+func (f *failures) Calls() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return slices.Clone(f.calls)
+}
+
+func (f *failures) call(operation string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls = append(f.calls, operation)
+	return f.errs[operation]
+}
+
+// ids hands out resource ids that are unique within one fake.
+type ids struct {
+	next int
+}
+
+func (i *ids) id(prefix string) string {
+	return prefix + "-" + i.suffix()
+}
+
+func (i *ids) suffix() string {
+	i.next++
+	return fmt.Sprintf("%017x", i.next)
+}
+
+func apiError(code, format string, a ...interface{}) error {
+	return &smithy.GenericAPIError{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+		Fault:   smithy.FaultClient,
+	}
+}
@@ -0,0 +1,699 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// The vpc api of the fake: vpcs, subnets, internet and nat gateways, route tables and elastic ip addresses. Deleting a
+// resource something else still depends on fails with DependencyViolation, like in aws, so that the teardown order is
+// tested.
+
+func localRoute(cidr string) ec2types.Route {
+	return ec2types.Route{
+		DestinationCidrBlock: aws.String(cidr),
+		GatewayId:            aws.String("local"),
+		Origin:               ec2types.RouteOriginCreateRouteTable,
+		State:                ec2types.RouteStateActive,
+	}
+}
+
+func (f *EC2) AllocateAddress(ctx context.Context, params *ec2.AllocateAddressInput, optFns ...func(*ec2.Options)) (*ec2.AllocateAddressOutput, error) {
+	if err := f.call("AllocateAddress"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	id := f.ids.id("eipalloc")
+	f.addresses[id] = &ec2types.Address{
+		AllocationId: aws.String(id),
+		Domain:       ec2types.DomainTypeVpc,
+		PublicIp:     aws.String(fmt.Sprintf("203.0.113.%d", len(f.addresses)+1)),
+	}
+	f.add(id, ec2types.ResourceTypeElasticIp, specTags(params.TagSpecifications, ec2types.ResourceTypeElasticIp))
+	return &ec2.AllocateAddressOutput{
+		AllocationId: aws.String(id),
+		Domain:       ec2types.DomainTypeVpc,
+		PublicIp:     f.addresses[id].PublicIp,
+	}, nil
+}
+
+// AssociateRouteTable associates the route table with a subnet. A subnet can only be associated with one route table.
+func (f *EC2) AssociateRouteTable(ctx context.Context, params *ec2.AssociateRouteTableInput, optFns ...func(*ec2.Options)) (*ec2.AssociateRouteTableOutput, error) {
+	if err := f.call("AssociateRouteTable"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	tableId := aws.ToString(params.RouteTableId)
+	table, ok := f.tables[tableId]
+	if !ok {
+		return nil, apiError("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", tableId)
+	}
+	subnetId := aws.ToString(params.SubnetId)
+	subnet, ok := f.subnets[subnetId]
+	if !ok {
+		return nil, apiError("InvalidSubnetID.NotFound", "The subnet ID '%s' does not exist", subnetId)
+	}
+	if aws.ToString(subnet.VpcId) != aws.ToString(table.VpcId) {
+		return nil, apiError("InvalidParameterValue", "Route table %s and subnet %s belong to different networks", tableId, subnetId)
+	}
+	for _, t := range f.tables {
+		for _, a := range t.Associations {
+			if aws.ToString(a.SubnetId) == subnetId {
+				return nil, apiError("Resource.AlreadyAssociated", "the specified association for route table %s conflicts with an existing association", tableId)
+			}
+		}
+	}
+	id := f.ids.id("rtbassoc")
+	table.Associations = append(table.Associations, ec2types.RouteTableAssociation{
+		RouteTableAssociationId: aws.String(id),
+		RouteTableId:            aws.String(tableId),
+		SubnetId:                aws.String(subnetId),
+		Main:                    aws.Bool(false),
+	})
+	return &ec2.AssociateRouteTableOutput{
+		AssociationId: aws.String(id),
+	}, nil
+}
+
+func (f *EC2) AttachInternetGateway(ctx context.Context, params *ec2.AttachInternetGatewayInput, optFns ...func(*ec2.Options)) (*ec2.AttachInternetGatewayOutput, error) {
+	if err := f.call("AttachInternetGateway"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	id := aws.ToString(params.InternetGatewayId)
+	gateway, ok := f.gateways[id]
+	if !ok {
+		return nil, apiError("InvalidInternetGatewayID.NotFound", "The internetGateway ID '%s' does not exist", id)
+	}
+	vpcId := aws.ToString(params.VpcId)
+	if _, ok := f.vpcs[vpcId]; !ok {
+		return nil, apiError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", vpcId)
+	}
+	if len(gateway.Attachments) > 0 {
+		return nil, apiError("Resource.AlreadyAssociated", "resource %s is already attached to network %s", id, aws.ToString(gateway.Attachments[0].VpcId))
+	}
+	gateway.Attachments = []ec2types.InternetGatewayAttachment{
+		{
+			VpcId: aws.String(vpcId),
+			State: ec2types.AttachmentStatus("available"),
+		},
+	}
+	return &ec2.AttachInternetGatewayOutput{}, nil
+}
+
+func (f *EC2) CreateInternetGateway(ctx context.Context, params *ec2.CreateInternetGatewayInput, optFns ...func(*ec2.Options)) (*ec2.CreateInternetGatewayOutput, error) {
+	if err := f.call("CreateInternetGateway"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	id := f.ids.id("igw")
+	f.gateways[id] = &ec2types.InternetGateway{
+		InternetGatewayId: aws.String(id),
+		OwnerId:           aws.String(account),
+	}
+	f.add(id, ec2types.ResourceTypeInternetGateway, specTags(params.TagSpecifications, ec2types.ResourceTypeInternetGateway))
+	gateway := *f.gateways[id]
+	gateway.Tags = slices.Clone(f.tags[id])
+	return &ec2.CreateInternetGatewayOutput{
+		InternetGateway: &gateway,
+	}, nil
+}
+
+// CreateNatGateway creates a public nat gateway that is available at once.
+func (f *EC2) CreateNatGateway(ctx context.Context, params *ec2.CreateNatGatewayInput, optFns ...func(*ec2.Options)) (*ec2.CreateNatGatewayOutput, error) {
+	if err := f.call("CreateNatGateway"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	subnetId := aws.ToString(params.SubnetId)
+	subnet, ok := f.subnets[subnetId]
+	if !ok {
+		return nil, apiError("InvalidSubnetID.NotFound", "The subnet ID '%s' does not exist", subnetId)
+	}
+	allocationId := aws.ToString(params.AllocationId)
+	address, ok := f.addresses[allocationId]
+	if !ok {
+		return nil, apiError("InvalidAllocationID.NotFound", "The allocation ID '%s' does not exist", allocationId)
+	}
+	if f.natUsing(allocationId) != "" {
+		return nil, apiError("Resource.AlreadyAssociated", "Elastic IP address [%s] is already associated", allocationId)
+	}
+	id := f.ids.id("nat")
+	f.nats[id] = &ec2types.NatGateway{
+		NatGatewayId:     aws.String(id),
+		SubnetId:         aws.String(subnetId),
+		VpcId:            subnet.VpcId,
+		ConnectivityType: ec2types.ConnectivityTypePublic,
+		State:            ec2types.NatGatewayStateAvailable,
+		NatGatewayAddresses: []ec2types.NatGatewayAddress{
+			{
+				AllocationId: aws.String(allocationId),
+				PublicIp:     address.PublicIp,
+			},
+		},
+	}
+	f.add(id, ec2types.ResourceTypeNatgateway, specTags(params.TagSpecifications, ec2types.ResourceTypeNatgateway))
+	nat := *f.nats[id]
+	nat.Tags = slices.Clone(f.tags[id])
+	return &ec2.CreateNatGatewayOutput{
+		NatGateway: &nat,
+	}, nil
+}
+
+// natUsing returns the nat gateway that is not deleted using the address, if any.
+func (f *EC2) natUsing(allocationId string) string {
+	for id, nat := range f.nats {
+		if nat.State == ec2types.NatGatewayStateDeleted {
+			continue
+		}
+		for _, address := range nat.NatGatewayAddresses {
+			if aws.ToString(address.AllocationId) == allocationId {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// CreateRoute adds a route to an internet gateway attached to the vpc of the route table or to a nat gateway.
+func (f *EC2) CreateRoute(ctx context.Context, params *ec2.CreateRouteInput, optFns ...func(*ec2.Options)) (*ec2.CreateRouteOutput, error) {
+	if err := f.call("CreateRoute"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	tableId := aws.ToString(params.RouteTableId)
+	table, ok := f.tables[tableId]
+	if !ok {
+		return nil, apiError("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", tableId)
+	}
+	destination := aws.ToString(params.DestinationCidrBlock)
+	for _, r := range table.Routes {
+		if aws.ToString(r.DestinationCidrBlock) == destination {
+			return nil, apiError("RouteAlreadyExists", "The route identified by %s already exists.", destination)
+		}
+	}
+	route := ec2types.Route{
+		DestinationCidrBlock: aws.String(destination),
+		Origin:               ec2types.RouteOriginCreateRoute,
+		State:                ec2types.RouteStateActive,
+	}
+	switch {
+	case params.GatewayId != nil:
+		id := aws.ToString(params.GatewayId)
+		gateway, ok := f.gateways[id]
+		if !ok {
+			return nil, apiError("InvalidGatewayID.NotFound", "The gateway ID '%s' does not exist", id)
+		}
+		if len(gateway.Attachments) == 0 || aws.ToString(gateway.Attachments[0].VpcId) != aws.ToString(table.VpcId) {
+			return nil, apiError("InvalidParameterValue", "route table %s and network gateway %s belong to different networks", tableId, id)
+		}
+		route.GatewayId = aws.String(id)
+	case params.NatGatewayId != nil:
+		id := aws.ToString(params.NatGatewayId)
+		if nat, ok := f.nats[id]; !ok || nat.State == ec2types.NatGatewayStateDeleted {
+			return nil, apiError("NatGatewayNotFound", "The Nat Gateway %s was not found", id)
+		}
+		route.NatGatewayId = aws.String(id)
+	default:
+		return nil, apiError("MissingParameter", "The request must contain exactly one gateway, instance or interface target")
+	}
+	table.Routes = append(table.Routes, route)
+	return &ec2.CreateRouteOutput{
+		Return: aws.Bool(true),
+	}, nil
+}
+
+func (f *EC2) CreateRouteTable(ctx context.Context, params *ec2.CreateRouteTableInput, optFns ...func(*ec2.Options)) (*ec2.CreateRouteTableOutput, error) {
+	if err := f.call("CreateRouteTable"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	vpcId := aws.ToString(params.VpcId)
+	vpc, ok := f.vpcs[vpcId]
+	if !ok {
+		return nil, apiError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", vpcId)
+	}
+	id := f.ids.id("rtb")
+	f.tables[id] = &ec2types.RouteTable{
+		RouteTableId: aws.String(id),
+		VpcId:        aws.String(vpcId),
+		Routes:       []ec2types.Route{localRoute(aws.ToString(vpc.CidrBlock))},
+	}
+	f.add(id, ec2types.ResourceTypeRouteTable, specTags(params.TagSpecifications, ec2types.ResourceTypeRouteTable))
+	table := *f.tables[id]
+	table.Tags = slices.Clone(f.tags[id])
+	return &ec2.CreateRouteTableOutput{
+		RouteTable: &table,
+	}, nil
+}
+
+// CreateSubnet creates a subnet that does not give servers public ip addresses. The cidr must be in the vpc and not
+// overlap the other subnets of the vpc.
+func (f *EC2) CreateSubnet(ctx context.Context, params *ec2.CreateSubnetInput, optFns ...func(*ec2.Options)) (*ec2.CreateSubnetOutput, error) {
+	if err := f.call("CreateSubnet"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	vpcId := aws.ToString(params.VpcId)
+	vpc, ok := f.vpcs[vpcId]
+	if !ok {
+		return nil, apiError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", vpcId)
+	}
+	zone := aws.ToString(params.AvailabilityZone)
+	if !slices.Contains(zones, zone) {
+		return nil, apiError("InvalidParameterValue", "Value (%s) for parameter availabilityZone is invalid.", zone)
+	}
+	cidr, err := netip.ParsePrefix(aws.ToString(params.CidrBlock))
+	if err != nil {
+		return nil, apiError("InvalidParameterValue", "Value (%s) for parameter cidrBlock is invalid.", aws.ToString(params.CidrBlock))
+	}
+	vpcCIDR := netip.MustParsePrefix(aws.ToString(vpc.CidrBlock))
+	if !vpcCIDR.Contains(cidr.Addr()) || cidr.Bits() < vpcCIDR.Bits() {
+		return nil, apiError("InvalidSubnet.Range", "The CIDR '%s' is invalid.", cidr)
+	}
+	for _, s := range f.subnets {
+		if aws.ToString(s.VpcId) == vpcId && netip.MustParsePrefix(aws.ToString(s.CidrBlock)).Overlaps(cidr) {
+			return nil, apiError("InvalidSubnet.Conflict", "The CIDR '%s' conflicts with another subnet", cidr)
+		}
+	}
+	id := f.addSubnet(vpcId, zone, cidr.String(), false)
+	f.tags[id] = specTags(params.TagSpecifications, ec2types.ResourceTypeSubnet)
+	subnet := *f.subnets[id]
+	subnet.Tags = slices.Clone(f.tags[id])
+	return &ec2.CreateSubnetOutput{
+		Subnet: &subnet,
+	}, nil
+}
+
+func (f *EC2) CreateVpc(ctx context.Context, params *ec2.CreateVpcInput, optFns ...func(*ec2.Options)) (*ec2.CreateVpcOutput, error) {
+	if err := f.call("CreateVpc"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	cidr, err := netip.ParsePrefix(aws.ToString(params.CidrBlock))
+	if err != nil || cidr.Bits() < 16 || cidr.Bits() > 28 {
+		return nil, apiError("InvalidVpc.Range", "The CIDR '%s' is invalid.", aws.ToString(params.CidrBlock))
+	}
+	id := f.addVPC(cidr.String(), false, specTags(params.TagSpecifications, ec2types.ResourceTypeVpc))
+	vpc := *f.vpcs[id]
+	vpc.Tags = slices.Clone(f.tags[id])
+	return &ec2.CreateVpcOutput{
+		Vpc: &vpc,
+	}, nil
+}
+
+func (f *EC2) DeleteInternetGateway(ctx context.Context, params *ec2.DeleteInternetGatewayInput, optFns ...func(*ec2.Options)) (*ec2.DeleteInternetGatewayOutput, error) {
+	if err := f.call("DeleteInternetGateway"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	id := aws.ToString(params.InternetGatewayId)
+	gateway, ok := f.gateways[id]
+	if !ok {
+		return nil, apiError("InvalidInternetGatewayID.NotFound", "The internetGateway ID '%s' does not exist", id)
+	}
+	if len(gateway.Attachments) > 0 {
+		return nil, apiError("DependencyViolation", "The internetGateway '%s' has dependencies and cannot be deleted.", id)
+	}
+	delete(f.gateways, id)
+	f.remove(id)
+	return &ec2.DeleteInternetGatewayOutput{}, nil
+}
+
+// DeleteNatGateway deletes the nat gateway at once. It is kept in deleted state like in aws.
+func (f *EC2) DeleteNatGateway(ctx context.Context, params *ec2.DeleteNatGatewayInput, optFns ...func(*ec2.Options)) (*ec2.DeleteNatGatewayOutput, error) {
+	if err := f.call("DeleteNatGateway"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	id := aws.ToString(params.NatGatewayId)
+	nat, ok := f.nats[id]
+	if !ok || nat.State == ec2types.NatGatewayStateDeleted {
+		return nil, apiError("NatGatewayNotFound", "The Nat Gateway %s was not found", id)
+	}
+	nat.State = ec2types.NatGatewayStateDeleted
+	f.remove(id)
+	return &ec2.DeleteNatGatewayOutput{
+		NatGatewayId: aws.String(id),
+	}, nil
+}
+
+func (f *EC2) DeleteRouteTable(ctx context.Context, params *ec2.DeleteRouteTableInput, optFns ...func(*ec2.Options)) (*ec2.DeleteRouteTableOutput, error) {
+	if err := f.call("DeleteRouteTable"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	id := aws.ToString(params.RouteTableId)
+	table, ok := f.tables[id]
+	if !ok {
+		return nil, apiError("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", id)
+	}
+	if len(table.Associations) > 0 {
+		return nil, apiError("DependencyViolation", "The routeTable '%s' has dependencies and cannot be deleted.", id)
+	}
+	delete(f.tables, id)
+	f.remove(id)
+	return &ec2.DeleteRouteTableOutput{}, nil
+}
+
+// DeleteSubnet deletes a subnet without servers or nat gateways in it. Its route table association is deleted with it.
+func (f *EC2) DeleteSubnet(ctx context.Context, params *ec2.DeleteSubnetInput, optFns ...func(*ec2.Options)) (*ec2.DeleteSubnetOutput, error) {
+	if err := f.call("DeleteSubnet"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	id := aws.ToString(params.SubnetId)
+	if _, ok := f.subnets[id]; !ok {
+		return nil, apiError("InvalidSubnetID.NotFound", "The subnet ID '%s' does not exist", id)
+	}
+	for _, instance := range f.instances {
+		if instance.State.Name != ec2types.InstanceStateNameTerminated && aws.ToString(instance.SubnetId) == id {
+			return nil, apiError("DependencyViolation", "The subnet '%s' has dependencies and cannot be deleted.", id)
+		}
+	}
+	for _, nat := range f.nats {
+		if nat.State != ec2types.NatGatewayStateDeleted && aws.ToString(nat.SubnetId) == id {
+			return nil, apiError("DependencyViolation", "The subnet '%s' has dependencies and cannot be deleted.", id)
+		}
+	}
+	for _, table := range f.tables {
+		table.Associations = slices.DeleteFunc(table.Associations, func(a ec2types.RouteTableAssociation) bool {
+			return aws.ToString(a.SubnetId) == id
+		})
+	}
+	delete(f.subnets, id)
+	f.remove(id)
+	return &ec2.DeleteSubnetOutput{}, nil
+}
+
+// DeleteVpc deletes a vpc that nothing is left in but its main route table.
+func (f *EC2) DeleteVpc(ctx context.Context, params *ec2.DeleteVpcInput, optFns ...func(*ec2.Options)) (*ec2.DeleteVpcOutput, error) {
+	if err := f.call("DeleteVpc"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	id := aws.ToString(params.VpcId)
+	if _, ok := f.vpcs[id]; !ok {
+		return nil, apiError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", id)
+	}
+	dependency := apiError("DependencyViolation", "The vpc '%s' has dependencies and cannot be deleted.", id)
+	for _, s := range f.subnets {
+		if aws.ToString(s.VpcId) == id {
+			return nil, dependency
+		}
+	}
+	for _, g := range f.groups {
+		if aws.ToString(g.VpcId) == id {
+			return nil, dependency
+		}
+	}
+	for _, gateway := range f.gateways {
+		if len(gateway.Attachments) > 0 && aws.ToString(gateway.Attachments[0].VpcId) == id {
+			return nil, dependency
+		}
+	}
+	for _, table := range f.tables {
+		main := slices.ContainsFunc(table.Associations, func(a ec2types.RouteTableAssociation) bool { return aws.ToBool(a.Main) })
+		if aws.ToString(table.VpcId) == id && !main {
+			return nil, dependency
+		}
+	}
+	f.removeVPC(id)
+	return &ec2.DeleteVpcOutput{}, nil
+}
+
+func (f *EC2) DescribeAddresses(ctx context.Context, params *ec2.DescribeAddressesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error) {
+	if err := f.call("DescribeAddresses"); err != nil {
+		return nil, err
+	}
+	if params == nil {
+		params = &ec2.DescribeAddressesInput{}
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, id := range params.AllocationIds {
+		if _, ok := f.addresses[id]; !ok {
+			return nil, apiError("InvalidAllocationID.NotFound", "The allocation ID '%s' does not exist", id)
+		}
+	}
+	out := &ec2.DescribeAddressesOutput{}
+	for _, id := range f.order {
+		a, ok := f.addresses[id]
+		if !ok || (len(params.AllocationIds) > 0 && !slices.Contains(params.AllocationIds, id)) {
+			continue
+		}
+		match, err := filter(params.Filters, map[string]string{
+			"allocation-id": id,
+			"domain":        string(a.Domain),
+			"public-ip":     aws.ToString(a.PublicIp),
+		}, f.tags[id])
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			continue
+		}
+		address := *a
+		address.Tags = slices.Clone(f.tags[id])
+		out.Addresses = append(out.Addresses, address)
+	}
+	return out, nil
+}
+
+func (f *EC2) DescribeAvailabilityZones(ctx context.Context, params *ec2.DescribeAvailabilityZonesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeAvailabilityZonesOutput, error) {
+	if err := f.call("DescribeAvailabilityZones"); err != nil {
+		return nil, err
+	}
+	if params == nil {
+		params = &ec2.DescribeAvailabilityZonesInput{}
+	}
+	out := &ec2.DescribeAvailabilityZonesOutput{}
+	for _, zone := range zones {
+		match, err := filter(params.Filters, map[string]string{
+			"zone-name":   zone,
+			"region-name": region,
+			"state":       string(ec2types.AvailabilityZoneStateAvailable),
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			continue
+		}
+		out.AvailabilityZones = append(out.AvailabilityZones, ec2types.AvailabilityZone{
+			ZoneName:   aws.String(zone),
+			RegionName: aws.String(region),
+			State:      ec2types.AvailabilityZoneStateAvailable,
+		})
+	}
+	return out, nil
+}
+
+func (f *EC2) DescribeInternetGateways(ctx context.Context, params *ec2.DescribeInternetGatewaysInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInternetGatewaysOutput, error) {
+	if err := f.call("DescribeInternetGateways"); err != nil {
+		return nil, err
+	}
+	if params == nil {
+		params = &ec2.DescribeInternetGatewaysInput{}
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, id := range params.InternetGatewayIds {
+		if _, ok := f.gateways[id]; !ok {
+			return nil, apiError("InvalidInternetGatewayID.NotFound", "The internetGateway ID '%s' does not exist", id)
+		}
+	}
+	out := &ec2.DescribeInternetGatewaysOutput{}
+	for _, id := range f.order {
+		g, ok := f.gateways[id]
+		if !ok || (len(params.InternetGatewayIds) > 0 && !slices.Contains(params.InternetGatewayIds, id)) {
+			continue
+		}
+		fields := map[string]string{
+			"internet-gateway-id": id,
+			"attachment.vpc-id":   "",
+		}
+		if len(g.Attachments) > 0 {
+			fields["attachment.vpc-id"] = aws.ToString(g.Attachments[0].VpcId)
+		}
+		match, err := filter(params.Filters, fields, f.tags[id])
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			continue
+		}
+		gateway := *g
+		gateway.Attachments = slices.Clone(g.Attachments)
+		gateway.Tags = slices.Clone(f.tags[id])
+		out.InternetGateways = append(out.InternetGateways, gateway)
+	}
+	return out, nil
+}
+
+// DescribeNatGateways also returns deleted nat gateways, like aws does for a while after they are deleted.
+func (f *EC2) DescribeNatGateways(ctx context.Context, params *ec2.DescribeNatGatewaysInput, optFns ...func(*ec2.Options)) (*ec2.DescribeNatGatewaysOutput, error) {
+	if err := f.call("DescribeNatGateways"); err != nil {
+		return nil, err
+	}
+	if params == nil {
+		params = &ec2.DescribeNatGatewaysInput{}
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, id := range params.NatGatewayIds {
+		if _, ok := f.nats[id]; !ok {
+			return nil, apiError("NatGatewayNotFound", "The Nat Gateway %s was not found", id)
+		}
+	}
+	out := &ec2.DescribeNatGatewaysOutput{}
+	for _, id := range f.order {
+		n, ok := f.nats[id]
+		if !ok || (len(params.NatGatewayIds) > 0 && !slices.Contains(params.NatGatewayIds, id)) {
+			continue
+		}
+		match, err := filter(params.Filter, map[string]string{
+			"nat-gateway-id": id,
+			"state":          string(n.State),
+			"subnet-id":      aws.ToString(n.SubnetId),
+			"vpc-id":         aws.ToString(n.VpcId),
+		}, f.tags[id])
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			continue
+		}
+		nat := *n
+		nat.Tags = slices.Clone(f.tags[id])
+		out.NatGateways = append(out.NatGateways, nat)
+	}
+	return out, nil
+}
+
+func (f *EC2) DescribeRouteTables(ctx context.Context, params *ec2.DescribeRouteTablesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeRouteTablesOutput, error) {
+	if err := f.call("DescribeRouteTables"); err != nil {
+		return nil, err
+	}
+	if params == nil {
+		params = &ec2.DescribeRouteTablesInput{}
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, id := range params.RouteTableIds {
+		if _, ok := f.tables[id]; !ok {
+			return nil, apiError("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", id)
+		}
+	}
+	out := &ec2.DescribeRouteTablesOutput{}
+	for _, id := range f.order {
+		t, ok := f.tables[id]
+		if !ok || (len(params.RouteTableIds) > 0 && !slices.Contains(params.RouteTableIds, id)) {
+			continue
+		}
+		match, err := filter(params.Filters, map[string]string{
+			"route-table-id": id,
+			"vpc-id":         aws.ToString(t.VpcId),
+		}, f.tags[id])
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			continue
+		}
+		table := *t
+		table.Associations = slices.Clone(t.Associations)
+		table.Routes = slices.Clone(t.Routes)
+		table.Tags = slices.Clone(f.tags[id])
+		out.RouteTables = append(out.RouteTables, table)
+	}
+	return out, nil
+}
+
+func (f *EC2) DetachInternetGateway(ctx context.Context, params *ec2.DetachInternetGatewayInput, optFns ...func(*ec2.Options)) (*ec2.DetachInternetGatewayOutput, error) {
+	if err := f.call("DetachInternetGateway"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	id := aws.ToString(params.InternetGatewayId)
+	gateway, ok := f.gateways[id]
+	if !ok {
+		return nil, apiError("InvalidInternetGatewayID.NotFound", "The internetGateway ID '%s' does not exist", id)
+	}
+	vpcId := aws.ToString(params.VpcId)
+	if len(gateway.Attachments) == 0 || aws.ToString(gateway.Attachments[0].VpcId) != vpcId {
+		return nil, apiError("Gateway.NotAttached", "resource %s is not attached to network %s", id, vpcId)
+	}
+	gateway.Attachments = nil
+	return &ec2.DetachInternetGatewayOutput{}, nil
+}
+
+func (f *EC2) ModifySubnetAttribute(ctx context.Context, params *ec2.ModifySubnetAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifySubnetAttributeOutput, error) {
+	if err := f.call("ModifySubnetAttribute"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	id := aws.ToString(params.SubnetId)
+	subnet, ok := f.subnets[id]
+	if !ok {
+		return nil, apiError("InvalidSubnetID.NotFound", "The subnet ID '%s' does not exist", id)
+	}
+	if params.MapPublicIpOnLaunch != nil {
+		subnet.MapPublicIpOnLaunch = aws.Bool(aws.ToBool(params.MapPublicIpOnLaunch.Value))
+	}
+	return &ec2.ModifySubnetAttributeOutput{}, nil
+}
+
+// ModifyVpcAttribute only checks that the vpc exists, the fake does not model dns.
+func (f *EC2) ModifyVpcAttribute(ctx context.Context, params *ec2.ModifyVpcAttributeInput, optFns ...func(*ec2.Options)) (*ec2.ModifyVpcAttributeOutput, error) {
+	if err := f.call("ModifyVpcAttribute"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	id := aws.ToString(params.VpcId)
+	if _, ok := f.vpcs[id]; !ok {
+		return nil, apiError("InvalidVpcID.NotFound", "The vpc ID '%s' does not exist", id)
+	}
+	return &ec2.ModifyVpcAttributeOutput{}, nil
+}
+
+func (f *EC2) ReleaseAddress(ctx context.Context, params *ec2.ReleaseAddressInput, optFns ...func(*ec2.Options)) (*ec2.ReleaseAddressOutput, error) {
+	if err := f.call("ReleaseAddress"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	id := aws.ToString(params.AllocationId)
+	if _, ok := f.addresses[id]; !ok {
+		return nil, apiError("InvalidAllocationID.NotFound", "The allocation ID '%s' does not exist", id)
+	}
+	if nat := f.natUsing(id); nat != "" {
+		return nil, apiError("InvalidIPAddress.InUse", "Address %s is in use by %s", id, nat)
+	}
+	delete(f.addresses, id)
+	f.remove(id)
+	return &ec2.ReleaseAddressOutput{}, nil
+}
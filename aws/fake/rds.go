@@ -0,0 +1,219 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	rdstypes "github.com/aws/aws-sdk-go-v2/service/rds/types"
+	"github.com/cantara/nerthus/aws/util"
+)
+
+var _ util.RDS = (*RDS)(nil)
+
+// RDS is an in-memory rds. Database instances are available with an endpoint as soon as they are created.
+type RDS struct {
+	failures
+	mutex        sync.Mutex
+	instances    []*rdstypes.DBInstance
+	subnetGroups []*rdstypes.DBSubnetGroup
+	snapshots    []string
+}
+
+func NewRDS() *RDS {
+	return &RDS{}
+}
+
+// Snapshots returns the identifiers of the final snapshots taken when database instances were deleted.
+func (f *RDS) Snapshots() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return slices.Clone(f.snapshots)
+}
+
+func (f *RDS) instance(identifier string) int {
+	return slices.IndexFunc(f.instances, func(i *rdstypes.DBInstance) bool {
+		return aws.ToString(i.DBInstanceIdentifier) == identifier
+	})
+}
+
+func (f *RDS) CreateDBInstance(ctx context.Context, params *rds.CreateDBInstanceInput, optFns ...func(*rds.Options)) (*rds.CreateDBInstanceOutput, error) {
+	if err := f.call("CreateDBInstance"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	identifier := aws.ToString(params.DBInstanceIdentifier)
+	if f.instance(identifier) >= 0 {
+		return nil, apiError("DBInstanceAlreadyExists", "DB instance already exists")
+	}
+	var subnetGroup *rdstypes.DBSubnetGroup
+	if params.DBSubnetGroupName != nil {
+		i := f.subnetGroup(aws.ToString(params.DBSubnetGroupName))
+		if i < 0 {
+			return nil, apiError("DBSubnetGroupNotFoundFault", "DBSubnetGroup %s not found.", aws.ToString(params.DBSubnetGroupName))
+		}
+		group := *f.subnetGroups[i]
+		subnetGroup = &group
+	}
+	var groups []rdstypes.VpcSecurityGroupMembership
+	for _, id := range params.VpcSecurityGroupIds {
+		groups = append(groups, rdstypes.VpcSecurityGroupMembership{
+			VpcSecurityGroupId: aws.String(id),
+			Status:             aws.String("active"),
+		})
+	}
+	instance := &rdstypes.DBInstance{
+		DBInstanceIdentifier: aws.String(identifier),
+		DBInstanceArn:        aws.String(fmt.Sprintf("arn:aws:rds:%s:%s:db:%s", region, account, identifier)),
+		DBInstanceClass:      params.DBInstanceClass,
+		DBInstanceStatus:     aws.String("available"),
+		DBName:               params.DBName,
+		Engine:               params.Engine,
+		EngineVersion:        params.EngineVersion,
+		MasterUsername:       params.MasterUsername,
+		AllocatedStorage:     params.AllocatedStorage,
+		StorageEncrypted:     params.StorageEncrypted,
+		PubliclyAccessible:   params.PubliclyAccessible,
+		VpcSecurityGroups:    groups,
+		DBSubnetGroup:        subnetGroup,
+		TagList:              slices.Clone(params.Tags),
+		Endpoint: &rdstypes.Endpoint{
+			Address: aws.String(fmt.Sprintf("%s.fake.%s.rds.amazonaws.com", identifier, region)),
+			Port:    params.Port,
+		},
+	}
+	f.instances = append(f.instances, instance)
+	out := *instance
+	return &rds.CreateDBInstanceOutput{
+		DBInstance: &out,
+	}, nil
+}
+
+func (f *RDS) DeleteDBInstance(ctx context.Context, params *rds.DeleteDBInstanceInput, optFns ...func(*rds.Options)) (*rds.DeleteDBInstanceOutput, error) {
+	if err := f.call("DeleteDBInstance"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	identifier := aws.ToString(params.DBInstanceIdentifier)
+	i := f.instance(identifier)
+	if i < 0 {
+		return nil, apiError("DBInstanceNotFound", "DBInstance %s not found.", identifier)
+	}
+	if !aws.ToBool(params.SkipFinalSnapshot) {
+		if params.FinalDBSnapshotIdentifier == nil {
+			return nil, apiError("InvalidParameterCombination", "FinalDBSnapshotIdentifier is required unless SkipFinalSnapshot is specified.")
+		}
+		f.snapshots = append(f.snapshots, aws.ToString(params.FinalDBSnapshotIdentifier))
+	}
+	instance := *f.instances[i]
+	instance.DBInstanceStatus = aws.String("deleting")
+	f.instances = slices.Delete(f.instances, i, i+1)
+	return &rds.DeleteDBInstanceOutput{
+		DBInstance: &instance,
+	}, nil
+}
+
+func (f *RDS) DescribeDBInstances(ctx context.Context, params *rds.DescribeDBInstancesInput, optFns ...func(*rds.Options)) (*rds.DescribeDBInstancesOutput, error) {
+	if err := f.call("DescribeDBInstances"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	out := &rds.DescribeDBInstancesOutput{}
+	for _, instance := range f.instances {
+		if params.DBInstanceIdentifier != nil && aws.ToString(params.DBInstanceIdentifier) != aws.ToString(instance.DBInstanceIdentifier) {
+			continue
+		}
+		i := *instance
+		i.TagList = slices.Clone(instance.TagList)
+		out.DBInstances = append(out.DBInstances, i)
+	}
+	if params.DBInstanceIdentifier != nil && len(out.DBInstances) == 0 {
+		return nil, apiError("DBInstanceNotFound", "DBInstance %s not found.", aws.ToString(params.DBInstanceIdentifier))
+	}
+	return out, nil
+}
+
+func (f *RDS) subnetGroup(name string) int {
+	return slices.IndexFunc(f.subnetGroups, func(g *rdstypes.DBSubnetGroup) bool {
+		return aws.ToString(g.DBSubnetGroupName) == name
+	})
+}
+
+func (f *RDS) CreateDBSubnetGroup(ctx context.Context, params *rds.CreateDBSubnetGroupInput, optFns ...func(*rds.Options)) (*rds.CreateDBSubnetGroupOutput, error) {
+	if err := f.call("CreateDBSubnetGroup"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name := aws.ToString(params.DBSubnetGroupName)
+	if f.subnetGroup(name) >= 0 {
+		return nil, apiError("DBSubnetGroupAlreadyExists", "DB subnet group %s already exists.", name)
+	}
+	if len(params.SubnetIds) == 0 {
+		return nil, apiError("InvalidParameterValue", "A DB subnet group needs at least one subnet.")
+	}
+	group := &rdstypes.DBSubnetGroup{
+		DBSubnetGroupName:        aws.String(name),
+		DBSubnetGroupArn:         aws.String(fmt.Sprintf("arn:aws:rds:%s:%s:subgrp:%s", region, account, name)),
+		DBSubnetGroupDescription: params.DBSubnetGroupDescription,
+		SubnetGroupStatus:        aws.String("Complete"),
+	}
+	for _, id := range params.SubnetIds {
+		group.Subnets = append(group.Subnets, rdstypes.Subnet{
+			SubnetIdentifier: aws.String(id),
+			SubnetStatus:     aws.String("Active"),
+		})
+	}
+	f.subnetGroups = append(f.subnetGroups, group)
+	out := *group
+	return &rds.CreateDBSubnetGroupOutput{
+		DBSubnetGroup: &out,
+	}, nil
+}
+
+func (f *RDS) DeleteDBSubnetGroup(ctx context.Context, params *rds.DeleteDBSubnetGroupInput, optFns ...func(*rds.Options)) (*rds.DeleteDBSubnetGroupOutput, error) {
+	if err := f.call("DeleteDBSubnetGroup"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name := aws.ToString(params.DBSubnetGroupName)
+	i := f.subnetGroup(name)
+	if i < 0 {
+		return nil, apiError("DBSubnetGroupNotFoundFault", "DBSubnetGroup %s not found.", name)
+	}
+	for _, instance := range f.instances {
+		if instance.DBSubnetGroup != nil && aws.ToString(instance.DBSubnetGroup.DBSubnetGroupName) == name {
+			return nil, apiError("InvalidDBSubnetGroupStateFault", "DB subnet group %s is in use by %s.", name, aws.ToString(instance.DBInstanceIdentifier))
+		}
+	}
+	f.subnetGroups = slices.Delete(f.subnetGroups, i, i+1)
+	return &rds.DeleteDBSubnetGroupOutput{}, nil
+}
+
+func (f *RDS) DescribeDBSubnetGroups(ctx context.Context, params *rds.DescribeDBSubnetGroupsInput, optFns ...func(*rds.Options)) (*rds.DescribeDBSubnetGroupsOutput, error) {
+	if err := f.call("DescribeDBSubnetGroups"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	out := &rds.DescribeDBSubnetGroupsOutput{}
+	for _, group := range f.subnetGroups {
+		if params.DBSubnetGroupName != nil && aws.ToString(params.DBSubnetGroupName) != aws.ToString(group.DBSubnetGroupName) {
+			continue
+		}
+		g := *group
+		g.Subnets = slices.Clone(group.Subnets)
+		out.DBSubnetGroups = append(out.DBSubnetGroups, g)
+	}
+	if params.DBSubnetGroupName != nil && len(out.DBSubnetGroups) == 0 {
+		return nil, apiError("DBSubnetGroupNotFoundFault", "DBSubnetGroup %s not found.", aws.ToString(params.DBSubnetGroupName))
+	}
+	return out, nil
+}
@@ -0,0 +1,68 @@
+package fake
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/cantara/nerthus/aws/util"
+)
+
+var _ util.SSM = (*SSM)(nil)
+
+// SSM is an in-memory ssm with only parameters. Commands are not supported, scripts are run with the
+// server.FakeExecutor in tests instead.
+type SSM struct {
+	failures
+	mutex      sync.Mutex
+	parameters map[string]string
+}
+
+func NewSSM() *SSM {
+	return &SSM{
+		parameters: make(map[string]string),
+	}
+}
+
+// SetParameter sets the value of a parameter, like the public parameters aws publishes the newest amis in.
+func (f *SSM) SetParameter(name, value string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.parameters[name] = value
+}
+
+func (f *SSM) GetCommandInvocation(ctx context.Context, params *ssm.GetCommandInvocationInput, optFns ...func(*ssm.Options)) (*ssm.GetCommandInvocationOutput, error) {
+	if err := f.call("GetCommandInvocation"); err != nil {
+		return nil, err
+	}
+	return nil, apiError("InvalidCommandId", "Commands are not supported by the fake")
+}
+
+func (f *SSM) GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	if err := f.call("GetParameter"); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name := aws.ToString(params.Name)
+	value, ok := f.parameters[name]
+	if !ok {
+		return nil, apiError("ParameterNotFound", "Parameter %s not found", name)
+	}
+	return &ssm.GetParameterOutput{
+		Parameter: &ssmtypes.Parameter{
+			Name:  aws.String(name),
+			Type:  ssmtypes.ParameterTypeString,
+			Value: aws.String(value),
+		},
+	}, nil
+}
+
+func (f *SSM) SendCommand(ctx context.Context, params *ssm.SendCommandInput, optFns ...func(*ssm.Options)) (*ssm.SendCommandOutput, error) {
+	if err := f.call("SendCommand"); err != nil {
+		return nil, err
+	}
+	return nil, apiError("UnsupportedOperation", "Commands are not supported by the fake")
+}
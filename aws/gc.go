@@ -0,0 +1,240 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	databaselib "github.com/cantara/nerthus/aws/database"
+	keylib "github.com/cantara/nerthus/aws/key"
+	loadbalancerlib "github.com/cantara/nerthus/aws/loadbalancer"
+	securitylib "github.com/cantara/nerthus/aws/security"
+	serverlib "github.com/cantara/nerthus/aws/server"
+	volumelib "github.com/cantara/nerthus/aws/volume"
+)
+
+const resourceVolume = "volume"
+
+// orphanOrder is the order orphans are deleted in, resources are deleted before the ones they might depend on.
+var orphanOrder = map[string]int{
+	resourceTargetGroup:     0,
+	resourceVolume:          1,
+	resourceDBSecurityGroup: 2,
+	resourceSecurityGroup:   3,
+	resourceKey:             4,
+}
+
+// Orphan is a resource tagged with a scope that no live scope or service is using. Orphans are left behind when a
+// cleanup fails partway through. Created is when the resource was created, it is only deletable when it is older than
+// the grace period. Resources Nerthus does not know the creation time of, like security groups and target groups created
+// before they were tagged with it, are never deletable and have to be deleted by hand.
+type Orphan struct {
+	Scope     string    `json:"scope"`
+	Resource  string    `json:"resource"`
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	Reason    string    `json:"reason"`
+	Created   time.Time `json:"created,omitzero"`
+	Deletable bool      `json:"deletable"`
+	deleter   deleter
+}
+
+// GetOrphanScopes returns the scopes to look for orphans in. These are the scopes of GetScopes and the scopes that only
+// have target groups or databases left, as a failed cleanup can leave those behind after the ec2 resources are deleted.
+func (c AWS) GetOrphanScopes() (scopes []string, err error) {
+	found := make(map[string]bool)
+	ec2Scopes, err := c.GetScopes()
+	if err != nil {
+		return
+	}
+	elbScopes, err := loadbalancerlib.GetTargetGroupScopes(c.elb)
+	if err != nil {
+		return
+	}
+	rdsScopes, err := databaselib.GetDatabaseScopes(c.rds)
+	if err != nil {
+		return
+	}
+	for _, list := range [][]string{ec2Scopes, elbScopes, rdsScopes} {
+		for _, scope := range list {
+			found[scope] = true
+		}
+	}
+	scopes = sortedKeys(found)
+	return
+}
+
+// FindOrphans returns the orphaned resources in the scopes.
+func (c AWS) FindOrphans(scopes []string, grace time.Duration) (orphans []Orphan, err error) {
+	orphans = []Orphan{}
+	for _, scope := range scopes {
+		found, err := c.scopeOrphans(scope)
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, found...)
+	}
+	now := time.Now()
+	for i := range orphans {
+		orphans[i].Deletable = !orphans[i].Created.IsZero() && now.Sub(orphans[i].Created) >= grace
+	}
+	return
+}
+
+func (c AWS) scopeOrphans(scope string) (orphans []Orphan, err error) {
+	servers, err := serverlib.GetServers(scope, c.ec2)
+	if err != nil {
+		return
+	}
+	databases, err := databaselib.GetDatabases(scope, c.rds)
+	if err != nil {
+		return
+	}
+	databaseIdentifiers := make(map[string]bool)
+	for _, d := range databases {
+		databaseIdentifiers[d.Identifier] = true
+	}
+	targetGroups, err := loadbalancerlib.GetTargetGroups(scope, c.elb)
+	if err != nil {
+		return
+	}
+	k, err := keylib.GetKey(scope, c.ec2)
+	keyExists := err == nil
+	if err != nil && !errors.Is(err, keylib.ErrNotFound) {
+		return
+	}
+	err = nil
+
+	for i := range targetGroups {
+		targets, err := targetGroups[i].GetTargets()
+		if err != nil {
+			return nil, err
+		}
+		rules, err := targetGroups[i].GetRules()
+		if err != nil {
+			return nil, err
+		}
+		if len(targets) > 0 || len(rules) > 0 {
+			continue
+		}
+		orphans = append(orphans, Orphan{
+			Scope:    scope,
+			Resource: resourceTargetGroup,
+			Id:       targetGroups[i].ARN,
+			Name:     targetGroups[i].Name,
+			Reason:   "Target group has no targets and no listener rules",
+			Created:  targetGroups[i].Created,
+			deleter:  &targetGroups[i],
+		})
+	}
+
+	volumes, err := volumelib.GetDetachedVolumes(scope, c.ec2)
+	if err != nil {
+		return
+	}
+	for i := range volumes {
+		orphans = append(orphans, Orphan{
+			Scope:    scope,
+			Resource: resourceVolume,
+			Id:       volumes[i].Id,
+			Name:     volumes[i].Name,
+			Reason:   "Volume is not attached to any server",
+			Created:  volumes[i].Created,
+			deleter:  &volumes[i],
+		})
+	}
+
+	groups, err := securitylib.GetGroups(scope, c.ec2)
+	if err != nil {
+		return
+	}
+	scopeGroupExists := false
+	for i := range groups {
+		if groups[i].IsScopeGroup() {
+			scopeGroupExists = true
+			if keyExists || len(servers) > 0 {
+				continue
+			}
+			orphans = append(orphans, Orphan{
+				Scope:    scope,
+				Resource: resourceSecurityGroup,
+				Id:       groups[i].Id,
+				Name:     groups[i].Name,
+				Reason:   "Scope has no key pair and no servers",
+				Created:  groups[i].Created,
+				deleter:  &groups[i],
+			})
+			continue
+		}
+		// Database security groups are named after the database instance they were created for
+		if databaseIdentifiers[groups[i].Name] {
+			continue
+		}
+		orphans = append(orphans, Orphan{
+			Scope:    scope,
+			Resource: resourceDBSecurityGroup,
+			Id:       groups[i].Id,
+			Name:     groups[i].Name,
+			Reason:   "No database instance uses the database security group",
+			Created:  groups[i].Created,
+			deleter:  &groups[i],
+		})
+	}
+
+	// A key pair next to its scope security group is a scope that has nothing in it yet, and is owned by that scope.
+	// A key pair is therefore only an orphan when nothing else is left in the scope, not whenever no server uses it.
+	if keyExists && !scopeGroupExists && len(servers) == 0 && len(databases) == 0 && len(targetGroups) == 0 {
+		orphans = append(orphans, Orphan{
+			Scope:    scope,
+			Resource: resourceKey,
+			Id:       k.Id,
+			Name:     k.Name,
+			Reason:   "Scope has no security group, servers, databases or target groups using the key pair",
+			Created:  k.Created,
+			deleter:  &k,
+		})
+	}
+	return
+}
+
+// DeleteOrphans deletes the orphans in the scopes that are older than the grace period. When ids are given only the
+// orphans with those ids are deleted. A failing delete does not stop the rest, all errors are returned at the end.
+func (c AWS) DeleteOrphans(scopes []string, grace time.Duration, ids []string) (deleted []Orphan, err error) {
+	orphans, err := c.FindOrphans(scopes, grace)
+	if err != nil {
+		return
+	}
+	only := make(map[string]bool)
+	for _, id := range ids {
+		only[id] = true
+	}
+	var toDelete []Orphan
+	for _, o := range orphans {
+		if !o.Deletable || (len(only) > 0 && !only[o.Id]) {
+			continue
+		}
+		toDelete = append(toDelete, o)
+	}
+	sort.SliceStable(toDelete, func(i, j int) bool {
+		return orphanOrder[toDelete[i].Resource] < orphanOrder[toDelete[j].Resource]
+	})
+
+	t := teardown{
+		ec2: c.ec2,
+		elb: c.elb,
+		rds: c.rds,
+		job: c.job,
+	}
+	deleted = []Orphan{}
+	status(c.job, fmt.Sprintf("Deleting %d orphaned resources.", len(toDelete)))
+	for _, o := range toDelete {
+		t.scope = o.Scope
+		if !t.remove(o.Resource, o.Name, o.deleter) {
+			continue
+		}
+		deleted = append(deleted, o)
+	}
+	err = t.Err()
+	return
+}
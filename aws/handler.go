@@ -2,15 +2,15 @@ package aws
 
 import (
 	"embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
-	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
-	"github.com/aws/aws-sdk-go-v2/service/rds"
 	log "github.com/cantara/bragi"
 	databaselib "github.com/cantara/nerthus/aws/database"
 	"github.com/cantara/nerthus/aws/key"
@@ -20,36 +20,48 @@ import (
 	securitylib "github.com/cantara/nerthus/aws/security"
 	serverlib "github.com/cantara/nerthus/aws/server"
 	"github.com/cantara/nerthus/aws/tag"
+	"github.com/cantara/nerthus/aws/util"
 	vpclib "github.com/cantara/nerthus/aws/vpc"
+	"github.com/cantara/nerthus/job"
+	"github.com/cantara/nerthus/journal"
+	"github.com/cantara/nerthus/secret"
 	servershlib "github.com/cantara/nerthus/server"
 	"github.com/cantara/nerthus/slack"
 )
 
 type Health struct {
-	Name string `form:"service_name" json:"service_name" xml:"service_name"`
-	Tag  string `form:"service_tag" json:"service_tag" xml:"service_tag"`
-	Type string `form:"service_type" json:"service_type" xml:"service_type"`
+	Name string `form:"service_name" json:"service_name" xml:"service_name" yaml:"service_name"`
+	Tag  string `form:"service_tag" json:"service_tag" xml:"service_tag" yaml:"service_tag"`
+	Type string `form:"service_type" json:"service_type" xml:"service_type" yaml:"service_type"`
 }
 
 type Service struct {
-	Port             int    `form:"port" json:"port" xml:"port" binding:"required"`
-	Path             string `form:"path" json:"path" xml:"path" binding:"required"`
-	Icon             string `form:"icon" json:"icon" xml:"icon"`
-	ELBListenerArn   string `form:"elb_listener_arn" json:"elb_listener_arn" xml:"elb_listener_arn" binding:"required"`
-	ELBSecurityGroup string `form:"elb_securitygroup_id" json:"elb_securitygroup_id" xml:"elb_securitygroup_id"`
-	UpdateProp       string `form:"semantic_update_service_properties" json:"semantic_update_service_properties" xml:"semantic_update_service_properties"`
-	ArtifactId       string `form:"artifact_id" json:"artifact_id" xml:"artifact_id" binding:"required"`
-	LocalOverride    string `form:"local_override_properties" json:"local_override_properties" xml:"local_override_properties"`
-	Health           Health `form:"health" json:"health" xml:"health"`
-	Key              string `form:"key" json:"key" xml:"key"`
-}
-
-func (c AWS) AddServiceToServer(scope, serverName string, v vpclib.VPC, k key.Key, sg security.Group, slackId string, service Service) (message string) {
+	Port             int    `form:"port" json:"port" xml:"port" yaml:"port" binding:"required"`
+	Path             string `form:"path" json:"path" xml:"path" yaml:"path" binding:"required"`
+	Icon             string `form:"icon" json:"icon" xml:"icon" yaml:"icon"`
+	ELBListenerArn   string `form:"elb_listener_arn" json:"elb_listener_arn" xml:"elb_listener_arn" yaml:"elb_listener_arn" binding:"required"`
+	ELBSecurityGroup string `form:"elb_securitygroup_id" json:"elb_securitygroup_id" xml:"elb_securitygroup_id" yaml:"elb_securitygroup_id"`
+	UpdateProp       string `form:"semantic_update_service_properties" json:"semantic_update_service_properties" xml:"semantic_update_service_properties" yaml:"semantic_update_service_properties"`
+	ArtifactId       string `form:"artifact_id" json:"artifact_id" xml:"artifact_id" yaml:"artifact_id" binding:"required"`
+	LocalOverride    string `form:"local_override_properties" json:"local_override_properties" xml:"local_override_properties" yaml:"local_override_properties"`
+	Health           Health `form:"health" json:"health" xml:"health" yaml:"health"`
+	Key              string `form:"key" json:"key" xml:"key" yaml:"key"`
+}
+
+func (c AWS) AddServiceToServer(scope, serverName string, v vpclib.VPC, k key.Key, sg security.Group, slackId string, service Service) (message string, err error) {
+	return c.addServiceToServer(nil, scope, serverName, v, k, sg, slackId, service)
+}
+
+func (c AWS) addServiceToServer(j *journal.Journal, scope, serverName string, v vpclib.VPC, k key.Key, sg security.Group, slackId string, service Service) (message string, err error) {
 	seq := sequence{
 		ec2:           c.ec2,
+		dial:          c.dial,
+		ssm:           c.ssm,
+		secrets:       c.secrets,
 		elb:           c.elb,
 		shouldCleanUp: false,
 		deleters:      NewStack(),
+		job:           c.job,
 		slackId:       slackId,
 		scope:         scope,
 		service:       service,
@@ -57,66 +69,138 @@ func (c AWS) AddServiceToServer(scope, serverName string, v vpclib.VPC, k key.Ke
 		key:           k,
 		securityGroup: sg,
 	}
-	defer seq.Cleanup()
+	defer seq.Cleanup(&err)
 	//Get server from server name
-	s, err := serverlib.GetServer(serverName, scope, k, sg, c.ec2)
-	if err != nil {
-		log.AddError(err).Fatal("While getting server by name")
-	}
-	seq.server = s
+	seq.do("GetServer", func() (err error) {
+		seq.server, err = serverlib.GetServer(serverName, scope, k, sg, c.ec2)
+		if err != nil {
+			return fail(resourceServer, err, "While getting server by name")
+		}
+		return
+	})
+	serviceJson, _ := json.Marshal(service)
+	seq.OpenJournal(j, operationAddService, map[string]string{
+		"server":  serverName,
+		"service": string(serviceJson),
+	})
 
 	//AWS
-	isNotNewService, err := CheckIfServiceExcistsInScope(scope, service.ArtifactId, c.ec2)
-	if err != nil {
-		log.AddError(err).Fatal("While chekking if service exits in scope")
+	var isNotNewService bool
+	seq.do("CheckIfServiceExcistsInScope", func() (err error) {
+		isNotNewService, err = CheckIfServiceExcistsInScope(scope, service.ArtifactId, c.ec2)
+		if err != nil {
+			return fail(resourceTag, err, "While chekking if service exits in scope")
+		}
+		if seq.journal.Done("CreateTargetGroup") {
+			isNotNewService = false
+		}
+		return
+	})
+	if !isNotNewService {
+		seq.do("CheckListenerVPC", seq.CheckListenerVPC)
 	}
 	if isNotNewService {
-		seq.GetTargetGroup()
+		seq.step("GetTargetGroup", seq.GetTargetGroup)
 	} else {
-		seq.AddLoadbalancerAuthorizationToSecurityGroup()
-		seq.CreateTargetGroup()
+		seq.step("AddLoadbalancerAuthorizationToSecurityGroup", seq.AddLoadbalancerAuthorizationToSecurityGroup)
+		seq.step("CreateTargetGroup", seq.CreateTargetGroup)
 	}
-	seq.CreateTarget()
+	seq.step("CreateTarget", seq.CreateTarget)
 	if !isNotNewService {
-		seq.AddRuleToListener()
+		seq.step("AddRuleToListener", seq.AddRuleToListener)
 	}
 
 	if isNotNewService {
-		seq.TagAdditionalServer()
+		seq.step("TagAdditionalServer", seq.TagAdditionalServer)
 	} else {
-		seq.TagNewService()
+		seq.step("TagNewService", seq.TagNewService)
 	}
 	seq.InstallOnServer()
 
-	seq.SendServiceOnServer()
+	seq.step("SendServiceOnServer", seq.SendServiceOnServer)
 	seq.FinishedAllOpperations()
 	//cryptData = seq.cryptData
 	message = "succsess"
 	return
 }
 
-func (c AWS) AddServerToScope(scope, serverName string, v vpclib.VPC, k key.Key, sg security.Group, slackId string) (message string) {
+// ValidateServerSizing resolves the ami of the sizing in the scope and checks it against what the region offers, so
+// that a request with a sizing that can not be launched is rejected before the job is started.
+func (c AWS) ValidateServerSizing(sizing serverlib.Sizing, sg security.Group) error {
+	sizing, err := sizing.ResolveAMI(sg.AMIParameter, c.ec2, c.ssm)
+	if err != nil {
+		return err
+	}
+	return sizing.Validate(c.ec2)
+}
+
+// ValidateServerPlacement checks that the subnet a server is pinned to is one of the subnets of the scope, before the
+// sequence is started.
+func (c AWS) ValidateServerPlacement(placement serverlib.Placement, v vpclib.VPC) error {
+	if placement.Subnet == "" {
+		return nil
+	}
+	subnets, err := scopeSubnets(v, c.ec2)
+	if err != nil {
+		return err
+	}
+	_, err = placement.Place("", subnets, c.ec2)
+	return err
+}
+
+// AddServerToScope creates a server in the scope with the instance type, ami and volumes of the sizing, empty fields in
+// the sizing are the defaults. The server is created in one of the subnets of the scope according to the placement.
+func (c AWS) AddServerToScope(scope, serverName string, sizing serverlib.Sizing, placement serverlib.Placement, v vpclib.VPC, k key.Key, sg security.Group, slackId string) (message string, err error) {
+	return c.addServerToScope(nil, scope, serverName, sizing, placement, v, k, sg, slackId)
+}
+
+func (c AWS) addServerToScope(j *journal.Journal, scope, serverName string, sizing serverlib.Sizing, placement serverlib.Placement, v vpclib.VPC, k key.Key, sg security.Group, slackId string) (message string, err error) {
 	seq := sequence{
 		ec2:           c.ec2,
+		dial:          c.dial,
+		ssm:           c.ssm,
+		secrets:       c.secrets,
 		elb:           c.elb,
 		shouldCleanUp: false,
 		deleters:      NewStack(),
+		job:           c.job,
 		slackId:       slackId,
 		scope:         scope,
 		vpc:           v,
 		key:           k,
 		securityGroup: sg,
 	}
-	defer seq.Cleanup()
+	defer seq.Cleanup(&err)
+	sizingJson, _ := json.Marshal(sizing)
+	placementJson, _ := json.Marshal(placement)
+	seq.OpenJournal(j, operationAddServer, map[string]string{
+		"server":    serverName,
+		"sizing":    string(sizingJson),
+		"placement": string(placementJson),
+	})
 
 	//AWS
-	seq.CheckServerName(serverName)
-	seq.StartingServiceSettup()
-	seq.CreateNewServer(serverName)
-	seq.WaitForServerToStart()
-	seq.VerifyServerSSH()
-	seq.AddAutoUpdate()
-	seq.InstallFilebeat()
+	seq.step("CheckServerName", func() error { return seq.CheckServerName(serverName) })
+	var subnet vpclib.Subnet
+	if !seq.journal.Done("CreateNewServer") {
+		seq.do("ResolveAMI", func() (err error) {
+			sizing, err = seq.ResolveAMI(sizing)
+			return
+		})
+		seq.do("PlaceServer", func() (err error) {
+			subnet, err = seq.PlaceServer(placement)
+			return
+		})
+	}
+	seq.step("ValidateServerSizing", func() error { return seq.ValidateServerSizing(sizing) })
+	if seq.failure == nil {
+		seq.StartingServiceSettup()
+	}
+	seq.step("CreateNewServer", func() error { return seq.CreateNewServer(serverName, sizing, subnet) })
+	seq.step("WaitForServerToStart", seq.WaitForServerToStart)
+	seq.step("VerifyServerSSH", seq.VerifyServerSSH)
+	seq.step("AddAutoUpdate", seq.AddAutoUpdate)
+	seq.step("InstallFilebeat", seq.InstallFilebeat)
 	/*
 		isNotNewService, err := CheckIfServiceExcistsInScope(scope, service.ArtifactId, c.ec2)
 		if err != nil {
@@ -140,61 +224,190 @@ func (c AWS) AddServerToScope(scope, serverName string, v vpclib.VPC, k key.Key,
 		}
 		seq.InstallOnServer()
 	*/
-	seq.SendLogin()
+	seq.step("SendLogin", seq.SendLogin)
 	seq.FinishedAllOpperations()
 	message = "succsess"
 	return
 }
 
-func (c AWS) CreateDatabase(scope, artifactId string, v vpclib.VPC, sg security.Group, slackId string) (endpoint string) {
+func (c AWS) CreateDatabase(scope, artifactId string, v vpclib.VPC, sg security.Group, slackId string) (endpoint string, err error) {
+	return c.createDatabase(nil, scope, artifactId, v, sg, slackId)
+}
+
+func (c AWS) createDatabase(j *journal.Journal, scope, artifactId string, v vpclib.VPC, sg security.Group, slackId string) (endpoint string, err error) {
 	seq := sequence{
 		ec2:           c.ec2,
+		dial:          c.dial,
+		ssm:           c.ssm,
+		secrets:       c.secrets,
 		rds:           c.rds,
 		shouldCleanUp: false,
 		deleters:      NewStack(),
+		job:           c.job,
 		slackId:       slackId,
 		scope:         scope,
 		vpc:           v,
 		securityGroup: sg,
 	}
-	defer seq.Cleanup()
+	defer seq.Cleanup(&err)
+	seq.OpenJournal(j, operationCreateDatabase, map[string]string{
+		"artifact_id": artifactId,
+	})
 
 	//AWS
-	seq.CreateDBSecurityGroup(artifactId)
-	seq.CreateNewDatabase(artifactId)
+	seq.step("CreateDBSecurityGroup", func() error { return seq.CreateDBSecurityGroup(artifactId) })
+	seq.step("CreateDBSubnetGroup", seq.CreateDBSubnetGroup)
+	seq.step("CreateNewDatabase", func() error { return seq.CreateNewDatabase(artifactId) })
+	seq.step("StoreDatabaseSecret", seq.StoreDatabaseSecret)
 
-	seq.SendDBSettup()
+	seq.step("SendDBSettup", seq.SendDBSettup)
 	seq.FinishedAllOpperations()
 	endpoint = seq.database.Endpoint
 	return
 }
 
-func (c AWS) CreateScope(scope string) (cryptData string) {
+// ScopeOptions are how a new scope is set up.
+type ScopeOptions struct {
+	// Executor is how scripts are run on the servers in the scope, security.ExecutorSSH or security.ExecutorSSM. Empty is ssh.
+	Executor string
+	// SSHSources are the cidrs, ip addresses and prefix lists ssh is allowed from. Without any, ssh scopes only allows
+	// ssh from nerthus and ssm scopes allows no ssh at all.
+	SSHSources []string
+	// AMIParameter is the ssm parameter the ami of new servers in the scope is looked up in, serverlib.AMIAmazonLinux2023,
+	// serverlib.AMIAmazonLinux2 or the path of a parameter. Empty is serverlib.DefaultAMIParameter when the server is
+	// created.
+	AMIParameter string
+	// VPC is the vpc the scope adopts, its id, a key=value tag on it or its Name tag. Empty is the default vpc.
+	VPC string
+	// Subnets are the ids of the subnets in the vpc the servers in the scope are spread across. Without any, the default
+	// subnets of the vpc are used.
+	Subnets []string
+	// VPCCIDR provisions a vpc for the scope with this cidr instead of adopting one, with a public and a private subnet
+	// in each of Zones availability zones, vpclib.DefaultZones if 0. NAT gives the private subnets a nat gateway. The vpc
+	// is deleted with the scope.
+	VPCCIDR string
+	Zones   int
+	NAT     bool
+}
+
+// scopeOptions validates the options and fills in the defaults.
+func (c AWS) scopeOptions(o ScopeOptions) (ScopeOptions, error) {
+	err := security.CheckExecutor(o.Executor)
+	if err != nil {
+		return o, err
+	}
+	err = serverlib.CheckAMIParameter(o.AMIParameter)
+	if err != nil {
+		return o, err
+	}
+	if o.VPCCIDR != "" {
+		if o.VPC != "" || len(o.Subnets) > 0 {
+			return o, fmt.Errorf("%w: a scope either adopts a vpc and its subnets or provisions one", vpclib.ErrInvalidNetwork)
+		}
+		n, err := vpclib.NewNetwork("", o.VPCCIDR, o.Zones, o.NAT, c.ec2)
+		if err != nil {
+			return o, err
+		}
+		o.VPCCIDR, o.Zones = n.CIDR, n.Zones
+	} else if o.Zones != 0 || o.NAT {
+		return o, fmt.Errorf("%w: zones and nat are only used when a vpc is provisioned", vpclib.ErrInvalidNetwork)
+	}
+	if o.Executor == "" {
+		o.Executor = security.ExecutorSSH
+	}
+	var sources []string
+	for _, source := range o.SSHSources {
+		source, err = security.NormalizeSource(source)
+		if err != nil {
+			return o, err
+		}
+		sources = append(sources, source)
+	}
+	o.SSHSources = sources
+	if len(o.SSHSources) == 0 && o.Executor == security.ExecutorSSH {
+		if c.nerthusIP == "" {
+			return o, fmt.Errorf("%w: no ssh sources provided and the ip of nerthus is unknown", security.ErrInvalidSource)
+		}
+		o.SSHSources = []string{c.nerthusIP}
+	}
+	return o, nil
+}
+
+// CreateScope creates the key pair and security group of a new scope.
+func (c AWS) CreateScope(scope string, o ScopeOptions) (cryptData string, err error) {
+	return c.createScope(nil, scope, o)
+}
+
+func (c AWS) createScope(j *journal.Journal, scope string, o ScopeOptions) (cryptData string, err error) {
+	o, err = c.scopeOptions(o)
+	if err != nil {
+		return
+	}
 	seq := sequence{
 		ec2:           c.ec2,
+		dial:          c.dial,
+		ssm:           c.ssm,
+		secrets:       c.secrets,
 		elb:           c.elb,
 		shouldCleanUp: false,
 		deleters:      NewStack(),
+		job:           c.job,
 		scope:         scope,
+		executor:      o.Executor,
+		sshSources:    o.SSHSources,
+		amiParameter:  o.AMIParameter,
+		vpc:           vpclib.VPC{Id: o.VPC},
+		subnets:       o.Subnets,
+		network: vpclib.Network{
+			CIDR:  o.VPCCIDR,
+			Zones: o.Zones,
+			NAT:   o.NAT,
+		},
 	}
-	defer seq.Cleanup()
+	defer seq.Cleanup(&err)
+	seq.OpenJournal(j, operationCreateScope, map[string]string{
+		"executor":      o.Executor,
+		"ssh_sources":   strings.Join(o.SSHSources, " "),
+		"ami_parameter": o.AMIParameter,
+		"vpc":           o.VPC,
+		"subnets":       strings.Join(o.Subnets, " "),
+		"vpc_cidr":      o.VPCCIDR,
+		"zones":         strconv.Itoa(o.Zones),
+		"nat":           strconv.FormatBool(o.NAT),
+	})
 
 	//AWS
 	seq.StartingServerSettup()
-	seq.CreateKey()
-	seq.GetVPC()
-	seq.CreateSecurityGroup()
+	seq.step("CreateKey", seq.CreateKey)
+	seq.step("StoreKeySecret", seq.StoreKeySecret)
+	if o.VPCCIDR != "" {
+		seq.step("CreateVPC", seq.CreateVPC)
+	} else {
+		seq.step("GetVPC", seq.GetVPC)
+	}
+	seq.step("CreateSecurityGroup", seq.CreateSecurityGroup)
 
-	seq.SendScope()
+	seq.do("SendScope", seq.SendScope)
 	seq.FinishedAllOpperations()
 	cryptData = seq.cryptData
 	return
 }
 
+// ruleHealthyWait and installationWait are how long the sequences give aws to settle before continuing.
+var ruleHealthyWait = 30 * time.Second
+var installationWait = 30 * time.Second
+
 type sequence struct {
-	ec2             *ec2.Client
-	elb             *elbv2.Client
-	rds             *rds.Client
+	ec2             util.EC2
+	elb             util.ELB
+	rds             util.RDS
+	dial            servershlib.Dialer
+	ssm             util.SSM
+	secrets         secret.Store
+	executor        string
+	sshSources      []string
+	amiParameter    string
+	subnets         []string
 	shouldCleanUp   bool
 	deleters        Stack
 	slackId         string
@@ -204,6 +417,7 @@ type sequence struct {
 	PemName         string
 	cryptData       string
 	vpc             vpclib.VPC
+	network         vpclib.Network
 	securityGroup   securitylib.Group
 	dbSecurityGroup securitylib.Group
 	database        databaselib.Database
@@ -212,432 +426,830 @@ type sequence struct {
 	rule            loadbalancerlib.Rule
 	serversh        servershlib.Server
 	user            servershlib.User
+	journal         *journal.Journal
+	job             *job.Job
+	current         string
+	failure         error
 }
 
-func (c *sequence) Cleanup() {
+// Cleanup is deferred by every sequence. When a step has failed everything the sequence created is removed and the
+// failure is returned through err. Steps return their errors, the recover is only a safety net for unexpected panics.
+func (c *sequence) Cleanup(err *error) {
 	if a := recover(); a != nil {
 		log.Warning("Recovered: ", a)
+		c.failure = &StepError{
+			Step:  c.current,
+			Cause: fmt.Errorf("%v", a),
+		}
+	}
+	if err != nil {
+		*err = c.failure
+	}
+	if c.failure != nil {
 		c.shouldCleanUp = true
 	}
 	if !c.shouldCleanUp {
+		c.CloseJournal(journal.StatusDone)
 		return
 	}
 	log.Info("Cleanup started.")
+	c.job.SetStep("Cleanup")
+	if c.failure != nil {
+		c.job.AddLog(fmt.Sprintf("%s: %v", c.scope, c.failure))
+	}
 	c.cryptData = ""
 	slack.SendStatus(":x: Something went wrong starting cleanup.")
+	c.job.AddLog(":x: Something went wrong starting cleanup.")
 	for delFunc := c.deleters.Pop(); delFunc != nil; delFunc = c.deleters.Pop() {
 		delFunc()
 	}
+	c.CloseJournal(journal.StatusRolledBack)
 	log.Info("Cleanup is \"done\", exiting.")
 	slack.SendStatus(":heavy_check_mark: Cleanup is \"done\".")
+	c.job.AddLog(":heavy_check_mark: Cleanup is \"done\".")
+}
+
+func (c sequence) status(s string) {
+	status(c.job, s)
+}
+
+// do runs f as the named part of the sequence. Once a part has failed the rest of the sequence is skipped.
+func (c *sequence) do(name string, f func() error) {
+	if c.failure != nil {
+		return
+	}
+	c.current = name
+	c.job.SetStep(name)
+	err := f()
+	if err == nil {
+		return
+	}
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) {
+		stepErr = &StepError{
+			Cause: err,
+		}
+		err = stepErr
+	}
+	if stepErr.Step == "" {
+		stepErr.Step = name
+	}
+	c.failure = err
+}
+
+// step is like do, but skips steps the journal has recorded as done and records the step when it succeeds.
+func (c *sequence) step(name string, f func() error) {
+	if c.failure != nil {
+		return
+	}
+	if c.journal.Done(name) {
+		log.Info(fmt.Sprintf("%s: Skipping %s, already done according to journal %s.", c.scope, name, c.journal.Id))
+		return
+	}
+	c.do(name, f)
+	if c.failure != nil {
+		return
+	}
+	err := c.journal.StepDone(name)
+	if err != nil {
+		log.AddError(err).Warning("While writing step ", name, " to journal")
+	}
 }
 
-func (c sequence) CheckServerName(name string) {
+func (c *sequence) created(object, logMessage string, obj deleter, r journal.Resource) {
+	c.job.AddResource(job.ActionCreated, r.Type, r.Id)
+	err := c.journal.Created(r)
+	if err != nil {
+		log.AddError(err).Warning("While writing ", r.Type, " ", r.Id, " to journal")
+	}
+	c.pushCleanup(object, logMessage, obj, r)
+}
+
+func (c *sequence) pushCleanup(object, logMessage string, obj deleter, r journal.Resource) {
+	c.deleters.Push(cleanup(object, logMessage, obj, c.job, func() {
+		c.job.AddResource(job.ActionDeleted, r.Type, r.Id)
+		err := c.journal.Removed(r.Type, r.Id)
+		if err != nil {
+			log.AddError(err).Warning("While writing removal of ", r.Type, " ", r.Id, " to journal")
+		}
+	}))
+}
+
+func (c sequence) CheckServerName(name string) (err error) {
 	available, err := serverlib.NameAvailable(name, c.ec2)
 	if err != nil {
-		log.AddError(err).Fatal("While checking server name availablility")
+		return fail(resourceServer, err, "While checking server name availablility")
 	}
 	if !available {
-		log.Fatal("Servername is not available")
+		return fail(resourceServer, fmt.Errorf("%w: %s", ErrNameNotAvailable, name), "Servername is not available")
 	}
+	return
+}
+
+func (c sequence) ResolveAMI(sizing serverlib.Sizing) (resolved serverlib.Sizing, err error) {
+	resolved, err = sizing.ResolveAMI(c.securityGroup.AMIParameter, c.ec2, c.ssm)
+	if err != nil {
+		return sizing, fail(resourceServer, err, "While resolving ami")
+	}
+	if resolved.AMIParameter != "" {
+		s := fmt.Sprintf("%s: Resolved ami %s from %s.", c.scope, resolved.AMI, resolved.AMIParameter)
+		c.status(s)
+	}
+	return
+}
+
+func (c sequence) PlaceServer(placement serverlib.Placement) (subnet vpclib.Subnet, err error) {
+	subnets, err := scopeSubnets(c.vpc, c.ec2)
+	if err != nil {
+		return subnet, fail(resourceServer, err, "While getting subnets")
+	}
+	subnet, err = placement.Place(c.scope, subnets, c.ec2)
+	if err != nil {
+		return subnet, fail(resourceServer, err, "While placing server")
+	}
+	if subnet.Id != "" {
+		s := fmt.Sprintf("%s: Placing server in subnet %s.", c.scope, subnet)
+		c.status(s)
+	}
+	return
+}
+
+// scopeSubnets returns the subnets of the scope. Scopes created before they had subnets use the default subnets of
+// their vpc, or none so that aws picks one like it used to.
+func scopeSubnets(v vpclib.VPC, e2 util.EC2) (subnets []vpclib.Subnet, err error) {
+	if len(v.Subnets) > 0 || v.Id == "" {
+		return v.Subnets, nil
+	}
+	subnets, err = vpclib.GetSubnets(v.Id, nil, e2)
+	if errors.Is(err, vpclib.ErrInvalidSubnet) {
+		return nil, nil
+	}
+	return
+}
+
+func (c sequence) ValidateServerSizing(sizing serverlib.Sizing) (err error) {
+	err = sizing.Validate(c.ec2)
+	if err != nil {
+		return fail(resourceServer, err, "Server sizing is not valid")
+	}
+	return
 }
 
 func (c sequence) StartingServerSettup() {
 	s := fmt.Sprintf("%s: %s Starting to setup server in aws.", c.scope, c.service.ArtifactId)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
 }
 
 func (c sequence) StartingServiceSettup() {
 	s := fmt.Sprintf("%s: %s Starting to setup service on server in aws.", c.scope, c.service.ArtifactId)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
 }
 
-func (c *sequence) CreateKey() {
+func (c *sequence) CreateKey() (err error) {
 	// Create a new key
 	key, err := keylib.NewKey(c.scope, c.ec2)
 	_, err = key.Create()
 	if err != nil {
-		log.AddError(err).Fatal("While creating keypair")
+		return fail(resourceKey, err, "While creating keypair")
 	}
-	c.deleters.Push(cleanup("Key pair", "while deleting created key pair", &key))
-	s := fmt.Sprintf("%s: Created key pair %s %s", c.scope, key.Name, key.Fingerprint)
-	log.Info(s)
-	slack.SendStatus(s)
-	pem, err := os.OpenFile("./"+key.PemName, os.O_WRONLY|os.O_CREATE, 0600)
-	if err == nil {
-		fmt.Fprint(pem, key.Material)
-		pem.Close()
+	material, err := journal.Secret(key.Material)
+	if err != nil {
+		log.AddError(err).Warning("While encrypting key material for journal")
 	}
+	c.created("Key pair", "while deleting created key pair", &key, journal.Resource{
+		Type: resourceKey,
+		Id:   key.Id,
+		Name: key.Name,
+		Properties: map[string]string{
+			"material": material,
+		},
+	})
+	s := fmt.Sprintf("%s: Created key pair %s %s", c.scope, key.Name, key.Fingerprint)
+	c.status(s)
 	c.key = key
 	c.PemName = c.key.PemName
+	return
+}
+
+// StoreKeySecret stores the private key of the scope in the secret store, so that it can be fetched without the crypt
+// data.
+func (c *sequence) StoreKeySecret() (err error) {
+	return c.storeSecret(secret.KeyName(c.scope), c.key.Material)
+}
+
+// StoreDatabaseSecret stores the master password of the database in the secret store, only the name of the secret is
+// sent to Slack.
+func (c *sequence) StoreDatabaseSecret() (err error) {
+	return c.storeSecret(secret.DatabaseName(c.scope, c.database.Identifier), c.database.Password)
 }
 
-func (c *sequence) GetVPC() {
-	// Get a list of VPCs so we can associate the group with the first VPC.
-	vpc, err := vpclib.GetVPC(c.ec2)
+func (c *sequence) storeSecret(name, value string) (err error) {
+	s := secret.New(name, c.secrets)
+	err = s.Put(value)
 	if err != nil {
-		log.AddError(err).Fatal("While getting vpcId")
+		return fail(resourceSecret, err, fmt.Sprintf("While storing secret %s", name))
 	}
-	s := fmt.Sprintf("%s: Found VPCId: %s.", c.scope, vpc.Id)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.created("Secret", "while deleting created secret", &s, journal.Resource{
+		Type: resourceSecret,
+		Id:   s.Name,
+		Name: s.Ref,
+	})
+	c.status(fmt.Sprintf("%s: Stored secret %s.", c.scope, s.Name))
+	return
+}
+
+func (c *sequence) GetVPC() (err error) {
+	// Get the VPC of the scope, the default one unless an id was given, and the subnets its servers are placed in.
+	vpc, err := vpclib.GetScopeVPC(c.vpc.Id, c.subnets, c.ec2)
+	if err != nil {
+		return fail(resourceVPC, err, "While getting vpcId")
+	}
+	err = c.journal.Created(journal.Resource{
+		Type: resourceVPC,
+		Id:   vpc.Id,
+		Properties: map[string]string{
+			"subnets": strings.Join(vpc.SubnetIds(), " "),
+		},
+	})
+	if err != nil {
+		log.AddError(err).Warning("While writing vpc to journal")
+	}
+	s := fmt.Sprintf("%s: Found VPCId: %s with subnets in %s.", c.scope, vpc.Id, strings.Join(vpc.AvailabilityZones(), ", "))
+	c.status(s)
 	c.vpc = vpc
+	return
 }
 
-func (c *sequence) CreateSecurityGroup() {
+// CreateVPC provisions the vpc of the scope. Its public subnets are the subnets the servers in the scope are placed in.
+func (c *sequence) CreateVPC() (err error) {
+	network, err := vpclib.NewNetwork(c.scope, c.network.CIDR, c.network.Zones, c.network.NAT, c.ec2)
+	if err != nil {
+		return fail(resourceNetwork, err, "While validating vpc")
+	}
+	_, err = network.Create()
+	if err != nil {
+		return fail(resourceNetwork, err, "While creating vpc")
+	}
+	c.created("VPC", "while deleting created vpc", &network, journal.Resource{
+		Type: resourceNetwork,
+		Id:   network.VPC.Id,
+		Name: network.CIDR,
+	})
+	s := fmt.Sprintf("%s: Created VPCId: %s with cidr %s and subnets in %s.", c.scope, network.VPC.Id, network.CIDR,
+		strings.Join(network.VPC.AvailabilityZones(), ", "))
+	if network.NAT {
+		s = fmt.Sprintf("%s NAT gateway %s gives the private subnets internet access.", s, network.NATGatewayId)
+	}
+	c.status(s)
+	c.network = network
+	c.vpc = network.VPC
+	return
+}
+
+func (c *sequence) CreateSecurityGroup() (err error) {
 	securityGroup, err := securitylib.NewGroup(c.scope, c.vpc, c.ec2)
+	securityGroup.Executor = c.executor
+	securityGroup.AMIParameter = c.amiParameter
 	_, err = securityGroup.Create()
 	if err != nil {
-		log.AddError(err).Fatal("While creating security group")
+		return fail(resourceSecurityGroup, err, "While creating security group")
 	}
-	c.deleters.Push(cleanup("Security group", "while deleting created security group",
-		&securityGroup))
+	c.created("Security group", "while deleting created security group", &securityGroup, journal.Resource{
+		Type: resourceSecurityGroup,
+		Id:   securityGroup.Id,
+		Name: securityGroup.Name,
+	})
 	s := fmt.Sprintf("%s: Created security group %s with VPC %s.",
 		c.scope, securityGroup.Id, c.vpc.Id)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
 	c.securityGroup = securityGroup
-	c.AddBaseAuthorizationToSecurityGroup()
+	if len(c.sshSources) == 0 {
+		return
+	}
+	return c.AddSSHAccessToSecurityGroup()
 }
 
-func (c *sequence) CreateDBSecurityGroup(artifactId string) {
+func (c *sequence) CreateDBSecurityGroup(artifactId string) (err error) {
 	securityGroup, err := securitylib.NewDBGroup(servershlib.ToFriendlyName(artifactId), c.scope, c.vpc, c.ec2)
 	_, err = securityGroup.Create()
 	if err != nil {
-		log.AddError(err).Fatal("while creating security group")
+		return fail(resourceDBSecurityGroup, err, "while creating security group")
 	}
-	c.deleters.Push(cleanup("Security group", "while deleting created security group",
-		&securityGroup))
+	c.created("Security group", "while deleting created security group", &securityGroup, journal.Resource{
+		Type: resourceDBSecurityGroup,
+		Id:   securityGroup.Id,
+		Name: securityGroup.Name,
+	})
 	s := fmt.Sprintf("%s: Created security group %s with VPC %s.",
 		c.scope, securityGroup.Id, c.vpc.Id)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
 	c.dbSecurityGroup = securityGroup
-	c.AddDatabaseAuthorizationToSecurityGroup()
+	return c.AddDatabaseAuthorizationToSecurityGroup()
 }
 
-func (c *sequence) AddBaseAuthorizationToSecurityGroup() {
-	err := c.securityGroup.AddBaseAuthorization()
+func (c *sequence) AddSSHAccessToSecurityGroup() (err error) {
+	_, err = c.securityGroup.AddSSHAccess(c.sshSources)
 	if err != nil {
-		log.AddError(err).Fatal("Could not add base authorization")
+		return fail(resourceSecurityGroup, err, "Could not add ssh access")
 	}
-	s := fmt.Sprintf("%s: Added base authorization to security group: %s.", c.scope, c.securityGroup.Id)
-	log.Info(s)
-	slack.SendStatus(s)
+	s := fmt.Sprintf("%s: Added ssh access from %s to security group: %s.", c.scope, strings.Join(c.sshSources, ", "), c.securityGroup.Id)
+	c.status(s)
+	return
 }
 
-func (c *sequence) AddDatabaseAuthorizationToSecurityGroup() {
-	err := c.dbSecurityGroup.AddDatabaseAuthorization(c.securityGroup.Id)
+func (c *sequence) AddDatabaseAuthorizationToSecurityGroup() (err error) {
+	err = c.dbSecurityGroup.AddDatabaseAuthorization(c.securityGroup.Id)
 	if err != nil {
-		log.AddError(err).Fatal("Could not add database authorization")
+		return fail(resourceDBSecurityGroup, err, "Could not add database authorization")
 	}
 	s := fmt.Sprintf("%s: Added database authorization to security group: %s.", c.scope, c.dbSecurityGroup.Id)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
+	return
 }
 
-func (c *sequence) AddLoadbalancerAuthorizationToSecurityGroup() {
-	err := c.securityGroup.AddLoadbalancerAuthorization(c.service.ELBSecurityGroup, c.service.Port)
+func (c *sequence) AddLoadbalancerAuthorizationToSecurityGroup() (err error) {
+	err = c.securityGroup.AddLoadbalancerAuthorization(c.service.ELBSecurityGroup, c.service.Port)
 	if err != nil {
-		log.AddError(err).Fatal("Could not add base authorization")
+		return fail(resourceSecurityGroup, err, "Could not add base authorization")
 	}
 	s := fmt.Sprintf("%s: %s %s, Added base authorization to security group: %s.", c.scope, c.server.Name, c.service.ArtifactId, c.securityGroup.Id)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
+	return
 }
 
-func (c *sequence) CreateNewDatabase(artifactId string) {
-	database, err := databaselib.NewDatabase(servershlib.ToFriendlyName(artifactId), c.scope, c.securityGroup, c.rds)
+// CreateDBSubnetGroup creates the db subnet group that places the databases of the scope in its vpc, unless an earlier
+// database in the scope already has. Databases go in the private subnets of a provisioned vpc, and in the subnets of
+// the scope otherwise.
+func (c *sequence) CreateDBSubnetGroup() (err error) {
+	_, err = databaselib.GetSubnetGroup(c.scope, c.rds)
+	if err == nil {
+		return
+	}
+	if !errors.Is(err, databaselib.ErrSubnetGroupNotFound) {
+		return fail(resourceDBSubnetGroup, err, "While getting db subnet group")
+	}
+	subnets, err := dbSubnets(c.scope, c.vpc, c.ec2)
+	if err != nil {
+		return fail(resourceDBSubnetGroup, err, "While getting subnets for db subnet group")
+	}
+	group, err := databaselib.NewSubnetGroup(c.scope, subnets, c.rds)
+	_, err = group.Create()
+	if err != nil {
+		return fail(resourceDBSubnetGroup, err, "Could not create db subnet group")
+	}
+	c.created("DB subnet group", "while deleting created db subnet group", &group, journal.Resource{
+		Type: resourceDBSubnetGroup,
+		Id:   group.Name,
+		Name: group.Name,
+	})
+	s := fmt.Sprintf("%s: Created db subnet group %s with subnets %s.", c.scope, group.Name, strings.Join(group.SubnetIds, ", "))
+	c.status(s)
+	return
+}
+
+// dbSubnets returns the subnets the databases of the scope are placed in, the private subnets of the vpc provisioned for
+// the scope or the subnets of the scope if it adopted its vpc.
+func dbSubnets(scope string, v vpclib.VPC, e2 util.EC2) (subnets []vpclib.Subnet, err error) {
+	network, err := vpclib.GetNetwork(scope, e2)
+	if errors.Is(err, vpclib.ErrNotFound) {
+		return v.Subnets, nil
+	}
+	if err != nil {
+		return
+	}
+	if len(network.PrivateSubnets) == 0 {
+		return network.VPC.Subnets, nil
+	}
+	return network.PrivateSubnets, nil
+}
+
+func (c *sequence) CreateNewDatabase(artifactId string) (err error) {
+	database, err := databaselib.NewDatabase(servershlib.ToFriendlyName(artifactId), c.scope, c.dbSecurityGroup,
+		databaselib.SubnetGroupName(c.scope), c.rds)
 	_, err = database.Create()
 	if err != nil {
-		log.Fatal("Could not create database", err)
+		return fail(resourceDatabase, err, "Could not create database")
+	}
+	password, err := journal.Secret(database.Password)
+	if err != nil {
+		log.AddError(err).Warning("While encrypting database password for journal")
 	}
-	c.deleters.Push(cleanup("Database", "while deleting created database", &database))
+	c.created("Database", "while deleting created database", &database, journal.Resource{
+		Type: resourceDatabase,
+		Id:   database.Identifier,
+		Name: database.Name,
+		Properties: map[string]string{
+			"password": password,
+		},
+	})
 	s := fmt.Sprintf("%s: Created database: %s.", c.scope, database.ARN)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
 	c.database = database
+	return
 }
 
-func (c *sequence) CreateNewServer(serverName string) {
+func (c *sequence) CreateNewServer(serverName string, sizing serverlib.Sizing, subnet vpclib.Subnet) (err error) {
 	server, err := serverlib.NewServer(serverName, c.scope, c.key, c.securityGroup, c.ec2)
+	server.SetSizing(sizing)
+	server.SetSubnet(subnet)
 	_, err = server.Create()
 	if err != nil {
-		log.Fatal("Could not create server", err)
+		return fail(resourceServer, err, "Could not create server")
 	}
-	c.deleters.Push(cleanup("Server", "while deleting created server", &server))
-	s := fmt.Sprintf("%s: %s, Created server: %s.", c.scope, c.server.Name, server.Id)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.created("Server", "while deleting created server", &server, journal.Resource{
+		Type: resourceServer,
+		Id:   server.Id,
+		Name: server.Name,
+	})
+	s := fmt.Sprintf("%s: %s, Created server: %s, %s with %s root volume from ami %s in %s.", c.scope, server.Name,
+		server.Id, server.InstanceType, server.RootVolume, server.ImageId, server.AvailabilityZone)
+	c.status(s)
 	c.server = server
+	return
 }
 
-func (c *sequence) WaitForServerToStart() {
-	err := c.server.WaitUntilRunning()
+func (c *sequence) WaitForServerToStart() (err error) {
+	err = c.server.WaitUntilRunning()
+	if err != nil {
+		return fail(resourceServer, err, "While waiting for server to start")
+	}
 	s := fmt.Sprintf("%s: %s, Server %s is now in running state.", c.scope, c.server.Name, c.server.Id)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
 	_, err = c.server.GetPublicDNS()
 	if err != nil {
-		log.AddError(err).Fatal("While getting public dns name")
+		return fail(resourceServer, err, "While getting public dns name")
 	}
 	s = fmt.Sprintf("%s: %s, Got server %s's public dns %s.", c.scope, c.server.Name, c.server.Id, c.server.PublicDNS)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
+	if c.securityGroup.UsesSSM() {
+		return
+	}
+	err = servershlib.ForgetHostKey(c.server.PublicDNS)
+	if err != nil {
+		log.AddError(err).Warning("While forgetting old host key for ", c.server.PublicDNS)
+	}
+	return nil
 }
 
-func (c *sequence) CreateTargetGroup() {
+func (c *sequence) CreateTargetGroup() (err error) {
 	targetGroup, err := loadbalancerlib.NewTargetGroup(c.scope, c.service.ArtifactId, c.service.Path, c.service.Port, c.vpc, c.elb)
 	_, err = targetGroup.Create()
 	if err != nil {
-		log.AddError(err).Fatal(fmt.Sprintf("While creating target group for %s", c.server.Name))
+		return fail(resourceTargetGroup, err, fmt.Sprintf("While creating target group for %s", c.server.Name))
 	}
-	c.deleters.Push(cleanup("Target group", "while deleting created target group", &targetGroup))
+	c.created("Target group", "while deleting created target group", &targetGroup, journal.Resource{
+		Type: resourceTargetGroup,
+		Id:   targetGroup.ARN,
+		Name: targetGroup.Name,
+	})
 	s := fmt.Sprintf("%s: %s %s, Created target group: %s.", c.scope, c.server.Name, c.service.ArtifactId, targetGroup.ARN)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
 	c.targetGroup = targetGroup
+	return
 }
 
-func (c *sequence) GetTargetGroup() {
+func (c *sequence) GetTargetGroup() (err error) {
 	targetGroup, err := loadbalancerlib.GetTargetGroup(c.scope, c.service.ArtifactId, c.service.Path, c.service.Port, c.elb)
 	if err != nil {
-		log.AddError(err).Fatal(fmt.Sprintf("While getting target group for %s", c.server.Name))
+		return fail(resourceTargetGroup, err, fmt.Sprintf("While getting target group for %s", c.server.Name))
 	}
 	s := fmt.Sprintf("%s: %s %s, Got target group: %s.", c.scope, c.server.Name, c.service.ArtifactId, targetGroup.ARN)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
 	c.targetGroup = targetGroup
+	return
 }
 
-func (c *sequence) CreateTarget() {
+func (c *sequence) CreateTarget() (err error) {
 	target, err := loadbalancerlib.NewTarget(c.targetGroup, c.server, c.elb)
 	_, err = target.Create()
 	if err != nil {
-		log.AddError(err).Fatal(fmt.Sprintf("While adding target to target group %s", c.targetGroup.ARN))
+		return fail(resourceTarget, err, fmt.Sprintf("While adding target to target group %s", c.targetGroup.ARN))
 	}
-	c.deleters.Push(cleanup("Target in targetgroup", "while removing registered target from targetgroup", &target))
+	c.created("Target in targetgroup", "while removing registered target from targetgroup", &target, journal.Resource{
+		Type: resourceTarget,
+		Id:   c.server.Id,
+		Properties: map[string]string{
+			"target_group_arn": c.targetGroup.ARN,
+		},
+	})
 	s := fmt.Sprintf("%s: %s %s, Registered server %s as target for target group %s.", c.scope, c.server.Name, c.service.ArtifactId, c.server.Id, c.targetGroup.ARN)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
+	return
+}
+
+// CheckListenerVPC checks that the loadbalancer of the listener is in the vpc of the scope before anything is created,
+// aws only refuses the listener rule after the target group has been created in the vpc of the scope. Scopes without a
+// vpc in their key are not checked.
+func (c *sequence) CheckListenerVPC() (err error) {
+	if c.vpc.Id == "" {
+		return
+	}
+	listener, err := loadbalancerlib.GetListener(c.service.ELBListenerArn, c.elb)
+	if err != nil {
+		return fail(resourceRule, err, "While getting listener")
+	}
+	err = listener.CheckVPC(c.vpc.Id)
+	if err != nil {
+		return fail(resourceRule, err, fmt.Sprintf("While checking the vpc of elb %s", listener.ARN))
+	}
+	return
 }
 
-func (c *sequence) AddRuleToListener() {
+func (c *sequence) AddRuleToListener() (err error) {
 	listener, err := loadbalancerlib.GetListener(c.service.ELBListenerArn, c.elb)
 	rule, err := loadbalancerlib.NewRule(listener, c.targetGroup, c.elb)
 	_, err = rule.Create()
 	if err != nil {
-		log.AddError(err).Fatal(fmt.Sprintf("While adding rule to elb %s", listener.ARN))
+		return fail(resourceRule, err, fmt.Sprintf("While adding rule to elb %s", listener.ARN))
 	}
-	c.deleters.Push(cleanup("Rule", "while removing rule added to loadbalancer", &rule))
+	c.created("Rule", "while removing rule added to loadbalancer", &rule, journal.Resource{
+		Type: resourceRule,
+		Id:   rule.ARN,
+	})
 	s := fmt.Sprintf("%s: %s %s, Adding elastic load balancer rule: %s.", c.scope, c.server.Name, c.service.ArtifactId, rule.ARN)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
 	c.rule = rule
+	return
 }
 
-func (c *sequence) TagNewService() {
+func (c *sequence) TagNewService() (err error) {
 	VolumeId, err := c.server.GetVolumeId()
 	if err != nil {
-		log.AddError(err).Fatal(fmt.Sprintf("While getting volume id for server %s", c.server.Name))
+		return fail(resourceTag, err, fmt.Sprintf("While getting volume id for server %s", c.server.Name))
 	}
 	listener, err := loadbalancerlib.GetListener(c.service.ELBListenerArn, c.elb)
 	loadbalancerARN, err := listener.GetLoadbalancer()
 	if err != nil {
-		log.AddError(err).Fatal(fmt.Sprintf("While getting loadbalancerARN for listener %s", c.service.ELBListenerArn))
+		return fail(resourceTag, err, fmt.Sprintf("While getting loadbalancerARN for listener %s", c.service.ELBListenerArn))
 	}
 	t, err := tag.NewNewTag(c.service.ArtifactId, c.scope, c.key.Id, c.securityGroup.Id, c.server.Id, VolumeId, c.server.NetworkInterfaceId, c.server.ImageId,
 		c.targetGroup.ARN, c.rule.ARN, c.service.ELBListenerArn, loadbalancerARN, c.ec2, c.elb)
 	_, err = t.Create()
 	if err != nil {
-		log.AddError(err).Fatal(fmt.Sprintf("While tagging new service %s", c.service.ArtifactId))
+		return fail(resourceTag, err, fmt.Sprintf("While tagging new service %s", c.service.ArtifactId))
 	}
-	c.deleters.Push(cleanup("Tag", "while removing tag added to all resources used by service", &t))
+	c.created("Tag", "while removing tag added to all resources used by service", &t, journal.Resource{
+		Type: resourceTag,
+		Id:   c.service.ArtifactId,
+		Properties: map[string]string{
+			"key_id":               t.KeyId,
+			"security_group_id":    t.SecurityGroupId,
+			"server_id":            t.ServerId,
+			"volume_id":            t.VolumeId,
+			"network_interface_id": t.NetworkInterfaceId,
+			"image_id":             t.ImageId,
+			"target_group_arn":     t.TargetGroupARN,
+			"rule_arn":             t.RuleARN,
+			"listener_arn":         t.ListenerARN,
+			"loadbalancer_arn":     t.LoadbalancerARN,
+		},
+	})
 	s := fmt.Sprintf("%s: %s %s, Adding tag to all resources used by service: %s.", c.scope, c.server.Name, c.service.ArtifactId, c.service.ArtifactId)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
+	return
 }
 
-func (c *sequence) TagAdditionalServer() {
+func (c *sequence) TagAdditionalServer() (err error) {
 	VolumeId, err := c.server.GetVolumeId()
 	if err != nil {
-		log.AddError(err).Fatal(fmt.Sprintf("While getting volume id for server %s", c.server.Name))
+		return fail(resourceTag, err, fmt.Sprintf("While getting volume id for server %s", c.server.Name))
 	}
 	t, err := tag.NewAddTag(c.service.ArtifactId, c.scope, c.server.Id, VolumeId, c.server.NetworkInterfaceId, c.server.ImageId, c.ec2)
 	_, err = t.Create()
 	if err != nil {
-		log.AddError(err).Fatal(fmt.Sprintf("While tagging additional service %s", c.service.ArtifactId))
+		return fail(resourceTag, err, fmt.Sprintf("While tagging additional service %s", c.service.ArtifactId))
 	}
-	c.deleters.Push(cleanup("Tag", "while removing tag added to resources used by the additional service", &t))
+	c.created("Tag", "while removing tag added to resources used by the additional service", &t, journal.Resource{
+		Type: resourceTag,
+		Id:   c.service.ArtifactId,
+		Properties: map[string]string{
+			"server_id":            t.ServerId,
+			"volume_id":            t.VolumeId,
+			"network_interface_id": t.NetworkInterfaceId,
+			"image_id":             t.ImageId,
+		},
+	})
 	s := fmt.Sprintf("%s: %s %s, Adding tag to resources used by additional service: %s.", c.scope, c.server.Name, c.service.ArtifactId, c.service.ArtifactId)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
+	return
 }
 
 func (c sequence) DoneSettingUpServer() {
 	s := fmt.Sprintf("%s: %s %s, Done setting up server in aws %s.", c.scope, c.server.Name, c.service.ArtifactId, c.server.Id)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
 }
 
-func (c sequence) WaitForELBRuleToBeHealthy() {
+func (c sequence) WaitForELBRuleToBeHealthy() (err error) {
 	s := fmt.Sprintf("%s: %s %s, Started waiting for elb rule to be healthy %s.", c.scope, c.server.Name, c.service.ArtifactId, c.rule.ARN)
-	log.Info(s)
-	slack.SendStatus(s)
-	time.Sleep(30 * time.Second)
+	c.status(s)
+	time.Sleep(ruleHealthyWait)
 	s = fmt.Sprintf("%s: %s %s, Done waiting for elb rule to be healthy %s.", c.scope, c.server.Name, c.service.ArtifactId, c.rule.ARN)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
+	return
 }
 
-func (c *sequence) VerifyServerSSH() {
-	serv, _ := servershlib.NewServer(c.server.PublicDNS, c.key.PemName)
+// remote returns the handle for running scripts on the server. Servers in scopes using ssm are reached by instance id
+// over ssm, the rest by public dns over ssh with the scope key. A dial set with AWS.WithDialer is used for both.
+func remote(server serverlib.Server, k keylib.Key, sg securitylib.Group, dial servershlib.Dialer, ssm util.SSM, secrets secret.Store) (servershlib.Server, error) {
+	if !sg.UsesSSM() {
+		material, err := keyMaterial(k, secrets)
+		if err != nil {
+			return servershlib.Server{}, err
+		}
+		return servershlib.NewServer(server.PublicDNS, []byte(material), dial)
+	}
+	if dial == nil {
+		dial = servershlib.DialSSM(ssm)
+	}
+	return servershlib.NewServer(server.Id, nil, dial)
+}
+
+// keyMaterial returns the private key of the scope. It is only kept in memory by the sequence that created it, the rest
+// reads it from the secret store.
+func keyMaterial(k keylib.Key, secrets secret.Store) (material string, err error) {
+	if k.Material != "" {
+		return k.Material, nil
+	}
+	if secrets == nil {
+		err = fmt.Errorf("No secret store found for the private key of %s", k.Scope)
+		return
+	}
+	return secrets.Get(secret.KeyName(k.Scope))
+}
+
+func (c *sequence) VerifyServerSSH() (err error) {
+	serv, err := remote(c.server, c.key, c.securityGroup, c.dial, c.ssm, c.secrets)
+	if err != nil {
+		return fail(resourceServer, err, fmt.Sprintf("While creating executor for %s: %s", c.server.Name, c.server.PublicDNS))
+	}
 	c.serversh = serv
-	err := c.serversh.WaitForConnection()
+	err = c.serversh.WaitForConnection()
 	if err != nil {
-		log.AddError(err).Fatal(fmt.Sprintf("While waiting for connection for %s: %s", c.server.Name, c.server.PublicDNS))
+		return fail(resourceServer, err, fmt.Sprintf("While waiting for connection for %s: %s", c.server.Name, c.server.PublicDNS))
 	}
-	s := fmt.Sprintf("%s: %s, SSH connection to %s is verified.", c.scope, c.server.Name, c.server.PublicDNS)
-	log.Info(s)
-	slack.SendStatus(s)
+	s := fmt.Sprintf("%s: %s, Connection to %s is verified.", c.scope, c.server.Name, c.server.PublicDNS)
+	c.status(s)
+	return
 }
 
-func (c sequence) StartingServiceInstallation() {
-	time.Sleep(time.Second * 30)
+func (c sequence) StartingServiceInstallation() (err error) {
+	time.Sleep(installationWait)
 	s := fmt.Sprintf("%s: %s %s, Starting to install stuff on server %s.", c.scope, c.server.Name, c.service.ArtifactId, c.server.PublicDNS)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
+	return
 }
 
-func (c sequence) AddAutoUpdate() {
-	err := c.serversh.AddAutoUpdate()
+func (c sequence) AddAutoUpdate() (err error) {
+	err = c.serversh.AddAutoUpdate()
 	if err != nil {
-		log.AddError(err).Fatal(fmt.Sprintf("While adding auto updatating %s: %s", c.server.Name, c.server.PublicDNS))
+		return fail(resourceServer, err, fmt.Sprintf("While adding auto updatating %s: %s", c.server.Name, c.server.PublicDNS))
 	}
 	s := fmt.Sprintf("%s: %s, Adding auto update to server %s.", c.scope, c.server.Name, c.server.PublicDNS)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
+	return
 }
 
-func (c sequence) UpdateServer() {
-	err := c.serversh.Update()
+func (c sequence) UpdateServer() (err error) {
+	err = c.serversh.Update()
 	if err != nil {
-		log.AddError(err).Fatal(fmt.Sprintf("While updatating %s: %s", c.server.Name, c.server.PublicDNS))
+		return fail(resourceServer, err, fmt.Sprintf("While updatating %s: %s", c.server.Name, c.server.PublicDNS))
 	}
 	s := fmt.Sprintf("%s: %s %s, Updated server %s.", c.scope, c.server.Name, c.service.ArtifactId, c.server.PublicDNS)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
+	return
 }
 
-func (c *sequence) InstallFilebeat() {
+func (c *sequence) InstallFilebeat() (err error) {
 	filebeat, err := servershlib.NewFilebeat(os.Getenv("filebeat_password"), c.serversh)
 	_, err = filebeat.Create()
 	if err != nil {
-		log.AddError(err).Fatal(fmt.Sprintf("While installed filebeat on %s", c.server.Name))
+		return fail(resourceFilebeat, err, fmt.Sprintf("While installed filebeat on %s", c.server.Name))
 	}
-	c.deleters.Push(cleanup("Filebeat service from server", "while removing filebeat service from server", &filebeat))
+	c.created("Filebeat service from server", "while removing filebeat service from server", &filebeat, journal.Resource{
+		Type: resourceFilebeat,
+		Id:   c.server.Id,
+	})
 	s := fmt.Sprintf("%s: %s, Added filebeat.", c.scope, c.server.Name)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
+	return
 }
 
-func (c *sequence) InstallPrograms() {
+func (c *sequence) InstallPrograms() (err error) {
 	java, err := servershlib.NewJava(servershlib.JAVA_ONE_ELEVEN, c.serversh)
 	_, err = java.Create()
 	if err != nil {
-		log.AddError(err).Fatal(fmt.Sprintf("While verifying or installing java %s", servershlib.JAVA_ONE_ELEVEN))
+		return fail(resourceJava, err, fmt.Sprintf("While verifying or installing java %s", servershlib.JAVA_ONE_ELEVEN))
 	}
-	c.deleters.Push(cleanup("Java from server", "while removing java if it was installed", &java))
+	c.created("Java from server", "while removing java if it was installed", &java, journal.Resource{
+		Type: resourceJava,
+		Id:   c.server.Id,
+		Name: servershlib.JAVA_ONE_ELEVEN.String(),
+	})
 	s := fmt.Sprintf("%s: %s %s, Verified or installed java %s.", c.scope, c.server.Name, c.service.ArtifactId, servershlib.JAVA_ONE_ELEVEN)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
+	return
 }
 
-func (c *sequence) AddUser() {
+func (c *sequence) AddUser() (err error) {
 	user, err := servershlib.NewUser(c.service.ArtifactId, c.serversh)
 	_, err = user.Create()
 	if err != nil {
-		log.AddError(err).Fatal(fmt.Sprintf("While adding user %s", user.Name))
+		return fail(resourceUser, err, fmt.Sprintf("While adding user %s", user.Name))
 	}
-	c.deleters.Push(cleanup("User from server", "while removing user from server", &user))
+	c.created("User from server", "while removing user from server", &user, journal.Resource{
+		Type: resourceUser,
+		Id:   c.server.Id,
+		Name: user.Name,
+	})
 	s := fmt.Sprintf("%s: %s %s, Added user %s.", c.scope, c.server.Name, c.service.ArtifactId, user.Name)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
 	c.user = user
+	return
 }
 
-func (c *sequence) AddFilebeatService() {
+func (c *sequence) AddFilebeatService() (err error) {
 	filebeatService, err := servershlib.NewFilebeatService(c.server.Name, c.service.ArtifactId, c.user.Name, c.serversh)
 	_, err = filebeatService.Create()
 	if err != nil {
-		log.AddError(err).Fatal(fmt.Sprintf("While adding filebeat script for %s", c.service.ArtifactId))
+		return fail(resourceFilebeatService, err, fmt.Sprintf("While adding filebeat script for %s", c.service.ArtifactId))
 	}
-	c.deleters.Push(cleanup("Filebeat service from server", "while removing filebeat service from server", &filebeatService))
+	c.created("Filebeat service from server", "while removing filebeat service from server", &filebeatService, journal.Resource{
+		Type: resourceFilebeatService,
+		Id:   c.server.Id,
+		Name: c.service.ArtifactId,
+	})
 	s := fmt.Sprintf("%s: %s %s, Added filebeat service.", c.scope, c.server.Name, c.service.ArtifactId)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
+	return
 }
 
-func (c *sequence) InstallService() {
+func (c *sequence) InstallService() (err error) {
 	healthReportUrl := fmt.Sprintf("%s/%s/%s?service_tag=%s&service_type=%s", os.Getenv("health_url_with_base_path"), url.PathEscape(c.service.Health.Name), c.server.Name, url.QueryEscape(c.service.Health.Tag), url.QueryEscape(c.service.Health.Type))
 	service, err := servershlib.NewService(c.service.ArtifactId, c.service.UpdateProp, c.service.LocalOverride, healthReportUrl, c.service.Path, c.service.Icon, c.service.Port, c.user, c.serversh)
 	_, err = service.Create()
 	if err != nil {
-		log.AddError(err).Fatal("While setting up service in user")
+		return fail(resourceService, err, "While setting up service in user")
 	}
-	c.deleters.Push(cleanup("Service installed on server", "while stopping service", &service))
+	c.created("Service installed on server", "while stopping service", &service, journal.Resource{
+		Type: resourceService,
+		Id:   c.server.Id,
+		Name: c.service.ArtifactId,
+	})
 	s := fmt.Sprintf("%s: %s %s, Done installing service on server %s.", c.scope, c.server.Name, c.service.ArtifactId, c.server.PublicDNS)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
+	return
 }
 
-func (c *sequence) SendScope() {
+func (c *sequence) SendScope() (err error) {
 	slackId, err := slack.SendBase(fmt.Sprintf("Created new scope: %s", c.scope))
 	if err != nil {
-		log.AddError(err).Fatal("While sending encrypted cert and login to slack")
+		return fail(resourceSlack, err, "While sending encrypted cert and login to slack")
 	}
 	encrypted, err := Encrypt(c.scope, c.vpc, c.key, c.securityGroup, slackId)
 	if err != nil {
-		log.AddError(err).Fatal("While encrypting data to send to slack")
+		return fail(resourceSlack, err, "While encrypting data to send to slack")
 	}
 	c.cryptData = encrypted
-	_, err = slack.SendFollowup(fmt.Sprintf("%s\n```%s```", c.key.PemName, encrypted), slackId)
+	_, err = slack.SendFollowup(fmt.Sprintf("%s, private key in secret %s", c.key.PemName, secret.KeyName(c.scope)), slackId)
 	if err != nil {
-		log.AddError(err).Fatal("While sending encrypted cert to slack")
+		return fail(resourceSlack, err, "While sending encrypted cert to slack")
 	}
+	return
 }
 
 //go:embed ssh_base.sh
 var fsSSH embed.FS
 
-func (c *sequence) SendLogin() {
+func (c *sequence) SendLogin() (err error) {
 	script, err := fsSSH.ReadFile("ssh_base.sh")
 	if err != nil {
-		log.AddError(err).Fatal("While reading in base ssh script")
+		return fail(resourceSlack, err, "While reading in base ssh script")
 	}
 	scripts := strings.ReplaceAll(string(script), "<url>", os.Getenv("url"))
-	scripts = strings.ReplaceAll(scripts, "<key>", c.key.Material)
+	scripts = strings.ReplaceAll(scripts, "<secret>", secret.KeyName(c.scope))
 	scripts = strings.ReplaceAll(scripts, "<server>", c.server.Name)
+	scripts = strings.ReplaceAll(scripts, "<scope>", c.scope)
 	_, err = slack.SendFollowupWFile(fmt.Sprintf("%s.sh", c.server.Name), fmt.Sprintf("%s\n`ssh ec2-user@%s -i %s`", c.server.Name, c.server.PublicDNS, c.key.PemName), c.slackId, []byte(scripts))
 	if err != nil {
-		log.AddError(err).Fatal("While sending new server login to slack")
+		return fail(resourceSlack, err, "While sending new server login to slack")
 	}
+	return
 }
 
-func (c *sequence) SendServiceOnServer() {
-	_, err := slack.SendFollowup(fmt.Sprintf("%s > %s", c.service.ArtifactId, c.server.Name), c.slackId)
+func (c *sequence) SendServiceOnServer() (err error) {
+	_, err = slack.SendFollowup(fmt.Sprintf("%s > %s", c.service.ArtifactId, c.server.Name), c.slackId)
 	if err != nil {
-		log.AddError(err).Fatal("While sending info about new service on server to slack")
+		return fail(resourceSlack, err, "While sending info about new service on server to slack")
 	}
+	return
 }
 
-func (c *sequence) SendDBSettup() {
-	_, err := slack.SendFollowup(fmt.Sprintf("> Database %s\n ```Endpoint: %s\nDatabase: %s\nUsername: %[3]s\nPassword: %s```", c.database.Name, c.database.Endpoint, c.database.Database, c.database.Password), c.slackId)
+func (c *sequence) SendDBSettup() (err error) {
+	_, err = slack.SendFollowup(fmt.Sprintf("> Database %s\n ```Endpoint: %s\nDatabase: %s\nUsername: %[3]s\nPassword: secret %s```", c.database.Name, c.database.Endpoint, c.database.Database, secret.DatabaseName(c.scope, c.database.Identifier)), c.slackId)
 	if err != nil {
-		log.AddError(err).Fatal("While sending database settup to slack")
+		return fail(resourceSlack, err, "While sending database settup to slack")
 	}
+	return
 }
 
 /*
@@ -655,23 +1267,25 @@ func (c *sequence) SendCertLogin() {
 */
 
 func (c *sequence) FinishedAllOpperations() {
+	if c.failure != nil {
+		return
+	}
 	s := fmt.Sprintf("%s: %s %s, Completed all operations for creating the new server %s.", c.scope, c.server.Name, c.service.ArtifactId, c.server.Name)
-	log.Info(s)
-	slack.SendStatus(s)
+	c.status(s)
 	//shouldCleanUp = true
 	return
 }
 
 func (seq *sequence) InstallOnServer() {
 	//Server
-	seq.WaitForELBRuleToBeHealthy()
-	seq.StartingServiceInstallation()
-	seq.VerifyServerSSH()
-	seq.UpdateServer()
-	seq.InstallPrograms()
-	seq.AddUser()
-	seq.InstallService()
-	seq.AddFilebeatService()
+	seq.step("WaitForELBRuleToBeHealthy", seq.WaitForELBRuleToBeHealthy)
+	seq.do("StartingServiceInstallation", seq.StartingServiceInstallation)
+	seq.do("VerifyServerSSH", seq.VerifyServerSSH)
+	seq.step("UpdateServer", seq.UpdateServer)
+	seq.step("InstallPrograms", seq.InstallPrograms)
+	seq.step("AddUser", seq.AddUser)
+	seq.step("InstallService", seq.InstallService)
+	seq.step("AddFilebeatService", seq.AddFilebeatService)
 }
 
 /*
@@ -0,0 +1,1568 @@
+package aws
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	elbv2types "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	databaselib "github.com/cantara/nerthus/aws/database"
+	"github.com/cantara/nerthus/aws/fake"
+	keylib "github.com/cantara/nerthus/aws/key"
+	loadbalancerlib "github.com/cantara/nerthus/aws/loadbalancer"
+	securitylib "github.com/cantara/nerthus/aws/security"
+	serverlib "github.com/cantara/nerthus/aws/server"
+	vpclib "github.com/cantara/nerthus/aws/vpc"
+	"github.com/cantara/nerthus/crypto"
+	"github.com/cantara/nerthus/secret"
+	servershlib "github.com/cantara/nerthus/server"
+	"github.com/cantara/nerthus/slack"
+)
+
+var errInjected = errors.New("injected failure")
+
+// TestMain sets up crypto for the scope keys in a temporary directory and replaces Slack with a server that accepts
+// everything.
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "nerthus-test")
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	err = os.Chdir(dir)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	err = setupCrypto()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	os.Setenv("ami", "ami-0123456789abcdef0")
+
+	slackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"ok":true,"ts":"1234567890.000100"}`)
+	}))
+	defer slackServer.Close()
+	slack.NewClientWithBaseurl(slackServer.URL, "token", "secret", "status", "commands")
+
+	ruleHealthyWait = 0
+	installationWait = 0
+	return m.Run()
+}
+
+func setupCrypto() (err error) {
+	aesKey := make([]byte, 32)
+	_, err = rand.Read(aesKey)
+	if err != nil {
+		return
+	}
+	os.Setenv("aeskey", base64.StdEncoding.EncodeToString(aesKey))
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(pk)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile("private.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return
+	}
+	return crypto.InitCrypto()
+}
+
+type fakes struct {
+	ec2     *fake.EC2
+	elb     *fake.ELB
+	rds     *fake.RDS
+	ssm     *fake.SSM
+	exec    *servershlib.FakeExecutor
+	secrets secret.File
+}
+
+func newFakeAWS() (AWS, fakes) {
+	f := fakes{
+		ec2:  fake.NewEC2(),
+		elb:  fake.NewELB(),
+		rds:  fake.NewRDS(),
+		ssm:  fake.NewSSM(),
+		exec: servershlib.NewFakeExecutor(),
+	}
+	f.ec2.AddImage(os.Getenv("ami"), ec2types.ArchitectureValuesX8664, 8, time.Now())
+	// A new server has neither java nor the service users, so the checks for them find nothing.
+	f.exec.Fail("yum list installed | grep zulu11\n", 1)
+	f.exec.Fail("cat /etc/passwd | grep", 1)
+	dir, err := os.MkdirTemp(".", "secrets")
+	if err != nil {
+		panic(err)
+	}
+	f.secrets, err = secret.NewFile(dir)
+	if err != nil {
+		panic(err)
+	}
+	c := NewWithClients(f.ec2, f.elb, f.rds).WithSSM(f.ssm).WithDialer(f.exec.Dialer()).WithSecrets(f.secrets)
+	c.SetNerthusIP(net.ParseIP(nerthusIP))
+	return c, f
+}
+
+// nerthusIP is the outbound ip of nerthus in the tests, new scopes allows ssh from it by default.
+const nerthusIP = "203.0.113.10"
+
+type scopeData struct {
+	scope     string
+	vpc       vpclib.VPC
+	key       keylib.Key
+	group     securitylib.Group
+	slackId   string
+	cryptData string
+}
+
+func createScope(t *testing.T, c AWS, scope string) (d scopeData) {
+	t.Helper()
+	return createScopeWithOptions(t, c, scope, ScopeOptions{})
+}
+
+func createScopeWithOptions(t *testing.T, c AWS, scope string, o ScopeOptions) (d scopeData) {
+	t.Helper()
+	cryptData, err := c.CreateScope(scope, o)
+	if err != nil {
+		t.Fatalf("CreateScope: %v", err)
+	}
+	d.scope, d.vpc, d.key, d.group, d.slackId, err = Decrypt(cryptData, &c)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	d.cryptData = cryptData
+	return
+}
+
+func addServer(t *testing.T, c AWS, d scopeData, name string) serverlib.Server {
+	t.Helper()
+	_, err := c.AddServerToScope(d.scope, name, serverlib.Sizing{}, serverlib.Placement{}, d.vpc, d.key, d.group, d.slackId)
+	if err != nil {
+		t.Fatalf("AddServerToScope: %v", err)
+	}
+	servers, err := serverlib.GetServers(d.scope, c.ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		if s.Name == name {
+			return s
+		}
+	}
+	t.Fatalf("server %s not found after AddServerToScope", name)
+	return serverlib.Server{}
+}
+
+func newService(t *testing.T, f fakes) Service {
+	t.Helper()
+	lbGroup, err := f.ec2.CreateSecurityGroup(t.Context(), &ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String("loadbalancer-sg"),
+		Description: aws.String("Loadbalancer"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, listenerARN := f.elb.AddLoadbalancer("loadbalancer", aws.ToString(lbGroup.GroupId), f.ec2.DefaultVPC())
+	return Service{
+		Port:             18080,
+		Path:             "inventory",
+		ArtifactId:       "inventory-api",
+		ELBListenerArn:   listenerARN,
+		ELBSecurityGroup: aws.ToString(lbGroup.GroupId),
+	}
+}
+
+func requireStep(t *testing.T, err error, step string) {
+	t.Helper()
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) {
+		t.Fatalf("expected a StepError, got %v", err)
+	}
+	if stepErr.Step != step {
+		t.Fatalf("expected step %s to fail, got %s: %v", step, stepErr.Step, err)
+	}
+	if !errors.Is(err, errInjected) {
+		t.Fatalf("expected the injected error, got %v", err)
+	}
+}
+
+func TestCreateScope(t *testing.T) {
+	c, _ := newFakeAWS()
+	d := createScope(t, c, "test")
+
+	k, err := keylib.GetKey("test", c.ec2)
+	if err != nil {
+		t.Fatalf("GetKey: %v", err)
+	}
+	if k.Id != d.key.Id {
+		t.Fatalf("key in crypt data %s does not match key pair %s", d.key.Id, k.Id)
+	}
+	material, err := c.GetSecret(secret.KeyName("test"))
+	if err != nil || !strings.Contains(material, "PRIVATE KEY") {
+		t.Fatalf("expected the private key in the secret store, got %v", err)
+	}
+	data, err := crypto.Decrypt(d.cryptData)
+	if err != nil || strings.Contains(string(data), "PRIVATE KEY") {
+		t.Fatalf("expected the crypt data to not have the private key, got %s %v", data, err)
+	}
+	groups, err := securitylib.GetGroups("test", c.ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || groups[0].Id != d.group.Id || !groups[0].IsScopeGroup() {
+		t.Fatalf("expected only the scope security group %s, got %v", d.group.Id, groups)
+	}
+	ingress, err := groups[0].GetIngress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nerthus, _ := securitylib.SSHIngress(nerthusIP)
+	if len(ingress) != 1 || !sameIngress(ingress[0], nerthus) || nerthus.Cidr != nerthusIP+"/32" {
+		t.Fatalf("expected only ssh from nerthus, got %v", ingress)
+	}
+}
+
+func TestCreateScopeRollback(t *testing.T) {
+	c, f := newFakeAWS()
+	f.ec2.Fail("AuthorizeSecurityGroupIngress", errInjected)
+
+	cryptData, err := c.CreateScope("test", ScopeOptions{})
+	requireStep(t, err, "CreateSecurityGroup")
+	if cryptData != "" {
+		t.Fatal("expected no crypt data from a failed sequence")
+	}
+	_, err = keylib.GetKey("test", c.ec2)
+	if !errors.Is(err, keylib.ErrNotFound) {
+		t.Fatalf("expected the key pair to be removed, got %v", err)
+	}
+	groups, err := securitylib.GetGroups("test", c.ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 0 {
+		t.Fatalf("expected the security group to be removed, got %v", groups)
+	}
+	_, err = c.GetSecret(secret.KeyName("test"))
+	if !errors.Is(err, secret.ErrNotFound) {
+		t.Fatalf("expected the key secret to be removed, got %v", err)
+	}
+}
+
+func TestUpdateSSHAccess(t *testing.T) {
+	c, _ := newFakeAWS()
+	d := createScopeWithOptions(t, c, "test", ScopeOptions{SSHSources: []string{"198.51.100.7"}})
+
+	access, err := c.GetSSHAccess(d.scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(access.Sources, []string{"198.51.100.7/32"}) {
+		t.Fatalf("expected ssh only from the provided source, got %v", access.Sources)
+	}
+
+	access, err = c.UpdateSSHAccess(d.scope, []string{"10.1.2.3/16", "pl-0123456789abcdef0", "2001:db8::1"}, []string{"198.51.100.7/32"}, "admin")
+	if err != nil {
+		t.Fatalf("UpdateSSHAccess: %v", err)
+	}
+	expected := []string{"10.1.0.0/16", "pl-0123456789abcdef0", "2001:db8::1/128"}
+	if !slices.Equal(access.Sources, expected) {
+		t.Fatalf("expected sources %v, got %v", expected, access.Sources)
+	}
+	groups, err := securitylib.GetGroups(d.scope, c.ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingress, err := groups[0].GetIngress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ingress) != len(expected) {
+		t.Fatalf("expected ingress from %v, got %v", expected, ingress)
+	}
+	report, err := c.CheckDrift(d.scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Drift) != 0 {
+		t.Fatalf("expected no drift, got %v", report.Drift)
+	}
+
+	_, err = c.UpdateSSHAccess(d.scope, []string{"not a cidr"}, nil, "admin")
+	if !errors.Is(err, securitylib.ErrInvalidSource) {
+		t.Fatalf("expected an invalid source, got %v", err)
+	}
+	_, err = c.GetSSHAccess("missing")
+	if !errors.Is(err, ErrScopeNotFound) {
+		t.Fatalf("expected the scope to not be found, got %v", err)
+	}
+}
+
+func TestRotateCryptData(t *testing.T) {
+	c, _ := newFakeAWS()
+	d := createScope(t, c, "test")
+	cryptData, err := Encrypt(d.scope, d.vpc, d.key, d.group, d.slackId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := os.Getenv("aeskey")
+	oldId, err := crypto.KeyIdOf(cryptData)
+	if err != nil || oldId != crypto.CurrentKeyId() {
+		t.Fatalf("expected the crypt data to have the current key id %s, got %s %v", crypto.CurrentKeyId(), oldId, err)
+	}
+	legacy := legacyEncrypt(t, oldKey, []byte("legacy"))
+	t.Cleanup(func() {
+		os.Setenv("aeskey", oldKey)
+		os.Setenv("aeskeys_previous", "")
+		crypto.UseKMS(nil, "")
+		crypto.InitCrypto()
+	})
+
+	newKey := make([]byte, 32)
+	rand.Read(newKey)
+	os.Setenv("aeskey", base64.StdEncoding.EncodeToString(newKey))
+	os.Setenv("aeskeys_previous", oldKey)
+	err = crypto.InitCrypto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scope, _, k, _, _, err := Decrypt(cryptData, &c)
+	if err != nil || scope != d.scope || k.Id != d.key.Id {
+		t.Fatalf("expected crypt data from the previous key to decrypt, got %s %v", scope, err)
+	}
+	data, err := crypto.Decrypt(legacy)
+	if err != nil || string(data) != "legacy" {
+		t.Fatalf("expected crypt data from before the envelope to decrypt, got %q %v", data, err)
+	}
+	rotated, err := crypto.Rotate(cryptData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := crypto.KeyIdOf(rotated)
+	if id != crypto.KeyId(newKey) {
+		t.Fatalf("expected rotated crypt data to have key id %s, got %s", crypto.KeyId(newKey), id)
+	}
+	oldKeyBytes, _ := base64.StdEncoding.DecodeString(oldKey)
+	// The ciphertext of a version 1 envelope is sealed like before the envelope, and is already base64 like json has it
+	v1 := envelope(t, map[string]any{
+		"v":   1,
+		"kid": crypto.KeyId(oldKeyBytes),
+		"ct":  legacy,
+	})
+	data, err = crypto.Decrypt(v1)
+	if err != nil || string(data) != "legacy" {
+		t.Fatalf("expected version 1 crypt data without authenticated header to decrypt, got %q %v", data, err)
+	}
+	_, err = crypto.Decrypt(rewriteEnvelope(t, rotated, "v", 1))
+	if err == nil {
+		t.Fatal("expected crypt data with a changed header to fail to decrypt")
+	}
+
+	os.Setenv("aeskeys_previous", "")
+	err = crypto.InitCrypto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = crypto.Decrypt(cryptData)
+	if !errors.Is(err, crypto.ErrUnknownKey) {
+		t.Fatalf("expected the removed key to be unknown, got %v", err)
+	}
+	scope, _, _, _, _, err = Decrypt(rotated, &c)
+	if err != nil || scope != d.scope {
+		t.Fatalf("expected rotated crypt data to decrypt, got %s %v", scope, err)
+	}
+
+	crypto.UseKMS(crypto.LocalKMS{}, crypto.LocalKMSKeyId())
+	sealed, err := crypto.Rotate(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ = crypto.KeyIdOf(sealed)
+	if id != crypto.LocalKMSKeyId() {
+		t.Fatalf("expected crypt data sealed with a kms data key, got key id %s", id)
+	}
+	scope, _, _, _, _, err = Decrypt(sealed, &c)
+	if err != nil || scope != d.scope {
+		t.Fatalf("expected kms crypt data to decrypt, got %s %v", scope, err)
+	}
+}
+
+// envelope returns crypt data in the envelope format with the fields.
+func envelope(t *testing.T, fields map[string]any) string {
+	t.Helper()
+	b, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "nerthus:" + base64.StdEncoding.EncodeToString(b)
+}
+
+// rewriteEnvelope returns the crypt data with a field of its envelope changed.
+func rewriteEnvelope(t *testing.T, cryptData, field string, value any) string {
+	t.Helper()
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(cryptData, "nerthus:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string]any)
+	err = json.Unmarshal(b, &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields[field] = value
+	return envelope(t, fields)
+}
+
+// legacyEncrypt seals data like crypt data was sealed before the envelope format, base64 of the nonce and ciphertext.
+func legacyEncrypt(t *testing.T, key string, data []byte) string {
+	t.Helper()
+	k, _ := base64.StdEncoding.DecodeString(key)
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, data, nil))
+}
+
+func TestAddServerToScope(t *testing.T) {
+	c, f := newFakeAWS()
+	d := createScope(t, c, "test")
+	s := addServer(t, c, d, "test-1")
+
+	if s.State != "running" || s.PublicDNS == "" || s.VolumeId == "" {
+		t.Fatalf("expected a running server with dns and volume, got %+v", s)
+	}
+	if !slices.Contains(f.exec.Hosts(), s.PublicDNS) || len(f.exec.Scripts()) == 0 {
+		t.Fatalf("expected scripts to be run on %s, got hosts %v", s.PublicDNS, f.exec.Hosts())
+	}
+	_, err := c.AddServerToScope(d.scope, "test-1", serverlib.Sizing{}, serverlib.Placement{}, d.vpc, d.key, d.group, d.slackId)
+	if !errors.Is(err, ErrNameNotAvailable) {
+		t.Fatalf("expected the server name to be taken, got %v", err)
+	}
+}
+
+func TestAddServerToScopeSSM(t *testing.T) {
+	c, f := newFakeAWS()
+	d := createScopeWithOptions(t, c, "test", ScopeOptions{Executor: securitylib.ExecutorSSM})
+	if !d.group.UsesSSM() {
+		t.Fatalf("expected the crypt data to say the scope uses ssm, got %q", d.group.Executor)
+	}
+	groups, err := securitylib.GetGroups(d.scope, c.ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || !groups[0].UsesSSM() {
+		t.Fatalf("expected the scope group to be tagged with ssm, got %v", groups)
+	}
+	ingress, err := groups[0].GetIngress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ingress) != 0 {
+		t.Fatalf("expected no ingress to a scope using ssm, got %v", ingress)
+	}
+
+	s := addServer(t, c, d, "test-1")
+	if !slices.Contains(f.exec.Hosts(), s.Id) || slices.Contains(f.exec.Hosts(), s.PublicDNS) {
+		t.Fatalf("expected scripts to be run on instance %s, got hosts %v", s.Id, f.exec.Hosts())
+	}
+	instances, err := f.ec2.DescribeInstances(t.Context(), &ec2.DescribeInstancesInput{InstanceIds: []string{s.Id}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := instances.Reservations[0].Instances[0].IamInstanceProfile
+	if profile == nil || !strings.HasSuffix(aws.ToString(profile.Arn), "/"+serverlib.InstanceProfile()) {
+		t.Fatalf("expected the server to have instance profile %s, got %v", serverlib.InstanceProfile(), profile)
+	}
+	report, err := c.CheckDrift(d.scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Drift) != 0 {
+		t.Fatalf("expected no drift, got %v", report.Drift)
+	}
+}
+
+func TestAddServerToScopeRollback(t *testing.T) {
+	c, f := newFakeAWS()
+	d := createScope(t, c, "test")
+	f.exec.Fail("filebeat", 1)
+
+	_, err := c.AddServerToScope(d.scope, "test-1", serverlib.Sizing{}, serverlib.Placement{}, d.vpc, d.key, d.group, d.slackId)
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != "InstallFilebeat" {
+		t.Fatalf("expected InstallFilebeat to fail, got %v", err)
+	}
+	servers, err := serverlib.GetServers(d.scope, c.ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 0 {
+		t.Fatalf("expected the server to be terminated, got %v", servers)
+	}
+	available, err := serverlib.NameAvailable("test-1", c.ec2)
+	if err != nil || !available {
+		t.Fatalf("expected the server name to be available after rollback, got %t %v", available, err)
+	}
+}
+
+func TestAddServerToScopeSizing(t *testing.T) {
+	c, f := newFakeAWS()
+	d := createScope(t, c, "test")
+	f.ec2.AddImage("ami-0fedcba9876543210", ec2types.ArchitectureValuesArm64, 30, time.Now())
+
+	invalid := []serverlib.Sizing{
+		{InstanceType: "x9.huge"},
+		{InstanceType: "t4g.small"},
+		{InstanceType: "t4g.small", AMI: "ami-0fedcba9876543210"},
+		{AMI: "ami-00000000000000000"},
+		{VolumeType: "io2"},
+		{VolumeIOPS: 100},
+		{DataVolumes: []serverlib.Volume{{Size: 100, Type: "sc1", IOPS: 3000}}},
+	}
+	for _, sizing := range invalid {
+		err := c.ValidateServerSizing(sizing, d.group)
+		if !errors.Is(err, serverlib.ErrInvalidSizing) {
+			t.Errorf("expected %+v to be invalid, got %v", sizing, err)
+		}
+	}
+	_, err := c.AddServerToScope(d.scope, "test-1", serverlib.Sizing{InstanceType: "x9.huge"}, serverlib.Placement{}, d.vpc, d.key, d.group, d.slackId)
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Step != "ValidateServerSizing" {
+		t.Fatalf("expected ValidateServerSizing to fail, got %v", err)
+	}
+	if slices.Contains(f.ec2.Calls(), "RunInstances") {
+		t.Fatal("expected no server to be launched with an invalid sizing")
+	}
+
+	sizing := serverlib.Sizing{
+		InstanceType: "t4g.small",
+		AMI:          "ami-0fedcba9876543210",
+		VolumeSize:   40,
+		VolumeType:   "io2",
+		VolumeIOPS:   5000,
+		DataVolumes:  []serverlib.Volume{{Size: 100}, {Size: 500, Type: "st1"}},
+	}
+	_, err = c.AddServerToScope(d.scope, "test-1", sizing, serverlib.Placement{}, d.vpc, d.key, d.group, d.slackId)
+	if err != nil {
+		t.Fatalf("AddServerToScope: %v", err)
+	}
+	servers, err := serverlib.GetServers(d.scope, c.ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 {
+		t.Fatalf("expected one server, got %v", servers)
+	}
+	s := servers[0]
+	if s.InstanceType != "t4g.small" || s.ImageId != "ami-0fedcba9876543210" || s.RootVolume != "40GiB io2 5000iops" ||
+		s.DataVolumes != "100GiB gp3, 500GiB st1" || len(s.Services) != 0 {
+		t.Fatalf("expected the server to have the requested sizing, got %+v", s)
+	}
+	volumes, err := f.ec2.DescribeVolumes(t.Context(), &ec2.DescribeVolumesInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes.Volumes) != 3 {
+		t.Fatalf("expected a root volume and two data volumes, got %d volumes", len(volumes.Volumes))
+	}
+}
+
+func TestAddServerToScopeAMIParameter(t *testing.T) {
+	c, f := newFakeAWS()
+	_, err := c.CreateScope("test", ScopeOptions{AMIParameter: "ubuntu"})
+	if !errors.Is(err, serverlib.ErrUnknownAMIParameter) {
+		t.Fatalf("expected the ami parameter to be unknown, got %v", err)
+	}
+	d := createScopeWithOptions(t, c, "test", ScopeOptions{AMIParameter: serverlib.AMIAmazonLinux2023})
+	if d.group.AMIParameter != serverlib.AMIAmazonLinux2023 {
+		t.Fatalf("expected the crypt data to have the ami parameter, got %q", d.group.AMIParameter)
+	}
+	x86 := "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-x86_64"
+	arm := "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-arm64"
+	f.ssm.SetParameter(x86, "ami-0aaaaaaaaaaaaaaaa")
+	f.ssm.SetParameter(arm, "ami-0bbbbbbbbbbbbbbbb")
+	f.ec2.AddImage("ami-0aaaaaaaaaaaaaaaa", ec2types.ArchitectureValuesX8664, 8, time.Now().Add(-40*24*time.Hour))
+	f.ec2.AddImage("ami-0bbbbbbbbbbbbbbbb", ec2types.ArchitectureValuesArm64, 8, time.Now())
+
+	s := addServer(t, c, d, "test-1")
+	if s.ImageId != "ami-0aaaaaaaaaaaaaaaa" || s.AMIParameter != x86 {
+		t.Fatalf("expected the ami from %s, got %s from %q", x86, s.ImageId, s.AMIParameter)
+	}
+	_, err = c.AddServerToScope(d.scope, "test-2", serverlib.Sizing{InstanceType: "t4g.small"}, serverlib.Placement{}, d.vpc, d.key, d.group, d.slackId)
+	if err != nil {
+		t.Fatalf("AddServerToScope: %v", err)
+	}
+	_, err = c.AddServerToScope(d.scope, "test-3", serverlib.Sizing{AMI: os.Getenv("ami")}, serverlib.Placement{}, d.vpc, d.key, d.group, d.slackId)
+	if err != nil {
+		t.Fatalf("AddServerToScope: %v", err)
+	}
+	servers, err := serverlib.GetServers(d.scope, c.ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	amis := make(map[string]string)
+	for _, s := range servers {
+		amis[s.Name] = s.ImageId + " " + s.AMIParameter
+	}
+	if amis["test-2"] != "ami-0bbbbbbbbbbbbbbbb "+arm || amis["test-3"] != os.Getenv("ami")+" " {
+		t.Fatalf("expected the arm64 ami on test-2 and the given ami on test-3, got %v", amis)
+	}
+
+	f.ssm.SetParameter(x86, "ami-0ccccccccccccccc0")
+	stale, err := c.GetStaleServers([]string{d.scope}, 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 1 || stale[0].Name != "test-1" || stale[0].AgeDays != 40 || stale[0].LatestAMI != "ami-0ccccccccccccccc0" {
+		t.Fatalf("expected test-1 to be stale with a newer ami available, got %+v", stale)
+	}
+	stale, err = c.GetStaleServers([]string{d.scope}, 50*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 0 {
+		t.Fatalf("expected no servers older than 50 days, got %+v", stale)
+	}
+}
+
+func TestAddServerToScopePlacement(t *testing.T) {
+	c, f := newFakeAWS()
+	d := createScope(t, c, "test")
+	if len(d.vpc.Subnets) != 3 || d.vpc.Id != f.ec2.DefaultVPC() {
+		t.Fatalf("expected the default subnets of the default vpc in the crypt data, got %+v", d.vpc)
+	}
+	for i := 1; i <= 4; i++ {
+		addServer(t, c, d, fmt.Sprintf("test-%d", i))
+	}
+	servers, err := serverlib.GetServers(d.scope, c.ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zones := make(map[string]string)
+	for _, s := range servers {
+		zones[s.Name] = s.AvailabilityZone
+	}
+	if zones["test-1"] != "eu-west-1a" || zones["test-2"] != "eu-west-1b" || zones["test-3"] != "eu-west-1c" ||
+		zones["test-4"] != "eu-west-1a" {
+		t.Fatalf("expected the servers round robin across the availability zones, got %v", zones)
+	}
+
+	vpcId := f.ec2.AddVPC("10.0.0.0/16")
+	a := f.ec2.AddSubnet(vpcId, "eu-west-1a", "10.0.0.0/24", true)
+	b := f.ec2.AddSubnet(vpcId, "eu-west-1b", "10.0.1.0/24", true)
+	private := f.ec2.AddSubnet(vpcId, "eu-west-1c", "10.0.2.0/24", false)
+	_, err = c.CreateScope("other", ScopeOptions{VPC: vpcId, Subnets: []string{a, d.vpc.Subnets[0].Id}})
+	if !errors.Is(err, vpclib.ErrInvalidSubnet) {
+		t.Fatalf("expected a subnet in another vpc to be invalid, got %v", err)
+	}
+	o := createScopeWithOptions(t, c, "other", ScopeOptions{VPC: vpcId})
+	if o.vpc.Id != vpcId || !slices.Equal(o.vpc.SubnetIds(), []string{a, b}) {
+		t.Fatalf("expected the public subnets of %s, got %+v", vpcId, o.vpc)
+	}
+	err = c.ValidateServerPlacement(serverlib.Placement{Subnet: private}, o.vpc)
+	if !errors.Is(err, serverlib.ErrInvalidPlacement) {
+		t.Fatalf("expected a subnet outside the scope to be invalid, got %v", err)
+	}
+	first := addServer(t, c, o, "other-1")
+	second := addServer(t, c, o, "other-2")
+	if first.SubnetId != a || second.SubnetId != b {
+		t.Fatalf("expected the servers in %s and %s, got %s and %s", a, b, first.SubnetId, second.SubnetId)
+	}
+	_, err = c.ec2.CreateTags(context.Background(), &ec2.CreateTagsInput{
+		Resources: []string{first.Id},
+		Tags:      []ec2types.Tag{{Key: aws.String("app"), Value: aws.String("other")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.AddServerToScope(o.scope, "other-3", serverlib.Sizing{}, serverlib.Placement{ArtifactId: "app"}, o.vpc, o.key, o.group, o.slackId)
+	if err != nil {
+		t.Fatalf("AddServerToScope: %v", err)
+	}
+	plan, err := c.PlanServer(o.scope, "other-4", serverlib.Sizing{}, serverlib.Placement{}, o.vpc, o.key, o.group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err = serverlib.GetServers(o.scope, c.ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		if s.Name == "other-3" && s.SubnetId != b {
+			t.Fatalf("expected other-3 away from the server running app, in %s, got %s", b, s.SubnetId)
+		}
+	}
+	if plan.Subnet != a || plan.AvailabilityZone != "eu-west-1a" {
+		t.Fatalf("expected the next server in %s, got %s in %s", a, plan.Subnet, plan.AvailabilityZone)
+	}
+}
+
+func TestCreateScopeVPC(t *testing.T) {
+	c, f := newFakeAWS()
+	shared := f.ec2.AddVPC("10.1.0.0/16", ec2types.Tag{Key: aws.String("Name"), Value: aws.String("shared")},
+		ec2types.Tag{Key: aws.String("team"), Value: aws.String("platform")})
+	f.ec2.AddSubnet(shared, "eu-west-1a", "10.1.0.0/24", true)
+	for _, ref := range []string{"shared", "team=platform"} {
+		v, err := vpclib.GetVPCByRef(ref, c.ec2)
+		if err != nil || v.Id != shared {
+			t.Fatalf("expected %s to be %s, got %+v %v", ref, shared, v, err)
+		}
+	}
+	d := createScopeWithOptions(t, c, "adopted", ScopeOptions{VPC: "shared"})
+	if d.vpc.Id != shared {
+		t.Fatalf("expected the scope in %s, got %s", shared, d.vpc.Id)
+	}
+
+	_, err := c.CreateScope("net", ScopeOptions{VPCCIDR: "10.2.0.0/16", VPC: shared})
+	if !errors.Is(err, vpclib.ErrInvalidNetwork) {
+		t.Fatalf("expected a vpc cidr with a vpc to be invalid, got %v", err)
+	}
+	plan, err := c.PlanScope("net", ScopeOptions{VPCCIDR: "10.2.0.0/16", NAT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Problems) != 0 || !slices.Equal(plan.Subnets, []string{"10.2.0.0/18 (eu-west-1a)", "10.2.64.0/18 (eu-west-1b)"}) ||
+		!slices.Contains(plan.Steps, "CreateVPC") {
+		t.Fatalf("expected a public subnet in two zones, got %+v", plan)
+	}
+	n := createScopeWithOptions(t, c, "net", ScopeOptions{VPCCIDR: "10.2.0.0/16", NAT: true})
+	network, err := vpclib.GetNetwork("net", c.ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.vpc.Id != network.VPC.Id || !slices.Equal(n.vpc.SubnetIds(), network.VPC.SubnetIds()) ||
+		!slices.Equal(n.vpc.AvailabilityZones(), []string{"eu-west-1a", "eu-west-1b"}) {
+		t.Fatalf("expected the scope in the public subnets of %+v, got %+v", network, n.vpc)
+	}
+	if len(network.PrivateSubnets) != 2 || network.InternetGatewayId == "" || network.NATGatewayId == "" ||
+		len(network.RouteTableIds) != 2 {
+		t.Fatalf("expected private subnets, an internet gateway, a nat gateway and two route tables, got %+v", network)
+	}
+	tagged, err := c.ec2.DescribeTags(t.Context(), &ec2.DescribeTagsInput{
+		Filters: []ec2types.Filter{{Name: aws.String("tag:Scope"), Values: []string{"net"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := make(map[ec2types.ResourceType]int)
+	for _, tag := range tagged.Tags {
+		types[tag.ResourceType]++
+	}
+	if types[ec2types.ResourceTypeVpc] != 1 || types[ec2types.ResourceTypeSubnet] != 4 ||
+		types[ec2types.ResourceTypeNatgateway] != 1 || types[ec2types.ResourceTypeElasticIp] != 1 {
+		t.Fatalf("expected the network to be tagged with the scope, got %v", types)
+	}
+	first := addServer(t, c, n, "net-1")
+	second := addServer(t, c, n, "net-2")
+	if first.SubnetId != n.vpc.Subnets[0].Id || second.SubnetId != n.vpc.Subnets[1].Id {
+		t.Fatalf("expected the servers spread across the public subnets, got %s and %s", first.SubnetId, second.SubnetId)
+	}
+	inv, err := c.GetInventory("net")
+	if err != nil || inv.Network == nil || inv.Network.VPC.Id != n.vpc.Id {
+		t.Fatalf("expected the network in the inventory, got %+v %v", inv.Network, err)
+	}
+	_, err = c.CreateDatabase(n.scope, "inventory-api", n.vpc, n.group, n.slackId)
+	if err != nil {
+		t.Fatalf("CreateDatabase: %v", err)
+	}
+	subnetGroup, err := databaselib.GetSubnetGroup("net", c.rds)
+	if err != nil || !slices.Equal(subnetGroup.SubnetIds, vpclib.VPC{Subnets: network.PrivateSubnets}.SubnetIds()) {
+		t.Fatalf("expected the database in the private subnets %v, got %+v %v", network.PrivateSubnets, subnetGroup, err)
+	}
+
+	err = c.DeleteScope("net")
+	if err != nil {
+		t.Fatalf("DeleteScope: %v", err)
+	}
+	_, err = vpclib.GetNetwork("net", c.ec2)
+	if !errors.Is(err, vpclib.ErrNotFound) {
+		t.Fatalf("expected the network to be deleted, got %v", err)
+	}
+	_, err = databaselib.GetSubnetGroup("net", c.rds)
+	if !errors.Is(err, databaselib.ErrSubnetGroupNotFound) {
+		t.Fatalf("expected the db subnet group to be deleted before the network, got %v", err)
+	}
+	addresses, err := c.ec2.DescribeAddresses(t.Context(), nil)
+	if err != nil || len(addresses.Addresses) != 0 {
+		t.Fatalf("expected the nat address to be released, got %v %v", addresses, err)
+	}
+	err = c.DeleteScope("adopted")
+	if err != nil {
+		t.Fatalf("DeleteScope: %v", err)
+	}
+	_, err = vpclib.GetVPCById(shared, c.ec2)
+	if err != nil {
+		t.Fatalf("expected the adopted vpc to be left alone, got %v", err)
+	}
+}
+
+func TestCreateScopeVPCRollback(t *testing.T) {
+	c, f := newFakeAWS()
+	f.ec2.Fail("CreateNatGateway", errInjected)
+	_, err := c.CreateScope("net", ScopeOptions{VPCCIDR: "10.2.0.0/16", NAT: true})
+	requireStep(t, err, "CreateVPC")
+	_, err = vpclib.GetNetwork("net", c.ec2)
+	if !errors.Is(err, vpclib.ErrNotFound) {
+		t.Fatalf("expected the partially created network to be deleted, got %v", err)
+	}
+	addresses, err := c.ec2.DescribeAddresses(t.Context(), nil)
+	if err != nil || len(addresses.Addresses) != 0 {
+		t.Fatalf("expected the nat address to be released, got %v %v", addresses, err)
+	}
+
+	f.ec2.Fail("CreateNatGateway", nil)
+	f.ec2.Fail("AuthorizeSecurityGroupIngress", errInjected)
+	_, err = c.CreateScope("net", ScopeOptions{VPCCIDR: "10.2.0.0/16", NAT: true})
+	requireStep(t, err, "CreateSecurityGroup")
+	_, err = vpclib.GetNetwork("net", c.ec2)
+	if !errors.Is(err, vpclib.ErrNotFound) {
+		t.Fatalf("expected the network to be deleted with the rest of the scope, got %v", err)
+	}
+}
+
+func TestCreateScopeWithoutDefaultVPC(t *testing.T) {
+	c, f := newFakeAWS()
+	f.ec2.RemoveDefaultVPC()
+	_, err := c.CreateScope("test", ScopeOptions{})
+	if !errors.Is(err, vpclib.ErrNotFound) {
+		t.Fatalf("expected the missing default vpc to be an error, got %v", err)
+	}
+	_, err = keylib.GetKey("test", c.ec2)
+	if !errors.Is(err, keylib.ErrNotFound) {
+		t.Fatalf("expected the key pair to be removed, got %v", err)
+	}
+	d := createScopeWithOptions(t, c, "test", ScopeOptions{VPCCIDR: "10.0.0.0/24", Zones: 3})
+	if len(d.vpc.Subnets) != 3 {
+		t.Fatalf("expected a subnet in each of three zones, got %+v", d.vpc)
+	}
+	addServer(t, c, d, "test-1")
+}
+
+func TestAddServiceToServer(t *testing.T) {
+	c, f := newFakeAWS()
+	d := createScope(t, c, "test")
+	s := addServer(t, c, d, "test-1")
+	service := newService(t, f)
+
+	_, err := c.AddServiceToServer(d.scope, s.Name, d.vpc, d.key, d.group, d.slackId, service)
+	if err != nil {
+		t.Fatalf("AddServiceToServer: %v", err)
+	}
+	exists, err := CheckIfServiceExcistsInScope(d.scope, service.ArtifactId, c.ec2)
+	if err != nil || !exists {
+		t.Fatalf("expected the service to be tagged in the scope, got %t %v", exists, err)
+	}
+	targetGroups, err := loadbalancerlib.GetTargetGroups(d.scope, c.elb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targetGroups) != 1 {
+		t.Fatalf("expected one target group, got %v", targetGroups)
+	}
+	targets, err := targetGroups[0].GetTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].ServerId != s.Id {
+		t.Fatalf("expected %s to be the only target, got %v", s.Id, targets)
+	}
+	rules, err := targetGroups[0].GetRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Priority != 1 {
+		t.Fatalf("expected one rule with priority 1, got %v", rules)
+	}
+	servers, err := serverlib.GetServers(d.scope, c.ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 || !slices.Contains(servers[0].Services, service.ArtifactId) {
+		t.Fatalf("expected the server to run %s, got %v", service.ArtifactId, servers)
+	}
+	report, err := c.CheckDrift(d.scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Drift) != 0 {
+		t.Fatalf("expected no drift, got %v", report.Drift)
+	}
+}
+
+func TestAddServiceToServerRollback(t *testing.T) {
+	c, f := newFakeAWS()
+	d := createScope(t, c, "test")
+	s := addServer(t, c, d, "test-1")
+	service := newService(t, f)
+	f.elb.Fail("CreateRule", errInjected)
+
+	_, err := c.AddServiceToServer(d.scope, s.Name, d.vpc, d.key, d.group, d.slackId, service)
+	requireStep(t, err, "AddRuleToListener")
+	targetGroups, err := loadbalancerlib.GetTargetGroups(d.scope, c.elb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targetGroups) != 0 {
+		t.Fatalf("expected the target group to be removed, got %v", targetGroups)
+	}
+	exists, err := CheckIfServiceExcistsInScope(d.scope, service.ArtifactId, c.ec2)
+	if err != nil || exists {
+		t.Fatalf("expected the service to not be tagged, got %t %v", exists, err)
+	}
+	servers, err := serverlib.GetServers(d.scope, c.ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 || servers[0].Id != s.Id {
+		t.Fatalf("expected the server to be left as it was, got %v", servers)
+	}
+}
+
+func TestAddServiceToServerWrongVPC(t *testing.T) {
+	c, f := newFakeAWS()
+	shared := f.ec2.AddVPC("10.1.0.0/16", ec2types.Tag{Key: aws.String("Name"), Value: aws.String("shared")})
+	f.ec2.AddSubnet(shared, "eu-west-1a", "10.1.0.0/24", true)
+	d := createScopeWithOptions(t, c, "test", ScopeOptions{VPC: "shared"})
+	s := addServer(t, c, d, "test-1")
+	service := newService(t, f)
+
+	plan, err := c.PlanService(d.scope, s.Name, d.vpc, d.key, d.group, service)
+	if err != nil || len(plan.Problems) != 1 {
+		t.Fatalf("expected the loadbalancer in another vpc to be a problem, got %+v %v", plan, err)
+	}
+	_, err = c.AddServiceToServer(d.scope, s.Name, d.vpc, d.key, d.group, d.slackId, service)
+	if !errors.Is(err, loadbalancerlib.ErrWrongVPC) {
+		t.Fatalf("expected the loadbalancer in another vpc to be refused, got %v", err)
+	}
+	targetGroups, err := loadbalancerlib.GetTargetGroups(d.scope, c.elb)
+	if err != nil || len(targetGroups) != 0 {
+		t.Fatalf("expected nothing to be created, got %v %v", targetGroups, err)
+	}
+	ingress, err := d.group.WithEC2(c.ec2).GetIngress()
+	if err != nil || slices.ContainsFunc(ingress, func(i securitylib.Ingress) bool {
+		return sameIngress(i, securitylib.LoadbalancerIngress(service.ELBSecurityGroup, service.Port))
+	}) {
+		t.Fatalf("expected no loadbalancer ingress, got %v %v", ingress, err)
+	}
+
+	m := Manifest{
+		Scope:   d.scope,
+		Servers: []ManifestServer{{Name: s.Name, Services: []Service{service}}},
+	}
+	_, err = c.PlanApply(m)
+	if !errors.Is(err, ErrInvalidManifest) || !errors.Is(err, loadbalancerlib.ErrWrongVPC) {
+		t.Fatalf("expected the manifest to be invalid, got %v", err)
+	}
+	m.Scope = "new"
+	_, err = c.PlanApply(m)
+	if err != nil {
+		t.Fatalf("expected a new scope in the default vpc to be valid, got %v", err)
+	}
+	m.VPCCIDR = "10.2.0.0/16"
+	_, err = c.PlanApply(m)
+	if !errors.Is(err, ErrInvalidManifest) {
+		t.Fatalf("expected services in a vpc that is not provisioned yet to be invalid, got %v", err)
+	}
+}
+
+func TestRemoveServiceFromServer(t *testing.T) {
+	c, f := newFakeAWS()
+	d := createScope(t, c, "test")
+	service := newService(t, f)
+	s1 := addServer(t, c, d, "test-1")
+	s2 := addServer(t, c, d, "test-2")
+	for _, s := range []serverlib.Server{s1, s2} {
+		_, err := c.AddServiceToServer(d.scope, s.Name, d.vpc, d.key, d.group, d.slackId, service)
+		if err != nil {
+			t.Fatalf("AddServiceToServer %s: %v", s.Name, err)
+		}
+	}
+	// The service user exists on the servers now
+	f.exec.Output("cat /etc/passwd | grep", "")
+
+	err := c.RemoveServiceFromServer(d.scope, s1.Name, service.ArtifactId, d.key, d.group)
+	if err != nil {
+		t.Fatalf("RemoveServiceFromServer %s: %v", s1.Name, err)
+	}
+	targetGroups, err := loadbalancerlib.GetTargetGroups(d.scope, c.elb)
+	if err != nil || len(targetGroups) != 1 {
+		t.Fatalf("expected the target group to stay while a server runs the service, got %v %v", targetGroups, err)
+	}
+	targets, err := targetGroups[0].GetTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].ServerId != s2.Id {
+		t.Fatalf("expected %s to be the only target left, got %v", s2.Id, targets)
+	}
+	ids, err := GetServerIdsWithServiceInScope(d.scope, service.ArtifactId, c.ec2)
+	if err != nil || !slices.Equal(ids, []string{s2.Id}) {
+		t.Fatalf("expected only %s to be tagged with the service, got %v %v", s2.Id, ids, err)
+	}
+
+	err = c.RemoveServiceFromServer(d.scope, s2.Name, service.ArtifactId, d.key, d.group)
+	if err != nil {
+		t.Fatalf("RemoveServiceFromServer %s: %v", s2.Name, err)
+	}
+	targetGroups, err = loadbalancerlib.GetTargetGroups(d.scope, c.elb)
+	if err != nil || len(targetGroups) != 0 {
+		t.Fatalf("expected the target group to be removed with the last server, got %v %v", targetGroups, err)
+	}
+	rules, err := f.elb.DescribeRules(t.Context(), &elbv2.DescribeRulesInput{
+		ListenerArn: aws.String(service.ELBListenerArn),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rules.Rules {
+		if !aws.ToBool(r.IsDefault) {
+			t.Fatalf("expected the listener rule to be removed with the last server, got %s", aws.ToString(r.RuleArn))
+		}
+	}
+	exists, err := CheckIfServiceExcistsInScope(d.scope, service.ArtifactId, c.ec2)
+	if err != nil || exists {
+		t.Fatalf("expected the service tag to be removed from the scope, got %t %v", exists, err)
+	}
+}
+
+func TestRemoveServerFromScopeLastHealthyTarget(t *testing.T) {
+	c, f := newFakeAWS()
+	d := createScope(t, c, "test")
+	service := newService(t, f)
+	s1 := addServer(t, c, d, "test-1")
+	s2 := addServer(t, c, d, "test-2")
+	for _, s := range []serverlib.Server{s1, s2} {
+		_, err := c.AddServiceToServer(d.scope, s.Name, d.vpc, d.key, d.group, d.slackId, service)
+		if err != nil {
+			t.Fatalf("AddServiceToServer %s: %v", s.Name, err)
+		}
+	}
+	targetGroups, err := loadbalancerlib.GetTargetGroups(d.scope, c.elb)
+	if err != nil || len(targetGroups) != 1 {
+		t.Fatalf("expected one target group, got %v %v", targetGroups, err)
+	}
+
+	f.elb.SetTargetHealth(targetGroups[0].ARN, s2.Id, elbv2types.TargetHealthStateEnumUnhealthy)
+	err = c.RemoveServerFromScope(d.scope, s1.Name, false)
+	if !errors.Is(err, ErrLastTarget) {
+		t.Fatalf("expected ErrLastTarget with the other target unhealthy, got %v", err)
+	}
+
+	f.elb.SetTargetHealth(targetGroups[0].ARN, s2.Id, elbv2types.TargetHealthStateEnumHealthy)
+	err = c.RemoveServerFromScope(d.scope, s1.Name, false)
+	if err != nil {
+		t.Fatalf("RemoveServerFromScope: %v", err)
+	}
+	targets, err := targetGroups[0].GetTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0].ServerId != s2.Id {
+		t.Fatalf("expected %s to be the only target left, got %v", s2.Id, targets)
+	}
+	err = c.CheckServerRemovable(d.scope, s2.Name)
+	if !errors.Is(err, ErrLastTarget) {
+		t.Fatalf("expected ErrLastTarget for the last target, got %v", err)
+	}
+}
+
+func TestCreateDatabase(t *testing.T) {
+	c, _ := newFakeAWS()
+	d := createScope(t, c, "test")
+
+	endpoint, err := c.CreateDatabase(d.scope, "inventory-api", d.vpc, d.group, d.slackId)
+	if err != nil {
+		t.Fatalf("CreateDatabase: %v", err)
+	}
+	databases, err := databaselib.GetDatabases(d.scope, c.rds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(databases) != 1 || databases[0].Endpoint != endpoint || endpoint == "" {
+		t.Fatalf("expected one database with endpoint %s, got %v", endpoint, databases)
+	}
+	password, err := c.GetSecret(secret.DatabaseName(d.scope, databases[0].Identifier))
+	if err != nil || password == "" {
+		t.Fatalf("expected the database password in the secret store, got %v", err)
+	}
+	subnetGroup, err := databaselib.GetSubnetGroup(d.scope, c.rds)
+	if err != nil || !slices.Equal(subnetGroup.SubnetIds, d.vpc.SubnetIds()) {
+		t.Fatalf("expected the database in the subnets of the scope %v, got %+v %v", d.vpc.SubnetIds(), subnetGroup, err)
+	}
+	instances, err := c.rds.DescribeDBInstances(t.Context(), &rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(databases[0].Identifier),
+	})
+	if err != nil || aws.ToString(instances.DBInstances[0].DBSubnetGroup.DBSubnetGroupName) != subnetGroup.Name ||
+		len(instances.DBInstances[0].VpcSecurityGroups) != 1 ||
+		aws.ToString(instances.DBInstances[0].VpcSecurityGroups[0].VpcSecurityGroupId) == d.group.Id {
+		t.Fatalf("expected the database in %s with the database security group, got %+v %v", subnetGroup.Name, instances, err)
+	}
+	groups, err := securitylib.GetGroups(d.scope, c.ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range groups {
+		if g.IsScopeGroup() {
+			continue
+		}
+		ingress, err := g.GetIngress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ingress) != 1 || !sameIngress(ingress[0], securitylib.DatabaseIngress(d.group.Id)) {
+			t.Fatalf("expected database ingress from %s, got %v", d.group.Id, ingress)
+		}
+		return
+	}
+	t.Fatal("expected a database security group")
+}
+
+func TestCreateDatabaseRollback(t *testing.T) {
+	c, f := newFakeAWS()
+	d := createScope(t, c, "test")
+	f.rds.Fail("CreateDBInstance", errInjected)
+
+	_, err := c.CreateDatabase(d.scope, "inventory-api", d.vpc, d.group, d.slackId)
+	requireStep(t, err, "CreateNewDatabase")
+	groups, err := securitylib.GetGroups(d.scope, c.ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || !groups[0].IsScopeGroup() {
+		t.Fatalf("expected the database security group to be removed, got %v", groups)
+	}
+	_, err = databaselib.GetSubnetGroup(d.scope, c.rds)
+	if !errors.Is(err, databaselib.ErrSubnetGroupNotFound) {
+		t.Fatalf("expected the db subnet group to be removed, got %v", err)
+	}
+}
+
+func TestDeleteScope(t *testing.T) {
+	c, f := newFakeAWS()
+	d := createScope(t, c, "test")
+	_, err := c.CreateDatabase(d.scope, "inventory-api", d.vpc, d.group, d.slackId)
+	if err != nil {
+		t.Fatalf("CreateDatabase: %v", err)
+	}
+
+	err = c.DeleteScope(d.scope)
+	if err != nil {
+		t.Fatalf("DeleteScope: %v", err)
+	}
+	names, err := f.secrets.List(secret.ScopePrefix(d.scope))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Fatalf("expected the secrets of the scope to be removed, got %v", names)
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	c, f := newFakeAWS()
+	d := createScope(t, c, "test")
+	scopes := []string{d.scope}
+
+	orphans, err := c.FindOrphans(scopes, 0)
+	if err != nil {
+		t.Fatalf("FindOrphans: %v", err)
+	}
+	if len(orphans) != 0 {
+		t.Fatalf("expected the key pair and security group of an empty scope to be owned, got %v", orphans)
+	}
+
+	_, err = f.ec2.DeleteSecurityGroup(t.Context(), &ec2.DeleteSecurityGroupInput{
+		GroupId: aws.String(d.group.Id),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphans, err = c.FindOrphans(scopes, time.Hour)
+	if err != nil {
+		t.Fatalf("FindOrphans: %v", err)
+	}
+	if len(orphans) != 1 || orphans[0].Resource != resourceKey || orphans[0].Created.IsZero() || orphans[0].Deletable {
+		t.Fatalf("expected a key pair newer than the grace period, got %v", orphans)
+	}
+	deleted, err := c.DeleteOrphans(scopes, 0, nil)
+	if err != nil {
+		t.Fatalf("DeleteOrphans: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0].Id != d.key.Id {
+		t.Fatalf("expected the key pair to be deleted, got %v", deleted)
+	}
+
+	tg, err := loadbalancerlib.NewTargetGroup(d.scope, "inventory", "inventory", 18080, d.vpc, c.elb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tg.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A target group created before the Created tag has no creation time
+	legacy, err := f.elb.CreateTargetGroup(t.Context(), &elbv2.CreateTargetGroupInput{
+		Name:  aws.String("test-legacy-tg"),
+		Port:  aws.Int32(18081),
+		VpcId: aws.String(d.vpc.Id),
+		Tags: []elbv2types.Tag{
+			{
+				Key:   aws.String("Scope"),
+				Value: aws.String(d.scope),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err = c.DeleteOrphans(scopes, 0, nil)
+	if err != nil {
+		t.Fatalf("DeleteOrphans: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0].Id != tg.ARN {
+		t.Fatalf("expected only the tagged target group to be deleted, got %v", deleted)
+	}
+	orphans, err = c.FindOrphans(scopes, 0)
+	if err != nil {
+		t.Fatalf("FindOrphans: %v", err)
+	}
+	if len(orphans) != 1 || orphans[0].Id != aws.ToString(legacy.TargetGroups[0].TargetGroupArn) || orphans[0].Deletable {
+		t.Fatalf("expected the untagged target group to be kept, got %v", orphans)
+	}
+}
+
+func planActions(p ApplyPlan) (actions []string) {
+	for _, action := range p.Actions {
+		actions = append(actions, action.String())
+	}
+	return
+}
+
+func serverNames(t *testing.T, c AWS, scope string) (names []string) {
+	t.Helper()
+	servers, err := serverlib.GetServers(scope, c.ec2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		names = append(names, s.Name)
+	}
+	slices.Sort(names)
+	return
+}
+
+func TestApplyPrune(t *testing.T) {
+	c, f := newFakeAWS()
+	d := createScope(t, c, "test")
+	service := newService(t, f)
+	s := addServer(t, c, d, "test-1")
+	addServer(t, c, d, "test-2")
+	_, err := c.AddServiceToServer(d.scope, s.Name, d.vpc, d.key, d.group, d.slackId, service)
+	if err != nil {
+		t.Fatalf("AddServiceToServer: %v", err)
+	}
+	f.exec.Output("cat /etc/passwd | grep", "")
+	m := Manifest{
+		Scope:   d.scope,
+		Key:     d.cryptData,
+		Servers: []ManifestServer{{Name: s.Name}},
+	}
+
+	p, err := c.PlanApply(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"service inventory-api on test-1", "server test-2"}
+	if len(p.Actions) != 0 || !slices.Equal(p.Unmanaged, expected) {
+		t.Fatalf("expected no actions and %v unmanaged without prune, got %v %v", expected, planActions(p), p.Unmanaged)
+	}
+
+	m.Prune = true
+	_, p, err = c.Apply(m)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	expected = []string{"remove_service inventory-api on test-1", "remove_server test-2"}
+	if !slices.Equal(planActions(p), expected) || len(p.Unmanaged) != 0 {
+		t.Fatalf("expected %v, got %v %v", expected, planActions(p), p.Unmanaged)
+	}
+	if names := serverNames(t, c, d.scope); !slices.Equal(names, []string{s.Name}) {
+		t.Fatalf("expected only %s to be left, got %v", s.Name, names)
+	}
+	exists, err := CheckIfServiceExcistsInScope(d.scope, service.ArtifactId, c.ec2)
+	if err != nil || exists {
+		t.Fatalf("expected the service to be removed from the scope, got %t %v", exists, err)
+	}
+	p, err = c.PlanApply(m)
+	if err != nil || len(p.Actions) != 0 {
+		t.Fatalf("expected the scope to be up to date with the manifest, got %v %v", planActions(p), err)
+	}
+}
+
+func TestApplyPruneKeepsDatabases(t *testing.T) {
+	c, _ := newFakeAWS()
+	d := createScope(t, c, "test")
+	_, err := c.CreateDatabase(d.scope, "inventory-api", d.vpc, d.group, d.slackId)
+	if err != nil {
+		t.Fatalf("CreateDatabase: %v", err)
+	}
+
+	_, p, err := c.Apply(Manifest{
+		Scope: d.scope,
+		Key:   d.cryptData,
+		Prune: true,
+	})
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	databases, err := databaselib.GetDatabases(d.scope, c.rds)
+	if err != nil || len(databases) != 1 {
+		t.Fatalf("expected the database to be kept, got %v %v", databases, err)
+	}
+	if len(p.Actions) != 0 || !slices.Equal(p.Unmanaged, []string{"database " + databases[0].Identifier}) {
+		t.Fatalf("expected the database to be listed as unmanaged, got %v %v", planActions(p), p.Unmanaged)
+	}
+}
+
+func TestApplyStopsAtFailure(t *testing.T) {
+	c, f := newFakeAWS()
+	d := createScope(t, c, "test")
+	service := newService(t, f)
+	addServer(t, c, d, "test-2")
+	f.elb.Fail("CreateRule", errInjected)
+
+	_, p, err := c.Apply(Manifest{
+		Scope: d.scope,
+		Key:   d.cryptData,
+		Prune: true,
+		Servers: []ManifestServer{{
+			Name:     "test-1",
+			Services: []Service{service},
+		}},
+	})
+	requireStep(t, err, "AddRuleToListener")
+	expected := []string{"add_server test-1", "add_service inventory-api on test-1", "remove_server test-2"}
+	if !slices.Equal(planActions(p), expected) {
+		t.Fatalf("expected %v, got %v", expected, planActions(p))
+	}
+	if names := serverNames(t, c, d.scope); !slices.Equal(names, []string{"test-1", "test-2"}) {
+		t.Fatalf("expected the apply to stop before removing test-2, got %v", names)
+	}
+}
+
+func TestPlanApplyCreatesScope(t *testing.T) {
+	c, _ := newFakeAWS()
+	d := createScope(t, c, "test")
+	m := Manifest{
+		Scope: d.scope,
+		Key:   d.cryptData,
+	}
+
+	p, err := c.PlanApply(m)
+	if err != nil || p.CreatesScope() {
+		t.Fatalf("expected the existing scope to not be created, got %v %v", planActions(p), err)
+	}
+	err = c.DeleteScope(d.scope)
+	if err != nil {
+		t.Fatalf("DeleteScope: %v", err)
+	}
+	p, err = c.PlanApply(m)
+	if err != nil || !p.CreatesScope() {
+		t.Fatalf("expected the deleted scope to be created even with its key, got %v %v", planActions(p), err)
+	}
+}
+
+func TestInventory(t *testing.T) {
+	c, f := newFakeAWS()
+	d := createScope(t, c, "test")
+	service := newService(t, f)
+	s := addServer(t, c, d, "test-1")
+	addServer(t, c, d, "test-2")
+	_, err := c.AddServiceToServer(d.scope, s.Name, d.vpc, d.key, d.group, d.slackId, service)
+	if err != nil {
+		t.Fatalf("AddServiceToServer: %v", err)
+	}
+	_, err = c.CreateDatabase(d.scope, "inventory-api", d.vpc, d.group, d.slackId)
+	if err != nil {
+		t.Fatalf("CreateDatabase: %v", err)
+	}
+	createScope(t, c, "other")
+
+	scopes, err := c.GetScopes()
+	if err != nil || !slices.Equal(scopes, []string{"other", "test"}) {
+		t.Fatalf("expected the scopes other and test, got %v %v", scopes, err)
+	}
+	inv, err := c.GetInventory(d.scope)
+	if err != nil {
+		t.Fatalf("GetInventory: %v", err)
+	}
+	if inv.KeyPair == nil || inv.KeyPair.Id != d.key.Id {
+		t.Fatalf("expected the key pair %s, got %v", d.key.Id, inv.KeyPair)
+	}
+	if len(inv.Servers) != 2 || inv.Servers[0].Name != "test-1" || inv.Servers[1].Name != "test-2" ||
+		!slices.Equal(inv.Servers[0].Services, []string{service.ArtifactId}) || len(inv.Servers[1].Services) != 0 {
+		t.Fatalf("expected test-1 running %s and test-2 running nothing, got %+v", service.ArtifactId, inv.Servers)
+	}
+	if len(inv.Services) != 1 || inv.Services[0].ArtifactId != service.ArtifactId ||
+		!slices.Equal(inv.Services[0].Servers, []string{s.Name}) || inv.Services[0].Port != service.Port ||
+		len(inv.Services[0].Targets) != 1 || inv.Services[0].Targets[0].ServerId != s.Id {
+		t.Fatalf("expected %s on %s with its target, got %+v", service.ArtifactId, s.Name, inv.Services)
+	}
+	if len(inv.Databases) != 1 || inv.Databases[0].Endpoint == "" {
+		t.Fatalf("expected one database, got %+v", inv.Databases)
+	}
+	servers, err := c.GetInventoryServers(d.scope)
+	if err != nil || !slices.EqualFunc(servers, inv.Servers, func(a, b InventoryServer) bool { return a.Id == b.Id }) {
+		t.Fatalf("expected the servers of the inventory, got %+v %v", servers, err)
+	}
+
+	_, err = c.GetInventory("missing")
+	if !errors.Is(err, ErrScopeNotFound) {
+		t.Fatalf("expected ErrScopeNotFound, got %v", err)
+	}
+}
+
+func requireDrift(t *testing.T, report DriftReport, expected ...Drift) {
+	t.Helper()
+	if len(report.Drift) != len(expected) {
+		t.Fatalf("expected %d drift, got %+v", len(expected), report.Drift)
+	}
+	for i, e := range expected {
+		got := report.Drift[i]
+		if got.Service != e.Service || got.Resource != e.Resource || got.Id != e.Id || got.Kind != e.Kind {
+			t.Fatalf("expected %+v, got %+v", e, got)
+		}
+	}
+}
+
+func TestCheckDrift(t *testing.T) {
+	c, f := newFakeAWS()
+	d := createScope(t, c, "test")
+	service := newService(t, f)
+	s := addServer(t, c, d, "test-1")
+	_, err := c.AddServiceToServer(d.scope, s.Name, d.vpc, d.key, d.group, d.slackId, service)
+	if err != nil {
+		t.Fatalf("AddServiceToServer: %v", err)
+	}
+	targetGroups, err := loadbalancerlib.GetTargetGroups(d.scope, c.elb)
+	if err != nil || len(targetGroups) != 1 {
+		t.Fatalf("expected one target group, got %v %v", targetGroups, err)
+	}
+	tg := targetGroups[0]
+	rules, err := tg.GetRules()
+	if err != nil || len(rules) != 1 {
+		t.Fatalf("expected one rule, got %v %v", rules, err)
+	}
+	other, err := f.ec2.CreateSecurityGroup(t.Context(), &ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String("other-loadbalancer-sg"),
+		Description: aws.String("Another loadbalancer"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherId := aws.ToString(other.GroupId)
+
+	// Any group is accepted on the port of a service, as the loadbalancer groups are not recorded.
+	err = d.group.AddLoadbalancerAuthorization(otherId, service.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := c.CheckDrift(d.scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireDrift(t, report)
+
+	err = d.group.AddLoadbalancerAuthorization(otherId, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.elb.SetRulePriority(rules[0].ARN, 7)
+	_, err = f.elb.DeregisterTargets(t.Context(), &elbv2.DeregisterTargetsInput{
+		TargetGroupArn: aws.String(tg.ARN),
+		Targets:        []elbv2types.TargetDescription{{Id: aws.String(s.Id)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.elb.RegisterTargets(t.Context(), &elbv2.RegisterTargetsInput{
+		TargetGroupArn: aws.String(tg.ARN),
+		Targets:        []elbv2types.TargetDescription{{Id: aws.String("i-0123456789abcdef0")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = c.CheckDrift(d.scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireDrift(t, report,
+		Drift{Service: service.ArtifactId, Resource: resourceRule, Id: rules[0].ARN, Kind: DriftChanged},
+		Drift{Service: service.ArtifactId, Resource: resourceTarget, Id: "i-0123456789abcdef0", Kind: DriftExtra},
+		Drift{Service: service.ArtifactId, Resource: resourceTarget, Id: s.Id, Kind: DriftMissing},
+		Drift{Resource: resourceSecurityGroup, Id: d.group.Id, Kind: DriftExtra},
+	)
+}
+
+func TestGetOrphanScopes(t *testing.T) {
+	c, _ := newFakeAWS()
+	d := createScope(t, c, "test")
+	tg, err := loadbalancerlib.NewTargetGroup("leftover", "inventory", "inventory", 18080, d.vpc, c.elb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tg.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scopes, err := c.GetOrphanScopes()
+	if err != nil || !slices.Equal(scopes, []string{"leftover", "test"}) {
+		t.Fatalf("expected the scope with only a target group to be found, got %v %v", scopes, err)
+	}
+	orphans, err := c.FindOrphans(scopes, 0)
+	if err != nil {
+		t.Fatalf("FindOrphans: %v", err)
+	}
+	if len(orphans) != 1 || orphans[0].Scope != "leftover" || orphans[0].Id != tg.ARN {
+		t.Fatalf("expected the target group to be an orphan, got %v", orphans)
+	}
+}
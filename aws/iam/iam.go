@@ -3,17 +3,18 @@ package main
 import (
 	"context"
 	"embed"
-	"fmt"
-	"github.com/joho/godotenv"
-	"log"
+	"errors"
 	"os"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/smithy-go"
+	log "github.com/cantara/bragi"
+	"github.com/joho/godotenv"
 )
 
-//go:embed nerthus_role.json nerthus_policy.json
+//go:embed nerthus_role.json nerthus_policy.json nerthus_server_role.json
 var fsFB embed.FS
 
 func main() {
@@ -30,16 +31,21 @@ func main() {
 	sess, err := config.LoadDefaultConfig(context.TODO(), opts...,
 	)
 	if err != nil {
-		log.Fatal("While creating aws session", err)
+		log.AddError(err).Fatal("While creating aws session")
 	}
 	script, err := fsFB.ReadFile("nerthus_role.json")
 	if err != nil {
-		log.Fatal("While reading in nerthus policy", err)
+		log.AddError(err).Fatal("While reading in nerthus role")
 		return
 	}
 	tmp := string(script)
-	fmt.Println(tmp)
+	log.Debug(tmp)
 	svc := iam.NewFromConfig(sess)
+	err = createServerProfile(svc)
+	if err != nil {
+		log.AddError(err).Fatal("While creating nerthus server profile")
+		return
+	}
 	inputRole := &iam.CreateRoleInput{
 		AssumeRolePolicyDocument: aws.String(tmp),
 		Path:                     aws.String("/"),
@@ -48,59 +54,129 @@ func main() {
 
 	resultRole, err := svc.CreateRole(context.Background(), inputRole)
 	if err != nil {
-		fmt.Println(err.Error())
+		log.AddError(err).Warning("While creating role ", aws.ToString(inputRole.RoleName))
 		return
 	}
-	fmt.Println(resultRole)
+	log.Info("Created role ", aws.ToString(resultRole.Role.Arn))
 
 	scriptPol, err := fsFB.ReadFile("nerthus_policy.json")
 	if err != nil {
-		log.Fatal("While reading in nerthus policy", err)
+		log.AddError(err).Fatal("While reading in nerthus policy")
 		return
 	}
 	tmpPol := string(scriptPol)
-	fmt.Println(tmpPol)
+	log.Debug(tmpPol)
 	inputPol := &iam.CreatePolicyInput{
 		PolicyDocument: aws.String(tmpPol),
 		PolicyName:     aws.String("Nerthus-Policy"),
 	}
 	resultPol, err := svc.CreatePolicy(context.Background(), inputPol)
 	if err != nil {
-		fmt.Println(err.Error())
+		log.AddError(err).Warning("While creating policy ", aws.ToString(inputPol.PolicyName))
+		return
 	}
-
-	fmt.Println(resultPol)
+	log.Info("Created policy ", aws.ToString(resultPol.Policy.Arn))
 
 	inputAttach := &iam.AttachRolePolicyInput{
 		PolicyArn: resultPol.Policy.Arn,
 		RoleName:  inputRole.RoleName,
 	}
 
-	resultAttach, err := svc.AttachRolePolicy(context.Background(), inputAttach)
+	_, err = svc.AttachRolePolicy(context.Background(), inputAttach)
 	if err != nil {
-		fmt.Println(err.Error())
+		log.AddError(err).Warning("While attaching policy to role ", aws.ToString(inputRole.RoleName))
 		return
 	}
-	fmt.Println(resultAttach)
+	log.Info("Attached policy ", aws.ToString(inputAttach.PolicyArn), " to role ", aws.ToString(inputRole.RoleName))
 
 	inputProfile := &iam.CreateInstanceProfileInput{
 		InstanceProfileName: aws.String("Nerthus"),
 	}
-	resultProfile, err := svc.CreateInstanceProfile(context.Background(), inputProfile)
+	_, err = svc.CreateInstanceProfile(context.Background(), inputProfile)
 	if err != nil {
-		fmt.Println(err.Error())
+		log.AddError(err).Warning("While creating instance profile ", aws.ToString(inputProfile.InstanceProfileName))
+	} else {
+		log.Info("Created instance profile ", aws.ToString(inputProfile.InstanceProfileName))
 	}
 
-	fmt.Println(resultProfile)
-
 	inputAdd := &iam.AddRoleToInstanceProfileInput{
 		InstanceProfileName: inputProfile.InstanceProfileName,
 		RoleName:            inputRole.RoleName,
 	}
-	result, err := svc.AddRoleToInstanceProfile(context.Background(), inputAdd)
+	_, err = svc.AddRoleToInstanceProfile(context.Background(), inputAdd)
 	if err != nil {
-		fmt.Println(err.Error())
+		log.AddError(err).Warning("While adding role ", aws.ToString(inputRole.RoleName), " to instance profile ",
+			aws.ToString(inputProfile.InstanceProfileName))
+		return
+	}
+	log.Info("Added role ", aws.ToString(inputRole.RoleName), " to instance profile ",
+		aws.ToString(inputProfile.InstanceProfileName))
+}
+
+// createServerProfile creates the instance profile servers in scopes using ssm are created with, so that the ssm agent
+// on them can register. What already exists is kept, so it can be run again to finish a profile that was only partly
+// created.
+func createServerProfile(svc *iam.Client) (err error) {
+	script, err := fsFB.ReadFile("nerthus_server_role.json")
+	if err != nil {
+		return
+	}
+	roleName := aws.String("Nerthus-Server")
+	profileName := aws.String("Nerthus-Server")
+	_, err = svc.CreateRole(context.Background(), &iam.CreateRoleInput{
+		AssumeRolePolicyDocument: aws.String(string(script)),
+		Path:                     aws.String("/"),
+		RoleName:                 roleName,
+	})
+	if err = createdOrExists(err, "role ", *roleName); err != nil {
+		return
 	}
 
-	fmt.Println(result)
+	_, err = svc.AttachRolePolicy(context.Background(), &iam.AttachRolePolicyInput{
+		PolicyArn: aws.String("arn:aws:iam::aws:policy/AmazonSSMManagedInstanceCore"),
+		RoleName:  roleName,
+	})
+	if err != nil {
+		return
+	}
+	log.Info("Attached AmazonSSMManagedInstanceCore to role ", *roleName)
+
+	_, err = svc.CreateInstanceProfile(context.Background(), &iam.CreateInstanceProfileInput{
+		InstanceProfileName: profileName,
+	})
+	if err = createdOrExists(err, "instance profile ", *profileName); err != nil {
+		return
+	}
+
+	_, err = svc.AddRoleToInstanceProfile(context.Background(), &iam.AddRoleToInstanceProfileInput{
+		InstanceProfileName: profileName,
+		RoleName:            roleName,
+	})
+	if isErrorCode(err, "LimitExceeded") {
+		// An instance profile holds a single role, so this is the role being in it already.
+		log.Info("Instance profile ", *profileName, " already has a role")
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	log.Info("Added role ", *roleName, " to instance profile ", *profileName)
+	return
+}
+
+// createdOrExists logs what was created and treats EntityAlreadyExists as success.
+func createdOrExists(err error, kind, name string) error {
+	if isErrorCode(err, "EntityAlreadyExists") {
+		log.Info("Found existing ", kind, name)
+		return nil
+	}
+	if err == nil {
+		log.Info("Created ", kind, name)
+	}
+	return err
+}
+
+func isErrorCode(err error, code string) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == code
 }
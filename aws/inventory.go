@@ -0,0 +1,239 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	databaselib "github.com/cantara/nerthus/aws/database"
+	keylib "github.com/cantara/nerthus/aws/key"
+	loadbalancerlib "github.com/cantara/nerthus/aws/loadbalancer"
+	securitylib "github.com/cantara/nerthus/aws/security"
+	serverlib "github.com/cantara/nerthus/aws/server"
+	"github.com/cantara/nerthus/aws/util"
+	vpclib "github.com/cantara/nerthus/aws/vpc"
+)
+
+var ErrScopeNotFound = errors.New("scope not found")
+
+// Inventory is what is deployed in a scope, reconstructed from the Scope, Name and per artifact tags.
+type Inventory struct {
+	Scope          string              `json:"scope"`
+	KeyPair        *keylib.Key         `json:"key_pair,omitempty"`
+	SecurityGroups []securitylib.Group `json:"security_groups"`
+	Servers        []InventoryServer   `json:"servers"`
+	Services       []InventoryService  `json:"services"`
+	Databases      []InventoryDatabase `json:"databases"`
+	Network        *vpclib.Network     `json:"network,omitempty"`
+}
+
+type InventoryServer struct {
+	Name         string   `json:"name"`
+	Id           string   `json:"id"`
+	State        string   `json:"state"`
+	PublicDNS    string   `json:"public_dns"`
+	InstanceType string   `json:"instance_type"`
+	ImageId      string   `json:"image_id"`
+	RootVolume   string   `json:"root_volume,omitempty"`
+	DataVolumes  string   `json:"data_volumes,omitempty"`
+	Subnet       string   `json:"subnet,omitempty"`
+	Zone         string   `json:"availability_zone,omitempty"`
+	Services     []string `json:"services"`
+}
+
+// InventoryService is a service in the scope with the servers tagged as running it and the health of the targets in its
+// target group.
+type InventoryService struct {
+	ArtifactId     string                   `json:"artifact_id"`
+	Servers        []string                 `json:"servers"`
+	TargetGroup    string                   `json:"target_group,omitempty"`
+	TargetGroupARN string                   `json:"target_group_arn,omitempty"`
+	Path           string                   `json:"path,omitempty"`
+	Port           int                      `json:"port,omitempty"`
+	Targets        []loadbalancerlib.Target `json:"targets"`
+}
+
+type InventoryDatabase struct {
+	Identifier string `json:"identifier"`
+	Database   string `json:"database"`
+	Endpoint   string `json:"endpoint"`
+	Status     string `json:"status"`
+	ARN        string `json:"arn"`
+}
+
+// GetScopes returns the name of every scope that has ec2 resources tagged with it.
+func (c AWS) GetScopes() (scopes []string, err error) {
+	err = util.CheckEC2Session(c.ec2)
+	if err != nil {
+		return
+	}
+	found := make(map[string]bool)
+	first := true
+	var nextToken *string
+	for nextToken != nil || first {
+		first = false
+		result, err := c.ec2.DescribeTags(context.Background(), &ec2.DescribeTagsInput{
+			Filters: []ec2types.Filter{
+				{
+					Name: aws.String("key"),
+					Values: []string{
+						"Scope",
+					},
+				},
+			},
+			NextToken: nextToken,
+		})
+		if err != nil {
+			return nil, err
+		}
+		nextToken = result.NextToken
+		for _, tag := range result.Tags {
+			found[aws.ToString(tag.Value)] = true
+		}
+	}
+	scopes = sortedKeys(found)
+	return
+}
+
+// GetInventory returns everything deployed in the scope, ErrScopeNotFound is returned when nothing is tagged with it.
+func (c AWS) GetInventory(scope string) (inv Inventory, err error) {
+	inv = Inventory{
+		Scope: scope,
+	}
+	k, err := keylib.GetKey(scope, c.ec2)
+	if err == nil {
+		inv.KeyPair = &k
+	} else if !errors.Is(err, keylib.ErrNotFound) {
+		return
+	}
+	inv.SecurityGroups, err = securitylib.GetGroups(scope, c.ec2)
+	if err != nil {
+		return
+	}
+	live, err := serverlib.GetServers(scope, c.ec2)
+	if err != nil {
+		return
+	}
+	inv.Servers = inventoryServers(live)
+	inv.Services, err = c.inventoryServices(scope, live)
+	if err != nil {
+		return
+	}
+	databases, err := databaselib.GetDatabases(scope, c.rds)
+	if err != nil {
+		return
+	}
+	inv.Databases = []InventoryDatabase{}
+	for _, d := range databases {
+		inv.Databases = append(inv.Databases, InventoryDatabase{
+			Identifier: d.Identifier,
+			Database:   d.Database,
+			Endpoint:   d.Endpoint,
+			Status:     d.Status,
+			ARN:        d.ARN,
+		})
+	}
+	network, err := vpclib.GetNetwork(scope, c.ec2)
+	if err == nil {
+		inv.Network = &network
+	} else if !errors.Is(err, vpclib.ErrNotFound) {
+		return
+	}
+	err = nil
+	if inv.KeyPair == nil && len(inv.SecurityGroups) == 0 && len(inv.Servers) == 0 && len(inv.Databases) == 0 &&
+		inv.Network == nil {
+		err = fmt.Errorf("%w: %s", ErrScopeNotFound, scope)
+	}
+	return
+}
+
+// GetInventoryServers returns the servers in the scope that are not terminated.
+func (c AWS) GetInventoryServers(scope string) (servers []InventoryServer, err error) {
+	live, err := serverlib.GetServers(scope, c.ec2)
+	if err != nil {
+		return
+	}
+	servers = inventoryServers(live)
+	return
+}
+
+func inventoryServers(live []serverlib.Server) (servers []InventoryServer) {
+	servers = []InventoryServer{}
+	for _, s := range live {
+		services := s.Services
+		if services == nil {
+			services = []string{}
+		}
+		sort.Strings(services)
+		servers = append(servers, InventoryServer{
+			Name:         s.Name,
+			Id:           s.Id,
+			State:        s.State,
+			PublicDNS:    s.PublicDNS,
+			InstanceType: s.InstanceType,
+			ImageId:      s.ImageId,
+			RootVolume:   s.RootVolume,
+			DataVolumes:  s.DataVolumes,
+			Subnet:       s.SubnetId,
+			Zone:         s.AvailabilityZone,
+			Services:     services,
+		})
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Name < servers[j].Name
+	})
+	return
+}
+
+// GetInventoryServices returns the services tagged on the servers in the scope together with their target groups.
+func (c AWS) GetInventoryServices(scope string) (services []InventoryService, err error) {
+	live, err := serverlib.GetServers(scope, c.ec2)
+	if err != nil {
+		return
+	}
+	return c.inventoryServices(scope, live)
+}
+
+func (c AWS) inventoryServices(scope string, live []serverlib.Server) (services []InventoryService, err error) {
+	servers := make(map[string][]string)
+	for _, s := range live {
+		for _, service := range s.Services {
+			servers[service] = append(servers[service], s.Name)
+		}
+	}
+	targetGroups, err := loadbalancerlib.GetTargetGroups(scope, c.elb)
+	if err != nil {
+		return
+	}
+	byName := make(map[string]loadbalancerlib.TargetGroup)
+	for _, tg := range targetGroups {
+		byName[tg.Name] = tg
+	}
+	services = []InventoryService{}
+	for _, artifactId := range sortedKeys(servers) {
+		service := InventoryService{
+			ArtifactId: artifactId,
+			Servers:    servers[artifactId],
+			Targets:    []loadbalancerlib.Target{},
+		}
+		sort.Strings(service.Servers)
+		name, nameErr := loadbalancerlib.TargetGroupName(scope, artifactId)
+		if tg, ok := byName[name]; nameErr == nil && ok {
+			service.TargetGroup = tg.Name
+			service.TargetGroupARN = tg.ARN
+			service.Path = tg.UriPath
+			service.Port = tg.Port
+			targets, err := tg.GetTargets()
+			if err != nil {
+				return nil, err
+			}
+			service.Targets = append(service.Targets, targets...)
+		}
+		services = append(services, service)
+	}
+	return
+}
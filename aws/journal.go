@@ -0,0 +1,383 @@
+package aws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/cantara/bragi"
+	databaselib "github.com/cantara/nerthus/aws/database"
+	keylib "github.com/cantara/nerthus/aws/key"
+	loadbalancerlib "github.com/cantara/nerthus/aws/loadbalancer"
+	securitylib "github.com/cantara/nerthus/aws/security"
+	serverlib "github.com/cantara/nerthus/aws/server"
+	"github.com/cantara/nerthus/aws/tag"
+	vpclib "github.com/cantara/nerthus/aws/vpc"
+	"github.com/cantara/nerthus/journal"
+	"github.com/cantara/nerthus/secret"
+	servershlib "github.com/cantara/nerthus/server"
+)
+
+const (
+	operationCreateScope    = "create_scope"
+	operationAddServer      = "add_server"
+	operationAddService     = "add_service"
+	operationCreateDatabase = "create_database"
+)
+
+const (
+	resourceKey             = "key"
+	resourceVPC             = "vpc"
+	resourceNetwork         = "network"
+	resourceSecurityGroup   = "security_group"
+	resourceDBSecurityGroup = "db_security_group"
+	resourceDBSubnetGroup   = "db_subnet_group"
+	resourceServer          = "server"
+	resourceTargetGroup     = "target_group"
+	resourceTarget          = "target"
+	resourceRule            = "rule"
+	resourceTag             = "tag"
+	resourceDatabase        = "database"
+	resourceSecret          = "secret"
+	resourceFilebeat        = "filebeat"
+	resourceJava            = "java"
+	resourceUser            = "user"
+	resourceService         = "service"
+	resourceFilebeatService = "filebeat_service"
+)
+
+// OpenJournal starts a new journal for the sequence, or continues the provided one by restoring the resources it has recorded.
+func (c *sequence) OpenJournal(j *journal.Journal, operation string, args map[string]string) {
+	if c.failure != nil {
+		return
+	}
+	if j != nil {
+		c.journal = j
+		err := c.restore()
+		if err != nil {
+			c.failure = &StepError{
+				Step:  "RestoreJournal",
+				Cause: fmt.Errorf("while restoring sequence from journal %s: %w", j.Id, err),
+			}
+			return
+		}
+		c.job.SetJournal(j.Id)
+		c.status(fmt.Sprintf("%s: Resuming %s from journal %s.", c.scope, operation, j.Id))
+		return
+	}
+	args["scope"] = c.scope
+	if c.key.Name != "" {
+		cryptData, err := Encrypt(c.scope, c.vpc, c.key, c.securityGroup, c.slackId)
+		if err != nil {
+			log.AddError(err).Warning("While encrypting scope data for journal")
+		}
+		args["key"] = cryptData
+	}
+	j, err := journal.New(operation, c.scope, args)
+	if err != nil {
+		log.AddError(err).Warning("While creating journal, continuing without it")
+		return
+	}
+	c.journal = j
+	c.job.SetJournal(j.Id)
+}
+
+func (c *sequence) CloseJournal(status journal.Status) {
+	err := c.journal.Finish(status, c.failure)
+	if err != nil {
+		log.AddError(err).Warning("While finishing journal")
+	}
+}
+
+// restore reads the resources recorded in the journal back into the sequence and pushes their deleters,
+// so that a failure after a restore cleans up everything the journal has created.
+func (c *sequence) restore() (err error) {
+	var errs []error
+	serverCreated := false
+	for _, r := range c.journal.Resources {
+		if r.Removed {
+			continue
+		}
+		err := c.restoreResource(r, serverCreated)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s: %w", r.Type, r.Id, err))
+			continue
+		}
+		if r.Type == resourceServer {
+			serverCreated = true
+		}
+	}
+	if c.server.PublicDNS != "" {
+		c.serversh, _ = remote(c.server, c.key, c.securityGroup, c.dial, c.ssm, c.secrets)
+	}
+	return errors.Join(errs...)
+}
+
+func (c *sequence) restoreResource(r journal.Resource, serverCreated bool) (err error) {
+	switch r.Type {
+	case resourceKey:
+		k, err := keylib.GetKey(c.scope, c.ec2)
+		if err != nil {
+			return err
+		}
+		k.Material, err = journal.FromSecret(r.Properties["material"])
+		if err != nil {
+			return err
+		}
+		c.key = k
+		c.PemName = k.PemName
+		c.pushCleanup("Key pair", "while deleting created key pair", &k, r)
+	case resourceVPC:
+		c.vpc = vpclib.VPC{Id: r.Id}
+		if ids := strings.Fields(r.Properties["subnets"]); len(ids) > 0 {
+			c.vpc.Subnets, err = vpclib.GetSubnets(r.Id, ids, c.ec2)
+		}
+	case resourceNetwork:
+		n, err := vpclib.GetNetwork(c.scope, c.ec2)
+		if err != nil {
+			return err
+		}
+		c.network = n
+		c.vpc = n.VPC
+		c.pushCleanup("VPC", "while deleting created vpc", &n, r)
+	case resourceSecurityGroup, resourceDBSecurityGroup:
+		g, err := securitylib.GetGroup(r.Id, c.ec2)
+		if err != nil {
+			return err
+		}
+		g.Scope = c.scope
+		if r.Type == resourceSecurityGroup {
+			c.securityGroup = g
+		} else {
+			c.dbSecurityGroup = g
+		}
+		c.pushCleanup("Security group", "while deleting created security group", &g, r)
+	case resourceServer:
+		s, err := serverlib.GetServerById(r.Id, c.key, c.securityGroup, c.ec2)
+		if err != nil {
+			return err
+		}
+		c.server = s
+		c.pushCleanup("Server", "while deleting created server", &s, r)
+	case resourceTargetGroup:
+		tg, err := loadbalancerlib.GetTargetGroupByARN(r.Id, c.elb)
+		if err != nil {
+			return err
+		}
+		tg.Scope = c.scope
+		c.targetGroup = tg
+		c.pushCleanup("Target group", "while deleting created target group", &tg, r)
+	case resourceTarget:
+		tg := c.targetGroup
+		if tg.ARN != r.Properties["target_group_arn"] {
+			tg, err = loadbalancerlib.GetTargetGroupByARN(r.Properties["target_group_arn"], c.elb)
+			if err != nil {
+				return
+			}
+		}
+		t, err := loadbalancerlib.GetTarget(tg, r.Id, c.elb)
+		if err != nil {
+			return err
+		}
+		c.pushCleanup("Target in targetgroup", "while removing registered target from targetgroup", &t, r)
+	case resourceRule:
+		rule, err := loadbalancerlib.GetRule(r.Id, c.elb)
+		if err != nil {
+			return err
+		}
+		c.rule = rule
+		c.pushCleanup("Rule", "while removing rule added to loadbalancer", &rule, r)
+	case resourceTag:
+		p := r.Properties
+		if p["target_group_arn"] != "" {
+			t, err := tag.GetNewTag(r.Id, c.scope, p["key_id"], p["security_group_id"], p["server_id"], p["volume_id"],
+				p["network_interface_id"], p["image_id"], p["target_group_arn"], p["rule_arn"], p["listener_arn"],
+				p["loadbalancer_arn"], c.ec2, c.elb)
+			if err != nil {
+				return err
+			}
+			c.pushCleanup("Tag", "while removing tag added to all resources used by service", &t, r)
+			return nil
+		}
+		t, err := tag.GetAddTag(r.Id, c.scope, p["server_id"], p["network_interface_id"], p["volume_id"], p["image_id"], c.ec2)
+		if err != nil {
+			return err
+		}
+		c.pushCleanup("Tag", "while removing tag added to resources used by the additional service", &t, r)
+	case resourceDBSubnetGroup:
+		g, err := databaselib.GetSubnetGroup(c.scope, c.rds)
+		if err != nil {
+			return err
+		}
+		c.pushCleanup("DB subnet group", "while deleting created db subnet group", &g, r)
+	case resourceDatabase:
+		d, err := databaselib.GetDatabase(r.Id, c.rds)
+		if err != nil {
+			return err
+		}
+		d.Password, err = journal.FromSecret(r.Properties["password"])
+		if err != nil {
+			return err
+		}
+		c.database = d
+		c.pushCleanup("Database", "while deleting created database", &d, r)
+	case resourceSecret:
+		s := secret.New(r.Id, c.secrets)
+		s.Ref = r.Name
+		c.pushCleanup("Secret", "while deleting created secret", &s, r)
+	case resourceFilebeat:
+		// Filebeat can not be removed from a server, the server is terminated instead.
+	case resourceJava, resourceUser, resourceService, resourceFilebeatService:
+		if serverCreated {
+			// Everything installed on a server created by the sequence is removed with the server.
+			return
+		}
+		return c.restoreOnServer(r)
+	default:
+		err = fmt.Errorf("unknown resource type %s", r.Type)
+	}
+	return
+}
+
+func (c *sequence) restoreOnServer(r journal.Resource) (err error) {
+	serversh, err := remote(c.server, c.key, c.securityGroup, c.dial, c.ssm, c.secrets)
+	if err != nil {
+		return
+	}
+	switch r.Type {
+	case resourceJava:
+		java, err := servershlib.GetJava(servershlib.JAVA_ONE_ELEVEN, serversh)
+		if err != nil {
+			return err
+		}
+		c.pushCleanup("Java from server", "while removing java if it was installed", &java, r)
+	case resourceUser:
+		user, err := servershlib.GetUser(r.Name, serversh)
+		if err != nil {
+			return err
+		}
+		c.user = user
+		c.pushCleanup("User from server", "while removing user from server", &user, r)
+	case resourceService:
+		service, err := servershlib.GetService(r.Name, c.user, serversh)
+		if err != nil {
+			return err
+		}
+		c.pushCleanup("Service installed on server", "while stopping service", &service, r)
+	case resourceFilebeatService:
+		filebeatService, err := servershlib.GetFilebeatService(c.server.Name, r.Name, c.user.Name, serversh)
+		if err != nil {
+			return err
+		}
+		c.pushCleanup("Filebeat service from server", "while removing filebeat service from server", &filebeatService, r)
+	}
+	return
+}
+
+// ScopeOperation reports if the operation works on a whole scope rather than on something in it, like creating the
+// scope. Journals of such operations may only be resumed or rolled back by those that can create and delete scopes.
+func ScopeOperation(operation string) bool {
+	return operation == operationCreateScope
+}
+
+// ResumeJournal continues an unfinished sequence from where its journal says it stopped.
+// If the resumed sequence fails it is cleaned up like any other sequence, including what was created before the restart.
+func (c AWS) ResumeJournal(id string) (result string, err error) {
+	j, err := journal.Open(id)
+	if err != nil {
+		return
+	}
+	defer j.Release()
+	scope := j.Scope
+	if j.Operation == operationCreateScope {
+		zones, _ := strconv.Atoi(j.Args["zones"])
+		return c.createScope(j, scope, ScopeOptions{
+			Executor:     j.Args["executor"],
+			SSHSources:   strings.Fields(j.Args["ssh_sources"]),
+			AMIParameter: j.Args["ami_parameter"],
+			VPC:          j.Args["vpc"],
+			Subnets:      strings.Fields(j.Args["subnets"]),
+			VPCCIDR:      j.Args["vpc_cidr"],
+			Zones:        zones,
+			NAT:          j.Args["nat"] == "true",
+		})
+	}
+	_, v, k, sg, slackId, err := Decrypt(j.Args["key"], &c)
+	if err != nil {
+		return
+	}
+	switch j.Operation {
+	case operationAddServer:
+		var sizing serverlib.Sizing
+		if j.Args["sizing"] != "" {
+			err = json.Unmarshal([]byte(j.Args["sizing"]), &sizing)
+			if err != nil {
+				return
+			}
+		}
+		var placement serverlib.Placement
+		if j.Args["placement"] != "" {
+			err = json.Unmarshal([]byte(j.Args["placement"]), &placement)
+			if err != nil {
+				return
+			}
+		}
+		result, err = c.addServerToScope(j, scope, j.Args["server"], sizing, placement, v, k, sg, slackId)
+	case operationAddService:
+		var service Service
+		err = json.Unmarshal([]byte(j.Args["service"]), &service)
+		if err != nil {
+			return
+		}
+		result, err = c.addServiceToServer(j, scope, j.Args["server"], v, k, sg, slackId, service)
+	case operationCreateDatabase:
+		result, err = c.createDatabase(j, scope, j.Args["artifact_id"], v, sg, slackId)
+	default:
+		err = fmt.Errorf("unknown operation %s", j.Operation)
+	}
+	return
+}
+
+// RollbackJournal removes everything an unfinished sequence had created according to its journal.
+func (c AWS) RollbackJournal(id string) (err error) {
+	j, err := journal.Open(id)
+	if err != nil {
+		return
+	}
+	defer j.Release()
+	seq := sequence{
+		ec2:           c.ec2,
+		elb:           c.elb,
+		rds:           c.rds,
+		dial:          c.dial,
+		ssm:           c.ssm,
+		secrets:       c.secrets,
+		shouldCleanUp: true,
+		deleters:      NewStack(),
+		scope:         j.Scope,
+		journal:       j,
+		job:           c.job,
+	}
+	if key, ok := j.Args["key"]; ok {
+		_, seq.vpc, seq.key, seq.securityGroup, seq.slackId, err = Decrypt(key, &c)
+		if err != nil {
+			return
+		}
+	}
+	if j.Operation == operationAddService {
+		seq.server, err = serverlib.GetServer(j.Args["server"], j.Scope, seq.key, seq.securityGroup, c.ec2)
+		if err != nil {
+			log.AddError(err).Warning("While getting server for rollback of journal ", id)
+		}
+	}
+	err = seq.restore()
+	if err != nil {
+		log.AddError(err).Warning("While restoring journal ", id, " for rollback, continuing with what could be restored")
+	}
+	c.job.SetJournal(j.Id)
+	seq.status(fmt.Sprintf("%s: Rolling back %s from journal %s.", j.Scope, j.Operation, j.Id))
+	seq.Cleanup(nil)
+	return
+}
@@ -2,6 +2,8 @@ package key
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
@@ -9,32 +11,76 @@ import (
 	"time"
 )
 
+var ErrNotFound = errors.New("key pair not found")
+
 type Key struct {
 	Scope       string           `json:"-"`
 	Id          string           `json:"id"`
 	Name        string           `json:"name"`
 	PemName     string           `json:"pem_name"`
 	Fingerprint string           `json:"fingerprint"`
-	Material    string           `json:"material"`
+	Material    string           `json:"-"`
 	Type        ec2types.KeyType `json:"type"`
-	ec2         *ec2.Client
+	Created     time.Time        `json:"-"`
+	ec2         util.EC2
 	created     bool
 }
 
-func NewKey(scope string, e2 *ec2.Client) (k Key, err error) {
+func Name(scope string) string {
+	return scope + "-key"
+}
+
+func NewKey(scope string, e2 util.EC2) (k Key, err error) {
 	err = util.CheckEC2Session(e2)
 	if err != nil {
 		return
 	}
 	k = Key{
 		Scope: scope,
-		Name:  scope + "-key",
+		Name:  Name(scope),
 		Type:  ec2types.KeyTypeEd25519,
 		ec2:   e2,
 	}
 	return
 }
 
+func GetKey(scope string, e2 util.EC2) (k Key, err error) {
+	err = util.CheckEC2Session(e2)
+	if err != nil {
+		return
+	}
+	name := Name(scope)
+	result, err := e2.DescribeKeyPairs(context.Background(), &ec2.DescribeKeyPairsInput{
+		Filters: []ec2types.Filter{
+			{
+				Name: aws.String("key-name"),
+				Values: []string{
+					name,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	if len(result.KeyPairs) < 1 {
+		err = fmt.Errorf("%w: %s", ErrNotFound, name)
+		return
+	}
+	k = Key{
+		Scope:       scope,
+		Id:          aws.ToString(result.KeyPairs[0].KeyPairId),
+		Name:        name,
+		PemName:     name + ".pem",
+		Fingerprint: aws.ToString(result.KeyPairs[0].KeyFingerprint),
+		Type:        result.KeyPairs[0].KeyType,
+		Created:     aws.ToTime(result.KeyPairs[0].CreateTime),
+		ec2:         e2,
+		created:     true,
+	}
+	return
+}
+
 func (k *Key) Create() (id string, err error) {
 	err = util.CheckEC2Session(k.ec2)
 	if err != nil {
@@ -43,6 +89,21 @@ func (k *Key) Create() (id string, err error) {
 	keyResult, err := k.ec2.CreateKeyPair(context.Background(), &ec2.CreateKeyPairInput{
 		KeyName: aws.String(k.Name),
 		KeyType: k.Type,
+		TagSpecifications: []ec2types.TagSpecification{
+			{
+				ResourceType: ec2types.ResourceTypeKeyPair,
+				Tags: []ec2types.Tag{
+					{
+						Key:   aws.String("Name"),
+						Value: aws.String(k.Name),
+					},
+					{
+						Key:   aws.String("Scope"),
+						Value: aws.String(k.Scope),
+					},
+				},
+			},
+		},
 	})
 	if err != nil {
 		return
@@ -88,7 +149,7 @@ func (k *Key) Delete() (err error) {
 	return
 }
 
-func (k Key) WithEC2(e *ec2.Client) Key {
+func (k Key) WithEC2(e util.EC2) Key {
 	k.ec2 = e
 	return k
 }
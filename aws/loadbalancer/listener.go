@@ -2,6 +2,8 @@ package loadbalancer
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"strconv"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -10,12 +12,14 @@ import (
 	"github.com/cantara/nerthus/aws/util"
 )
 
+var ErrWrongVPC = errors.New("loadbalancer is not in the vpc of the scope")
+
 type Listener struct {
 	ARN string
-	elb *elbv2.Client
+	elb util.ELB
 }
 
-func GetListener(arn string, elb *elbv2.Client) (l Listener, err error) {
+func GetListener(arn string, elb util.ELB) (l Listener, err error) {
 	err = util.CheckELBV2Session(elb)
 	if err != nil {
 		return
@@ -40,7 +44,42 @@ func (l Listener) GetLoadbalancer() (loadbalancer string, err error) {
 	return
 }
 
-func GetListeners(loadbalancerARN string, elb *elbv2.Client) (l []Listener, err error) {
+// GetVPC returns the id of the vpc the loadbalancer of the listener is in. Target groups the listener forwards to must
+// be in the same vpc.
+func (l Listener) GetVPC() (vpcId string, err error) {
+	loadbalancer, err := l.GetLoadbalancer()
+	if err != nil {
+		return
+	}
+	result, err := l.elb.DescribeLoadBalancers(context.Background(), &elbv2.DescribeLoadBalancersInput{
+		LoadBalancerArns: []string{
+			loadbalancer,
+		},
+	})
+	if err != nil {
+		return
+	}
+	if len(result.LoadBalancers) < 1 {
+		err = fmt.Errorf("No loadbalancer with arn %s", loadbalancer)
+		return
+	}
+	vpcId = aws.ToString(result.LoadBalancers[0].VpcId)
+	return
+}
+
+// CheckVPC returns ErrWrongVPC unless the loadbalancer of the listener is in the vpc.
+func (l Listener) CheckVPC(vpcId string) error {
+	lbVPC, err := l.GetVPC()
+	if err != nil {
+		return err
+	}
+	if lbVPC != vpcId {
+		return fmt.Errorf("%w: the loadbalancer of listener %s is in %s, the scope is in %s", ErrWrongVPC, l.ARN, lbVPC, vpcId)
+	}
+	return nil
+}
+
+func GetListeners(loadbalancerARN string, elb util.ELB) (l []Listener, err error) {
 	err = util.CheckELBV2Session(elb)
 	if err != nil {
 		return
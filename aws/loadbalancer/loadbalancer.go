@@ -9,6 +9,7 @@ import (
 	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
 	elbv2types "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
 	"github.com/aws/smithy-go"
+	"github.com/cantara/nerthus/aws/util"
 )
 
 type Loadbalancer struct {
@@ -19,7 +20,7 @@ type Loadbalancer struct {
 	Paths         []string `json:"paths"`
 }
 
-func GetLoadbalancers(svc *elbv2.Client) (loadbalancers []Loadbalancer, err error) {
+func GetLoadbalancers(svc util.ELB) (loadbalancers []Loadbalancer, err error) {
 	input := &elbv2.DescribeLoadBalancersInput{}
 
 	result, err := svc.DescribeLoadBalancers(context.Background(), input)
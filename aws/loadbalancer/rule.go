@@ -3,6 +3,7 @@ package loadbalancer
 import (
 	"context"
 	"fmt"
+	"strconv"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	//"github.com/aws/aws-sdk-go-v2/aws/awserr"
@@ -11,15 +12,19 @@ import (
 	"github.com/cantara/nerthus/aws/util"
 )
 
+// priorityTag is the tag the priority a rule was created with is recorded in, so that re-prioritised rules can be found.
+const priorityTag = "Priority"
+
 type Rule struct {
 	ARN         string
+	Priority    int
 	listener    Listener
 	targetGroup TargetGroup
-	elb         *elbv2.Client
+	elb         util.ELB
 	created     bool
 }
 
-func NewRule(l Listener, tg TargetGroup, elb *elbv2.Client) (r Rule, err error) {
+func NewRule(l Listener, tg TargetGroup, elb util.ELB) (r Rule, err error) {
 	err = util.CheckELBV2Session(elb)
 	if err != nil {
 		return
@@ -32,7 +37,32 @@ func NewRule(l Listener, tg TargetGroup, elb *elbv2.Client) (r Rule, err error)
 	return
 }
 
-func GetRules(listenerARN string, elb *elbv2.Client) (r []Rule, err error) {
+func GetRule(arn string, elb util.ELB) (r Rule, err error) {
+	err = util.CheckELBV2Session(elb)
+	if err != nil {
+		return
+	}
+	result, err := elb.DescribeRules(context.Background(), &elbv2.DescribeRulesInput{
+		RuleArns: []string{
+			arn,
+		},
+	})
+	if err != nil {
+		return
+	}
+	if len(result.Rules) < 1 {
+		err = fmt.Errorf("No rule with arn %s", arn)
+		return
+	}
+	r = Rule{
+		ARN:     aws.ToString(result.Rules[0].RuleArn),
+		elb:     elb,
+		created: true,
+	}
+	return
+}
+
+func GetRules(listenerARN string, elb util.ELB) (r []Rule, err error) {
 	err = util.CheckELBV2Session(elb)
 	if err != nil {
 		return
@@ -69,6 +99,7 @@ func (r *Rule) Create() (id string, err error) {
 	if err != nil {
 		return
 	}
+	priority := highestPriority + 1
 	path := fmt.Sprintf("/%s", r.targetGroup.UriPath)
 	input := &elbv2.CreateRuleInput{
 		Actions: []elbv2types.Action{
@@ -87,7 +118,13 @@ func (r *Rule) Create() (id string, err error) {
 			},
 		},
 		ListenerArn: aws.String(r.listener.ARN),
-		Priority:    aws.Int32(int32(highestPriority + 1)),
+		Priority:    aws.Int32(int32(priority)),
+		Tags: []elbv2types.Tag{
+			{
+				Key:   aws.String(priorityTag),
+				Value: aws.String(strconv.Itoa(priority)),
+			},
+		},
 	}
 
 	result, err := r.elb.CreateRule(context.Background(), input)
@@ -95,11 +132,47 @@ func (r *Rule) Create() (id string, err error) {
 		return
 	}
 	r.ARN = aws.ToString(result.Rules[0].RuleArn)
+	r.Priority = priority
 	id = r.ARN
 	r.created = true
 	return
 }
 
+// RecordedPriority returns the priority recorded when the rule was created. Rules created before priorities were
+// recorded are returned as not recorded.
+func (r Rule) RecordedPriority() (priority int, recorded bool, err error) {
+	err = util.CheckELBV2Session(r.elb)
+	if err != nil {
+		return
+	}
+	result, err := r.elb.DescribeTags(context.Background(), &elbv2.DescribeTagsInput{
+		ResourceArns: []string{
+			r.ARN,
+		},
+	})
+	if err != nil {
+		return
+	}
+	for _, desc := range result.TagDescriptions {
+		for _, tag := range desc.Tags {
+			if aws.ToString(tag.Key) != priorityTag {
+				continue
+			}
+			priority, err = strconv.Atoi(aws.ToString(tag.Value))
+			if err != nil {
+				return
+			}
+			recorded = true
+			return
+		}
+	}
+	return
+}
+
+func (r Rule) ListenerARN() string {
+	return r.listener.ARN
+}
+
 func (r *Rule) Delete() (err error) {
 	if !r.created {
 		return
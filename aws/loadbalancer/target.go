@@ -12,25 +12,45 @@ import (
 )
 
 type Target struct {
+	ServerId    string `json:"server_id"`
+	Health      string `json:"health"`
 	targetGroup TargetGroup
-	server      server.Server
-	elb         *elbv2.Client
+	elb         util.ELB
 	created     bool
 }
 
-func NewTarget(tg TargetGroup, s server.Server, elb *elbv2.Client) (t Target, err error) {
+func NewTarget(tg TargetGroup, s server.Server, elb util.ELB) (t Target, err error) {
 	err = util.CheckELBV2Session(elb)
 	if err != nil {
 		return
 	}
 	t = Target{
+		ServerId:    s.Id,
 		targetGroup: tg,
-		server:      s,
 		elb:         elb,
 	}
 	return
 }
 
+func GetTarget(tg TargetGroup, serverId string, elb util.ELB) (t Target, err error) {
+	err = util.CheckELBV2Session(elb)
+	if err != nil {
+		return
+	}
+	t = Target{
+		ServerId:    serverId,
+		targetGroup: tg,
+		elb:         elb,
+		created:     true,
+	}
+	return
+}
+
+// Healthy reports if the loadbalancer is sending traffic to the target, as of when it was read with GetTargets.
+func (t Target) Healthy() bool {
+	return t.Health == string(elbv2types.TargetHealthStateEnumHealthy)
+}
+
 func (t *Target) Create() (id string, err error) {
 	err = util.CheckELBV2Session(t.elb)
 	if err != nil {
@@ -40,7 +60,7 @@ func (t *Target) Create() (id string, err error) {
 		TargetGroupArn: aws.String(t.targetGroup.ARN),
 		Targets: []elbv2types.TargetDescription{
 			{
-				Id: aws.String(t.server.Id),
+				Id: aws.String(t.ServerId),
 			},
 		},
 	}
@@ -65,7 +85,7 @@ func (t *Target) Delete() (err error) {
 		TargetGroupArn: aws.String(t.targetGroup.ARN),
 		Targets: []elbv2types.TargetDescription{
 			{
-				Id: aws.String(t.server.Id),
+				Id: aws.String(t.ServerId),
 			},
 		},
 	}
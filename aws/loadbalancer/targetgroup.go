@@ -3,11 +3,14 @@ package loadbalancer
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	//"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	elbv2types "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
 	"github.com/cantara/nerthus/aws/util"
 	"github.com/cantara/nerthus/aws/vpc"
 )
@@ -18,12 +21,16 @@ type TargetGroup struct {
 	UriPath string `json:"path"`
 	Port    int    `json:"port"`
 	ARN     string `json:"arn"`
+	// Created is when the target group was created, from its Created tag. It is zero for target groups created before
+	// the tag was added.
+	Created time.Time `json:"-"`
 	vpc     vpc.VPC
-	elb     *elbv2.Client
+	elb     util.ELB
 	created bool
 }
 
-func createTargetGroupName(scope, name string) (string, error) {
+// TargetGroupName is the name of the target group for a service in a scope, target groups are limited to 32 characters.
+func TargetGroupName(scope, name string) (string, error) {
 	tgName := strings.Split(scope, "-")[0] + "-" + strings.ToLower(name)
 	tgName = strings.TrimSuffix(tgName, "api")
 	tgName = strings.ReplaceAll(tgName, "-", " ")
@@ -37,12 +44,12 @@ func createTargetGroupName(scope, name string) (string, error) {
 	return tgName, nil
 }
 
-func NewTargetGroup(scope, name, uriPath string, port int, vpc vpc.VPC, elb *elbv2.Client) (tg TargetGroup, err error) {
+func NewTargetGroup(scope, name, uriPath string, port int, vpc vpc.VPC, elb util.ELB) (tg TargetGroup, err error) {
 	err = util.CheckELBV2Session(elb)
 	if err != nil {
 		return
 	}
-	name, err = createTargetGroupName(scope, name)
+	name, err = TargetGroupName(scope, name)
 	if err != nil {
 		return
 	}
@@ -57,12 +64,12 @@ func NewTargetGroup(scope, name, uriPath string, port int, vpc vpc.VPC, elb *elb
 	return
 }
 
-func GetTargetGroup(scope, name, uriPath string, port int, elb *elbv2.Client) (tg TargetGroup, err error) {
+func GetTargetGroup(scope, name, uriPath string, port int, elb util.ELB) (tg TargetGroup, err error) {
 	err = util.CheckELBV2Session(elb)
 	if err != nil {
 		return
 	}
-	name, err = createTargetGroupName(scope, name)
+	name, err = TargetGroupName(scope, name)
 	if err != nil {
 		return
 	}
@@ -83,14 +90,148 @@ func GetTargetGroup(scope, name, uriPath string, port int, elb *elbv2.Client) (t
 		elb:     elb,
 	}
 	tg.ARN = aws.ToString(result.TargetGroups[0].TargetGroupArn)
+	tg.created = true
+	return
+}
+
+func GetTargetGroupByARN(arn string, elb util.ELB) (tg TargetGroup, err error) {
+	err = util.CheckELBV2Session(elb)
+	if err != nil {
+		return
+	}
+	result, err := elb.DescribeTargetGroups(context.Background(), &elbv2.DescribeTargetGroupsInput{
+		TargetGroupArns: []string{
+			arn,
+		},
+	})
+	if err != nil {
+		return
+	}
+	if len(result.TargetGroups) < 1 {
+		err = fmt.Errorf("No target group with arn %s", arn)
+		return
+	}
+	group := result.TargetGroups[0]
+	tg = TargetGroup{
+		Name:    aws.ToString(group.TargetGroupName),
+		Port:    int(aws.ToInt32(group.Port)),
+		ARN:     aws.ToString(group.TargetGroupArn),
+		UriPath: strings.TrimSuffix(strings.TrimPrefix(aws.ToString(group.HealthCheckPath), "/"), "/health"),
+		vpc:     vpc.VPC{Id: aws.ToString(group.VpcId)},
+		elb:     elb,
+		created: true,
+	}
+	return
+}
+
+// GetTargetGroups returns all target groups that belongs to the scope. Either by the Scope tag or by the per service tag,
+// where the tag key is the artifact id and the value is the scope.
+func GetTargetGroups(scope string, elb util.ELB) (tgs []TargetGroup, err error) {
+	err = eachTargetGroup(elb, func(group elbv2types.TargetGroup, tags []elbv2types.Tag) {
+		name := aws.ToString(group.TargetGroupName)
+		if !inScope(scope, name, tags) {
+			return
+		}
+		tg := TargetGroup{
+			Scope:   scope,
+			Name:    name,
+			Port:    int(aws.ToInt32(group.Port)),
+			ARN:     aws.ToString(group.TargetGroupArn),
+			vpc:     vpc.VPC{Id: aws.ToString(group.VpcId)},
+			elb:     elb,
+			created: true,
+		}
+		for _, tag := range tags {
+			if aws.ToString(tag.Key) == util.CreatedTag {
+				tg.Created = util.ParseCreated(aws.ToString(tag.Value))
+			}
+		}
+		tg.UriPath = strings.TrimSuffix(strings.TrimPrefix(aws.ToString(group.HealthCheckPath), "/"), "/health")
+		tgs = append(tgs, tg)
+	})
+	return
+}
+
+// GetTargetGroupScopes returns the scopes in the Scope tag of the target groups.
+func GetTargetGroupScopes(elb util.ELB) (scopes []string, err error) {
+	found := make(map[string]bool)
+	err = eachTargetGroup(elb, func(group elbv2types.TargetGroup, tags []elbv2types.Tag) {
+		for _, tag := range tags {
+			if aws.ToString(tag.Key) == "Scope" && !found[aws.ToString(tag.Value)] {
+				found[aws.ToString(tag.Value)] = true
+				scopes = append(scopes, aws.ToString(tag.Value))
+			}
+		}
+	})
+	return
+}
+
+// eachTargetGroup calls f with every target group and its tags.
+func eachTargetGroup(elb util.ELB, f func(group elbv2types.TargetGroup, tags []elbv2types.Tag)) (err error) {
+	err = util.CheckELBV2Session(elb)
+	if err != nil {
+		return
+	}
+	var groups []elbv2types.TargetGroup
+	first := true
+	var marker *string
+	for marker != nil || first {
+		first = false
+		result, err := elb.DescribeTargetGroups(context.Background(), &elbv2.DescribeTargetGroupsInput{
+			Marker: marker,
+		})
+		if err != nil {
+			return err
+		}
+		marker = result.NextMarker
+		groups = append(groups, result.TargetGroups...)
+	}
+	for i := 0; i < len(groups); i += 20 {
+		end := i + 20
+		if end > len(groups) {
+			end = len(groups)
+		}
+		var arns []string
+		byARN := make(map[string]elbv2types.TargetGroup)
+		for _, group := range groups[i:end] {
+			arns = append(arns, aws.ToString(group.TargetGroupArn))
+			byARN[aws.ToString(group.TargetGroupArn)] = group
+		}
+		result, err := elb.DescribeTags(context.Background(), &elbv2.DescribeTagsInput{
+			ResourceArns: arns,
+		})
+		if err != nil {
+			return err
+		}
+		for _, desc := range result.TagDescriptions {
+			f(byARN[aws.ToString(desc.ResourceArn)], desc.Tags)
+		}
+	}
 	return
 }
 
+func inScope(scope, name string, tags []elbv2types.Tag) bool {
+	for _, tag := range tags {
+		if aws.ToString(tag.Value) != scope {
+			continue
+		}
+		if aws.ToString(tag.Key) == "Scope" {
+			return true
+		}
+		tgName, err := TargetGroupName(scope, aws.ToString(tag.Key))
+		if err == nil && tgName == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (tg *TargetGroup) Create() (id string, err error) {
 	err = util.CheckELBV2Session(tg.elb)
 	if err != nil {
 		return
 	}
+	created := time.Now()
 	input := &elbv2.CreateTargetGroupInput{
 		Name:                       aws.String(tg.Name),
 		Port:                       aws.Int32(int32(tg.Port)),
@@ -104,6 +245,20 @@ func (tg *TargetGroup) Create() (id string, err error) {
 		HealthCheckProtocol:        "HTTP",
 		HealthCheckTimeoutSeconds:  aws.Int32(2),
 		HealthyThresholdCount:      aws.Int32(2),
+		Tags: []elbv2types.Tag{
+			{
+				Key:   aws.String("Name"),
+				Value: aws.String(tg.Name),
+			},
+			{
+				Key:   aws.String("Scope"),
+				Value: aws.String(tg.Scope),
+			},
+			{
+				Key:   aws.String(util.CreatedTag),
+				Value: aws.String(util.CreatedValue(created)),
+			},
+		},
 	}
 
 	result, err := tg.elb.CreateTargetGroup(context.Background(), input)
@@ -112,6 +267,7 @@ func (tg *TargetGroup) Create() (id string, err error) {
 	}
 	tg.ARN = aws.ToString(result.TargetGroups[0].TargetGroupArn)
 	id = tg.ARN
+	tg.Created = created
 	tg.created = true
 	return
 }
@@ -132,7 +288,107 @@ func (tg *TargetGroup) Delete() (err error) {
 	return
 }
 
-func (tg TargetGroup) WithELB(e *elbv2.Client) TargetGroup {
+// GetRules returns the listener rules that forwards to the target group.
+func (tg TargetGroup) GetRules() (rules []Rule, err error) {
+	err = util.CheckELBV2Session(tg.elb)
+	if err != nil {
+		return
+	}
+	result, err := tg.elb.DescribeTargetGroups(context.Background(), &elbv2.DescribeTargetGroupsInput{
+		TargetGroupArns: []string{
+			tg.ARN,
+		},
+	})
+	if err != nil {
+		return
+	}
+	if len(result.TargetGroups) < 1 {
+		return
+	}
+	for _, loadbalancerARN := range result.TargetGroups[0].LoadBalancerArns {
+		listeners, err := tg.elb.DescribeListeners(context.Background(), &elbv2.DescribeListenersInput{
+			LoadBalancerArn: aws.String(loadbalancerARN),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, listener := range listeners.Listeners {
+			result, err := tg.elb.DescribeRules(context.Background(), &elbv2.DescribeRulesInput{
+				ListenerArn: listener.ListenerArn,
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, rule := range result.Rules {
+				if aws.ToBool(rule.IsDefault) || !forwardsTo(rule.Actions, tg.ARN) {
+					continue
+				}
+				priority, _ := strconv.Atoi(aws.ToString(rule.Priority))
+				rules = append(rules, Rule{
+					ARN:      aws.ToString(rule.RuleArn),
+					Priority: priority,
+					listener: Listener{
+						ARN: aws.ToString(listener.ListenerArn),
+						elb: tg.elb,
+					},
+					targetGroup: tg,
+					elb:         tg.elb,
+					created:     true,
+				})
+			}
+		}
+	}
+	return
+}
+
+func forwardsTo(actions []elbv2types.Action, targetGroupARN string) bool {
+	for _, action := range actions {
+		if aws.ToString(action.TargetGroupArn) == targetGroupARN {
+			return true
+		}
+		if action.ForwardConfig == nil {
+			continue
+		}
+		for _, tuple := range action.ForwardConfig.TargetGroups {
+			if aws.ToString(tuple.TargetGroupArn) == targetGroupARN {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetTargets returns the targets currently registered in the target group.
+func (tg TargetGroup) GetTargets() (targets []Target, err error) {
+	err = util.CheckELBV2Session(tg.elb)
+	if err != nil {
+		return
+	}
+	result, err := tg.elb.DescribeTargetHealth(context.Background(), &elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(tg.ARN),
+	})
+	if err != nil {
+		return
+	}
+	for _, desc := range result.TargetHealthDescriptions {
+		if desc.Target == nil {
+			continue
+		}
+		t := Target{
+			ServerId:    aws.ToString(desc.Target.Id),
+			targetGroup: tg,
+			elb:         tg.elb,
+			created:     true,
+		}
+		if desc.TargetHealth != nil {
+			t.Health = string(desc.TargetHealth.State)
+		}
+		targets = append(targets, t)
+	}
+	return
+}
+
+func (tg TargetGroup) WithELB(e util.ELB) TargetGroup {
 	tg.elb = e
 	return tg
 }
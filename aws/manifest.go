@@ -0,0 +1,125 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+
+	securitylib "github.com/cantara/nerthus/aws/security"
+	serverlib "github.com/cantara/nerthus/aws/server"
+	vpclib "github.com/cantara/nerthus/aws/vpc"
+	"gopkg.in/yaml.v3"
+)
+
+var ErrInvalidManifest = errors.New("invalid manifest")
+
+// Manifest describes the desired state of a scope. It is usually kept in git as scope.yaml and applied with POST /apply.
+// Key is the crypt key returned when the scope was created, it is not needed when the scope is created by the apply.
+// Executor, SSHSources, AMIParameter and the vpc fields are only used when the scope is created, see CreateScope. The ssh sources of an
+// existing scope are changed with UpdateSSHAccess.
+type Manifest struct {
+	Scope        string             `yaml:"scope" json:"scope"`
+	Key          string             `yaml:"key" json:"key,omitempty"`
+	Executor     string             `yaml:"executor" json:"executor,omitempty"`
+	SSHSources   []string           `yaml:"ssh_sources" json:"ssh_sources,omitempty"`
+	AMIParameter string             `yaml:"ami_parameter" json:"ami_parameter,omitempty"`
+	VPC          string             `yaml:"vpc" json:"vpc,omitempty"`
+	Subnets      []string           `yaml:"subnets" json:"subnets,omitempty"`
+	VPCCIDR      string             `yaml:"vpc_cidr" json:"vpc_cidr,omitempty"`
+	Zones        int                `yaml:"zones" json:"zones,omitempty"`
+	NAT          bool               `yaml:"nat" json:"nat,omitempty"`
+	Prune        bool               `yaml:"prune" json:"prune"`
+	Servers      []ManifestServer   `yaml:"servers" json:"servers"`
+	Databases    []ManifestDatabase `yaml:"databases" json:"databases"`
+}
+
+type ManifestServer struct {
+	Name     string    `yaml:"name" json:"name"`
+	Services []Service `yaml:"services" json:"services"`
+
+	// Sizing and Subnet are only used when the server is created, changing them does not change an existing server.
+	serverlib.Sizing `yaml:",inline"`
+	Subnet           string `yaml:"subnet" json:"subnet,omitempty"`
+}
+
+// placement spreads the server across the availability zones with the other servers for its first service.
+func (s ManifestServer) placement() serverlib.Placement {
+	p := serverlib.Placement{
+		Subnet: s.Subnet,
+	}
+	if len(s.Services) > 0 {
+		p.ArtifactId = s.Services[0].ArtifactId
+	}
+	return p
+}
+
+type ManifestDatabase struct {
+	ArtifactId string `yaml:"artifact_id" json:"artifact_id"`
+}
+
+// ParseManifest reads a manifest from yaml, json is accepted as well as it is a subset of yaml.
+func ParseManifest(data []byte) (m Manifest, err error) {
+	err = yaml.Unmarshal(data, &m)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+		return
+	}
+	err = m.Validate()
+	return
+}
+
+// Validate checks the fields the sequences requires, so that an apply does not fail halfway on bad input.
+func (m Manifest) Validate() error {
+	if err := CheckNameLen(m.Scope); err != nil {
+		return fmt.Errorf("%w: scope: %v", ErrInvalidManifest, err)
+	}
+	if err := securitylib.CheckExecutor(m.Executor); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	if err := serverlib.CheckAMIParameter(m.AMIParameter); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	if m.VPCCIDR != "" {
+		if m.VPC != "" || len(m.Subnets) > 0 {
+			return fmt.Errorf("%w: vpc_cidr can not be combined with vpc or subnets", ErrInvalidManifest)
+		}
+		if err := vpclib.CheckNetwork(m.VPCCIDR, m.Zones); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+		}
+	}
+	for _, source := range m.SSHSources {
+		if _, err := securitylib.NormalizeSource(source); err != nil {
+			return fmt.Errorf("%w: ssh_sources: %v", ErrInvalidManifest, err)
+		}
+	}
+	servers := make(map[string]bool)
+	for _, server := range m.Servers {
+		if server.Name == "" {
+			return fmt.Errorf("%w: server without name", ErrInvalidManifest)
+		}
+		if servers[server.Name] {
+			return fmt.Errorf("%w: server %s is listed more than once", ErrInvalidManifest, server.Name)
+		}
+		servers[server.Name] = true
+		services := make(map[string]bool)
+		for _, service := range server.Services {
+			if service.ArtifactId == "" || service.Path == "" || service.Port == 0 || service.ELBListenerArn == "" {
+				return fmt.Errorf("%w: service on %s is missing one of artifact_id, path, port or elb_listener_arn", ErrInvalidManifest, server.Name)
+			}
+			if services[service.ArtifactId] {
+				return fmt.Errorf("%w: service %s is listed more than once on %s", ErrInvalidManifest, service.ArtifactId, server.Name)
+			}
+			services[service.ArtifactId] = true
+		}
+	}
+	databases := make(map[string]bool)
+	for _, database := range m.Databases {
+		if database.ArtifactId == "" {
+			return fmt.Errorf("%w: database without artifact_id", ErrInvalidManifest)
+		}
+		if databases[database.ArtifactId] {
+			return fmt.Errorf("%w: database %s is listed more than once", ErrInvalidManifest, database.ArtifactId)
+		}
+		databases[database.ArtifactId] = true
+	}
+	return nil
+}
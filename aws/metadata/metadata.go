@@ -12,7 +12,7 @@ type VPC struct {
 	Id string `json:"id"`
 }
 
-func GetAllServerIds(e2 *ec2.Client) (ids []string, err error) {
+func GetAllServerIds(e2 util.EC2) (ids []string, err error) {
 	first := true
 	var nextToken *string
 	for nextToken != nil || first {
@@ -33,7 +33,7 @@ func GetAllServerIds(e2 *ec2.Client) (ids []string, err error) {
 	return
 }
 
-func GetAllServersWithMetadataV1IDs(e2 *ec2.Client) (ids []string, err error) {
+func GetAllServersWithMetadataV1IDs(e2 util.EC2) (ids []string, err error) {
 	first := true
 	var nextToken *string
 	for nextToken != nil || first {
@@ -57,7 +57,7 @@ func GetAllServersWithMetadataV1IDs(e2 *ec2.Client) (ids []string, err error) {
 	return
 }
 
-func SetMetadataV2(id string, e2 *ec2.Client) (err error) {
+func SetMetadataV2(id string, e2 util.EC2) (err error) {
 	err = util.CheckEC2Session(e2)
 	if err != nil {
 		return
@@ -0,0 +1,313 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+
+	databaselib "github.com/cantara/nerthus/aws/database"
+	keylib "github.com/cantara/nerthus/aws/key"
+	loadbalancerlib "github.com/cantara/nerthus/aws/loadbalancer"
+	securitylib "github.com/cantara/nerthus/aws/security"
+	serverlib "github.com/cantara/nerthus/aws/server"
+	vpclib "github.com/cantara/nerthus/aws/vpc"
+	servershlib "github.com/cantara/nerthus/server"
+)
+
+const (
+	PathNewService       = "new_service"
+	PathAdditionalServer = "additional_server"
+)
+
+// Plan describes what an orchestration would create without creating anything. Validations that would make the
+// orchestration fail are reported as problems, errors are only returned when the lookups themselves fails.
+type Plan struct {
+	Operation            string                `json:"operation"`
+	Scope                string                `json:"scope"`
+	Steps                []string              `json:"steps"`
+	KeyPair              string                `json:"key_pair,omitempty"`
+	VPC                  string                `json:"vpc,omitempty"`
+	Subnets              []string              `json:"subnets,omitempty"`
+	VPCCIDR              string                `json:"vpc_cidr,omitempty"`
+	PrivateSubnets       []string              `json:"private_subnets,omitempty"`
+	NAT                  bool                  `json:"nat,omitempty"`
+	SecurityGroup        string                `json:"security_group,omitempty"`
+	Ingress              []securitylib.Ingress `json:"ingress,omitempty"`
+	Server               string                `json:"server,omitempty"`
+	AMI                  string                `json:"ami,omitempty"`
+	AMIParameter         string                `json:"ami_parameter,omitempty"`
+	InstanceType         string                `json:"instance_type,omitempty"`
+	RootVolume           string                `json:"root_volume,omitempty"`
+	DataVolumes          []string              `json:"data_volumes,omitempty"`
+	Subnet               string                `json:"subnet,omitempty"`
+	AvailabilityZone     string                `json:"availability_zone,omitempty"`
+	ServicePath          string                `json:"service_path,omitempty"`
+	TargetGroup          string                `json:"target_group,omitempty"`
+	ListenerRulePriority int                   `json:"listener_rule_priority,omitempty"`
+	DBSecurityGroup      string                `json:"db_security_group,omitempty"`
+	DBSubnetGroup        string                `json:"db_subnet_group,omitempty"`
+	Database             string                `json:"database,omitempty"`
+	Problems             []string              `json:"problems,omitempty"`
+}
+
+func (p *Plan) step(name string) {
+	p.Steps = append(p.Steps, name)
+}
+
+func (p *Plan) problem(format string, a ...interface{}) {
+	p.Problems = append(p.Problems, fmt.Sprintf(format, a...))
+}
+
+// PlanScope returns the plan for CreateScope.
+func (c AWS) PlanScope(scope string, o ScopeOptions) (p Plan, err error) {
+	p = Plan{
+		Operation:     operationCreateScope,
+		Scope:         scope,
+		KeyPair:       keylib.Name(scope),
+		SecurityGroup: securitylib.GroupName(scope),
+	}
+	if err := CheckNameLen(scope); err != nil {
+		p.problem("%v", err)
+	}
+	if o, err := c.scopeOptions(o); err != nil {
+		p.problem("%v", err)
+	} else {
+		p.Ingress, _ = securitylib.SSHIngresses(o.SSHSources)
+		p.AMIParameter = o.AMIParameter
+	}
+	_, err = keylib.GetKey(scope, c.ec2)
+	if err == nil {
+		p.problem("Key pair %s already exists", p.KeyPair)
+	} else if !errors.Is(err, keylib.ErrNotFound) {
+		return
+	}
+	p.step("CreateKey")
+	if o.VPCCIDR != "" {
+		err = c.planNetwork(&p, scope, o)
+		if err != nil {
+			return
+		}
+	} else {
+		err = c.planVPC(&p, o)
+		if err != nil {
+			return
+		}
+	}
+	groups, err := securitylib.GetGroups(scope, c.ec2)
+	if err != nil {
+		return
+	}
+	for _, group := range groups {
+		if group.Name == p.SecurityGroup {
+			p.problem("Security group %s already exists as %s", group.Name, group.Id)
+		}
+	}
+	p.step("CreateSecurityGroup")
+	p.step("SendScope")
+	return
+}
+
+// planVPC plans adopting the vpc of the options, or the default vpc.
+func (c AWS) planVPC(p *Plan, o ScopeOptions) (err error) {
+	v, err := vpclib.GetScopeVPC(o.VPC, o.Subnets, c.ec2)
+	if errors.Is(err, vpclib.ErrNotFound) || errors.Is(err, vpclib.ErrInvalidSubnet) {
+		p.problem("%v", err)
+	} else if err != nil {
+		return
+	}
+	p.VPC = v.Id
+	for _, subnet := range v.Subnets {
+		p.Subnets = append(p.Subnets, subnet.String())
+	}
+	p.step("GetVPC")
+	return nil
+}
+
+// planNetwork plans provisioning a vpc for the scope.
+func (c AWS) planNetwork(p *Plan, scope string, o ScopeOptions) (err error) {
+	p.VPCCIDR = o.VPCCIDR
+	p.NAT = o.NAT
+	n, err := vpclib.NewNetwork(scope, o.VPCCIDR, o.Zones, o.NAT, c.ec2)
+	if errors.Is(err, vpclib.ErrInvalidNetwork) {
+		// Already reported by scopeOptions
+		return nil
+	} else if err != nil {
+		return
+	}
+	p.VPCCIDR = n.CIDR
+	p.Subnets, p.PrivateSubnets, err = n.PlannedSubnets()
+	if errors.Is(err, vpclib.ErrInvalidNetwork) {
+		p.problem("%v", err)
+	} else if err != nil {
+		return
+	}
+	existing, err := vpclib.GetNetwork(scope, c.ec2)
+	if err == nil {
+		p.problem("VPC %s is already provisioned for scope %s", existing.VPC.Id, scope)
+	} else if !errors.Is(err, vpclib.ErrNotFound) {
+		return
+	}
+	p.step("CreateVPC")
+	return nil
+}
+
+// PlanServer returns the plan for AddServerToScope.
+func (c AWS) PlanServer(scope, serverName string, sizing serverlib.Sizing, placement serverlib.Placement, v vpclib.VPC, k keylib.Key, sg securitylib.Group) (p Plan, err error) {
+	server, err := serverlib.NewServer(serverName, scope, k, sg, c.ec2)
+	if err != nil {
+		return
+	}
+	resolved, resolveErr := sizing.ResolveAMI(sg.AMIParameter, c.ec2, c.ssm)
+	if resolveErr == nil {
+		sizing = resolved
+	}
+	server.SetSizing(sizing)
+	p = Plan{
+		Operation:     operationAddServer,
+		Scope:         scope,
+		KeyPair:       k.Name,
+		VPC:           v.Id,
+		SecurityGroup: sg.Name,
+		Server:        server.Name,
+		AMI:           server.ImageId,
+		AMIParameter:  server.AMIParameter,
+		InstanceType:  server.InstanceType,
+		RootVolume:    server.RootVolume,
+	}
+	for _, volume := range sizing.WithDefaults().DataVolumes {
+		p.DataVolumes = append(p.DataVolumes, volume.String())
+	}
+	if resolveErr != nil {
+		p.problem("%v", resolveErr)
+	} else if err = sizing.Validate(c.ec2); errors.Is(err, serverlib.ErrInvalidSizing) {
+		p.problem("%v", err)
+	} else if err != nil {
+		return
+	}
+	subnets, err := scopeSubnets(v, c.ec2)
+	if err != nil {
+		return
+	}
+	subnet, err := placement.Place(scope, subnets, c.ec2)
+	if errors.Is(err, serverlib.ErrInvalidPlacement) {
+		p.problem("%v", err)
+	} else if err != nil {
+		return
+	}
+	p.Subnet = subnet.Id
+	p.AvailabilityZone = subnet.AvailabilityZone
+	available, err := serverlib.NameAvailable(serverName, c.ec2)
+	if err != nil {
+		return
+	}
+	if !available {
+		p.problem("%v: %s", ErrNameNotAvailable, serverName)
+	}
+	p.Steps = []string{"CheckServerName", "ResolveAMI", "PlaceServer", "ValidateServerSizing", "CreateNewServer", "WaitForServerToStart",
+		"VerifyServerSSH", "AddAutoUpdate", "InstallFilebeat", "SendLogin"}
+	return
+}
+
+// PlanService returns the plan for AddServiceToServer, including if the service would be set up as a new service in
+// the scope or added to an additional server.
+func (c AWS) PlanService(scope, serverName string, v vpclib.VPC, k keylib.Key, sg securitylib.Group, service Service) (p Plan, err error) {
+	p = Plan{
+		Operation:     operationAddService,
+		Scope:         scope,
+		KeyPair:       k.Name,
+		SecurityGroup: sg.Name,
+		Server:        serverName,
+	}
+	_, err = serverlib.GetServer(serverName, scope, k, sg, c.ec2)
+	if errors.Is(err, serverlib.ErrNotFound) {
+		p.problem("%v", err)
+	} else if err != nil {
+		return
+	}
+	p.TargetGroup, err = loadbalancerlib.TargetGroupName(scope, service.ArtifactId)
+	if err != nil {
+		p.problem("%v", err)
+	}
+	isNotNewService, err := CheckIfServiceExcistsInScope(scope, service.ArtifactId, c.ec2)
+	if err != nil {
+		return
+	}
+	if isNotNewService {
+		p.ServicePath = PathAdditionalServer
+		p.step("GetTargetGroup")
+		if p.TargetGroup != "" {
+			_, tgErr := loadbalancerlib.GetTargetGroup(scope, service.ArtifactId, service.Path, service.Port, c.elb)
+			if tgErr != nil {
+				p.problem("Target group %s for the existing service was not found: %v", p.TargetGroup, tgErr)
+			}
+		}
+		p.step("CreateTarget")
+		p.step("TagAdditionalServer")
+	} else {
+		p.ServicePath = PathNewService
+		p.Ingress = []securitylib.Ingress{
+			securitylib.LoadbalancerIngress(service.ELBSecurityGroup, service.Port),
+		}
+		p.step("AddLoadbalancerAuthorizationToSecurityGroup")
+		p.step("CreateTargetGroup")
+		p.step("CreateTarget")
+		listener, err := loadbalancerlib.GetListener(service.ELBListenerArn, c.elb)
+		if err != nil {
+			return p, err
+		}
+		if v.Id != "" {
+			err = listener.CheckVPC(v.Id)
+			if errors.Is(err, loadbalancerlib.ErrWrongVPC) {
+				p.problem("%v", err)
+			} else if err != nil {
+				return p, err
+			}
+		}
+		highestPriority, err := listener.GetHighestPriority()
+		if err != nil {
+			return p, err
+		}
+		p.ListenerRulePriority = highestPriority + 1
+		p.step("AddRuleToListener")
+		p.step("TagNewService")
+	}
+	p.Steps = append(p.Steps, "WaitForELBRuleToBeHealthy", "UpdateServer", "InstallPrograms", "AddUser", "InstallService",
+		"AddFilebeatService", "SendServiceOnServer")
+	return
+}
+
+// PlanDatabase returns the plan for CreateDatabase.
+func (c AWS) PlanDatabase(scope, artifactId string, v vpclib.VPC, sg securitylib.Group) (p Plan, err error) {
+	name := servershlib.ToFriendlyName(artifactId)
+	database, err := databaselib.NewDatabase(name, scope, sg, databaselib.SubnetGroupName(scope), c.rds)
+	if err != nil {
+		return
+	}
+	subnets, err := dbSubnets(scope, v, c.ec2)
+	if err != nil {
+		return
+	}
+	p = Plan{
+		Operation:       operationCreateDatabase,
+		Scope:           scope,
+		VPC:             v.Id,
+		SecurityGroup:   sg.Name,
+		DBSecurityGroup: securitylib.DBGroupName(scope, name),
+		Ingress: []securitylib.Ingress{
+			securitylib.DatabaseIngress(sg.Id),
+		},
+		Subnets:       vpclib.VPC{Subnets: subnets}.SubnetIds(),
+		DBSubnetGroup: databaselib.SubnetGroupName(scope),
+		Database:      database.Identifier,
+		Steps:         []string{"CreateDBSecurityGroup", "CreateDBSubnetGroup", "CreateNewDatabase", "SendDBSettup"},
+	}
+	databases, err := databaselib.GetDatabases(scope, c.rds)
+	if err != nil {
+		return
+	}
+	for _, d := range databases {
+		if d.Identifier == database.Identifier {
+			p.problem("Database %s already exists", d.Identifier)
+		}
+	}
+	return
+}
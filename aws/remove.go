@@ -0,0 +1,227 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	log "github.com/cantara/bragi"
+	"github.com/cantara/nerthus/aws/key"
+	loadbalancerlib "github.com/cantara/nerthus/aws/loadbalancer"
+	"github.com/cantara/nerthus/aws/security"
+	serverlib "github.com/cantara/nerthus/aws/server"
+	"github.com/cantara/nerthus/aws/tag"
+	servershlib "github.com/cantara/nerthus/server"
+)
+
+var ErrLastTarget = errors.New("server is the last healthy target of a listener rule")
+
+// CheckServerRemovable returns ErrLastTarget if no other healthy target is left in a target group that a listener rule
+// forwards to, so that the check can be done before RemoveServerFromScope is started.
+func (c AWS) CheckServerRemovable(scope, serverName string) (err error) {
+	_, _, _, err = c.serverTargets(scope, serverName, false)
+	return
+}
+
+// RemoveServerFromScope undoes AddServerToScope. The server is deregistered from every target group in the scope and
+// terminated. Unless forced it refuses to remove the last healthy target of a target group that a listener rule
+// forwards to.
+func (c AWS) RemoveServerFromScope(scope, serverName string, force bool) (err error) {
+	t := teardown{
+		ec2:   c.ec2,
+		elb:   c.elb,
+		scope: scope,
+		job:   c.job,
+	}
+	server, targets, targetGroupNames, err := c.serverTargets(scope, serverName, force)
+	if err != nil {
+		return
+	}
+
+	t.status(fmt.Sprintf("%s, Starting to remove server from scope.", server.Name))
+	t.job.SetStep("DeregisterTargets")
+	for i := range targets {
+		t.remove("target from target group "+targetGroupNames[i], server.Id, &targets[i])
+	}
+	t.job.SetStep("TerminateServer")
+	t.status(fmt.Sprintf("%s, Terminating server %s.", server.Name, server.Id))
+	if t.remove("server", server.Name, &server) {
+		t.status(fmt.Sprintf("%s, Server %s is now terminated.", server.Name, server.Id))
+	}
+	t.status(fmt.Sprintf("%s, Completed all operations for removing the server from scope.", server.Name))
+	err = t.Err()
+	return
+}
+
+func (c AWS) serverTargets(scope, serverName string, force bool) (server serverlib.Server, targets []loadbalancerlib.Target, targetGroupNames []string, err error) {
+	server, err = serverlib.GetServer(serverName, scope, key.Key{}, security.Group{}, c.ec2)
+	if err != nil {
+		return
+	}
+	targetGroups, err := loadbalancerlib.GetTargetGroups(scope, c.elb)
+	if err != nil {
+		return
+	}
+	for _, targetGroup := range targetGroups {
+		tgTargets, err := targetGroup.GetTargets()
+		if err != nil {
+			return server, nil, nil, err
+		}
+		i := slices.IndexFunc(tgTargets, func(t loadbalancerlib.Target) bool {
+			return t.ServerId == server.Id
+		})
+		if i < 0 {
+			continue
+		}
+		// Only the other healthy targets can take over the traffic, unhealthy and draining ones are not counted
+		healthy := 0
+		for _, target := range tgTargets {
+			if target.ServerId != server.Id && target.Healthy() {
+				healthy++
+			}
+		}
+		if healthy == 0 && !force {
+			rules, err := targetGroup.GetRules()
+			if err != nil {
+				return server, nil, nil, err
+			}
+			if len(rules) > 0 {
+				return server, nil, nil, fmt.Errorf("%w: %s in target group %s", ErrLastTarget, server.Name, targetGroup.Name)
+			}
+		}
+		targets = append(targets, tgTargets[i])
+		targetGroupNames = append(targetGroupNames, targetGroup.Name)
+	}
+	return
+}
+
+// RemoveServiceFromServer undoes AddServiceToServer. When the server is the last one running the service in the scope,
+// the listener rule and target group for the service are removed as well.
+func (c AWS) RemoveServiceFromServer(scope, serverName, service string, k key.Key, sg security.Group) (err error) {
+	t := teardown{
+		ec2:   c.ec2,
+		elb:   c.elb,
+		scope: scope,
+		job:   c.job,
+	}
+	server, err := serverlib.GetServer(serverName, scope, k, sg, c.ec2)
+	if err != nil {
+		return
+	}
+	t.status(fmt.Sprintf("%s %s, Starting to remove service from server.", server.Name, service))
+
+	targetGroup, err := loadbalancerlib.GetTargetGroup(scope, service, "", 0, c.elb)
+	if err != nil {
+		t.fail(err, fmt.Sprintf("While getting target group for %s", service))
+	} else {
+		t.step("DeregisterTarget", func() { t.DeregisterTarget(targetGroup, server) })
+	}
+
+	serversh, err := remote(server, k, sg, c.dial, c.ssm, c.secrets)
+	if err != nil {
+		t.fail(err, fmt.Sprintf("While creating executor for %s: %s", server.Name, server.PublicDNS))
+	} else {
+		t.step("RemoveServiceFromServer", func() { t.RemoveServiceFromServer(server, service, serversh) })
+	}
+	t.step("RemoveAdditionalTag", func() { t.RemoveAdditionalTag(server, service) })
+
+	ids, err := GetServerIdsWithServiceInScope(scope, service, c.ec2)
+	if err != nil {
+		t.fail(err, fmt.Sprintf("While checking if %s is running on other servers", service))
+	} else if len(ids) == 0 && targetGroup.ARN != "" {
+		t.step("RemoveService", func() { t.RemoveService(targetGroup, service, server.ImageId, k, sg) })
+	}
+	t.status(fmt.Sprintf("%s %s, Completed all operations for removing the service from server.", server.Name, service))
+	err = t.Err()
+	return
+}
+
+func (t *teardown) DeregisterTarget(targetGroup loadbalancerlib.TargetGroup, server serverlib.Server) {
+	targets, err := targetGroup.GetTargets()
+	if err != nil {
+		t.fail(err, fmt.Sprintf("While getting targets for target group %s", targetGroup.Name))
+		return
+	}
+	for i := range targets {
+		if targets[i].ServerId != server.Id {
+			continue
+		}
+		t.remove("target from target group "+targetGroup.Name, server.Id, &targets[i])
+	}
+}
+
+func (t *teardown) RemoveServiceFromServer(server serverlib.Server, service string, serversh servershlib.Server) {
+	err := serversh.WaitForConnection()
+	if err != nil {
+		t.fail(err, fmt.Sprintf("While waiting for connection for %s: %s", server.Name, server.PublicDNS))
+		return
+	}
+	user, err := servershlib.GetUser(service, serversh)
+	if err != nil {
+		t.fail(err, fmt.Sprintf("While getting user for %s on %s", service, server.Name))
+		return
+	}
+	serv, err := servershlib.GetService(service, user, serversh)
+	if err != nil {
+		t.fail(err, fmt.Sprintf("While getting service %s on %s", service, server.Name))
+		return
+	}
+	t.remove("service", service, &serv)
+	filebeatService, err := servershlib.GetFilebeatService(server.Name, service, user.Name, serversh)
+	if err != nil {
+		t.fail(err, fmt.Sprintf("While getting filebeat service for %s on %s", service, server.Name))
+		return
+	}
+	t.remove("filebeat service", service, &filebeatService)
+	t.remove("user", user.Name, &user)
+}
+
+func (t *teardown) RemoveAdditionalTag(server serverlib.Server, service string) {
+	volumeId, err := server.GetVolumeId()
+	if err != nil {
+		t.fail(err, fmt.Sprintf("While getting volume id for server %s", server.Name))
+		return
+	}
+	tg, err := tag.GetAddTag(service, t.scope, server.Id, server.NetworkInterfaceId, volumeId, server.ImageId, t.ec2)
+	if err != nil {
+		t.fail(err, fmt.Sprintf("While getting tag for %s on server %s", service, server.Name))
+		return
+	}
+	t.remove("tag from server", server.Name, &tg)
+}
+
+// RemoveService removes the resources only used by the service when no servers are running it anymore. The image of the
+// last server is untagged along with the scope resources, as adding the service to the first server tagged it.
+func (t *teardown) RemoveService(targetGroup loadbalancerlib.TargetGroup, service, imageId string, k key.Key, sg security.Group) {
+	t.status(fmt.Sprintf("%s, No servers left running the service, removing its loadbalancer resources.", service))
+	rules, err := targetGroup.GetRules()
+	if err != nil {
+		t.fail(err, fmt.Sprintf("While getting rules for target group %s", targetGroup.Name))
+		return
+	}
+	var listenerARN, loadbalancerARN string
+	for i := range rules {
+		listenerARN = rules[i].ListenerARN()
+		t.remove("listener rule", rules[i].ARN, &rules[i])
+	}
+	if !t.remove("target group", targetGroup.Name, &targetGroup) {
+		return
+	}
+	if listenerARN != "" {
+		listener, err := loadbalancerlib.GetListener(listenerARN, t.elb)
+		if err != nil {
+			t.fail(err, fmt.Sprintf("While getting listener %s", listenerARN))
+			return
+		}
+		loadbalancerARN, err = listener.GetLoadbalancer()
+		if err != nil {
+			log.AddError(err).Notice("While getting loadbalancer for listener ", listenerARN)
+		}
+	}
+	tg, err := tag.GetNewTag(service, t.scope, k.Id, sg.Id, "", "", "", imageId, "", "", listenerARN, loadbalancerARN, t.ec2, t.elb)
+	if err != nil {
+		t.fail(err, fmt.Sprintf("While getting tag for %s on scope resources", service))
+		return
+	}
+	t.remove("tag from scope resources", service, &tg)
+}
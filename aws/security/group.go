@@ -2,56 +2,215 @@ package security
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
 	"github.com/cantara/nerthus/aws/util"
 	"github.com/cantara/nerthus/aws/vpc"
 )
 
+// Executors are how scripts are run on the servers in a scope. The scope security group is tagged with it, scopes
+// created before the tag was added use ssh.
+const (
+	ExecutorSSH = "ssh"
+	ExecutorSSM = "ssm"
+)
+
+var ErrUnknownExecutor = errors.New("unknown executor")
+
+// CheckExecutor returns ErrUnknownExecutor for anything else than ssh, ssm and empty, which means ssh.
+func CheckExecutor(executor string) error {
+	switch executor {
+	case "", ExecutorSSH, ExecutorSSM:
+		return nil
+	}
+	return fmt.Errorf("%w %s, use %s or %s", ErrUnknownExecutor, executor, ExecutorSSH, ExecutorSSM)
+}
+
 type Group struct {
-	Scope   string `json:"-"`
-	Name    string `json:"name"`
-	Desc    string `json:"-"`
-	Id      string `json:"id"`
-	vpc     vpc.VPC
-	ec2     *ec2.Client
-	created bool
+	Scope    string `json:"-"`
+	Name     string `json:"name"`
+	Desc     string `json:"-"`
+	Id       string `json:"id"`
+	Executor string `json:"executor,omitempty"`
+	// AMIParameter is the ssm parameter the newest ami for servers in the scope is looked up in, empty is the default.
+	AMIParameter string `json:"ami_parameter,omitempty"`
+	// SSHSources are the cidrs and prefix lists ssh is allowed from, as recorded in the tags of the scope group.
+	SSHSources []string `json:"-"`
+	// Created is when the group was created, from its Created tag. It is zero for groups created before the tag was added.
+	Created     time.Time `json:"-"`
+	sshRecorded bool
+	vpc         vpc.VPC
+	ec2         util.EC2
+	created     bool
 }
 
-func NewGroup(scope string, vpc vpc.VPC, e2 *ec2.Client) (g Group, err error) {
+// VPCId returns the id of the vpc the group is in, empty for groups from crypt data.
+func (g Group) VPCId() string {
+	return g.vpc.Id
+}
+
+// UsesSSM reports if the servers in the scope run their scripts over ssm, and so needs no ssh access.
+func (g Group) UsesSSM() bool {
+	return g.Executor == ExecutorSSM
+}
+
+func GroupName(scope string) string {
+	return scope + "-sg"
+}
+
+func DBGroupName(scope, serviceName string) string {
+	return fmt.Sprintf("%s-%s-db", scope, serviceName)
+}
+
+func NewGroup(scope string, vpc vpc.VPC, e2 util.EC2) (g Group, err error) {
 	err = util.CheckEC2Session(e2)
 	if err != nil {
 		return
 	}
 	g = Group{
 		Scope: scope,
-		Name:  scope + "-sg",
-		Desc:  "Security group for scope: " + g.Scope,
+		Name:  GroupName(scope),
+		Desc:  "Security group for scope: " + scope,
 		vpc:   vpc,
 		ec2:   e2,
 	}
 	return
 }
 
-func NewDBGroup(serviceName, scope string, vpc vpc.VPC, e2 *ec2.Client) (g Group, err error) {
+func NewDBGroup(serviceName, scope string, vpc vpc.VPC, e2 util.EC2) (g Group, err error) {
 	err = util.CheckEC2Session(e2)
 	if err != nil {
 		return
 	}
 	g = Group{
 		Scope: scope,
-		Name:  fmt.Sprintf("%s-%s-db", g.Scope, serviceName),
-		Desc:  "Database security group for scope: " + g.Scope + " " + serviceName,
+		Name:  DBGroupName(scope, serviceName),
+		Desc:  "Database security group for scope: " + scope + " " + serviceName,
 		vpc:   vpc,
 		ec2:   e2,
 	}
 	return
 }
 
+func GetGroups(scope string, e2 util.EC2) (groups []Group, err error) {
+	err = util.CheckEC2Session(e2)
+	if err != nil {
+		return
+	}
+	result, err := e2.DescribeSecurityGroups(context.Background(), &ec2.DescribeSecurityGroupsInput{
+		Filters: []ec2types.Filter{
+			{
+				Name: aws.String("tag:Scope"),
+				Values: []string{
+					scope,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	for _, sg := range result.SecurityGroups {
+		groups = append(groups, Group{
+			Scope:        scope,
+			Name:         aws.ToString(sg.GroupName),
+			Desc:         aws.ToString(sg.Description),
+			Id:           aws.ToString(sg.GroupId),
+			Executor:     tagValue(sg.Tags, "Executor"),
+			AMIParameter: tagValue(sg.Tags, "AMIParameter"),
+			Created:      util.ParseCreated(tagValue(sg.Tags, util.CreatedTag)),
+			vpc:          vpc.VPC{Id: aws.ToString(sg.VpcId)},
+			ec2:          e2,
+			created:      true,
+		})
+		groups[len(groups)-1].readSSHSources(sg.Tags)
+	}
+	return
+}
+
+func GetGroup(id string, e2 util.EC2) (g Group, err error) {
+	err = util.CheckEC2Session(e2)
+	if err != nil {
+		return
+	}
+	result, err := e2.DescribeSecurityGroups(context.Background(), &ec2.DescribeSecurityGroupsInput{
+		GroupIds: []string{
+			id,
+		},
+	})
+	if err != nil {
+		return
+	}
+	if len(result.SecurityGroups) < 1 {
+		err = fmt.Errorf("No security group with id %s", id)
+		return
+	}
+	sg := result.SecurityGroups[0]
+	g = Group{
+		Name:         aws.ToString(sg.GroupName),
+		Desc:         aws.ToString(sg.Description),
+		Id:           aws.ToString(sg.GroupId),
+		Executor:     tagValue(sg.Tags, "Executor"),
+		AMIParameter: tagValue(sg.Tags, "AMIParameter"),
+		Created:      util.ParseCreated(tagValue(sg.Tags, util.CreatedTag)),
+		vpc:          vpc.VPC{Id: aws.ToString(sg.VpcId)},
+		ec2:          e2,
+		created:      true,
+	}
+	g.readSSHSources(sg.Tags)
+	for _, tag := range sg.Tags {
+		if aws.ToString(tag.Key) == "Scope" {
+			g.Scope = aws.ToString(tag.Value)
+		}
+	}
+	return
+}
+
+func tagValue(tags []ec2types.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == key {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
+
+// GetIngress returns the inbound rules the security group currently has in aws.
+func (g Group) GetIngress() (rules []Ingress, err error) {
+	err = util.CheckEC2Session(g.ec2)
+	if err != nil {
+		return
+	}
+	result, err := g.ec2.DescribeSecurityGroups(context.Background(), &ec2.DescribeSecurityGroupsInput{
+		GroupIds: []string{
+			g.Id,
+		},
+	})
+	if err != nil {
+		return
+	}
+	if len(result.SecurityGroups) < 1 {
+		err = fmt.Errorf("No security group with id %s", g.Id)
+		return
+	}
+	for _, p := range result.SecurityGroups[0].IpPermissions {
+		rules = append(rules, ingress(p)...)
+	}
+	return
+}
+
+func (g Group) IsScopeGroup() bool {
+	return g.Name == GroupName(g.Scope)
+}
+
 func (g *Group) Create() (groupId string, err error) {
 	err = util.CheckEC2Session(g.ec2)
 	if err != nil {
@@ -67,20 +226,45 @@ func (g *Group) Create() (groupId string, err error) {
 	}
 	g.Id = aws.ToString(secGroupRes.GroupId)
 	groupId = g.Id
+	g.Created = time.Now()
 
 	// Add tags to the created security group
+	tags := []ec2types.Tag{
+		{
+			Key:   aws.String("Name"),
+			Value: aws.String(g.Name),
+		},
+		{
+			Key:   aws.String("Scope"),
+			Value: aws.String(g.Scope),
+		},
+		{
+			Key:   aws.String(util.CreatedTag),
+			Value: aws.String(util.CreatedValue(g.Created)),
+		},
+	}
+	if g.Executor != "" {
+		tags = append(tags, ec2types.Tag{
+			Key:   aws.String("Executor"),
+			Value: aws.String(g.Executor),
+		})
+	}
+	if g.AMIParameter != "" {
+		tags = append(tags, ec2types.Tag{
+			Key:   aws.String("AMIParameter"),
+			Value: aws.String(g.AMIParameter),
+		})
+	}
+	if g.IsScopeGroup() {
+		// A new scope group allows ssh from nowhere until sources are added
+		tags = append(tags, ec2types.Tag{
+			Key:   aws.String("SSHSources"),
+			Value: aws.String(strings.Join(g.SSHSources, " ")),
+		})
+	}
 	_, err = g.ec2.CreateTags(context.Background(), &ec2.CreateTagsInput{
 		Resources: []string{groupId},
-		Tags: []ec2types.Tag{
-			{
-				Key:   aws.String("Name"),
-				Value: aws.String(g.Name),
-			},
-			{
-				Key:   aws.String("Scope"),
-				Value: aws.String(g.Scope),
-			},
-		},
+		Tags:      tags,
 	})
 	if err != nil {
 		err = util.CreateError{
@@ -90,6 +274,7 @@ func (g *Group) Create() (groupId string, err error) {
 		return
 	}
 	g.created = true
+	g.sshRecorded = g.IsScopeGroup()
 	return groupId, nil
 }
 
@@ -123,63 +308,156 @@ func (g *Group) Delete() (err error) {
 	return
 }
 
-func (g Group) AddBaseAuthorization() (err error) {
+func (g *Group) readSSHSources(tags []ec2types.Tag) {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == "SSHSources" {
+			g.SSHSources = strings.Fields(aws.ToString(tag.Value))
+			g.sshRecorded = true
+		}
+	}
+}
+
+// sshSources returns where ssh is allowed from. Scope groups created before the sources were recorded allows ssh from
+// everywhere, unless the scope uses ssm.
+func (g Group) sshSources() []string {
+	if g.sshRecorded || g.UsesSSM() {
+		return g.SSHSources
+	}
+	return []string{BaseIngress().Cidr}
+}
+
+// ScopeIngress returns the ingress the scope group should have, besides the ingress from the loadbalancers.
+func (g Group) ScopeIngress() (rules []Ingress) {
+	for _, source := range g.sshSources() {
+		i, err := SSHIngress(source)
+		if err != nil {
+			continue
+		}
+		rules = append(rules, i)
+	}
+	return
+}
+
+// AddSSHAccess allows ssh from the sources and records them in the tags of the group. Sources already allowed are
+// skipped, added are the ones that were not.
+func (g *Group) AddSSHAccess(sources []string) (added []string, err error) {
 	err = util.CheckEC2Session(g.ec2)
 	if err != nil {
 		return
 	}
-	input := &ec2.AuthorizeSecurityGroupIngressInput{
-		GroupId: aws.String(g.Id),
-		IpPermissions: []ec2types.IpPermission{
-			{
-				FromPort:   aws.Int32(22),
-				IpProtocol: aws.String("tcp"),
-				ToPort:     aws.Int32(22),
-				IpRanges: []ec2types.IpRange{
-					{
-						CidrIp:      aws.String("0.0.0.0/0"),
-						Description: aws.String("SSH access from everywhere"),
-					},
-				},
-			},
-		},
+	current := g.sshSources()
+	var rules []Ingress
+	var normalized []string
+	for _, source := range sources {
+		i, err := SSHIngress(source)
+		if err != nil {
+			return nil, err
+		}
+		source, _ = NormalizeSource(source)
+		if slices.Contains(current, source) || slices.Contains(normalized, source) {
+			continue
+		}
+		rules = append(rules, i)
+		normalized = append(normalized, source)
 	}
+	recorded := append(slices.Clone(current), normalized...)
+	if len(strings.Join(recorded, " ")) > maxTagValueLen {
+		return nil, fmt.Errorf("%w: too many ssh sources to record on security group %s, use a prefix list", ErrInvalidSource, g.Id)
+	}
+	for n, i := range rules {
+		_, err = g.ec2.AuthorizeSecurityGroupIngress(context.Background(), &ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId:       aws.String(g.Id),
+			IpPermissions: []ec2types.IpPermission{i.permission()},
+		})
+		if err != nil && !isErrorCode(err, "InvalidPermission.Duplicate") {
+			err = util.CreateError{
+				Text: fmt.Sprintf("Could not add ssh access from %s to security group %s %s.", normalized[n], g.Id, g.Name),
+				Err:  err,
+			}
+			return
+		}
+		added = append(added, normalized[n])
+	}
+	if len(added) == 0 && g.sshRecorded {
+		return added, nil
+	}
+	err = g.recordSSHSources(recorded)
+	return
+}
 
-	_, err = g.ec2.AuthorizeSecurityGroupIngress(context.Background(), input)
+// RevokeSSHAccess removes ssh access from the sources and records the ones left in the tags of the group. Sources that
+// are not allowed are skipped, revoked are the ones that were.
+func (g *Group) RevokeSSHAccess(sources []string) (revoked []string, err error) {
+	err = util.CheckEC2Session(g.ec2)
 	if err != nil {
-		err = util.CreateError{
-			Text: fmt.Sprintf("Could not add base authorization to security group %s %s.", g.Id, g.Name),
-			Err:  err,
+		return
+	}
+	current := g.sshSources()
+	for _, source := range sources {
+		i, err := SSHIngress(source)
+		if err != nil {
+			return revoked, err
+		}
+		source, _ = NormalizeSource(source)
+		if !slices.Contains(current, source) || slices.Contains(revoked, source) {
+			continue
+		}
+		_, err = g.ec2.RevokeSecurityGroupIngress(context.Background(), &ec2.RevokeSecurityGroupIngressInput{
+			GroupId:       aws.String(g.Id),
+			IpPermissions: []ec2types.IpPermission{i.permission()},
+		})
+		if err != nil && !isErrorCode(err, "InvalidPermission.NotFound") {
+			return revoked, fmt.Errorf("could not revoke ssh access from %s to security group %s %s: %w", source, g.Id, g.Name, err)
 		}
+		revoked = append(revoked, source)
+	}
+	if len(revoked) == 0 {
 		return
 	}
+	err = g.recordSSHSources(slices.DeleteFunc(slices.Clone(current), func(s string) bool {
+		return slices.Contains(revoked, s)
+	}))
+	return
+}
 
+// maxTagValueLen is the longest tag value aws accepts.
+const maxTagValueLen = 256
+
+func (g *Group) recordSSHSources(sources []string) (err error) {
+	value := strings.Join(sources, " ")
+	_, err = g.ec2.CreateTags(context.Background(), &ec2.CreateTagsInput{
+		Resources: []string{g.Id},
+		Tags: []ec2types.Tag{
+			{
+				Key:   aws.String("SSHSources"),
+				Value: aws.String(value),
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	g.SSHSources = sources
+	g.sshRecorded = true
 	return
 }
 
+func isErrorCode(err error, code string) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == code
+}
+
 func (g Group) AddDatabaseAuthorization(serverSgId string) (err error) {
 	err = util.CheckEC2Session(g.ec2)
 	if err != nil {
 		return
 	}
-	input := &ec2.AuthorizeSecurityGroupIngressInput{
+	_, err = g.ec2.AuthorizeSecurityGroupIngress(context.Background(), &ec2.AuthorizeSecurityGroupIngressInput{
 		GroupId: aws.String(g.Id),
 		IpPermissions: []ec2types.IpPermission{
-			{
-				FromPort:   aws.Int32(5432),
-				IpProtocol: aws.String("tcp"),
-				ToPort:     aws.Int32(5432),
-				UserIdGroupPairs: []ec2types.UserIdGroupPair{
-					{
-						Description: aws.String("Postgresql access from server"),
-						GroupId:     aws.String(serverSgId),
-					},
-				},
-			},
+			DatabaseIngress(serverSgId).permission(),
 		},
-	}
-
-	_, err = g.ec2.AuthorizeSecurityGroupIngress(context.Background(), input)
+	})
 	if err != nil {
 		err = util.CreateError{
 			Text: fmt.Sprintf("Could not add base authorization to security group %s %s.", g.Id, g.Name),
@@ -196,24 +474,12 @@ func (g Group) AddLoadbalancerAuthorization(loadbalancerId string, port int) (er
 	if err != nil {
 		return
 	}
-	input := &ec2.AuthorizeSecurityGroupIngressInput{
+	_, err = g.ec2.AuthorizeSecurityGroupIngress(context.Background(), &ec2.AuthorizeSecurityGroupIngressInput{
 		GroupId: aws.String(g.Id),
 		IpPermissions: []ec2types.IpPermission{
-			{
-				FromPort:   aws.Int32(int32(port)),
-				IpProtocol: aws.String("tcp"),
-				ToPort:     aws.Int32(int32(port)),
-				UserIdGroupPairs: []ec2types.UserIdGroupPair{
-					{
-						Description: aws.String("HTTP access from loadbalancer"),
-						GroupId:     aws.String(loadbalancerId),
-					},
-				},
-			},
+			LoadbalancerIngress(loadbalancerId, port).permission(),
 		},
-	}
-
-	_, err = g.ec2.AuthorizeSecurityGroupIngress(context.Background(), input)
+	})
 	if err != nil {
 		err = util.CreateError{
 			Text: fmt.Sprintf("Could not add service loadbalancer authorization to security group %s %s.", g.Id, g.Name),
@@ -293,7 +559,7 @@ func (g *Group) AuthorizeHazelcast() (err error) {
 	return
 }
 
-func (g Group) WithEC2(e *ec2.Client) Group {
+func (g Group) WithEC2(e util.EC2) Group {
 	g.ec2 = e
 	return g
 }
@@ -0,0 +1,180 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+var ErrInvalidSource = errors.New("invalid ssh source")
+
+// Ingress is a rule allowing inbound traffic to a security group, either from a cidr, a managed prefix list or from
+// another security group.
+type Ingress struct {
+	Port         int    `json:"port"`
+	ToPort       int    `json:"to_port,omitempty"`
+	Protocol     string `json:"protocol"`
+	Cidr         string `json:"cidr,omitempty"`
+	PrefixListId string `json:"prefix_list_id,omitempty"`
+	GroupId      string `json:"group_id,omitempty"`
+	Description  string `json:"description"`
+}
+
+func BaseIngress() Ingress {
+	return Ingress{
+		Port:        22,
+		Protocol:    "tcp",
+		Cidr:        "0.0.0.0/0",
+		Description: "SSH access from everywhere",
+	}
+}
+
+// SSHIngress returns the ingress allowing ssh from the source. The source is a cidr, a single ip address or the id of a
+// managed prefix list. Everywhere, 0.0.0.0/0, is BaseIngress.
+func SSHIngress(source string) (i Ingress, err error) {
+	source, err = NormalizeSource(source)
+	if err != nil {
+		return
+	}
+	if source == BaseIngress().Cidr {
+		return BaseIngress(), nil
+	}
+	i = Ingress{
+		Port:        22,
+		Protocol:    "tcp",
+		Description: "SSH access for admins",
+	}
+	if strings.HasPrefix(source, "pl-") {
+		i.PrefixListId = source
+		return
+	}
+	i.Cidr = source
+	return
+}
+
+// SSHIngresses returns the ingress allowing ssh from each of the sources.
+func SSHIngresses(sources []string) (rules []Ingress, err error) {
+	for _, source := range sources {
+		i, err := SSHIngress(source)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, i)
+	}
+	return
+}
+
+// NormalizeSource returns the source as it is stored in aws. Ip addresses becomes /32 or /128 cidrs and the host bits
+// of cidrs are cleared.
+func NormalizeSource(source string) (string, error) {
+	source = strings.TrimSpace(source)
+	if strings.HasPrefix(source, "pl-") {
+		return source, nil
+	}
+	if prefix, err := netip.ParsePrefix(source); err == nil {
+		return prefix.Masked().String(), nil
+	}
+	if addr, err := netip.ParseAddr(source); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()).String(), nil
+	}
+	return "", fmt.Errorf("%w %q, use a cidr, an ip address or a prefix list id", ErrInvalidSource, source)
+}
+
+func DatabaseIngress(serverSgId string) Ingress {
+	return Ingress{
+		Port:        5432,
+		Protocol:    "tcp",
+		GroupId:     serverSgId,
+		Description: "Postgresql access from server",
+	}
+}
+
+func LoadbalancerIngress(loadbalancerId string, port int) Ingress {
+	return Ingress{
+		Port:        port,
+		Protocol:    "tcp",
+		GroupId:     loadbalancerId,
+		Description: "HTTP access from loadbalancer",
+	}
+}
+
+func (i Ingress) permission() (p ec2types.IpPermission) {
+	p = ec2types.IpPermission{
+		FromPort:   aws.Int32(int32(i.Port)),
+		IpProtocol: aws.String(i.Protocol),
+		ToPort:     aws.Int32(int32(i.Port)),
+	}
+	if i.Cidr != "" && strings.Contains(i.Cidr, ":") {
+		p.Ipv6Ranges = []ec2types.Ipv6Range{
+			{
+				CidrIpv6:    aws.String(i.Cidr),
+				Description: aws.String(i.Description),
+			},
+		}
+	} else if i.Cidr != "" {
+		p.IpRanges = []ec2types.IpRange{
+			{
+				CidrIp:      aws.String(i.Cidr),
+				Description: aws.String(i.Description),
+			},
+		}
+	}
+	if i.PrefixListId != "" {
+		p.PrefixListIds = []ec2types.PrefixListId{
+			{
+				Description:  aws.String(i.Description),
+				PrefixListId: aws.String(i.PrefixListId),
+			},
+		}
+	}
+	if i.GroupId != "" {
+		p.UserIdGroupPairs = []ec2types.UserIdGroupPair{
+			{
+				Description: aws.String(i.Description),
+				GroupId:     aws.String(i.GroupId),
+			},
+		}
+	}
+	return
+}
+
+// ingress flattens a permission to one Ingress per cidr, prefix list and security group it allows traffic from.
+// ToPort is only set for permissions that covers a range of ports.
+func ingress(p ec2types.IpPermission) (rules []Ingress) {
+	base := Ingress{
+		Port:     int(aws.ToInt32(p.FromPort)),
+		Protocol: aws.ToString(p.IpProtocol),
+	}
+	if aws.ToInt32(p.ToPort) != aws.ToInt32(p.FromPort) {
+		base.ToPort = int(aws.ToInt32(p.ToPort))
+	}
+	for _, r := range p.IpRanges {
+		i := base
+		i.Cidr = aws.ToString(r.CidrIp)
+		i.Description = aws.ToString(r.Description)
+		rules = append(rules, i)
+	}
+	for _, r := range p.Ipv6Ranges {
+		i := base
+		i.Cidr = aws.ToString(r.CidrIpv6)
+		i.Description = aws.ToString(r.Description)
+		rules = append(rules, i)
+	}
+	for _, pl := range p.PrefixListIds {
+		i := base
+		i.PrefixListId = aws.ToString(pl.PrefixListId)
+		i.Description = aws.ToString(pl.Description)
+		rules = append(rules, i)
+	}
+	for _, pair := range p.UserIdGroupPairs {
+		i := base
+		i.GroupId = aws.ToString(pair.GroupId)
+		i.Description = aws.ToString(pair.Description)
+		rules = append(rules, i)
+	}
+	return
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/smithy-go"
+	"github.com/cantara/nerthus/aws/util"
+)
+
+// The ami parameters a scope or server can be given by name. They are the public ssm parameters aws keeps the newest
+// Amazon Linux amis in, for the architecture of the instance type. Any other parameter is given by its path.
+const (
+	AMIAmazonLinux2023 = "al2023"
+	AMIAmazonLinux2    = "al2"
+)
+
+var ErrUnknownAMIParameter = errors.New("unknown ami parameter")
+
+// CheckAMIParameter returns ErrUnknownAMIParameter for anything else than al2023, al2, a parameter path and empty,
+// which means the default.
+func CheckAMIParameter(parameter string) error {
+	switch {
+	case parameter == "", parameter == AMIAmazonLinux2023, parameter == AMIAmazonLinux2, strings.HasPrefix(parameter, "/"):
+		return nil
+	}
+	return fmt.Errorf("%w %s, use %s, %s or the path of a parameter", ErrUnknownAMIParameter, parameter, AMIAmazonLinux2023,
+		AMIAmazonLinux2)
+}
+
+// DefaultAMIParameter is the ami parameter of scopes that are not given one, ami_parameter in the env file or al2023.
+func DefaultAMIParameter() string {
+	if parameter := os.Getenv("ami_parameter"); parameter != "" {
+		return parameter
+	}
+	return AMIAmazonLinux2023
+}
+
+// AMIParameterPath returns the path of the ami parameter for the architecture.
+func AMIParameterPath(parameter string, architecture ec2types.ArchitectureType) (string, error) {
+	switch parameter {
+	case AMIAmazonLinux2023:
+		return "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-" + string(architecture), nil
+	case AMIAmazonLinux2:
+		return "/aws/service/ami-amazon-linux-latest/amzn2-ami-hvm-" + string(architecture) + "-gp2", nil
+	}
+	err := CheckAMIParameter(parameter)
+	if err != nil || parameter == "" {
+		return "", fmt.Errorf("%w %q", ErrUnknownAMIParameter, parameter)
+	}
+	return parameter, nil
+}
+
+// architecture returns the architecture the instance type runs amis for, preferring arm64 and x86_64 over older ones.
+func architecture(instanceType string, e2 util.EC2) (architecture ec2types.ArchitectureType, err error) {
+	result, err := e2.DescribeInstanceTypes(context.Background(), &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []ec2types.InstanceType{ec2types.InstanceType(instanceType)},
+	})
+	if err != nil {
+		return "", fmt.Errorf("%w: instance type %s: %w", ErrInvalidSizing, instanceType, err)
+	}
+	if len(result.InstanceTypes) == 0 || result.InstanceTypes[0].ProcessorInfo == nil {
+		return "", fmt.Errorf("%w: instance type %s does not exist", ErrInvalidSizing, instanceType)
+	}
+	supported := result.InstanceTypes[0].ProcessorInfo.SupportedArchitectures
+	for _, a := range []ec2types.ArchitectureType{ec2types.ArchitectureTypeArm64, ec2types.ArchitectureTypeX8664} {
+		if slices.Contains(supported, a) {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("%w: instance type %s only supports %v", ErrInvalidSizing, instanceType, supported)
+}
+
+// GetParameterAMI returns the ami id the parameter at path has as value.
+func GetParameterAMI(path string, p util.SSM) (ami string, err error) {
+	if p == nil {
+		return "", fmt.Errorf("No ssm session found")
+	}
+	result, err := p.GetParameter(context.Background(), &ssm.GetParameterInput{
+		Name: aws.String(path),
+	})
+	if err != nil {
+		return "", fmt.Errorf("%w: while getting ami from parameter %s: %w", ErrInvalidSizing, path, err)
+	}
+	ami = aws.ToString(result.Parameter.Value)
+	if !strings.HasPrefix(ami, "ami-") {
+		return "", fmt.Errorf("%w: parameter %s has %q, not an ami id", ErrInvalidSizing, path, ami)
+	}
+	return
+}
+
+// ResolveAMI returns the sizing with the ami it is created from. An ami in the sizing is used as it is, otherwise it
+// is looked up in the ami parameter of the sizing or else the one of the scope. Without either the ami from the env
+// file is used if there is one, and the default ami parameter if not. The path of the parameter the ami was looked up
+// in is kept in AMIParameter.
+func (s Sizing) ResolveAMI(scopeParameter string, e2 util.EC2, p util.SSM) (Sizing, error) {
+	if s.AMI != "" {
+		s.AMIParameter = ""
+		return s, nil
+	}
+	parameter := s.AMIParameter
+	if parameter == "" {
+		parameter = scopeParameter
+	}
+	if parameter == "" {
+		if ami := os.Getenv("ami"); ami != "" {
+			s.AMI = ami
+			return s, nil
+		}
+		parameter = DefaultAMIParameter()
+	}
+	instanceType := s.InstanceType
+	if instanceType == "" {
+		instanceType = DefaultInstanceType
+	}
+	arch, err := architecture(instanceType, e2)
+	if err != nil {
+		return s, err
+	}
+	path, err := AMIParameterPath(parameter, arch)
+	if err != nil {
+		return s, fmt.Errorf("%w: %w", ErrInvalidSizing, err)
+	}
+	s.AMI, err = GetParameterAMI(path, p)
+	if err != nil {
+		return s, err
+	}
+	s.AMIParameter = path
+	return s, nil
+}
+
+// ImageCreated returns when each of the amis was created. Amis that no longer exists are left out.
+func ImageCreated(amis []string, e2 util.EC2) (created map[string]time.Time, err error) {
+	created = make(map[string]time.Time)
+	for _, ami := range amis {
+		result, err := e2.DescribeImages(context.Background(), &ec2.DescribeImagesInput{
+			ImageIds: []string{ami},
+		})
+		if err != nil {
+			var apiErr smithy.APIError
+			if errors.As(err, &apiErr) && strings.HasPrefix(apiErr.ErrorCode(), "InvalidAMIID") {
+				continue
+			}
+			return nil, err
+		}
+		for _, image := range result.Images {
+			t, err := time.Parse(time.RFC3339, aws.ToString(image.CreationDate))
+			if err != nil {
+				return nil, fmt.Errorf("while parsing creation date of %s: %w", ami, err)
+			}
+			created[aws.ToString(image.ImageId)] = t
+		}
+	}
+	return
+}
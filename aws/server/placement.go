@@ -0,0 +1,62 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/cantara/nerthus/aws/util"
+	"github.com/cantara/nerthus/aws/vpc"
+)
+
+var ErrInvalidPlacement = errors.New("invalid placement")
+
+// Placement is where in the subnets of the scope a server is created. Servers for the same artifact are spread across
+// the availability zones of the scope, and the rest of the servers in the scope as evenly as that allows. A subnet pins
+// the server to that subnet instead.
+type Placement struct {
+	ArtifactId string `form:"artifact_id" json:"artifact_id,omitempty" xml:"artifact_id" yaml:"artifact_id,omitempty"`
+	Subnet     string `form:"subnet" json:"subnet,omitempty" xml:"subnet" yaml:"subnet,omitempty"`
+}
+
+// Place returns the subnet the server is created in, the subnet in the availability zone with the fewest servers running
+// the artifact, then with the fewest servers at all, and the first such subnet on a tie. Servers created one after
+// another go round robin across the zones, also before the artifact is installed on them. Without subnets the server is
+// created where aws puts it, in a default subnet of the default vpc.
+func (p Placement) Place(scope string, subnets []vpc.Subnet, e2 util.EC2) (subnet vpc.Subnet, err error) {
+	if p.Subnet != "" {
+		i := slices.IndexFunc(subnets, func(s vpc.Subnet) bool { return s.Id == p.Subnet })
+		if i < 0 {
+			err = fmt.Errorf("%w: %s is not one of the subnets of scope %s", ErrInvalidPlacement, p.Subnet, scope)
+			return
+		}
+		return subnets[i], nil
+	}
+	if len(subnets) == 0 {
+		return
+	}
+	servers, err := GetServers(scope, e2)
+	if err != nil {
+		return
+	}
+	artifact := make(map[string]int)
+	zones := make(map[string]int)
+	perSubnet := make(map[string]int)
+	for _, s := range servers {
+		if p.ArtifactId != "" && slices.Contains(s.Services, p.ArtifactId) {
+			artifact[s.AvailabilityZone]++
+		}
+		zones[s.AvailabilityZone]++
+		perSubnet[s.SubnetId]++
+	}
+	load := func(s vpc.Subnet) []int {
+		return []int{artifact[s.AvailabilityZone], zones[s.AvailabilityZone], perSubnet[s.Id]}
+	}
+	subnet = subnets[0]
+	for _, s := range subnets[1:] {
+		if slices.Compare(load(s), load(subnet)) < 0 {
+			subnet = s
+		}
+	}
+	return
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"time"
@@ -12,39 +13,80 @@ import (
 	"github.com/cantara/nerthus/aws/key"
 	"github.com/cantara/nerthus/aws/security"
 	"github.com/cantara/nerthus/aws/util"
+	"github.com/cantara/nerthus/aws/vpc"
 )
 
+var ErrNotFound = errors.New("server not found")
+
 type Server struct {
 	Name               string
 	Scope              string
 	Id                 string
 	PublicDNS          string
-	VolumeId           string `json:"volume_id"`
-	NetworkInterfaceId string `json:"network_interface_id"`
-	ImageId            string `json:"image_id"`
+	VolumeId           string   `json:"volume_id"`
+	NetworkInterfaceId string   `json:"network_interface_id"`
+	ImageId            string   `json:"image_id"`
+	AMIParameter       string   `json:"ami_parameter,omitempty"`
+	InstanceType       string   `json:"instance_type"`
+	InstanceProfile    string   `json:"instance_profile,omitempty"`
+	SubnetId           string   `json:"subnet_id,omitempty"`
+	AvailabilityZone   string   `json:"availability_zone,omitempty"`
+	RootVolume         string   `json:"root_volume,omitempty"`
+	DataVolumes        string   `json:"data_volumes,omitempty"`
+	Services           []string `json:"services,omitempty"`
+	State              string   `json:"state,omitempty"`
 	key                key.Key
 	group              security.Group
-	ec2                *ec2.Client
+	ec2                util.EC2
+	sizing             Sizing
 	created            bool
 }
 
-func NewServer(name, scope string, key key.Key, group security.Group, e2 *ec2.Client) (s Server, err error) {
+func NewServer(name, scope string, key key.Key, group security.Group, e2 util.EC2) (s Server, err error) {
 	err = util.CheckEC2Session(e2)
 	if err != nil {
 		return
 	}
 	s = Server{
-		Name:    name,
-		Scope:   scope,
-		ImageId: os.Getenv("ami"),
-		key:     key,
-		group:   group,
-		ec2:     e2,
+		Name:  name,
+		Scope: scope,
+		key:   key,
+		group: group,
+		ec2:   e2,
+	}
+	s.SetSizing(Sizing{})
+	if group.UsesSSM() {
+		s.InstanceProfile = InstanceProfile()
 	}
 	return
 }
 
-func GetServer(name, scope string, key key.Key, group security.Group, e2 *ec2.Client) (s Server, err error) {
+// SetSizing sets the instance type, ami and volumes the server is created with, empty fields are the defaults.
+func (s *Server) SetSizing(z Sizing) {
+	s.sizing = z.WithDefaults()
+	s.ImageId = s.sizing.AMI
+	s.AMIParameter = s.sizing.AMIParameter
+	s.InstanceType = s.sizing.InstanceType
+	s.RootVolume = s.sizing.RootVolume().String()
+	s.DataVolumes = s.sizing.dataVolumes()
+}
+
+// SetSubnet sets the subnet the server is created in. Without one aws picks a default subnet of the default vpc.
+func (s *Server) SetSubnet(subnet vpc.Subnet) {
+	s.SubnetId = subnet.Id
+	s.AvailabilityZone = subnet.AvailabilityZone
+}
+
+// InstanceProfile is the instance profile servers in scopes using ssm are created with. It needs the
+// AmazonSSMManagedInstanceCore policy for the ssm agent to register the server.
+func InstanceProfile() string {
+	if profile := os.Getenv("ssm_instance_profile"); profile != "" {
+		return profile
+	}
+	return "Nerthus-Server"
+}
+
+func GetServer(name, scope string, key key.Key, group security.Group, e2 util.EC2) (s Server, err error) {
 	result, err := e2.DescribeInstances(context.Background(), &ec2.DescribeInstancesInput{
 		Filters: []ec2types.Filter{
 			{
@@ -59,7 +101,7 @@ func GetServer(name, scope string, key key.Key, group security.Group, e2 *ec2.Cl
 		return
 	}
 	if len(result.Reservations) < 1 {
-		err = fmt.Errorf("No servers with name %s", name)
+		err = fmt.Errorf("%w: no servers with name %s", ErrNotFound, name)
 		return
 	}
 	/* if len(result.Reservations) > 1 {
@@ -86,17 +128,135 @@ func GetServer(name, scope string, key key.Key, group security.Group, e2 *ec2.Cl
 						NetworkInterfaceId: aws.ToString(instance.NetworkInterfaces[0].NetworkInterfaceId),
 						ImageId:            aws.ToString(instance.ImageId),
 						ec2:                e2,
+						created:            true,
 					}
 					return
 				}
 			}
 		}
 	}
-	err = fmt.Errorf("Server name %s was not in scope %s", name, scope)
+	err = fmt.Errorf("%w: server name %s was not in scope %s", ErrNotFound, name, scope)
+	return
+}
+
+func GetServerById(id string, key key.Key, group security.Group, e2 util.EC2) (s Server, err error) {
+	err = util.CheckEC2Session(e2)
+	if err != nil {
+		return
+	}
+	result, err := e2.DescribeInstances(context.Background(), &ec2.DescribeInstancesInput{
+		InstanceIds: []string{id},
+	})
+	if err != nil {
+		return
+	}
+	if len(result.Reservations) < 1 || len(result.Reservations[0].Instances) < 1 {
+		err = fmt.Errorf("%w: no server with id %s", ErrNotFound, id)
+		return
+	}
+	instance := result.Reservations[0].Instances[0]
+	s = Server{
+		Id:        aws.ToString(instance.InstanceId),
+		PublicDNS: aws.ToString(instance.PublicDnsName),
+		ImageId:   aws.ToString(instance.ImageId),
+		key:       key,
+		group:     group,
+		ec2:       e2,
+		created:   true,
+	}
+	for _, tag := range instance.Tags {
+		switch aws.ToString(tag.Key) {
+		case "Name":
+			s.Name = aws.ToString(tag.Value)
+		case "Scope":
+			s.Scope = aws.ToString(tag.Value)
+		}
+	}
+	if len(instance.BlockDeviceMappings) > 0 && instance.BlockDeviceMappings[0].Ebs != nil {
+		s.VolumeId = aws.ToString(instance.BlockDeviceMappings[0].Ebs.VolumeId)
+	}
+	if len(instance.NetworkInterfaces) > 0 {
+		s.NetworkInterfaceId = aws.ToString(instance.NetworkInterfaces[0].NetworkInterfaceId)
+	}
+	return
+}
+
+func GetServers(scope string, e2 util.EC2) (servers []Server, err error) {
+	err = util.CheckEC2Session(e2)
+	if err != nil {
+		return
+	}
+	first := true
+	var nextToken *string
+	for nextToken != nil || first {
+		first = false
+		result, err := e2.DescribeInstances(context.Background(), &ec2.DescribeInstancesInput{
+			Filters: []ec2types.Filter{
+				{
+					Name: aws.String("tag:Scope"),
+					Values: []string{
+						scope,
+					},
+				},
+			},
+			NextToken: nextToken,
+		})
+		if err != nil {
+			return nil, err
+		}
+		nextToken = result.NextToken
+		for _, reservation := range result.Reservations {
+			for _, instance := range reservation.Instances {
+				if instance.State.Name == ec2types.InstanceStateNameTerminated || instance.State.Name == ec2types.InstanceStateNameShuttingDown {
+					continue
+				}
+				s := Server{
+					Scope:        scope,
+					Id:           aws.ToString(instance.InstanceId),
+					PublicDNS:    aws.ToString(instance.PublicDnsName),
+					ImageId:      aws.ToString(instance.ImageId),
+					InstanceType: string(instance.InstanceType),
+					State:        string(instance.State.Name),
+					SubnetId:     aws.ToString(instance.SubnetId),
+					ec2:          e2,
+					created:      true,
+				}
+				if instance.Placement != nil {
+					s.AvailabilityZone = aws.ToString(instance.Placement.AvailabilityZone)
+				}
+				for _, tag := range instance.Tags {
+					key := aws.ToString(tag.Key)
+					switch key {
+					case "Name":
+						s.Name = aws.ToString(tag.Value)
+					case "RootVolume":
+						s.RootVolume = aws.ToString(tag.Value)
+					case "DataVolumes":
+						s.DataVolumes = aws.ToString(tag.Value)
+					case "AMIParameter":
+						s.AMIParameter = aws.ToString(tag.Value)
+					case "Scope", "InstanceType", "AMI":
+					default:
+						if aws.ToString(tag.Value) == scope {
+							// Services are tagged on the servers running them with the artifact id as key and scope as value
+							s.Services = append(s.Services, key)
+						}
+					}
+				}
+				if len(instance.BlockDeviceMappings) > 0 && instance.BlockDeviceMappings[0].Ebs != nil {
+					s.VolumeId = aws.ToString(instance.BlockDeviceMappings[0].Ebs.VolumeId)
+				}
+				if len(instance.NetworkInterfaces) > 0 {
+					s.NetworkInterfaceId = aws.ToString(instance.NetworkInterfaces[0].NetworkInterfaceId)
+				}
+				servers = append(servers, s)
+			}
+		}
+	}
 	return
 }
 
-func NameAvailable(name string, e2 *ec2.Client) (available bool, err error) {
+func NameAvailable(name string, e2 util.EC2) (available bool, err error) {
 	result, err := e2.DescribeInstances(context.Background(), &ec2.DescribeInstancesInput{
 		Filters: []ec2types.Filter{
 			{
@@ -124,30 +284,30 @@ func NameAvailable(name string, e2 *ec2.Client) (available bool, err error) {
 }
 
 func (s *Server) Create() (id string, err error) {
+	var profile *ec2types.IamInstanceProfileSpecification
+	if s.InstanceProfile != "" {
+		profile = &ec2types.IamInstanceProfileSpecification{
+			Name: aws.String(s.InstanceProfile),
+		}
+	}
 	// Specify the details of the instance that you want to create
 	result, err := s.ec2.RunInstances(context.Background(), &ec2.RunInstancesInput{
-		ImageId:          aws.String(s.ImageId), //ami-0142f6ace1c558c7d"),
-		InstanceType:     "t3.micro",
-		MinCount:         aws.Int32(1),
-		MaxCount:         aws.Int32(1),
-		SecurityGroupIds: []string{s.group.Id},
-		KeyName:          aws.String(s.key.Name),
-		BlockDeviceMappings: []ec2types.BlockDeviceMapping{
-			{
-				DeviceName: aws.String("/dev/xvda"),
-				Ebs: &ec2types.EbsBlockDevice{
-					VolumeSize: aws.Int32(20),
-					VolumeType: "gp3",
-				},
-			},
-		},
+		IamInstanceProfile: profile,
+		ImageId:            aws.String(s.ImageId), //ami-0142f6ace1c558c7d"),
+		InstanceType:       ec2types.InstanceType(s.InstanceType),
+		MinCount:           aws.Int32(1),
+		MaxCount:           aws.Int32(1),
+		SecurityGroupIds:   []string{s.group.Id},
+		SubnetId:           subnetId(s.SubnetId),
+		KeyName:            aws.String(s.key.Name),
 		MetadataOptions: &ec2types.InstanceMetadataOptionsRequest{
 			HttpTokens: ec2types.HttpTokensStateRequired,
 		},
+		BlockDeviceMappings: s.sizing.blockDevices(),
 		TagSpecifications: []ec2types.TagSpecification{
 			{
 				ResourceType: "instance",
-				Tags: []ec2types.Tag{
+				Tags: append([]ec2types.Tag{
 					{
 						Key:   aws.String("Name"),
 						Value: aws.String(s.Name),
@@ -156,7 +316,7 @@ func (s *Server) Create() (id string, err error) {
 						Key:   aws.String("Scope"),
 						Value: aws.String(s.Scope),
 					},
-				},
+				}, s.sizing.tags()...),
 			},
 			{
 				ResourceType: "volume",
@@ -181,6 +341,10 @@ func (s *Server) Create() (id string, err error) {
 		return
 	}
 	s.Id = aws.ToString(result.Instances[0].InstanceId)
+	s.SubnetId = aws.ToString(result.Instances[0].SubnetId)
+	if result.Instances[0].Placement != nil {
+		s.AvailabilityZone = aws.ToString(result.Instances[0].Placement.AvailabilityZone)
+	}
 	s.NetworkInterfaceId = aws.ToString(result.Instances[0].NetworkInterfaces[0].NetworkInterfaceId)
 	//s.VolumeId = aws.ToString(result.Instances[0].BlockDeviceMappings[0].Ebs.VolumeId)
 	id = s.Id
@@ -188,6 +352,13 @@ func (s *Server) Create() (id string, err error) {
 	return
 }
 
+func subnetId(id string) *string {
+	if id == "" {
+		return nil
+	}
+	return aws.String(id)
+}
+
 func (s *Server) Delete() (err error) {
 	if !s.created {
 		return
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/cantara/nerthus/aws/util"
+)
+
+var ErrInvalidSizing = errors.New("invalid server sizing")
+
+const (
+	DefaultInstanceType = "t3.micro"
+	DefaultVolumeSize   = 20
+	DefaultVolumeType   = "gp3"
+	// maxDataVolumes is how many data volumes a server can have, they are attached as /dev/sdf to /dev/sdm.
+	maxDataVolumes = 8
+)
+
+// Volume is an ebs volume of a server. Size is in GiB, IOPS is only for gp3, io1 and io2.
+type Volume struct {
+	Size int32  `form:"size" json:"size" xml:"size" yaml:"size"`
+	Type string `form:"type" json:"type,omitempty" xml:"type" yaml:"type"`
+	IOPS int32  `form:"iops" json:"iops,omitempty" xml:"iops" yaml:"iops"`
+}
+
+// Sizing is the instance type, ami and volumes of a server. Empty fields are the defaults, t3.micro with the ami from the
+// ami parameter of the scope and a 20 GiB gp3 root volume. AMIParameter is only used when AMI is empty, see ResolveAMI.
+type Sizing struct {
+	InstanceType string   `form:"instance_type" json:"instance_type,omitempty" xml:"instance_type" yaml:"instance_type"`
+	AMI          string   `form:"ami" json:"ami,omitempty" xml:"ami" yaml:"ami"`
+	AMIParameter string   `form:"ami_parameter" json:"ami_parameter,omitempty" xml:"ami_parameter" yaml:"ami_parameter"`
+	VolumeSize   int32    `form:"volume_size" json:"volume_size,omitempty" xml:"volume_size" yaml:"volume_size"`
+	VolumeType   string   `form:"volume_type" json:"volume_type,omitempty" xml:"volume_type" yaml:"volume_type"`
+	VolumeIOPS   int32    `form:"volume_iops" json:"volume_iops,omitempty" xml:"volume_iops" yaml:"volume_iops"`
+	DataVolumes  []Volume `form:"data_volumes" json:"data_volumes,omitempty" xml:"data_volumes" yaml:"data_volumes"`
+}
+
+// WithDefaults fills in the defaults for the empty fields.
+func (s Sizing) WithDefaults() Sizing {
+	if s.InstanceType == "" {
+		s.InstanceType = DefaultInstanceType
+	}
+	if s.AMI == "" {
+		s.AMI = os.Getenv("ami")
+	}
+	if s.VolumeSize == 0 {
+		s.VolumeSize = DefaultVolumeSize
+	}
+	if s.VolumeType == "" {
+		s.VolumeType = DefaultVolumeType
+	}
+	s.DataVolumes = slices.Clone(s.DataVolumes)
+	for i := range s.DataVolumes {
+		if s.DataVolumes[i].Type == "" {
+			s.DataVolumes[i].Type = DefaultVolumeType
+		}
+	}
+	return s
+}
+
+// RootVolume is the root volume of the sizing.
+func (s Sizing) RootVolume() Volume {
+	return Volume{
+		Size: s.VolumeSize,
+		Type: s.VolumeType,
+		IOPS: s.VolumeIOPS,
+	}
+}
+
+// iopsRange is the iops each volume type allows, types that are not here does not take iops.
+var iopsRange = map[string][2]int32{
+	"gp3": {3000, 16000},
+	"io1": {100, 64000},
+	"io2": {100, 256000},
+}
+
+var volumeTypes = []string{"gp2", "gp3", "io1", "io2", "st1", "sc1", "standard"}
+
+func (v Volume) check(name string) error {
+	if !slices.Contains(volumeTypes, v.Type) {
+		return fmt.Errorf("%w: %s has unknown volume type %q, use one of %s", ErrInvalidSizing, name, v.Type, strings.Join(volumeTypes, ", "))
+	}
+	if v.Size < 1 || v.Size > 16384 {
+		return fmt.Errorf("%w: %s size %d GiB is not between 1 and 16384", ErrInvalidSizing, name, v.Size)
+	}
+	limits, ok := iopsRange[v.Type]
+	if !ok && v.IOPS != 0 {
+		return fmt.Errorf("%w: %s of type %s does not take iops", ErrInvalidSizing, name, v.Type)
+	}
+	if (v.Type == "io1" || v.Type == "io2") && v.IOPS == 0 {
+		return fmt.Errorf("%w: %s of type %s needs iops", ErrInvalidSizing, name, v.Type)
+	}
+	if v.IOPS != 0 && (v.IOPS < limits[0] || v.IOPS > limits[1]) {
+		return fmt.Errorf("%w: %s iops %d is not between %d and %d for %s", ErrInvalidSizing, name, v.IOPS, limits[0], limits[1], v.Type)
+	}
+	return nil
+}
+
+// String is how the volume is shown in tags and inventory, like "20GiB gp3" or "100GiB io2 5000iops".
+func (v Volume) String() string {
+	s := fmt.Sprintf("%dGiB %s", v.Size, v.Type)
+	if v.IOPS != 0 {
+		s += fmt.Sprintf(" %diops", v.IOPS)
+	}
+	return s
+}
+
+// Validate checks the sizing, with defaults, against what the region offers: the instance type must be offered in the
+// region, the ami must be available, built for an architecture the instance type supports and fit on the root volume.
+func (s Sizing) Validate(e2 util.EC2) (err error) {
+	s = s.WithDefaults()
+	if s.AMI == "" {
+		return fmt.Errorf("%w: no ami is configured", ErrInvalidSizing)
+	}
+	err = s.RootVolume().check("root volume")
+	if err != nil {
+		return
+	}
+	if len(s.DataVolumes) > maxDataVolumes {
+		return fmt.Errorf("%w: %d data volumes, at most %d are supported", ErrInvalidSizing, len(s.DataVolumes), maxDataVolumes)
+	}
+	for i, v := range s.DataVolumes {
+		err = v.check(fmt.Sprintf("data volume %d", i+1))
+		if err != nil {
+			return
+		}
+	}
+	offerings, err := e2.DescribeInstanceTypeOfferings(context.Background(), &ec2.DescribeInstanceTypeOfferingsInput{
+		LocationType: ec2types.LocationTypeRegion,
+		Filters: []ec2types.Filter{
+			{
+				Name:   aws.String("instance-type"),
+				Values: []string{s.InstanceType},
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	if len(offerings.InstanceTypeOfferings) == 0 {
+		return fmt.Errorf("%w: instance type %s is not offered in the region", ErrInvalidSizing, s.InstanceType)
+	}
+	types, err := e2.DescribeInstanceTypes(context.Background(), &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []ec2types.InstanceType{ec2types.InstanceType(s.InstanceType)},
+	})
+	if err != nil {
+		return
+	}
+	images, err := e2.DescribeImages(context.Background(), &ec2.DescribeImagesInput{
+		ImageIds: []string{s.AMI},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: ami %s: %w", ErrInvalidSizing, s.AMI, err)
+	}
+	if len(images.Images) == 0 || images.Images[0].State != ec2types.ImageStateAvailable {
+		return fmt.Errorf("%w: ami %s is not available", ErrInvalidSizing, s.AMI)
+	}
+	image := images.Images[0]
+	if len(types.InstanceTypes) > 0 && types.InstanceTypes[0].ProcessorInfo != nil {
+		architectures := types.InstanceTypes[0].ProcessorInfo.SupportedArchitectures
+		if !slices.Contains(architectures, ec2types.ArchitectureType(image.Architecture)) {
+			return fmt.Errorf("%w: ami %s is built for %s, instance type %s supports %v", ErrInvalidSizing, s.AMI, image.Architecture,
+				s.InstanceType, architectures)
+		}
+	}
+	for _, bdm := range image.BlockDeviceMappings {
+		if aws.ToString(bdm.DeviceName) != aws.ToString(image.RootDeviceName) || bdm.Ebs == nil {
+			continue
+		}
+		if size := aws.ToInt32(bdm.Ebs.VolumeSize); size > s.VolumeSize {
+			return fmt.Errorf("%w: ami %s needs a root volume of at least %d GiB", ErrInvalidSizing, s.AMI, size)
+		}
+	}
+	return nil
+}
+
+// dataDevice is the device name of the data volume at index i.
+func dataDevice(i int) string {
+	return "/dev/sd" + string(rune('f'+i))
+}
+
+func (v Volume) blockDevice(device string) ec2types.BlockDeviceMapping {
+	ebs := &ec2types.EbsBlockDevice{
+		VolumeSize:          aws.Int32(v.Size),
+		VolumeType:          ec2types.VolumeType(v.Type),
+		DeleteOnTermination: aws.Bool(true),
+	}
+	if v.IOPS != 0 {
+		ebs.Iops = aws.Int32(v.IOPS)
+	}
+	return ec2types.BlockDeviceMapping{
+		DeviceName: aws.String(device),
+		Ebs:        ebs,
+	}
+}
+
+// blockDevices are the root volume and data volumes of the server.
+func (s Sizing) blockDevices() []ec2types.BlockDeviceMapping {
+	devices := []ec2types.BlockDeviceMapping{s.RootVolume().blockDevice("/dev/xvda")}
+	for i, v := range s.DataVolumes {
+		devices = append(devices, v.blockDevice(dataDevice(i)))
+	}
+	return devices
+}
+
+// dataVolumes is how the data volumes are shown in tags and inventory, like "100GiB gp3, 500GiB st1".
+func (s Sizing) dataVolumes() string {
+	volumes := make([]string, len(s.DataVolumes))
+	for i, v := range s.DataVolumes {
+		volumes[i] = v.String()
+	}
+	return strings.Join(volumes, ", ")
+}
+
+// tags records the sizing on the server so that inventory can show it.
+func (s Sizing) tags() []ec2types.Tag {
+	tags := []ec2types.Tag{
+		{
+			Key:   aws.String("InstanceType"),
+			Value: aws.String(s.InstanceType),
+		},
+		{
+			Key:   aws.String("AMI"),
+			Value: aws.String(s.AMI),
+		},
+		{
+			Key:   aws.String("RootVolume"),
+			Value: aws.String(s.RootVolume().String()),
+		},
+	}
+	if s.AMIParameter != "" {
+		tags = append(tags, ec2types.Tag{
+			Key:   aws.String("AMIParameter"),
+			Value: aws.String(s.AMIParameter),
+		})
+	}
+	if volumes := s.dataVolumes(); volumes != "" {
+		tags = append(tags, ec2types.Tag{
+			Key:   aws.String("DataVolumes"),
+			Value: aws.String(volumes),
+		})
+	}
+	return tags
+}
@@ -4,20 +4,16 @@ read -sp 'Password: ' passvar
 user=$uservar":"$passvar
 url="<url>"
 server="<server>"
-key="<key>"
-
-key="{\"key\":\"$key\"}"
+scope="<scope>"
+secret="<secret>"
 
 var=$(curl \
   --header "Content-Type: application/json" \
-  --request POST \
-  --data-raw $key \
+  --request GET \
   -u $user \
-  ${url}/key)
+  ${url}/secret/${secret})
 
-pem_name=$(echo $var | jq .key.pem_name -r)
-scope="$(echo $var | jq .scope -r)"
-sh_name="${server}.sh"
+pem_name="${scope}-key.pem"
 
 var_dns=$(curl \
   --header "Content-Type: application/json" \
@@ -27,7 +23,7 @@ var_dns=$(curl \
 
 dns="$(echo $var_dns | jq .public_dns -r)"
 
-echo $var | jq .key.material -r > $pem_name
+echo $var | jq .value -r > $pem_name
 chmod 0600 $pem_name
 ssh ec2-user@$dns -i $pem_name
 rm -f $pem_name
@@ -1,7 +1,6 @@
 package tag
 
 import (
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/cantara/nerthus/aws/util"
 )
 
@@ -13,11 +12,11 @@ type additional struct {
 	NetworkInterfaceId string `json:"network_interface_id"`
 	ImageId            string `json:"image_id"`
 	tag                *tag
-	ec2                *ec2.Client
+	ec2                util.EC2
 	created            bool
 }
 
-func NewAddTag(serviceName, scope, serverId, networkInterfaceId, volumeId, imageId string, e2 *ec2.Client) (t additional, err error) {
+func NewAddTag(serviceName, scope, serverId, networkInterfaceId, volumeId, imageId string, e2 util.EC2) (t additional, err error) {
 	err = util.CheckEC2Session(e2)
 	if err != nil {
 		return
@@ -44,6 +43,17 @@ func NewAddTag(serviceName, scope, serverId, networkInterfaceId, volumeId, image
 	return
 }
 
+// GetAddTag returns the tag an additional server already has, so that it can be removed.
+func GetAddTag(serviceName, scope, serverId, networkInterfaceId, volumeId, imageId string, e2 util.EC2) (t additional, err error) {
+	t, err = NewAddTag(serviceName, scope, serverId, networkInterfaceId, volumeId, imageId, e2)
+	if err != nil {
+		return
+	}
+	t.tag.created = true
+	t.created = true
+	return
+}
+
 func (t *additional) Create() (id string, err error) {
 	id, err = t.tag.Create()
 	return
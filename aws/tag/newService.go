@@ -1,8 +1,6 @@
 package tag
 
 import (
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
-	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
 	"github.com/cantara/nerthus/aws/util"
 )
 
@@ -26,7 +24,7 @@ type New struct {
 
 func NewNewTag(serviceName, scope, keyId, securityGroupId, serverId, volumeId, networkInterfaceId, imageId,
 	targetGroupARN, ruleARN, listnerARN, loadbalancerARN string,
-	e2 *ec2.Client, el *elbv2.Client) (t New, err error) {
+	e2 util.EC2, el util.ELB) (t New, err error) {
 
 	err = util.CheckEC2Session(e2)
 	if err != nil {
@@ -73,6 +71,21 @@ func NewNewTag(serviceName, scope, keyId, securityGroupId, serverId, volumeId, n
 	return
 }
 
+// GetNewTag returns the tag a new service has put on its resources, so that it can be removed.
+// Resources that no longer exists can be left empty.
+func GetNewTag(serviceName, scope, keyId, securityGroupId, serverId, volumeId, networkInterfaceId, imageId,
+	targetGroupARN, ruleARN, listnerARN, loadbalancerARN string,
+	e2 util.EC2, el util.ELB) (t New, err error) {
+	t, err = NewNewTag(serviceName, scope, keyId, securityGroupId, serverId, volumeId, networkInterfaceId, imageId,
+		targetGroupARN, ruleARN, listnerARN, loadbalancerARN, e2, el)
+	if err != nil {
+		return
+	}
+	t.tag.created = true
+	t.created = true
+	return
+}
+
 func (t *New) Create() (id string, err error) {
 	id, err = t.tag.Create()
 	return
@@ -21,12 +21,24 @@ type tag struct {
 	elbResources []string
 	Key          string
 	Value        string
-	ec2          *ec2.Client
-	elb          *elbv2.Client
+	ec2          util.EC2
+	elb          util.ELB
 	created      bool
 }
 
+func nonEmpty(resources []string) (out []string) {
+	for _, resource := range resources {
+		if resource == "" {
+			continue
+		}
+		out = append(out, resource)
+	}
+	return
+}
+
 func (t *tag) Create() (id string, err error) {
+	t.ec2Resources = nonEmpty(t.ec2Resources)
+	t.elbResources = nonEmpty(t.elbResources)
 	if t.ec2Resources != nil {
 		err = util.CheckEC2Session(t.ec2)
 		if err != nil {
@@ -73,6 +85,8 @@ func (t *tag) Delete() (err error) {
 	if !t.created {
 		return
 	}
+	t.ec2Resources = nonEmpty(t.ec2Resources)
+	t.elbResources = nonEmpty(t.elbResources)
 	if t.ec2Resources != nil {
 		err = util.CheckEC2Session(t.ec2)
 		if err != nil {
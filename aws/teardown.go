@@ -0,0 +1,243 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/cantara/bragi"
+	databaselib "github.com/cantara/nerthus/aws/database"
+	keylib "github.com/cantara/nerthus/aws/key"
+	loadbalancerlib "github.com/cantara/nerthus/aws/loadbalancer"
+	securitylib "github.com/cantara/nerthus/aws/security"
+	serverlib "github.com/cantara/nerthus/aws/server"
+	"github.com/cantara/nerthus/aws/util"
+	volumelib "github.com/cantara/nerthus/aws/volume"
+	vpclib "github.com/cantara/nerthus/aws/vpc"
+	"github.com/cantara/nerthus/job"
+	"github.com/cantara/nerthus/secret"
+	"github.com/cantara/nerthus/slack"
+)
+
+// DeleteScope removes every resource tagged with the scope. Resources are removed in dependency order,
+// a failing resource does not stop the teardown, all errors are returned when everything has been tried.
+func (c AWS) DeleteScope(scope string) (err error) {
+	t := teardown{
+		ec2:     c.ec2,
+		elb:     c.elb,
+		rds:     c.rds,
+		secrets: c.secrets,
+		scope:   scope,
+		job:     c.job,
+	}
+
+	t.StartingTeardown()
+	t.step("DeleteLoadbalancerResources", t.DeleteLoadbalancerResources)
+	t.step("DeleteServers", t.DeleteServers)
+	t.step("DeleteVolumes", t.DeleteVolumes)
+	t.step("DeleteDatabases", t.DeleteDatabases)
+	t.step("DeleteSecurityGroups", t.DeleteSecurityGroups)
+	t.step("DeleteKey", t.DeleteKey)
+	t.step("DeleteSecrets", t.DeleteSecrets)
+	t.step("DeleteVPC", t.DeleteVPC)
+	t.FinishedTeardown()
+	err = t.Err()
+	return
+}
+
+// deleter is a resource, or something like a secret or a service on a server, that can be removed again. Unlike
+// util.AWSObject it does not need to be created by Nerthus, so teardowns and cleanups can delete what they only looked up.
+type deleter interface {
+	Delete() error
+}
+
+type teardown struct {
+	ec2     util.EC2
+	elb     util.ELB
+	rds     util.RDS
+	secrets secret.Store
+	scope   string
+	job     *job.Job
+	errs    []error
+}
+
+func (t *teardown) step(name string, f func()) {
+	t.job.SetStep(name)
+	f()
+}
+
+func (t *teardown) status(s string) {
+	status(t.job, fmt.Sprintf("%s: %s", t.scope, s))
+}
+
+func (t *teardown) fail(err error, s string) {
+	log.AddError(err).Crit(s)
+	s = fmt.Sprintf(":x: %s: %s", t.scope, s)
+	slack.SendStatus(s)
+	t.job.AddLog(s)
+	t.errs = append(t.errs, util.CreateError{
+		Text: s,
+		Err:  err,
+	})
+}
+
+func (t *teardown) remove(object, name string, obj deleter) bool {
+	err := obj.Delete()
+	if err != nil {
+		t.fail(err, fmt.Sprintf("While deleting %s %s", object, name))
+		return false
+	}
+	t.job.AddResource(job.ActionDeleted, object, name)
+	t.status(fmt.Sprintf("Deleted %s %s.", object, name))
+	return true
+}
+
+func (t teardown) Err() error {
+	return errors.Join(t.errs...)
+}
+
+func (t *teardown) StartingTeardown() {
+	t.status("Starting to tear down scope in aws.")
+}
+
+func (t *teardown) DeleteLoadbalancerResources() {
+	targetGroups, err := loadbalancerlib.GetTargetGroups(t.scope, t.elb)
+	if err != nil {
+		t.fail(err, "While getting target groups")
+		return
+	}
+	for i := range targetGroups {
+		rules, err := targetGroups[i].GetRules()
+		if err != nil {
+			t.fail(err, fmt.Sprintf("While getting rules for target group %s", targetGroups[i].Name))
+			continue
+		}
+		for j := range rules {
+			t.remove("listener rule", rules[j].ARN, &rules[j])
+		}
+		t.remove("target group", targetGroups[i].Name, &targetGroups[i])
+	}
+}
+
+func (t *teardown) DeleteServers() {
+	servers, err := serverlib.GetServers(t.scope, t.ec2)
+	if err != nil {
+		t.fail(err, "While getting servers")
+		return
+	}
+	for i := range servers {
+		t.status(fmt.Sprintf("Terminating server %s %s.", servers[i].Name, servers[i].Id))
+		t.remove("server", servers[i].Name, &servers[i])
+	}
+}
+
+func (t *teardown) DeleteVolumes() {
+	volumes, err := volumelib.GetDetachedVolumes(t.scope, t.ec2)
+	if err != nil {
+		t.fail(err, "While getting volumes")
+		return
+	}
+	for i := range volumes {
+		t.remove("volume", volumes[i].Id, &volumes[i])
+	}
+}
+
+func (t *teardown) DeleteDatabases() {
+	databases, err := databaselib.GetDatabases(t.scope, t.rds)
+	if err != nil {
+		t.fail(err, "While getting databases")
+		return
+	}
+	for i := range databases {
+		if !t.remove("database", databases[i].Name, &databases[i]) {
+			continue
+		}
+		t.status(fmt.Sprintf("Waiting for database %s to be deleted.", databases[i].Name))
+		err = databases[i].WaitUntilDeleted()
+		if err != nil {
+			t.fail(err, fmt.Sprintf("While waiting for database %s to be deleted", databases[i].Name))
+		}
+	}
+	// The subnet group is in the subnets of the vpc, so it has to be gone before the vpc is deleted.
+	group, err := databaselib.GetSubnetGroup(t.scope, t.rds)
+	if errors.Is(err, databaselib.ErrSubnetGroupNotFound) {
+		return
+	}
+	if err != nil {
+		t.fail(err, "While getting db subnet group")
+		return
+	}
+	t.remove("db subnet group", group.Name, &group)
+}
+
+func (t *teardown) DeleteSecurityGroups() {
+	groups, err := securitylib.GetGroups(t.scope, t.ec2)
+	if err != nil {
+		t.fail(err, "While getting security groups")
+		return
+	}
+	// Database security groups references the scope security group, so they are removed first.
+	for i := range groups {
+		if groups[i].IsScopeGroup() {
+			continue
+		}
+		t.remove("security group", groups[i].Name, &groups[i])
+	}
+	for i := range groups {
+		if !groups[i].IsScopeGroup() {
+			continue
+		}
+		t.remove("security group", groups[i].Name, &groups[i])
+	}
+}
+
+func (t *teardown) DeleteKey() {
+	key, err := keylib.GetKey(t.scope, t.ec2)
+	if errors.Is(err, keylib.ErrNotFound) {
+		t.status("No key pair found.")
+		return
+	}
+	if err != nil {
+		t.fail(err, "While getting key pair")
+		return
+	}
+	t.remove("key pair", key.Name, &key)
+}
+
+func (t *teardown) DeleteSecrets() {
+	if t.secrets == nil {
+		t.status("No secret store configured.")
+		return
+	}
+	names, err := t.secrets.List(secret.ScopePrefix(t.scope))
+	if err != nil {
+		t.fail(err, "While getting secrets")
+		return
+	}
+	for _, name := range names {
+		s := secret.New(name, t.secrets)
+		t.remove("secret", name, &s)
+	}
+}
+
+// DeleteVPC deletes the vpc provisioned for the scope, it has to be empty so it goes last. Adopted vpcs are not
+// tagged with the scope and are left alone.
+func (t *teardown) DeleteVPC() {
+	network, err := vpclib.GetNetwork(t.scope, t.ec2)
+	if errors.Is(err, vpclib.ErrNotFound) {
+		t.status("No provisioned vpc found.")
+		return
+	}
+	if err != nil {
+		t.fail(err, "While getting vpc")
+		return
+	}
+	t.remove("vpc", network.VPC.Id, &network)
+}
+
+func (t *teardown) FinishedTeardown() {
+	if len(t.errs) > 0 {
+		t.status(fmt.Sprintf(":x: Teardown finished with %d errors.", len(t.errs)))
+		return
+	}
+	t.status(":heavy_check_mark: Completed all operations for tearing down the scope.")
+}
@@ -2,32 +2,45 @@ package util
 
 import (
 	"fmt"
-
-	"github.com/aws/aws-sdk-go-v2/service/ec2"
-	elbv2 "github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
-	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"time"
 )
 
+// CreatedTag is the tag resources that aws does not record a creation time for are tagged with when they are created.
+const CreatedTag = "Created"
+
+func CreatedValue(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// ParseCreated returns the time in a CreatedTag, the zero time if it is missing or not a time.
+func ParseCreated(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
 type AWSObject interface {
 	Create() (string, error)
 	Delete() error
 }
 
-func CheckEC2Session(e2 *ec2.Client) error {
+func CheckEC2Session(e2 EC2) error {
 	if e2 == nil {
 		return fmt.Errorf("No ec2 session found")
 	}
 	return nil
 }
 
-func CheckELBV2Session(elb *elbv2.Client) error {
+func CheckELBV2Session(elb ELB) error {
 	if elb == nil {
 		return fmt.Errorf("No elbv2 session found")
 	}
 	return nil
 }
 
-func CheckRDSSession(db *rds.Client) error {
+func CheckRDSSession(db RDS) error {
 	if db == nil {
 		return fmt.Errorf("No rds session found")
 	}
@@ -0,0 +1,77 @@
+package volume
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/cantara/nerthus/aws/util"
+)
+
+type Volume struct {
+	Scope   string    `json:"-"`
+	Id      string    `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"-"`
+	ec2     util.EC2
+	created bool
+}
+
+// GetDetachedVolumes returns every volume tagged with the scope that is no longer attached to an instance.
+func GetDetachedVolumes(scope string, e2 util.EC2) (volumes []Volume, err error) {
+	err = util.CheckEC2Session(e2)
+	if err != nil {
+		return
+	}
+	result, err := e2.DescribeVolumes(context.Background(), &ec2.DescribeVolumesInput{
+		Filters: []ec2types.Filter{
+			{
+				Name: aws.String("tag:Scope"),
+				Values: []string{
+					scope,
+				},
+			},
+			{
+				Name: aws.String("status"),
+				Values: []string{
+					string(ec2types.VolumeStateAvailable),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	for _, vol := range result.Volumes {
+		v := Volume{
+			Scope:   scope,
+			Id:      aws.ToString(vol.VolumeId),
+			Created: aws.ToTime(vol.CreateTime),
+			ec2:     e2,
+			created: true,
+		}
+		for _, tag := range vol.Tags {
+			if aws.ToString(tag.Key) == "Name" {
+				v.Name = aws.ToString(tag.Value)
+			}
+		}
+		volumes = append(volumes, v)
+	}
+	return
+}
+
+func (v *Volume) Delete() (err error) {
+	if !v.created {
+		return
+	}
+	err = util.CheckEC2Session(v.ec2)
+	if err != nil {
+		return
+	}
+	_, err = v.ec2.DeleteVolume(context.Background(), &ec2.DeleteVolumeInput{
+		VolumeId: aws.String(v.Id),
+	})
+	return
+}
@@ -0,0 +1,520 @@
+package vpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/cantara/nerthus/aws/util"
+)
+
+var ErrInvalidNetwork = errors.New("invalid network")
+
+// DefaultZones is how many availability zones a provisioned vpc spans when nothing else is asked for.
+const DefaultZones = 2
+
+// Network is a vpc provisioned for a scope, with a public and a private subnet in each availability zone, an internet
+// gateway for the public subnets and optionally a nat gateway for the private ones. The public subnets are the subnets
+// of the vpc servers are placed in. Everything is tagged with the scope and deleted with it.
+type Network struct {
+	Scope             string   `json:"-"`
+	CIDR              string   `json:"cidr"`
+	Zones             int      `json:"zones"`
+	NAT               bool     `json:"nat"`
+	VPC               VPC      `json:"vpc"`
+	PrivateSubnets    []Subnet `json:"private_subnets,omitempty"`
+	InternetGatewayId string   `json:"internet_gateway_id,omitempty"`
+	RouteTableIds     []string `json:"route_table_ids,omitempty"`
+	NATGatewayId      string   `json:"nat_gateway_id,omitempty"`
+	AllocationId      string   `json:"allocation_id,omitempty"`
+	subnetCIDRs       []netip.Prefix
+	ec2               util.EC2
+	created           bool
+}
+
+// NewNetwork validates the cidr of the vpc and splits it in a public and private subnet for each zone. Zones 0 is
+// DefaultZones.
+func NewNetwork(scope, cidr string, zones int, nat bool, e2 util.EC2) (n Network, err error) {
+	err = util.CheckEC2Session(e2)
+	if err != nil {
+		return
+	}
+	n, err = newNetwork(scope, cidr, zones, nat)
+	n.ec2 = e2
+	return
+}
+
+// CheckNetwork returns ErrInvalidNetwork if a vpc with the cidr can not be split in subnets across the zones.
+func CheckNetwork(cidr string, zones int) error {
+	_, err := newNetwork("", cidr, zones, false)
+	return err
+}
+
+func newNetwork(scope, cidr string, zones int, nat bool) (n Network, err error) {
+	if zones == 0 {
+		zones = DefaultZones
+	}
+	if zones < 1 || zones > 6 {
+		err = fmt.Errorf("%w: zones must be between 1 and 6, got %d", ErrInvalidNetwork, zones)
+		return
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil || !prefix.Addr().Is4() {
+		err = fmt.Errorf("%w: %q is not an ipv4 cidr", ErrInvalidNetwork, cidr)
+		return
+	}
+	if prefix.Bits() < 16 || prefix.Bits() > 24 {
+		err = fmt.Errorf("%w: the cidr of a vpc must be between /16 and /24, got %s", ErrInvalidNetwork, cidr)
+		return
+	}
+	prefix = prefix.Masked()
+	n = Network{
+		Scope: scope,
+		CIDR:  prefix.String(),
+		Zones: zones,
+		NAT:   nat,
+	}
+	n.subnetCIDRs, err = splitPrefix(prefix, 2*zones)
+	return
+}
+
+// splitPrefix splits the prefix in count equally large subnets, as large as possible.
+func splitPrefix(prefix netip.Prefix, count int) (subnets []netip.Prefix, err error) {
+	size := prefix.Bits() + bits.Len(uint(count-1))
+	if size > 28 {
+		return nil, fmt.Errorf("%w: %s is too small for %d subnets", ErrInvalidNetwork, prefix, count)
+	}
+	start := prefix.Addr().As4()
+	first := uint32(start[0])<<24 | uint32(start[1])<<16 | uint32(start[2])<<8 | uint32(start[3])
+	for i := range count {
+		a := first + uint32(i)<<(32-size)
+		subnets = append(subnets, netip.PrefixFrom(netip.AddrFrom4([4]byte{byte(a >> 24), byte(a >> 16), byte(a >> 8), byte(a)}), size))
+	}
+	return
+}
+
+// PlannedSubnets returns the cidr and availability zone of the public and private subnets Create would create.
+func (n Network) PlannedSubnets() (public, private []string, err error) {
+	zones, err := n.availabilityZones()
+	if err != nil {
+		return
+	}
+	for i, zone := range zones {
+		public = append(public, fmt.Sprintf("%s (%s)", n.subnetCIDRs[i], zone))
+		private = append(private, fmt.Sprintf("%s (%s)", n.subnetCIDRs[n.Zones+i], zone))
+	}
+	return
+}
+
+func (n Network) tags(typ ec2types.ResourceType, name string) []ec2types.TagSpecification {
+	return []ec2types.TagSpecification{
+		{
+			ResourceType: typ,
+			Tags: []ec2types.Tag{
+				{
+					Key:   aws.String("Name"),
+					Value: aws.String(name),
+				},
+				{
+					Key:   aws.String("Scope"),
+					Value: aws.String(n.Scope),
+				},
+			},
+		},
+	}
+}
+
+// Create provisions the network. If any part fails, what was already created is deleted again before the error is
+// returned, so a failed Create leaves nothing behind.
+func (n *Network) Create() (id string, err error) {
+	err = n.create()
+	if err != nil {
+		n.created = true
+		if deleteErr := n.Delete(); deleteErr != nil {
+			err = errors.Join(err, fmt.Errorf("while deleting partially created network: %w", deleteErr))
+		}
+		n.created = false
+		n.VPC = VPC{}
+		return
+	}
+	n.created = true
+	id = n.VPC.Id
+	return
+}
+
+func (n *Network) create() (err error) {
+	zones, err := n.availabilityZones()
+	if err != nil {
+		return
+	}
+	vpc, err := n.ec2.CreateVpc(context.Background(), &ec2.CreateVpcInput{
+		CidrBlock:         aws.String(n.CIDR),
+		TagSpecifications: n.tags(ec2types.ResourceTypeVpc, n.Scope),
+	})
+	if err != nil {
+		return util.CreateError{
+			Text: fmt.Sprintf("Could not create vpc %s for %s.", n.CIDR, n.Scope),
+			Err:  err,
+		}
+	}
+	n.VPC.Id = aws.ToString(vpc.Vpc.VpcId)
+	// Servers are reached by their public dns name, which vpcs only give them with dns hostnames enabled.
+	_, err = n.ec2.ModifyVpcAttribute(context.Background(), &ec2.ModifyVpcAttributeInput{
+		VpcId:              aws.String(n.VPC.Id),
+		EnableDnsHostnames: &ec2types.AttributeBooleanValue{Value: aws.Bool(true)},
+	})
+	if err != nil {
+		return
+	}
+
+	igw, err := n.ec2.CreateInternetGateway(context.Background(), &ec2.CreateInternetGatewayInput{
+		TagSpecifications: n.tags(ec2types.ResourceTypeInternetGateway, n.Scope),
+	})
+	if err != nil {
+		return
+	}
+	n.InternetGatewayId = aws.ToString(igw.InternetGateway.InternetGatewayId)
+	_, err = n.ec2.AttachInternetGateway(context.Background(), &ec2.AttachInternetGatewayInput{
+		InternetGatewayId: aws.String(n.InternetGatewayId),
+		VpcId:             aws.String(n.VPC.Id),
+	})
+	if err != nil {
+		return
+	}
+
+	for i, zone := range zones {
+		public, err := n.createSubnet(fmt.Sprintf("%s-public-%s", n.Scope, zone), zone, n.subnetCIDRs[i])
+		if err != nil {
+			return err
+		}
+		n.VPC.Subnets = append(n.VPC.Subnets, public)
+		_, err = n.ec2.ModifySubnetAttribute(context.Background(), &ec2.ModifySubnetAttributeInput{
+			SubnetId:            aws.String(public.Id),
+			MapPublicIpOnLaunch: &ec2types.AttributeBooleanValue{Value: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		private, err := n.createSubnet(fmt.Sprintf("%s-private-%s", n.Scope, zone), zone, n.subnetCIDRs[n.Zones+i])
+		if err != nil {
+			return err
+		}
+		n.PrivateSubnets = append(n.PrivateSubnets, private)
+	}
+
+	err = n.createRouteTable(n.Scope+"-public", n.VPC.Subnets, &ec2.CreateRouteInput{
+		GatewayId: aws.String(n.InternetGatewayId),
+	})
+	if err != nil {
+		return
+	}
+	if !n.NAT {
+		return n.createRouteTable(n.Scope+"-private", n.PrivateSubnets, nil)
+	}
+	address, err := n.ec2.AllocateAddress(context.Background(), &ec2.AllocateAddressInput{
+		Domain:            ec2types.DomainTypeVpc,
+		TagSpecifications: n.tags(ec2types.ResourceTypeElasticIp, n.Scope+"-nat"),
+	})
+	if err != nil {
+		return
+	}
+	n.AllocationId = aws.ToString(address.AllocationId)
+	nat, err := n.ec2.CreateNatGateway(context.Background(), &ec2.CreateNatGatewayInput{
+		SubnetId:          aws.String(n.VPC.Subnets[0].Id),
+		AllocationId:      aws.String(n.AllocationId),
+		TagSpecifications: n.tags(ec2types.ResourceTypeNatgateway, n.Scope+"-nat"),
+	})
+	if err != nil {
+		return
+	}
+	n.NATGatewayId = aws.ToString(nat.NatGateway.NatGatewayId)
+	err = ec2.NewNatGatewayAvailableWaiter(n.ec2).Wait(context.Background(), &ec2.DescribeNatGatewaysInput{
+		NatGatewayIds: []string{n.NATGatewayId},
+	}, 10*time.Minute)
+	if err != nil {
+		return
+	}
+	return n.createRouteTable(n.Scope+"-private", n.PrivateSubnets, &ec2.CreateRouteInput{
+		NatGatewayId: aws.String(n.NATGatewayId),
+	})
+}
+
+// availabilityZones returns the first zones of the region that are available.
+func (n Network) availabilityZones() (zones []string, err error) {
+	result, err := n.ec2.DescribeAvailabilityZones(context.Background(), &ec2.DescribeAvailabilityZonesInput{
+		Filters: []ec2types.Filter{
+			{
+				Name:   aws.String("state"),
+				Values: []string{string(ec2types.AvailabilityZoneStateAvailable)},
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	for _, zone := range result.AvailabilityZones {
+		zones = append(zones, aws.ToString(zone.ZoneName))
+	}
+	slices.Sort(zones)
+	if len(zones) < n.Zones {
+		return nil, fmt.Errorf("%w: the region only has %d availability zones, not %d", ErrInvalidNetwork, len(zones), n.Zones)
+	}
+	return zones[:n.Zones], nil
+}
+
+func (n Network) createSubnet(name, zone string, cidr netip.Prefix) (subnet Subnet, err error) {
+	result, err := n.ec2.CreateSubnet(context.Background(), &ec2.CreateSubnetInput{
+		VpcId:             aws.String(n.VPC.Id),
+		AvailabilityZone:  aws.String(zone),
+		CidrBlock:         aws.String(cidr.String()),
+		TagSpecifications: n.tags(ec2types.ResourceTypeSubnet, name),
+	})
+	if err != nil {
+		return
+	}
+	subnet = Subnet{
+		Id:               aws.ToString(result.Subnet.SubnetId),
+		AvailabilityZone: zone,
+	}
+	return
+}
+
+// createRouteTable creates a route table for the subnets, with the default route if there is one.
+func (n *Network) createRouteTable(name string, subnets []Subnet, defaultRoute *ec2.CreateRouteInput) (err error) {
+	table, err := n.ec2.CreateRouteTable(context.Background(), &ec2.CreateRouteTableInput{
+		VpcId:             aws.String(n.VPC.Id),
+		TagSpecifications: n.tags(ec2types.ResourceTypeRouteTable, name),
+	})
+	if err != nil {
+		return
+	}
+	id := aws.ToString(table.RouteTable.RouteTableId)
+	n.RouteTableIds = append(n.RouteTableIds, id)
+	if defaultRoute != nil {
+		defaultRoute.RouteTableId = aws.String(id)
+		defaultRoute.DestinationCidrBlock = aws.String("0.0.0.0/0")
+		_, err = n.ec2.CreateRoute(context.Background(), defaultRoute)
+		if err != nil {
+			return
+		}
+	}
+	for _, subnet := range subnets {
+		_, err = n.ec2.AssociateRouteTable(context.Background(), &ec2.AssociateRouteTableInput{
+			RouteTableId: aws.String(id),
+			SubnetId:     aws.String(subnet.Id),
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// GetNetwork returns the network provisioned for the scope from the tags on the vpc, ErrNotFound is returned when the
+// scope has no provisioned vpc. Vpcs that were adopted by a scope are not tagged with it.
+func GetNetwork(scope string, e2 util.EC2) (n Network, err error) {
+	err = util.CheckEC2Session(e2)
+	if err != nil {
+		return
+	}
+	vpcs, err := e2.DescribeVpcs(context.Background(), &ec2.DescribeVpcsInput{
+		Filters: []ec2types.Filter{
+			{
+				Name:   aws.String("tag:Scope"),
+				Values: []string{scope},
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	if len(vpcs.Vpcs) == 0 {
+		err = fmt.Errorf("%w: no vpc provisioned for scope %s", ErrNotFound, scope)
+		return
+	}
+	n = Network{
+		Scope:   scope,
+		CIDR:    aws.ToString(vpcs.Vpcs[0].CidrBlock),
+		VPC:     VPC{Id: aws.ToString(vpcs.Vpcs[0].VpcId)},
+		ec2:     e2,
+		created: true,
+	}
+	vpcFilter := []ec2types.Filter{
+		{
+			Name:   aws.String("vpc-id"),
+			Values: []string{n.VPC.Id},
+		},
+	}
+	subnets, err := e2.DescribeSubnets(context.Background(), &ec2.DescribeSubnetsInput{Filters: vpcFilter})
+	if err != nil {
+		return
+	}
+	zones := make(map[string]bool)
+	for _, s := range subnets.Subnets {
+		subnet := Subnet{
+			Id:               aws.ToString(s.SubnetId),
+			AvailabilityZone: aws.ToString(s.AvailabilityZone),
+		}
+		zones[subnet.AvailabilityZone] = true
+		if aws.ToBool(s.MapPublicIpOnLaunch) {
+			n.VPC.Subnets = append(n.VPC.Subnets, subnet)
+		} else {
+			n.PrivateSubnets = append(n.PrivateSubnets, subnet)
+		}
+	}
+	n.Zones = len(zones)
+	byZone := func(a, b Subnet) int {
+		return strings.Compare(a.AvailabilityZone, b.AvailabilityZone)
+	}
+	slices.SortStableFunc(n.VPC.Subnets, byZone)
+	slices.SortStableFunc(n.PrivateSubnets, byZone)
+	igws, err := e2.DescribeInternetGateways(context.Background(), &ec2.DescribeInternetGatewaysInput{
+		Filters: []ec2types.Filter{
+			{
+				Name:   aws.String("attachment.vpc-id"),
+				Values: []string{n.VPC.Id},
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	for _, igw := range igws.InternetGateways {
+		n.InternetGatewayId = aws.ToString(igw.InternetGatewayId)
+	}
+	tables, err := e2.DescribeRouteTables(context.Background(), &ec2.DescribeRouteTablesInput{Filters: vpcFilter})
+	if err != nil {
+		return
+	}
+	for _, table := range tables.RouteTables {
+		// The main route table of the vpc is deleted with the vpc
+		if slices.ContainsFunc(table.Associations, func(a ec2types.RouteTableAssociation) bool { return aws.ToBool(a.Main) }) {
+			continue
+		}
+		n.RouteTableIds = append(n.RouteTableIds, aws.ToString(table.RouteTableId))
+	}
+	nats, err := e2.DescribeNatGateways(context.Background(), &ec2.DescribeNatGatewaysInput{Filter: vpcFilter})
+	if err != nil {
+		return
+	}
+	for _, nat := range nats.NatGateways {
+		if nat.State == ec2types.NatGatewayStateDeleted || nat.State == ec2types.NatGatewayStateDeleting {
+			continue
+		}
+		n.NAT = true
+		n.NATGatewayId = aws.ToString(nat.NatGatewayId)
+		for _, address := range nat.NatGatewayAddresses {
+			n.AllocationId = aws.ToString(address.AllocationId)
+		}
+	}
+	if n.AllocationId == "" {
+		// The address is left behind if the nat gateway was deleted but not the address
+		addresses, err := e2.DescribeAddresses(context.Background(), &ec2.DescribeAddressesInput{
+			Filters: []ec2types.Filter{
+				{
+					Name:   aws.String("tag:Scope"),
+					Values: []string{scope},
+				},
+			},
+		})
+		if err != nil {
+			return n, err
+		}
+		for _, address := range addresses.Addresses {
+			n.AllocationId = aws.ToString(address.AllocationId)
+		}
+	}
+	return
+}
+
+// Delete removes the network in the reverse order of Create. Everything in the vpc, like servers and security groups,
+// must be deleted first.
+func (n *Network) Delete() (err error) {
+	if !n.created {
+		return
+	}
+	err = util.CheckEC2Session(n.ec2)
+	if err != nil {
+		return
+	}
+	if n.NATGatewayId != "" {
+		_, err = n.ec2.DeleteNatGateway(context.Background(), &ec2.DeleteNatGatewayInput{
+			NatGatewayId: aws.String(n.NATGatewayId),
+		})
+		if err != nil {
+			return
+		}
+		err = ec2.NewNatGatewayDeletedWaiter(n.ec2).Wait(context.Background(), &ec2.DescribeNatGatewaysInput{
+			NatGatewayIds: []string{n.NATGatewayId},
+		}, 10*time.Minute)
+		if err != nil {
+			return
+		}
+		n.NATGatewayId = ""
+	}
+	if n.AllocationId != "" {
+		_, err = n.ec2.ReleaseAddress(context.Background(), &ec2.ReleaseAddressInput{
+			AllocationId: aws.String(n.AllocationId),
+		})
+		if err != nil {
+			return
+		}
+		n.AllocationId = ""
+	}
+	for _, subnet := range slices.Concat(n.VPC.Subnets, n.PrivateSubnets) {
+		_, err = n.ec2.DeleteSubnet(context.Background(), &ec2.DeleteSubnetInput{
+			SubnetId: aws.String(subnet.Id),
+		})
+		if err != nil {
+			return
+		}
+	}
+	n.VPC.Subnets = nil
+	n.PrivateSubnets = nil
+	for _, id := range n.RouteTableIds {
+		_, err = n.ec2.DeleteRouteTable(context.Background(), &ec2.DeleteRouteTableInput{
+			RouteTableId: aws.String(id),
+		})
+		if err != nil {
+			return
+		}
+	}
+	n.RouteTableIds = nil
+	if n.InternetGatewayId != "" {
+		_, err = n.ec2.DetachInternetGateway(context.Background(), &ec2.DetachInternetGatewayInput{
+			InternetGatewayId: aws.String(n.InternetGatewayId),
+			VpcId:             aws.String(n.VPC.Id),
+		})
+		// The gateway is not attached if creating the network failed before it was
+		var apiErr smithy.APIError
+		if err != nil && !(errors.As(err, &apiErr) && apiErr.ErrorCode() == "Gateway.NotAttached") {
+			return
+		}
+		_, err = n.ec2.DeleteInternetGateway(context.Background(), &ec2.DeleteInternetGatewayInput{
+			InternetGatewayId: aws.String(n.InternetGatewayId),
+		})
+		if err != nil {
+			return
+		}
+		n.InternetGatewayId = ""
+	}
+	if n.VPC.Id != "" {
+		_, err = n.ec2.DeleteVpc(context.Background(), &ec2.DeleteVpcInput{
+			VpcId: aws.String(n.VPC.Id),
+		})
+		if err != nil {
+			return
+		}
+	}
+	n.created = false
+	return
+}
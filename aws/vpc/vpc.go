@@ -2,24 +2,122 @@ package vpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"slices"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/cantara/nerthus/aws/util"
 )
 
+var ErrNotFound = errors.New("vpc not found")
+var ErrInvalidSubnet = errors.New("invalid subnet")
+
+// VPC is the vpc of a scope and the subnets its servers are placed in, sorted by availability zone.
 type VPC struct {
-	Id string `json:"id"`
+	Id      string   `json:"id"`
+	Subnets []Subnet `json:"subnets,omitempty"`
+}
+
+type Subnet struct {
+	Id               string `json:"id"`
+	AvailabilityZone string `json:"availability_zone"`
+}
+
+func (s Subnet) String() string {
+	return fmt.Sprintf("%s (%s)", s.Id, s.AvailabilityZone)
+}
+
+// SubnetIds returns the ids of the subnets of the vpc.
+func (v VPC) SubnetIds() (ids []string) {
+	for _, s := range v.Subnets {
+		ids = append(ids, s.Id)
+	}
+	return
+}
+
+// AvailabilityZones returns the availability zones the subnets of the vpc are in.
+func (v VPC) AvailabilityZones() (zones []string) {
+	for _, s := range v.Subnets {
+		if !slices.Contains(zones, s.AvailabilityZone) {
+			zones = append(zones, s.AvailabilityZone)
+		}
+	}
+	return
+}
+
+// GetVPC returns the default vpc. Regions where it has been deleted has none, scopes there must be given a vpc.
+func GetVPC(e2 util.EC2) (vpc VPC, err error) {
+	vpcs, err := describeVPCs("is-default", "true", e2)
+	if err != nil {
+		return
+	}
+	if len(vpcs) == 0 {
+		err = fmt.Errorf("%w: there is no default vpc, give the scope a vpc or let it provision one", ErrNotFound)
+		return
+	}
+	vpc = VPC{
+		Id: aws.ToString(vpcs[0].VpcId),
+	}
+	return
+}
+
+// GetVPCById returns the vpc with the id, for scopes that are not in the default vpc.
+func GetVPCById(id string, e2 util.EC2) (vpc VPC, err error) {
+	vpcs, err := describeVPCs("vpc-id", id, e2)
+	if err != nil {
+		return
+	}
+	if len(vpcs) == 0 {
+		err = fmt.Errorf("%w: %s", ErrNotFound, id)
+		return
+	}
+	vpc = VPC{
+		Id: aws.ToString(vpcs[0].VpcId),
+	}
+	return
 }
 
-func GetVPC(e2 *ec2.Client) (vpc VPC, err error) {
+// GetVPCByRef returns the vpc a scope adopts. The reference is a vpc id, a key=value tag or the value of the Name tag,
+// and a tag must be on exactly one vpc.
+func GetVPCByRef(ref string, e2 util.EC2) (vpc VPC, err error) {
+	if strings.HasPrefix(ref, "vpc-") {
+		return GetVPCById(ref, e2)
+	}
+	key, value, found := strings.Cut(ref, "=")
+	if !found {
+		key, value = "Name", ref
+	}
+	vpcs, err := describeVPCs("tag:"+key, value, e2)
+	if err != nil {
+		return
+	}
+	if len(vpcs) != 1 {
+		err = fmt.Errorf("%w: %d vpcs are tagged %s=%s, expected one", ErrNotFound, len(vpcs), key, value)
+		return
+	}
+	vpc = VPC{
+		Id: aws.ToString(vpcs[0].VpcId),
+	}
+	return
+}
+
+func describeVPCs(filter, value string, e2 util.EC2) (vpcs []ec2types.Vpc, err error) {
 	err = util.CheckEC2Session(e2)
 	if err != nil {
 		return
 	}
-	result, err := e2.DescribeVpcs(context.Background(), nil)
+	result, err := e2.DescribeVpcs(context.Background(), &ec2.DescribeVpcsInput{
+		Filters: []ec2types.Filter{
+			{
+				Name:   aws.String(filter),
+				Values: []string{value},
+			},
+		},
+	})
 	if err != nil {
 		err = util.CreateError{
 			Text: "Unable to describe VPCs",
@@ -27,21 +125,84 @@ func GetVPC(e2 *ec2.Client) (vpc VPC, err error) {
 		}
 		return
 	}
-	if len(result.Vpcs) == 0 {
-		err = fmt.Errorf("No VPCs found.")
+	return result.Vpcs, nil
+}
+
+// GetSubnets returns the subnets in the vpc with the ids, sorted by availability zone. Without ids the default subnets
+// of the vpc are used, and for vpcs without default subnets the ones giving servers public ip addresses. Servers are
+// reached by their public dns, so a vpc with neither needs the subnets to be given.
+func GetSubnets(vpcId string, ids []string, e2 util.EC2) (subnets []Subnet, err error) {
+	err = util.CheckEC2Session(e2)
+	if err != nil {
 		return
 	}
-	var filtered []ec2types.Vpc
-
-	for _, entry := range result.Vpcs {
-		if *entry.IsDefault {
-			filtered = append(filtered, entry)
-			break
+	result, err := e2.DescribeSubnets(context.Background(), &ec2.DescribeSubnetsInput{
+		Filters: []ec2types.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: []string{vpcId},
+			},
+		},
+	})
+	if err != nil {
+		err = util.CreateError{
+			Text: "Unable to describe subnets",
+			Err:  err,
 		}
+		return
+	}
+	found := make(map[string]ec2types.Subnet)
+	for _, s := range result.Subnets {
+		found[aws.ToString(s.SubnetId)] = s
+	}
+	if len(ids) == 0 {
+		var public []string
+		for _, s := range result.Subnets {
+			switch {
+			case aws.ToBool(s.DefaultForAz):
+				ids = append(ids, aws.ToString(s.SubnetId))
+			case aws.ToBool(s.MapPublicIpOnLaunch):
+				public = append(public, aws.ToString(s.SubnetId))
+			}
+		}
+		if len(ids) == 0 {
+			ids = public
+		}
+		if len(ids) == 0 {
+			err = fmt.Errorf("%w: vpc %s has no default or public subnets, the subnets of the scope must be given", ErrInvalidSubnet, vpcId)
+			return
+		}
+	}
+	for _, id := range ids {
+		s, ok := found[id]
+		if !ok {
+			err = fmt.Errorf("%w: %s is not a subnet in vpc %s", ErrInvalidSubnet, id, vpcId)
+			return nil, err
+		}
+		if slices.ContainsFunc(subnets, func(subnet Subnet) bool { return subnet.Id == id }) {
+			continue
+		}
+		subnets = append(subnets, Subnet{
+			Id:               id,
+			AvailabilityZone: aws.ToString(s.AvailabilityZone),
+		})
+	}
+	slices.SortStableFunc(subnets, func(a, b Subnet) int {
+		return strings.Compare(a.AvailabilityZone, b.AvailabilityZone)
+	})
+	return
+}
 
+// GetScopeVPC returns the vpc the reference is to, or the default vpc without one, with the subnets of a new scope in it.
+func GetScopeVPC(ref string, subnetIds []string, e2 util.EC2) (vpc VPC, err error) {
+	if ref == "" {
+		vpc, err = GetVPC(e2)
+	} else {
+		vpc, err = GetVPCByRef(ref, e2)
 	}
-	vpc = VPC{
-		Id: aws.ToString(filtered[0].VpcId),
+	if err != nil {
+		return
 	}
+	vpc.Subnets, err = GetSubnets(vpc.Id, subnetIds, e2)
 	return
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	cloud "github.com/cantara/nerthus/aws"
+	serverlib "github.com/cantara/nerthus/aws/server"
+)
+
+const planUsage = `Usage:
+  nerthus plan scope [-executor ssh|ssm] [-ssh-source <cidr|prefix list>]... [-ami-parameter al2023|al2|<path>]
+                     [-vpc <vpc id|tag>] [-subnet <subnet id>]... [-vpc-cidr <cidr> [-zones <n>] [-nat]] <scope>
+  nerthus plan server -key <key> [-f <server.json>] <scope> <server>
+  nerthus plan service -key <key> -f <service.json> <scope> <server>
+  nerthus plan database -key <key> <scope> <artifactId>`
+
+// stringsFlag is a flag that can be repeated, every value is kept.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// runPlan is the command line equivalent of calling the orchestration endpoints with dry_run=true.
+// The plan is printed as json and nothing in aws is changed.
+func runPlan(args []string, cld *cloud.AWS) (err error) {
+	if len(args) < 1 {
+		return errors.New(planUsage)
+	}
+	fs := flag.NewFlagSet("plan "+args[0], flag.ContinueOnError)
+	cryptKey := fs.String("key", "", "encrypted scope key returned when the scope was created")
+	serviceFile := fs.String("f", "", "json file with the service definition, or the sizing and placement of a server")
+	executor := fs.String("executor", "", "how scripts are run on the servers in a new scope, ssh or ssm")
+	amiParameter := fs.String("ami-parameter", "", "ssm parameter the ami of servers in a new scope is looked up in, al2023, al2 or a path")
+	vpc := fs.String("vpc", "", "vpc id, key=value tag or Name tag of the vpc of a new scope, the default vpc if not set")
+	vpcCIDR := fs.String("vpc-cidr", "", "cidr of a vpc provisioned for a new scope, instead of using an existing vpc")
+	zones := fs.Int("zones", 0, "availability zones a provisioned vpc spans, 2 if not set")
+	nat := fs.Bool("nat", false, "give the private subnets of a provisioned vpc a nat gateway")
+	var sshSources, subnets stringsFlag
+	fs.Var(&sshSources, "ssh-source", "cidr or prefix list ssh is allowed from in a new scope, can be repeated")
+	fs.Var(&subnets, "subnet", "subnet the servers in a new scope are spread across, can be repeated")
+	err = fs.Parse(args[1:])
+	if err != nil {
+		return
+	}
+	pos := fs.Args()
+	if args[0] == "scope" && len(pos) == 1 {
+		plan, err := cld.PlanScope(pos[0], cloud.ScopeOptions{
+			Executor:     *executor,
+			SSHSources:   sshSources,
+			AMIParameter: *amiParameter,
+			VPC:          *vpc,
+			Subnets:      subnets,
+			VPCCIDR:      *vpcCIDR,
+			Zones:        *zones,
+			NAT:          *nat,
+		})
+		if err != nil {
+			return err
+		}
+		return printJSON(plan)
+	}
+	if len(pos) != 2 {
+		return errors.New(planUsage)
+	}
+	scope, v, k, sg, _, err := cloud.Decrypt(*cryptKey, cld)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt key: %v", err)
+	}
+	if scope != pos[0] {
+		return errors.New("scope in cryptodata and provided scope are different")
+	}
+	var plan cloud.Plan
+	switch args[0] {
+	case "server":
+		var sizing serverlib.Sizing
+		var placement serverlib.Placement
+		if *serviceFile != "" {
+			var data []byte
+			data, err = os.ReadFile(*serviceFile)
+			if err != nil {
+				return
+			}
+			err = json.Unmarshal(data, &sizing)
+			if err != nil {
+				return
+			}
+			err = json.Unmarshal(data, &placement)
+			if err != nil {
+				return
+			}
+		}
+		plan, err = cld.PlanServer(scope, pos[1], sizing, placement, v, k, sg)
+	case "service":
+		var data []byte
+		data, err = os.ReadFile(*serviceFile)
+		if err != nil {
+			return
+		}
+		var service cloud.Service
+		err = json.Unmarshal(data, &service)
+		if err != nil {
+			return
+		}
+		plan, err = cld.PlanService(scope, pos[1], v, k, sg, service)
+	case "database":
+		plan, err = cld.PlanDatabase(scope, pos[1], v, sg)
+	default:
+		return errors.New(planUsage)
+	}
+	if err != nil {
+		return
+	}
+	return printJSON(plan)
+}
+
+func printJSON(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// runApply is the command line equivalent of POST /apply, the manifest is applied directly instead of as a job.
+func runApply(args []string, cld *cloud.AWS) (err error) {
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	manifestFile := fs.String("f", "", "scope manifest in yaml")
+	dryRun := fs.Bool("dry-run", false, "only print the plan")
+	err = fs.Parse(args)
+	if err != nil {
+		return
+	}
+	if *manifestFile == "" {
+		return errors.New("Usage:\n  nerthus apply [-dry-run] -f <scope.yaml>")
+	}
+	data, err := os.ReadFile(*manifestFile)
+	if err != nil {
+		return
+	}
+	m, err := cloud.ParseManifest(data)
+	if err != nil {
+		return
+	}
+	if *dryRun {
+		plan, err := cld.PlanApply(m)
+		if err != nil {
+			return err
+		}
+		return printJSON(plan)
+	}
+	cryptData, plan, err := cld.Apply(m)
+	if err != nil {
+		return
+	}
+	return printJSON(map[string]interface{}{
+		"plan": plan,
+		"key":  cryptData,
+	})
+}
@@ -1,32 +1,58 @@
 package crypto
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base32"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
 )
 
 var privateKey *rsa.PrivateKey
-var key []byte
 
+// keys are the aes keys crypt data can be decrypted with, by key id. New crypt data is encrypted with the current key,
+// the others are previous keys that are kept while crypt data is rotated.
+var keys map[string][]byte
+var current string
+
+var ErrUnknownKey = errors.New("unknown crypt key")
+
+// InitCrypto reads the current aes key from aeskey and the previous keys from aeskeys_previous, a comma separated list.
 func InitCrypto() (err error) {
-	key, err = base64.StdEncoding.DecodeString(os.Getenv("aeskey"))
+	key, err := parseKey(os.Getenv("aeskey"))
 	if err != nil {
 		return
 	}
-	if len(key) != 32 {
-		err = errors.New("Wrong aes key length")
-		return
+	current = KeyId(key)
+	keys = map[string][]byte{
+		current: key,
+	}
+	for _, previous := range strings.Split(os.Getenv("aeskeys_previous"), ",") {
+		if strings.TrimSpace(previous) == "" {
+			continue
+		}
+		key, err = parseKey(previous)
+		if err != nil {
+			return fmt.Errorf("previous aes key: %w", err)
+		}
+		keys[KeyId(key)] = key
 	}
 	privatePem, err := ioutil.ReadFile("./private.pem")
 	if err != nil {
@@ -44,7 +70,188 @@ func InitCrypto() (err error) {
 	return
 }
 
+func parseKey(encoded string) (key []byte, err error) {
+	key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return
+	}
+	if len(key) != 32 {
+		err = errors.New("Wrong aes key length")
+	}
+	return
+}
+
+// KeyId identifies an aes key without revealing it, it is the start of the sha256 of the key in hex.
+func KeyId(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// CurrentKeyId returns the id of the key new crypt data is encrypted with, the kms key if kms is used.
+func CurrentKeyId() string {
+	if kmsClient != nil {
+		return kmsKeyId
+	}
+	return current
+}
+
+// envelopePrefix starts all crypt data in the envelope format. Crypt data from before the envelope is plain base64,
+// which never contains a colon.
+const envelopePrefix = "nerthus:"
+
+// envelopeVersion is the version new crypt data is sealed with. From version 2 the header is authenticated together
+// with the ciphertext, version 1 crypt data is still opened without it.
+const envelopeVersion = 2
+
+// header is the unencrypted part of the envelope.
+type header struct {
+	Version int    `json:"v"`
+	KeyId   string `json:"kid"`
+	DataKey []byte `json:"dk,omitempty"`
+}
+
+// aad is the additional data the ciphertext is sealed with, so that the key id, data key and version can not be changed
+// without the crypt data failing to open.
+func (h header) aad() []byte {
+	if h.Version < 2 {
+		return nil
+	}
+	b, _ := json.Marshal(h)
+	return b
+}
+
+// envelope is the versioned format of crypt data. The data is sealed with the aes key with id KeyId, or, when DataKey is
+// set, with a data key that is encrypted by the kms key with id KeyId.
+type envelope struct {
+	header
+	Ciphertext []byte `json:"ct"`
+}
+
+// Encrypt seals the data in an envelope with the current key.
 func Encrypt(data []byte) (baseText string, err error) {
+	env := envelope{
+		header: header{
+			Version: envelopeVersion,
+			KeyId:   current,
+		},
+	}
+	key := keys[current]
+	if kmsClient != nil {
+		var dataKey *kms.GenerateDataKeyOutput
+		dataKey, err = kmsClient.GenerateDataKey(context.Background(), &kms.GenerateDataKeyInput{
+			KeyId:   aws.String(kmsKeyId),
+			KeySpec: kmstypes.DataKeySpecAes256,
+		})
+		if err != nil {
+			return
+		}
+		key = dataKey.Plaintext
+		env.KeyId = aws.ToString(dataKey.KeyId)
+		env.DataKey = dataKey.CiphertextBlob
+	}
+	if key == nil {
+		err = ErrUnknownKey
+		return
+	}
+	env.Ciphertext, err = seal(key, data, env.aad())
+	if err != nil {
+		return
+	}
+	b, err := json.Marshal(env)
+	if err != nil {
+		return
+	}
+	baseText = envelopePrefix + base64.StdEncoding.EncodeToString(b)
+	return
+}
+
+// Decrypt opens crypt data sealed with the current or a previous key, in the envelope format or from before it.
+func Decrypt(baseText string) (data []byte, err error) {
+	if !strings.HasPrefix(baseText, envelopePrefix) {
+		return decryptLegacy(baseText)
+	}
+	env, err := parseEnvelope(baseText)
+	if err != nil {
+		return
+	}
+	if env.Version < 1 || env.Version > envelopeVersion {
+		err = fmt.Errorf("unsupported crypt data version %d", env.Version)
+		return
+	}
+	key := keys[env.KeyId]
+	if env.DataKey != nil {
+		if kmsClient == nil {
+			err = fmt.Errorf("%w: %s is a kms key and kms is not configured", ErrUnknownKey, env.KeyId)
+			return
+		}
+		var dataKey *kms.DecryptOutput
+		dataKey, err = kmsClient.Decrypt(context.Background(), &kms.DecryptInput{
+			CiphertextBlob: env.DataKey,
+			KeyId:          aws.String(env.KeyId),
+		})
+		if err != nil {
+			return
+		}
+		key = dataKey.Plaintext
+	}
+	if key == nil {
+		err = fmt.Errorf("%w: %s", ErrUnknownKey, env.KeyId)
+		return
+	}
+	return open(key, env.Ciphertext, env.aad())
+}
+
+// decryptLegacy opens crypt data from before the envelope format. It has no key id, so every key is tried.
+func decryptLegacy(baseText string) (data []byte, err error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(baseText)
+	if err != nil {
+		return
+	}
+	data, err = open(keys[current], ciphertext, nil)
+	if err == nil {
+		return
+	}
+	for id, key := range keys {
+		if id == current {
+			continue
+		}
+		data, err = open(key, ciphertext, nil)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+func parseEnvelope(baseText string) (env envelope, err error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(baseText, envelopePrefix))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &env)
+	return
+}
+
+// KeyIdOf returns the id of the key the crypt data was encrypted with, or legacy for crypt data from before the
+// envelope format.
+func KeyIdOf(baseText string) (string, error) {
+	if !strings.HasPrefix(baseText, envelopePrefix) {
+		return "legacy", nil
+	}
+	env, err := parseEnvelope(baseText)
+	return env.KeyId, err
+}
+
+// Rotate decrypts the crypt data and encrypts it again with the current key.
+func Rotate(baseText string) (rotated string, err error) {
+	data, err := Decrypt(baseText)
+	if err != nil {
+		return
+	}
+	return Encrypt(data)
+}
+
+func seal(key, data, aad []byte) (ciphertext []byte, err error) {
 	c, err := aes.NewCipher(key)
 	if err != nil {
 		return
@@ -60,14 +267,13 @@ func Encrypt(data []byte) (baseText string, err error) {
 		return
 	}
 
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
-	baseText = base64.StdEncoding.EncodeToString(ciphertext)
+	ciphertext = gcm.Seal(nonce, nonce, data, aad)
 	return
 }
 
-func Decrypt(baseText string) (data []byte, err error) {
-	ciphertext, err := base64.StdEncoding.DecodeString(baseText)
-	if err != nil {
+func open(key, ciphertext, aad []byte) (data []byte, err error) {
+	if key == nil {
+		err = ErrUnknownKey
 		return
 	}
 	c, err := aes.NewCipher(key)
@@ -86,7 +292,7 @@ func Decrypt(baseText string) (data []byte, err error) {
 	}
 
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	data, err = gcm.Open(nil, nonce, ciphertext, nil)
+	data, err = gcm.Open(nil, nonce, ciphertext, aad)
 	return
 }
 
@@ -0,0 +1,85 @@
+package crypto
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// KMS is the part of the aws kms client used for data keys, so that LocalKMS can stand in for it.
+type KMS interface {
+	GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+var kmsClient KMS
+var kmsKeyId string
+
+// UseKMS makes new crypt data be sealed with data keys from the kms key. Crypt data sealed with the aes keys can still be
+// decrypted, and is moved to kms with Rotate.
+func UseKMS(client KMS, keyId string) {
+	kmsClient = client
+	kmsKeyId = keyId
+}
+
+// LocalKMS stands in for aws kms where it is not available, like in development. Its data keys are encrypted with the
+// aes keys from InitCrypto, so it gives no more protection than them.
+type LocalKMS struct{}
+
+// localKMSPrefix starts the ids of the keys of LocalKMS, the rest is the id of the aes key.
+const localKMSPrefix = "local/"
+
+// LocalKMSKeyId is the id to give UseKMS together with LocalKMS, it is the current aes key.
+func LocalKMSKeyId() string {
+	return localKMSPrefix + current
+}
+
+func (LocalKMS) GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	keyId := aws.ToString(params.KeyId)
+	master, err := localKey(keyId)
+	if err != nil {
+		return nil, err
+	}
+	dataKey := make([]byte, 32)
+	_, err = rand.Read(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := seal(master, dataKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GenerateDataKeyOutput{
+		CiphertextBlob: blob,
+		KeyId:          aws.String(keyId),
+		Plaintext:      dataKey,
+	}, nil
+}
+
+func (LocalKMS) Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	keyId := aws.ToString(params.KeyId)
+	master, err := localKey(keyId)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := open(master, params.CiphertextBlob, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.DecryptOutput{
+		KeyId:     aws.String(keyId),
+		Plaintext: dataKey,
+	}, nil
+}
+
+func localKey(keyId string) ([]byte, error) {
+	key, ok := keys[strings.TrimPrefix(keyId, localKMSPrefix)]
+	if !strings.HasPrefix(keyId, localKMSPrefix) || !ok {
+		return nil, fmt.Errorf("%w: %s is not a local kms key", ErrUnknownKey, keyId)
+	}
+	return key, nil
+}
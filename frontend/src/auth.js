@@ -0,0 +1,18 @@
+// authorization is the Authorization header for the user, the Whydah user token when logged in with Whydah and the
+// username and password otherwise.
+export function authorization(user) {
+  if (user.token) {
+    return 'Bearer ' + user.token;
+  }
+  return 'Basic ' + btoa(user.name + ":" + user.password);
+}
+
+// whydahToken takes the Whydah user token Nerthus sends back after a Whydah login out of the url.
+export function whydahToken() {
+  const params = new URLSearchParams(window.location.hash.substring(1));
+  const token = params.get("token");
+  if (token) {
+    history.replaceState(null, "", window.location.pathname);
+  }
+  return token || "";
+}
@@ -0,0 +1,251 @@
+package job
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/cantara/bragi"
+)
+
+type Status string
+
+const (
+	StatusRunning Status = "running"
+	StatusDone    Status = "done"
+	StatusFailed  Status = "failed"
+)
+
+// Finished jobs are kept in memory this long so that clients have time to poll the result.
+const retention = 24 * time.Hour
+
+type Job struct {
+	Id        string            `json:"id"`
+	Name      string            `json:"name"`
+	User      string            `json:"user,omitempty"`
+	Scope     string            `json:"scope,omitempty"`
+	Status    Status            `json:"status"`
+	Step      string            `json:"step"`
+	Log       []string          `json:"log"`
+	Result    map[string]string `json:"result,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Code      int               `json:"code,omitempty"`
+	Failure   any               `json:"failure,omitempty"`
+	Journal   string            `json:"journal,omitempty"`
+	Resources []Resource        `json:"resources,omitempty"`
+	Created   time.Time         `json:"created"`
+	Updated   time.Time         `json:"updated"`
+	Finished  *time.Time        `json:"finished,omitempty"`
+	mutex     *sync.Mutex
+	done      chan struct{}
+}
+
+type Action string
+
+const (
+	ActionCreated Action = "created"
+	ActionUpdated Action = "updated"
+	ActionDeleted Action = "deleted"
+)
+
+// Resource is something in aws the job has created, changed or deleted.
+type Resource struct {
+	Action Action    `json:"action"`
+	Type   string    `json:"type"`
+	Id     string    `json:"id"`
+	Time   time.Time `json:"time"`
+}
+
+type store struct {
+	jobs  map[string]*Job
+	next  int
+	mutex sync.Mutex
+}
+
+var s = store{
+	jobs: make(map[string]*Job),
+}
+
+// Start runs f in the background as a new job started by user, working on scope. If a job with the same name is already
+// running that job is returned instead and started is false, so that clients retrying a request does not start the same
+// operation twice.
+func Start(name, user, scope string, f func(j *Job) (result map[string]string, err error)) (j *Job, started bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.prune()
+	for _, running := range s.jobs {
+		if running.Name == name && running.status() == StatusRunning {
+			return running, false
+		}
+	}
+	s.next++
+	now := time.Now()
+	j = &Job{
+		Id:      fmt.Sprintf("%d-%d", now.Unix(), s.next),
+		Name:    name,
+		User:    user,
+		Scope:   scope,
+		Status:  StatusRunning,
+		Log:     []string{},
+		Created: now,
+		Updated: now,
+		mutex:   &sync.Mutex{},
+		done:    make(chan struct{}),
+	}
+	s.jobs[j.Id] = j
+	go j.run(f)
+	return j, true
+}
+
+func Get(id string) (j *Job, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	j, ok = s.jobs[id]
+	return
+}
+
+func List() (jobs []*Job) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].Created.Before(jobs[k].Created)
+	})
+	return
+}
+
+func (j *Job) run(f func(j *Job) (map[string]string, error)) {
+	var result map[string]string
+	var err error
+	defer func() {
+		if a := recover(); a != nil {
+			log.Warning("Recovered in job ", j.Id, ": ", a)
+			err = fmt.Errorf("%v", a)
+		}
+		j.finish(result, err)
+	}()
+	result, err = f(j)
+}
+
+func (j *Job) finish(result map[string]string, err error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	now := time.Now()
+	j.Result = result
+	j.Status = StatusDone
+	if err != nil {
+		j.Status = StatusFailed
+		j.Error = err.Error()
+	}
+	j.Updated = now
+	j.Finished = &now
+	close(j.done)
+}
+
+// Done is closed when the job has finished.
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// SetStep records the step the job is currently doing. Safe to call on a nil job.
+func (j *Job) SetStep(step string) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Step = step
+	j.Updated = time.Now()
+}
+
+// SetFailure records the http status the failure maps to and details about where it failed, like the failed step.
+func (j *Job) SetFailure(code int, failure any) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Code = code
+	j.Failure = failure
+}
+
+// SetJournal links the job to the journal of the sequence it runs. Safe to call on a nil job.
+func (j *Job) SetJournal(id string) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Journal = id
+}
+
+// AddResource records that the job has created, changed or deleted a resource. Safe to call on a nil job.
+func (j *Job) AddResource(action Action, resourceType, id string) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Resources = append(j.Resources, Resource{
+		Action: action,
+		Type:   resourceType,
+		Id:     id,
+		Time:   time.Now(),
+	})
+}
+
+// AddLog appends a status line to the job. Safe to call on a nil job.
+func (j *Job) AddLog(line string) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Log = append(j.Log, line)
+	j.Updated = time.Now()
+}
+
+// Snapshot returns a copy of the job that can be serialized while the job keeps running.
+func (j *Job) Snapshot() Job {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return Job{
+		Id:        j.Id,
+		Name:      j.Name,
+		User:      j.User,
+		Scope:     j.Scope,
+		Status:    j.Status,
+		Step:      j.Step,
+		Log:       append([]string{}, j.Log...),
+		Result:    maps.Clone(j.Result),
+		Error:     j.Error,
+		Code:      j.Code,
+		Failure:   j.Failure,
+		Journal:   j.Journal,
+		Resources: append([]Resource{}, j.Resources...),
+		Created:   j.Created,
+		Updated:   j.Updated,
+		Finished:  j.Finished,
+	}
+}
+
+func (j *Job) status() Status {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.Status
+}
+
+func (s *store) prune() {
+	for id, j := range s.jobs {
+		j.mutex.Lock()
+		old := j.Finished != nil && time.Since(*j.Finished) > retention
+		j.mutex.Unlock()
+		if old {
+			delete(s.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package job
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func wait(t *testing.T, j *Job) {
+	t.Helper()
+	select {
+	case <-j.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("job did not finish")
+	}
+}
+
+func TestStartDedup(t *testing.T) {
+	release := make(chan struct{})
+	first, started := Start("dedup", "admin", "devtest", func(j *Job) (map[string]string, error) {
+		<-release
+		return map[string]string{"ok": "true"}, nil
+	})
+	if !started {
+		t.Fatal("expected the first job to be started")
+	}
+	second, started := Start("dedup", "admin", "devtest", func(j *Job) (map[string]string, error) {
+		t.Error("a job with the same name as a running job was started")
+		return nil, nil
+	})
+	if started || second != first {
+		t.Fatalf("expected the running job %s to be returned, got %s started %v", first.Id, second.Id, started)
+	}
+	other, started := Start("other", "admin", "devtest", func(j *Job) (map[string]string, error) {
+		return nil, errors.New("failed")
+	})
+	if !started || other == first {
+		t.Fatal("expected a job with another name to be started")
+	}
+	wait(t, other)
+	if status := other.Snapshot().Status; status != StatusFailed {
+		t.Fatalf("expected %s, got %s", StatusFailed, status)
+	}
+
+	close(release)
+	wait(t, first)
+	if status := first.Snapshot().Status; status != StatusDone {
+		t.Fatalf("expected %s, got %s", StatusDone, status)
+	}
+	third, started := Start("dedup", "admin", "devtest", func(j *Job) (map[string]string, error) {
+		return nil, nil
+	})
+	if !started || third == first {
+		t.Fatal("expected a new job to be started once the job with the same name has finished")
+	}
+	wait(t, third)
+}
+
+func TestPrune(t *testing.T) {
+	j, _ := Start("prune", "admin", "devtest", func(j *Job) (map[string]string, error) {
+		return nil, nil
+	})
+	wait(t, j)
+	recent, _ := Start("prune recent", "admin", "devtest", func(j *Job) (map[string]string, error) {
+		return nil, nil
+	})
+	wait(t, recent)
+
+	j.mutex.Lock()
+	old := time.Now().Add(-retention - time.Minute)
+	j.Finished = &old
+	j.mutex.Unlock()
+
+	next, _ := Start("prune next", "admin", "devtest", func(j *Job) (map[string]string, error) {
+		return nil, nil
+	})
+	wait(t, next)
+	if _, ok := Get(j.Id); ok {
+		t.Fatal("expected a job finished more than 24h ago to be pruned")
+	}
+	if _, ok := Get(recent.Id); !ok {
+		t.Fatal("expected a recently finished job to be kept")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	release := make(chan struct{})
+	j, _ := Start("snapshot", "admin", "devtest", func(j *Job) (map[string]string, error) {
+		j.AddLog("first")
+		j.AddResource(ActionCreated, "key", "key-1")
+		<-release
+		return map[string]string{"key": "value"}, nil
+	})
+	for len(j.Snapshot().Log) == 0 || len(j.Snapshot().Resources) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	snapshot := j.Snapshot()
+	j.AddLog("second")
+	j.AddResource(ActionDeleted, "key", "key-1")
+	j.SetStep("step")
+	if len(snapshot.Log) != 1 || len(snapshot.Resources) != 1 || snapshot.Step != "" {
+		t.Fatalf("expected the snapshot to be unchanged by the running job, got %+v", snapshot)
+	}
+	snapshot.Log[0] = "changed"
+	snapshot.Resources[0].Id = "changed"
+	close(release)
+	wait(t, j)
+
+	done := j.Snapshot()
+	done.Result["key"] = "changed"
+	got := j.Snapshot()
+	if got.Log[0] != "first" || got.Resources[0].Id != "key-1" || got.Result["key"] != "value" {
+		t.Fatalf("expected changes to a snapshot to not change the job, got %+v", got)
+	}
+}
@@ -0,0 +1,298 @@
+package journal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cantara/nerthus/crypto"
+)
+
+type Status string
+
+const (
+	StatusRunning    Status = "running"
+	StatusDone       Status = "done"
+	StatusRolledBack Status = "rolled_back"
+)
+
+var (
+	ErrNotFound = errors.New("journal not found")
+	ErrInUse    = errors.New("journal is in use or finished")
+)
+
+// Resource is something a sequence step has created. Properties holds whatever is needed to find the resource again.
+type Resource struct {
+	Type       string            `json:"type"`
+	Id         string            `json:"id"`
+	Name       string            `json:"name,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+	Removed    bool              `json:"removed"`
+}
+
+type Journal struct {
+	Id        string            `json:"id"`
+	Operation string            `json:"operation"`
+	Scope     string            `json:"scope"`
+	Args      map[string]string `json:"args"`
+	Steps     []string          `json:"steps"`
+	Resources []Resource        `json:"resources"`
+	Status    Status            `json:"status"`
+	Error     string            `json:"error,omitempty"`
+	Started   time.Time         `json:"started"`
+	Updated   time.Time         `json:"updated"`
+	mutex     sync.Mutex
+}
+
+type store struct {
+	dir    string
+	active map[string]bool
+	mutex  sync.Mutex
+}
+
+var s store
+
+func Init(dir string) (err error) {
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+	s = store{
+		dir:    dir,
+		active: make(map[string]bool),
+	}
+	return
+}
+
+// New creates and persists a journal for an operation that is about to start.
+func New(operation, scope string, args map[string]string) (j *Journal, err error) {
+	j = &Journal{
+		Id:        fmt.Sprintf("%s-%s-%d", operation, scope, time.Now().UnixNano()),
+		Operation: operation,
+		Scope:     scope,
+		Args:      args,
+		Status:    StatusRunning,
+		Started:   time.Now(),
+	}
+	err = j.save()
+	if err != nil {
+		return
+	}
+	setActive(j.Id, true)
+	return
+}
+
+// Open loads a journal so that it can be resumed or rolled back by this process.
+func Open(id string) (j *Journal, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.active[id] {
+		err = fmt.Errorf("%w: %s is already in use", ErrInUse, id)
+		return
+	}
+	j, err = read(id)
+	if err != nil {
+		return
+	}
+	if j.Status != StatusRunning {
+		err = fmt.Errorf("%w: %s is %s", ErrInUse, id, j.Status)
+		return
+	}
+	s.active[id] = true
+	return
+}
+
+func Get(id string) (j *Journal, err error) {
+	return read(id)
+}
+
+func List() (journals []*Journal, err error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		j, err := read(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		journals = append(journals, j)
+	}
+	sort.Slice(journals, func(i, k int) bool {
+		return journals[i].Started.Before(journals[k].Started)
+	})
+	return
+}
+
+// Unfinished returns the journals that are still running, but not by this process.
+func Unfinished() (journals []*Journal, err error) {
+	all, err := List()
+	if err != nil {
+		return
+	}
+	for _, j := range all {
+		if j.Status != StatusRunning || isActive(j.Id) {
+			continue
+		}
+		journals = append(journals, j)
+	}
+	return
+}
+
+func (j *Journal) Done(step string) bool {
+	if j == nil {
+		return false
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	for _, s := range j.Steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *Journal) StepDone(step string) (err error) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	j.Steps = append(j.Steps, step)
+	j.mutex.Unlock()
+	return j.save()
+}
+
+func (j *Journal) Created(r Resource) (err error) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	j.Resources = append(j.Resources, r)
+	j.mutex.Unlock()
+	return j.save()
+}
+
+func (j *Journal) Removed(typ, id string) (err error) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	for i := range j.Resources {
+		if j.Resources[i].Type == typ && j.Resources[i].Id == id {
+			j.Resources[i].Removed = true
+		}
+	}
+	j.mutex.Unlock()
+	return j.save()
+}
+
+func (j *Journal) Finish(status Status, cause error) (err error) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	j.Status = status
+	if cause != nil {
+		j.Error = cause.Error()
+	}
+	j.mutex.Unlock()
+	err = j.save()
+	setActive(j.Id, false)
+	return
+}
+
+// Release gives up the journal without finishing it, so that it can be opened again. It is deferred by everything that
+// opens a journal, and does nothing once the journal is finished.
+func (j *Journal) Release() {
+	if j == nil {
+		return
+	}
+	setActive(j.Id, false)
+}
+
+// Secret encrypts values that needs to be stored in the journal, but should not be readable from disk.
+func Secret(value string) (string, error) {
+	return crypto.Encrypt([]byte(value))
+}
+
+func FromSecret(value string) (string, error) {
+	data, err := crypto.Decrypt(value)
+	return string(data), err
+}
+
+func (j *Journal) save() (err error) {
+	if s.dir == "" {
+		return
+	}
+	j.mutex.Lock()
+	j.Updated = time.Now()
+	data, err := json.MarshalIndent(j, "", "  ")
+	j.mutex.Unlock()
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(s.dir, j.Id+"-*.tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return
+	}
+	err = tmp.Close()
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, j.Id+".json"))
+}
+
+func read(id string) (j *Journal, err error) {
+	if s.dir == "" || strings.ContainsAny(id, `/\`) {
+		err = fmt.Errorf("%w: %s", ErrNotFound, id)
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, id+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		err = fmt.Errorf("%w: %s", ErrNotFound, id)
+		return
+	}
+	if err != nil {
+		return
+	}
+	j = &Journal{}
+	err = json.Unmarshal(data, j)
+	return
+}
+
+func setActive(id string, active bool) {
+	if s.active == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if active {
+		s.active[id] = true
+		return
+	}
+	delete(s.active, id)
+}
+
+func isActive(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.active[id]
+}
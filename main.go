@@ -3,20 +3,39 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/cantara/nerthus/aws/metadata"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	log "github.com/cantara/bragi"
+	"github.com/cantara/nerthus/audit"
+	authlib "github.com/cantara/nerthus/auth"
 	cloud "github.com/cantara/nerthus/aws"
+	keylib "github.com/cantara/nerthus/aws/key"
 	"github.com/cantara/nerthus/aws/loadbalancer"
+	securitylib "github.com/cantara/nerthus/aws/security"
+	serverlib "github.com/cantara/nerthus/aws/server"
+	vpclib "github.com/cantara/nerthus/aws/vpc"
 	"github.com/cantara/nerthus/crypto"
+	"github.com/cantara/nerthus/job"
+	"github.com/cantara/nerthus/journal"
+	"github.com/cantara/nerthus/secret"
+	servershlib "github.com/cantara/nerthus/server"
 	"github.com/cantara/nerthus/slack"
+	"github.com/cantara/nerthus/whydah"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -26,6 +45,8 @@ var Version string
 
 var BuildTime string
 
+var basePath string
+
 func loadEnv() {
 	err := godotenv.Load(".env")
 	if err != nil {
@@ -49,7 +70,10 @@ func main() {
 	loadEnv()
 	//log.SetOutputFolder()
 	slack.NewClient(os.Getenv("slack_token"), os.Getenv("slack_channel_secret"), os.Getenv("slack_channel_status"), os.Getenv("slack_channel_commands"))
-	crypto.InitCrypto()
+	err := crypto.InitCrypto()
+	if err != nil {
+		log.AddError(err).Warning("While initializing crypto")
+	}
 	since := time.Now()
 
 	//region := os.Getenv("region") //"us-west-2" //"eu-central-1"
@@ -66,6 +90,14 @@ func main() {
 	if err != nil {
 		log.AddError(err).Fatal("While creating aws session")
 	}
+	// Seal new crypt data with kms data keys, local is a stand in for development that uses the aes keys.
+	switch kmsKeyId := os.Getenv("kms_key_id"); kmsKeyId {
+	case "":
+	case "local":
+		crypto.UseKMS(crypto.LocalKMS{}, crypto.LocalKMSKeyId())
+	default:
+		crypto.UseKMS(kms.NewFromConfig(sess), kmsKeyId)
+	}
 
 	var c cloud.AWS
 	// Create an EC2 service client.
@@ -74,6 +106,41 @@ func main() {
 	c.NewELB(sess)
 	// Create an rds service client.
 	c.NewRDS(sess)
+	// Create an ssm service client.
+	c.NewSSM(sess)
+
+	// Keep the scope keys and database passwords in secrets manager, file is for development without it.
+	var secrets secret.Store
+	if os.Getenv("secret_store") == "file" {
+		secretDir := os.Getenv("secret_dir")
+		if secretDir == "" {
+			secretDir = "./secrets"
+		}
+		secrets, err = secret.NewFile(secretDir)
+		if err != nil {
+			log.AddError(err).Fatal("While creating secret dir")
+		}
+	} else {
+		secrets = secret.NewSecretsManager(secretsmanager.NewFromConfig(sess))
+	}
+	c = c.WithSecrets(secrets)
+
+	outboudIp := GetOutboundIP()
+	// New scopes only allows ssh from nerthus unless they are given other sources.
+	c.SetNerthusIP(outboudIp)
+
+	if len(os.Args) > 1 && (os.Args[1] == "plan" || os.Args[1] == "apply") {
+		if os.Args[1] == "plan" {
+			err = runPlan(os.Args[2:], &c)
+		} else {
+			err = runApply(os.Args[2:], &c)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	ids, err := metadata.GetAllServersWithMetadataV1IDs(c.GetEC2())
 	if err != nil {
@@ -89,6 +156,66 @@ func main() {
 		}
 	}
 
+	journalDir := os.Getenv("journal_dir")
+	if journalDir == "" {
+		journalDir = "./data/journal"
+	}
+	err = journal.Init(journalDir)
+	if err != nil {
+		log.AddError(err).Fatal("while initializing journal")
+		return
+	}
+	auditFile := os.Getenv("audit_file")
+	if auditFile == "" {
+		auditFile = "./audit.jsonl"
+	}
+	err = audit.Init(auditFile)
+	if err != nil {
+		log.AddError(err).Fatal("while initializing audit log")
+		return
+	}
+	knownHostsFile := os.Getenv("known_hosts_file")
+	if knownHostsFile == "" {
+		knownHostsFile = "./known_hosts"
+	}
+	err = servershlib.InitHostKeys(knownHostsFile)
+	if err != nil {
+		log.AddError(err).Fatal("while initializing pinned host keys")
+		return
+	}
+	unfinished, err := journal.Unfinished()
+	if err != nil {
+		log.AddError(err).Fatal("while reading unfinished journals")
+		return
+	}
+	for _, j := range unfinished {
+		s := fmt.Sprintf(":warning: %s: Found unfinished %s from %s, journal %s. Resume it with POST /journal/%[4]s/resume or roll it back with POST /journal/%[4]s/rollback.",
+			j.Scope, j.Operation, j.Started.Format(time.RFC3339), j.Id)
+		log.Warning(s)
+		slack.SendStatus(s)
+	}
+
+	driftInterval := time.Hour
+	if os.Getenv("drift_interval") != "" {
+		driftInterval, err = time.ParseDuration(os.Getenv("drift_interval"))
+		if err != nil {
+			log.AddError(err).Fatal("while parsing drift_interval")
+			return
+		}
+	}
+	if driftInterval > 0 {
+		c.StartDriftChecker(driftInterval)
+	}
+
+	gcGrace := 24 * time.Hour
+	if os.Getenv("gc_grace_period") != "" {
+		gcGrace, err = time.ParseDuration(os.Getenv("gc_grace_period"))
+		if err != nil {
+			log.AddError(err).Fatal("while parsing gc_grace_period")
+			return
+		}
+	}
+
 	r := gin.New()
 	r.Use(gin.LoggerWithConfig(gin.LoggerConfig{
 		SkipPaths: []string{"/nerthus/health"},
@@ -98,7 +225,6 @@ func main() {
 	cConfig := cors.DefaultConfig()
 	cConfig.AllowOrigins = []string{"*"}
 	r.Use(cors.New(cConfig))
-	basePath := ""
 	if os.Getenv("run_as_base") != "true" {
 		basePath = "/nerthus"
 	}
@@ -112,7 +238,6 @@ func main() {
 		dash.StaticFS("/build", http.Dir("./frontend"+os.Getenv("frontend_path")+"/build"))
 	}
 
-	outboudIp := GetOutboundIP()
 	api := base.Group("")
 	api.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
@@ -125,24 +250,84 @@ func main() {
 		})
 	})
 
+	tokensFile := os.Getenv("tokens_file")
+	if tokensFile == "" {
+		tokensFile = "./tokens.json"
+	}
+	authenticator, err := authlib.New(os.Getenv("users_file"), tokensFile)
+	if err != nil {
+		log.AddError(err).Fatal("While reading users and tokens")
+	}
+	// OIDC tokens are for ci pipelines, so that they deploy with their own identity instead of a shared password.
+	if oidcFile := os.Getenv("oidc_file"); oidcFile != "" {
+		providers, err := authlib.ReadOIDC(oidcFile)
+		if err != nil {
+			log.AddError(err).Fatal("While reading oidc providers")
+		}
+		for _, p := range providers {
+			authenticator.AddProvider(p)
+		}
+	}
+	// With Whydah login the users log in with Whydah SSO instead of the shared username and password.
+	whydahLogin := os.Getenv("whydah_login") == "true"
+	if whydahLogin {
+		authenticator.AddProvider(authlib.NewWhydah(os.Getenv("whydah_application_id")))
+		api.GET("/login/whydah", whydahLoginHandler())
+		api.GET("/login/whydah/callback", whydahCallbackHandler())
+	}
+	// The user from the env file is an admin of every scope, like before there were more users.
 	username := os.Getenv("username")
 	password := os.Getenv("password")
-	if username == "" || password == "" {
-		log.Fatal("Missing user config in env file")
+	if !whydahLogin && username != "" && password != "" {
+		err = authenticator.AddUser(username, password, authlib.RoleAdmin, nil)
+		if err != nil {
+			log.AddError(err).Fatal("While adding user from env file")
+		}
+	}
+	if !authenticator.HasUsers() {
+		log.Fatal("Missing user config in env file, users file, oidc file or whydah login")
 	}
 
-	auth := api.Group("", gin.BasicAuth(gin.Accounts{
-		username: password,
-	}))
+	auth := api.Group("", authenticator.Middleware(), audit.Middleware())
+	viewer := auth.Group("", authlib.Require(authlib.RoleViewer))
+	deployer := auth.Group("", authlib.Require(authlib.RoleDeployer))
+	admin := auth.Group("", authlib.Require(authlib.RoleAdmin))
 	//auth.PUT("/server/:scope/*server", newServerHandler(&c))
-	auth.PUT("/scope/:scope", newScopeHandler(&c))
-	auth.PUT("/server/:scope/:server", newServerInScopeHandler(&c))
-	auth.PUT("/service/:scope/:server/:service", newServiceOnServerHandler(&c))
-	auth.PUT("/database/:scope/:artifactId", newDatabaseInScopeHandler(&c))
-	auth.POST("/key", newKeyHandler(&c))
-	auth.POST("/keyCrypt", newKeyCryptHandler())
-	auth.GET("/loadbalancers", newLoadbalancerHandler(&c))
-	auth.GET("/dns/:scope/:server", dnsHandler(&c))
+	admin.PUT("/scope/:scope", newScopeHandler(&c))
+	admin.DELETE("/scope/:scope", deleteScopeHandler(&c))
+	viewer.GET("/scope/:scope/ssh", scopeSSHHandler(&c))
+	admin.POST("/scope/:scope/ssh", updateScopeSSHHandler(&c))
+	deployer.PUT("/server/:scope/:server", newServerInScopeHandler(&c))
+	deployer.DELETE("/server/:scope/:server", deleteServerInScopeHandler(&c))
+	deployer.PUT("/service/:scope/:server/:service", newServiceOnServerHandler(&c))
+	deployer.DELETE("/service/:scope/:server/:service", deleteServiceOnServerHandler(&c))
+	deployer.PUT("/database/:scope/:artifactId", newDatabaseInScopeHandler(&c))
+	admin.POST("/key", newKeyHandler(&c))
+	admin.POST("/keyCrypt", newKeyCryptHandler())
+	admin.POST("/key/rotate", rotateKeyHandler())
+	deployer.GET("/secret/*name", audit.Always(), secretHandler(&c))
+	viewer.GET("/loadbalancers", newLoadbalancerHandler(&c))
+	viewer.GET("/scopes", scopesHandler(&c))
+	viewer.GET("/scopes/:scope", scopeHandler(&c))
+	viewer.GET("/scopes/:scope/servers", scopeServersHandler(&c))
+	viewer.GET("/scopes/:scope/services", scopeServicesHandler(&c))
+	viewer.GET("/servers/stale", staleServersHandler(&c))
+	viewer.GET("/dns/:scope/:server", dnsHandler(&c))
+	viewer.GET("/journals", journalsHandler())
+	viewer.GET("/journal/:id", journalHandler())
+	deployer.POST("/journal/:id/resume", resumeJournalHandler(&c))
+	deployer.POST("/journal/:id/rollback", rollbackJournalHandler(&c))
+	deployer.POST("/apply", applyHandler(&c))
+	viewer.GET("/drift", driftHandler(&c))
+	viewer.GET("/gc", orphansHandler(&c, gcGrace))
+	admin.POST("/gc/delete", deleteOrphansHandler(&c, gcGrace))
+	viewer.GET("/jobs", jobsHandler())
+	viewer.GET("/jobs/:id", jobHandler())
+	viewer.GET("/whoami", whoamiHandler())
+	admin.GET("/tokens", tokensHandler(authenticator))
+	admin.POST("/tokens", newTokenHandler(authenticator))
+	admin.DELETE("/tokens/:name", deleteTokenHandler(authenticator))
+	admin.GET("/audit", auditHandler())
 
 	/*
 		serverName := "devtest-entraos-notification3"
@@ -197,6 +382,44 @@ type keyBody struct {
 	Key string `form:"key" json:"key" xml:"key" binding:"required"`
 }
 
+// rotateKeyHandler encrypts crypt data, like the key of a scope, again with the current key. Crypt data encrypted with
+// a previous key keeps working until the key is removed from aeskeys_previous, so that keys can be rotated first.
+func rotateKeyHandler() func(*gin.Context) {
+	return func(c *gin.Context) {
+		var body keyBody
+		err := c.ShouldBind(&body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unable to get requred data from request. Supported formats are: JSON, XML and HTML form",
+				"error":   err.Error(),
+			})
+			return
+		}
+		previous, err := crypto.KeyIdOf(body.Key)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unable to read key",
+				"error":   err.Error(),
+			})
+			return
+		}
+		rotated, err := crypto.Rotate(body.Key)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unable to rotate key",
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":         "Rotated key successfully",
+			"data":            rotated,
+			"key_id":          crypto.CurrentKeyId(),
+			"previous_key_id": previous,
+		})
+	}
+}
+
 func newKeyHandler(cld *cloud.AWS) func(*gin.Context) {
 	return func(c *gin.Context) {
 		var body keyBody
@@ -216,6 +439,10 @@ func newKeyHandler(cld *cloud.AWS) func(*gin.Context) {
 			})
 			return
 		}
+		audit.SetScope(c, scope)
+		if !authlib.AllowScope(c, scope) {
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{
 			"message":        "Dekoded key successfully",
 			"scope":          scope,
@@ -225,16 +452,44 @@ func newKeyHandler(cld *cloud.AWS) func(*gin.Context) {
 	}
 }
 
+// secretHandler returns a secret from the secret store, like the private key of a scope. Every secret that is fetched
+// is reported to the status channel with the user that fetched it.
+func secretHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		name := strings.TrimPrefix(c.Param("name"), "/")
+		parts := strings.SplitN(name, "/", 3)
+		if len(parts) != 3 || parts[0] != "nerthus" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Only secrets created by Nerthus can be fetched",
+			})
+			return
+		}
+		audit.SetScope(c, parts[1])
+		if !authlib.AllowScope(c, parts[1]) {
+			return
+		}
+		value, err := cld.GetSecret(name)
+		if err != nil {
+			c.JSON(errorStatus(err), errorJSON("Unable to get secret", err))
+			return
+		}
+		s := fmt.Sprintf("%s fetched secret %s.", c.GetString(gin.AuthUserKey), name)
+		log.Info(s)
+		slack.SendStatus(s)
+		c.JSON(http.StatusOK, gin.H{
+			"name":  name,
+			"value": value,
+		})
+	}
+}
+
 func dnsHandler(cld *cloud.AWS) func(*gin.Context) {
 	return func(c *gin.Context) {
 		scope := c.Param("scope")
 		server := c.Param("server")
 		publicDNS, err := cloud.GetPublicDNS(server, scope, cld)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": "Unable to find server",
-				"error":   err.Error(),
-			})
+			c.JSON(errorStatus(err), errorJSON("Unable to find server", err))
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{
@@ -244,172 +499,261 @@ func dnsHandler(cld *cloud.AWS) func(*gin.Context) {
 	}
 }
 
-func newLoadbalancerHandler(cld *cloud.AWS) func(*gin.Context) {
+func journalsHandler() func(*gin.Context) {
 	return func(c *gin.Context) {
-		loadbalancers, err := loadbalancer.GetLoadbalancers(cld.GetELB())
+		var journals []*journal.Journal
+		var err error
+		if c.Query("unfinished") == "true" {
+			journals, err = journal.Unfinished()
+		} else {
+			journals, err = journal.List()
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "Something wend wrong while gettign loadbalancers",
+				"message": "Something went wrong while reading journals",
+				"error":   err.Error(),
 			})
 			return
 		}
+		id := authlib.Get(c)
+		journals = slices.DeleteFunc(journals, func(j *journal.Journal) bool {
+			return !id.AllowsScope(j.Scope)
+		})
+		for _, j := range journals {
+			redactJournal(j)
+		}
 		c.JSON(http.StatusOK, gin.H{
-			"message":       "Success",
-			"loadbalancers": loadbalancers,
+			"message":  "Success",
+			"journals": journals,
 		})
 	}
 }
 
-func newScopeHandler(cld *cloud.AWS) func(*gin.Context) {
+func journalHandler() func(*gin.Context) {
 	return func(c *gin.Context) {
-		scope := c.Param("scope")
-		if err := cloud.CheckNameLen(scope); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": fmt.Sprintf("Scope name is limited by length"),
+		j, err := journal.Get(c.Param("id"))
+		if errors.Is(err, journal.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"message": "Journal not found",
 				"error":   err.Error(),
 			})
 			return
 		}
-		go slack.SendCommand(fmt.Sprintf("scope/%s", scope), "")
-		crypData := cld.CreateScope(scope)
-		if crypData == "" {
+		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "Something went wrong while creating scope",
+				"message": "Something went wrong while reading journal",
+				"error":   err.Error(),
 			})
 			return
 		}
+		audit.SetScope(c, j.Scope)
+		if !authlib.AllowScope(c, j.Scope) {
+			return
+		}
+		redactJournal(j)
 		c.JSON(http.StatusOK, gin.H{
-			"message": "Server successfully created",
-			"key":     crypData,
+			"message": "Success",
+			"journal": j,
 		})
-		return
 	}
 }
 
-type serverReq struct {
-	Key string `form:"key" json:"key" xml:"key"`
+// redactJournal removes the crypt key of the scope from the args of a journal before it is shown. The key is only
+// needed by Nerthus itself to resume or roll back the journal.
+func redactJournal(j *journal.Journal) {
+	if _, ok := j.Args["key"]; ok {
+		j.Args["key"] = redacted
+	}
 }
 
-func newServerInScopeHandler(cld *cloud.AWS) func(*gin.Context) {
+// allowJournal aborts with 403 unless the caller may resume and roll back the journal, which needs access to its scope
+// and the role that is needed to start the operation it journals.
+func allowJournal(c *gin.Context, j *journal.Journal) bool {
+	audit.SetScope(c, j.Scope)
+	if !authlib.AllowScope(c, j.Scope) {
+		return false
+	}
+	role := authlib.RoleDeployer
+	if cloud.ScopeOperation(j.Operation) {
+		role = authlib.RoleAdmin
+	}
+	id := authlib.Get(c)
+	if !id.Role.Allows(role) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"message": fmt.Sprintf("Journal of %s requires the %s role, %s is %s", j.Operation, role, id, id.Role),
+		})
+		return false
+	}
+	return true
+}
+
+func resumeJournalHandler(cld *cloud.AWS) func(*gin.Context) {
 	return func(c *gin.Context) {
-		scope := c.Param("scope")
-		server := c.Param("server") //[1:]
-		if err := cloud.CheckNameLen(scope); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": fmt.Sprintf("Scope name is limited by length"),
-				"error":   err.Error(),
-			})
+		id := c.Param("id")
+		j, err := journal.Get(id)
+		if err != nil {
+			c.JSON(errorStatus(err), errorJSON("Unable to read journal", err))
 			return
 		}
-		var req serverReq
-		err := c.ShouldBind(&req)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": "Unable to get requred data from request. Supported formats are: JSON, XML and HTML form",
-				"error":   err.Error(),
-			})
+		if !allowJournal(c, j) {
 			return
 		}
-		if req.Key == "" {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": "Body with key and service is required",
+		if j.Status != journal.StatusRunning {
+			c.JSON(http.StatusConflict, gin.H{
+				"message": fmt.Sprintf("Journal is %s", j.Status),
 			})
 			return
 		}
-		body, _ := json.Marshal(req)
-		go slack.SendCommand(fmt.Sprintf("server/%s/%s", scope, server), string(body))
-		cryptScope, v, k, sg, ts, err := cloud.Decrypt(req.Key, cld)
+		go slack.SendCommand(c.GetString(gin.AuthUserKey), c.Request.Method, fmt.Sprintf("journal/%s/resume", id), "")
+		startJob(c, func(j *job.Job) (map[string]string, error) {
+			result, err := cld.WithJob(j).ResumeJournal(id)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{
+				"result": result,
+			}, nil
+		})
+	}
+}
+
+func rollbackJournalHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		j, err := journal.Get(id)
 		if err != nil {
-			log.AddError(err).Fatal("While dekrypting cryptdata")
+			c.JSON(errorStatus(err), errorJSON("Unable to read journal", err))
+			return
 		}
-		log.Println("Decrypted key")
-		if cryptScope != scope {
-			log.Fatal("Scope in cryptodata and provided scope are different")
+		if !allowJournal(c, j) {
+			return
 		}
-		crypData := cld.AddServerToScope(scope, server, v, k, sg, ts)
-		if crypData == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "Something wend wrong while creating server",
+		if j.Status != journal.StatusRunning {
+			c.JSON(http.StatusConflict, gin.H{
+				"message": fmt.Sprintf("Journal is %s", j.Status),
 			})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Server successfully created",
-			"key":     crypData,
+		go slack.SendCommand(c.GetString(gin.AuthUserKey), c.Request.Method, fmt.Sprintf("journal/%s/rollback", id), "")
+		startJob(c, func(j *job.Job) (map[string]string, error) {
+			return nil, cld.WithJob(j).RollbackJournal(id)
 		})
 	}
 }
 
-func newDatabaseInScopeHandler(cld *cloud.AWS) func(*gin.Context) {
+func jobsHandler() func(*gin.Context) {
 	return func(c *gin.Context) {
-		scope := c.Param("scope")
-		artifactId := c.Param("artifactId") //[1:]
-		if err := cloud.CheckNameLen(scope); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": fmt.Sprintf("Scope name is limited by length"),
-				"error":   err.Error(),
-			})
-			return
+		jobs := []job.Job{}
+		for _, j := range job.List() {
+			snapshot, ok := visibleJob(c, j)
+			if !ok {
+				continue
+			}
+			jobs = append(jobs, snapshot)
 		}
-		var req serverReq
-		err := c.ShouldBind(&req)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": "Unable to get requred data from request. Supported formats are: JSON, XML and HTML form",
-				"error":   err.Error(),
-			})
-			return
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Success",
+			"jobs":    jobs,
+		})
+	}
+}
+
+func jobHandler() func(*gin.Context) {
+	return func(c *gin.Context) {
+		j, ok := job.Get(c.Param("id"))
+		if ok {
+			var snapshot job.Job
+			snapshot, ok = visibleJob(c, j)
+			if ok {
+				c.JSON(http.StatusOK, gin.H{
+					"message": "Success",
+					"job":     snapshot,
+				})
+				return
+			}
 		}
-		if req.Key == "" {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "Job not found",
+		})
+	}
+}
+
+// redacted replaces crypt keys in responses to those that should not see them.
+const redacted = "[redacted]"
+
+// visibleJob returns the job as the caller may see it, and false if the job is outside of the scopes of the caller.
+// Jobs that are not in a scope, like deleting orphans, are only visible to callers that has every scope. The crypt key
+// of a scope in the result of a job is only visible to the one that started the job.
+func visibleJob(c *gin.Context, j *job.Job) (snapshot job.Job, ok bool) {
+	snapshot = j.Snapshot()
+	id := authlib.Get(c)
+	if snapshot.Scope == "" && len(id.Scopes) > 0 || !id.AllowsScope(snapshot.Scope) {
+		return
+	}
+	if _, ok := snapshot.Result["key"]; ok && snapshot.User != c.GetString(gin.AuthUserKey) {
+		snapshot.Result["key"] = redacted
+	}
+	return snapshot, true
+}
+
+// whydahLoginHandler sends the user to Whydah SSO, which sends the user back to whydahCallbackHandler.
+func whydahLoginHandler() func(*gin.Context) {
+	return func(c *gin.Context) {
+		c.Redirect(http.StatusFound, whydah.LoginURL(os.Getenv("url")+"/login/whydah/callback"))
+	}
+}
+
+// whydahCallbackHandler exchanges the user ticket from Whydah SSO for a user token and sends the user to the dashboard
+// with the user token id in the fragment, where the dashboard reads it and sends it as a bearer token.
+func whydahCallbackHandler() func(*gin.Context) {
+	return func(c *gin.Context) {
+		ticket := c.Query("userticket")
+		if ticket == "" {
 			c.JSON(http.StatusBadRequest, gin.H{
-				"message": "Body with key and service is required",
+				"message": "Missing userticket",
 			})
 			return
 		}
-		body, _ := json.Marshal(req)
-		go slack.SendCommand(fmt.Sprintf("database/%s/%s", scope, artifactId), string(body))
-		cryptScope, v, _, sg, slackId, err := cloud.Decrypt(req.Key, cld)
+		ut, err := whydah.GetUserTokenByTicket(ticket)
 		if err != nil {
-			log.AddError(err).Fatal("While dekrypting cryptdata")
-		}
-		log.Println("Decrypted key")
-		if cryptScope != scope {
-			log.Fatal("Scope in cryptodata and provided scope are different")
-		}
-		endpoint := cld.CreateDatabase(scope, artifactId, v, sg, slackId)
-		if endpoint == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "Something wend wrong while creating database",
-			})
+			log.AddError(err).Info("While getting whydah user token by ticket")
+			c.JSON(http.StatusUnauthorized, errorJSON("Unable to log in with Whydah", err))
 			return
 		}
+		log.Info(ut.Username, " logged in with Whydah")
+		c.Redirect(http.StatusFound, path.Join("/", basePath)+"#token="+url.QueryEscape(ut.Id))
+	}
+}
+
+func whoamiHandler() func(*gin.Context) {
+	return func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
-			"message":  "Database successfully created",
-			"endpoint": endpoint,
+			"message":  "Success",
+			"identity": authlib.Get(c),
 		})
 	}
 }
 
-type serviceReq struct {
-	Key       string            `form:"key" json:"key" xml:"key"`
-	Service   cloud.Service     `form:"service" json:"service" xml:"service" binding:"required"`
-	ISpesProp map[string]string `form:"instance_specific_propperties" json:"instance_specific_propperties" xml:"instance_specific_propperties"`
+func tokensHandler(a *authlib.Authenticator) func(*gin.Context) {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Success",
+			"tokens":  a.Tokens(authlib.Get(c)),
+		})
+	}
 }
 
-func newServiceOnServerHandler(cld *cloud.AWS) func(*gin.Context) {
+type tokenBody struct {
+	Name   string       `form:"name" json:"name" xml:"name" binding:"required"`
+	Role   authlib.Role `form:"role" json:"role" xml:"role" binding:"required"`
+	Scopes []string     `form:"scopes" json:"scopes" xml:"scopes"`
+}
+
+// newTokenHandler creates an api token, like for ci. The token is only in the response, Nerthus only keeps its hash.
+func newTokenHandler(a *authlib.Authenticator) func(*gin.Context) {
 	return func(c *gin.Context) {
-		scope := c.Param("scope")
-		server := c.Param("server")
-		service := c.Param("service")
-		if err := cloud.CheckNameLen(scope); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"message": fmt.Sprintf("Scope name is limited by length"),
-				"error":   err.Error(),
-			})
-			return
-		}
-		var req serviceReq
-		err := c.ShouldBind(&req)
+		var body tokenBody
+		err := c.ShouldBind(&body)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{
 				"message": "Unable to get requred data from request. Supported formats are: JSON, XML and HTML form",
@@ -417,28 +761,941 @@ func newServiceOnServerHandler(cld *cloud.AWS) func(*gin.Context) {
 			})
 			return
 		}
-		body, _ := json.Marshal(req)
-		go slack.SendCommand(fmt.Sprintf("service/%s/%s/%s", scope, server, service), string(body))
-		cryptScope, v, k, sg, ts, err := cloud.Decrypt(req.Key, cld)
+		createdBy := c.GetString(gin.AuthUserKey)
+		token, t, err := a.CreateToken(body.Name, body.Role, body.Scopes, authlib.Get(c))
 		if err != nil {
-			log.AddError(err).Fatal("While dekrypting cryptdata")
-		}
-		if cryptScope != scope {
-			log.Fatal("Scope in cryptodata and provided scope are different")
-		}
-		if req.Service.ArtifactId != service {
-			log.Fatal("Artifact id and provided service does not match")
-		}
-		crypData := cld.AddServiceToServer(scope, server, v, k, sg, ts, req.Service)
-		if crypData == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "Something wend wrong while creating server",
-			})
+			c.JSON(errorStatus(err), errorJSON("Unable to create token", err))
 			return
 		}
+		slack.SendStatus(fmt.Sprintf("%s created api token %s with role %s.", createdBy, t.Name, t.Role))
 		c.JSON(http.StatusOK, gin.H{
-			"message": "Server successfully created",
-			"key":     crypData,
+			"message": "Token created, it is not possible to get it again",
+			"token":   token,
+			"info":    t,
+		})
+	}
+}
+
+func deleteTokenHandler(a *authlib.Authenticator) func(*gin.Context) {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		err := a.RevokeToken(name, authlib.Get(c))
+		if err != nil {
+			c.JSON(errorStatus(err), errorJSON("Unable to revoke token", err))
+			return
+		}
+		slack.SendStatus(fmt.Sprintf("%s revoked api token %s.", c.GetString(gin.AuthUserKey), name))
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Token revoked",
+		})
+	}
+}
+
+// auditHandler exports the audit log as json, filtered by scope, user and time range. from and to are RFC 3339 times.
+func auditHandler() func(*gin.Context) {
+	return func(c *gin.Context) {
+		f := audit.Filter{
+			Scope: c.Query("scope"),
+			User:  c.Query("user"),
+		}
+		var err error
+		if from := c.Query("from"); from != "" {
+			f.From, err = time.Parse(time.RFC3339, from)
+		}
+		if to := c.Query("to"); err == nil && to != "" {
+			f.To, err = time.Parse(time.RFC3339, to)
+		}
+		if limit := c.Query("limit"); err == nil && limit != "" {
+			f.Limit, err = strconv.Atoi(limit)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorJSON("Unable to parse filter", err))
+			return
+		}
+		entries, err := audit.List(f)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errorJSON("Something went wrong while reading audit log", err))
+			return
+		}
+		id := authlib.Get(c)
+		entries = slices.DeleteFunc(entries, func(e audit.Entry) bool {
+			return e.Scope != "" && !id.AllowsScope(e.Scope)
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Success",
+			"entries": entries,
+		})
+	}
+}
+
+// errorStatus maps errors from the orchestration to the http status they are reported with.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, journal.ErrNotFound), errors.Is(err, serverlib.ErrNotFound), errors.Is(err, keylib.ErrNotFound),
+		errors.Is(err, cloud.ErrScopeNotFound), errors.Is(err, secret.ErrNotFound), errors.Is(err, authlib.ErrTokenNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, journal.ErrInUse), errors.Is(err, cloud.ErrLastTarget), errors.Is(err, cloud.ErrNameNotAvailable),
+		errors.Is(err, authlib.ErrTokenExists):
+		return http.StatusConflict
+	case errors.Is(err, authlib.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, cloud.ErrInvalidManifest), errors.Is(err, cloud.ErrMissingKey), errors.Is(err, securitylib.ErrInvalidSource),
+		errors.Is(err, authlib.ErrUnknownRole), errors.Is(err, serverlib.ErrInvalidSizing),
+		errors.Is(err, serverlib.ErrUnknownAMIParameter), errors.Is(err, serverlib.ErrInvalidPlacement),
+		errors.Is(err, vpclib.ErrNotFound), errors.Is(err, vpclib.ErrInvalidSubnet), errors.Is(err, vpclib.ErrInvalidNetwork),
+		errors.Is(err, loadbalancer.ErrWrongVPC):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func errorJSON(message string, err error) gin.H {
+	resp := gin.H{
+		"message": message,
+		"error":   err.Error(),
+	}
+	var stepErr *cloud.StepError
+	if errors.As(err, &stepErr) {
+		resp["step"] = stepErr.Step
+		resp["resource"] = stepErr.Resource
+	}
+	return resp
+}
+
+// startJob runs f in the background and responds with where the progress and result of the job can be polled.
+// Jobs are named after the request, so a retried request gets the job that is already running instead of a new one.
+func startJob(c *gin.Context, f func(j *job.Job) (map[string]string, error)) {
+	startNamedJob(c, fmt.Sprintf("%s %s", c.Request.Method, c.Request.URL.Path), f)
+}
+
+// startNamedJob is startJob for requests where the path does not tell what the job works on.
+func startNamedJob(c *gin.Context, name string, f func(j *job.Job) (map[string]string, error)) {
+	j, started := job.Start(name, c.GetString(gin.AuthUserKey), audit.Scope(c), func(j *job.Job) (map[string]string, error) {
+		result, err := f(j)
+		if err == nil {
+			return result, nil
+		}
+		var stepErr *cloud.StepError
+		if errors.As(err, &stepErr) {
+			j.SetFailure(errorStatus(err), stepErr)
+		} else {
+			j.SetFailure(errorStatus(err), nil)
+		}
+		return result, err
+	})
+	location := fmt.Sprintf("%s/jobs/%s", basePath, j.Id)
+	message := "Job started"
+	if !started {
+		message = "An identical job is already running"
+	} else {
+		audit.SetJob(c, j)
+	}
+	c.Header("Location", location)
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":  message,
+		"job_id":   j.Id,
+		"location": location,
+	})
+}
+
+// planResponse responds with the plan of a dry run, nothing in aws is changed by creating it.
+func planResponse(c *gin.Context, plan cloud.Plan, err error) {
+	if err != nil {
+		c.JSON(errorStatus(err), errorJSON("Unable to create plan", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Dry run, nothing was changed",
+		"plan":    plan,
+	})
+}
+
+func applyHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unable to read body",
+				"error":   err.Error(),
+			})
+			return
+		}
+		c.Request.Body.Close()
+		m, err := cloud.ParseManifest(body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errorJSON("Unable to parse manifest", err))
+			return
+		}
+		audit.SetScope(c, m.Scope)
+		if !authlib.AllowScope(c, m.Scope) {
+			return
+		}
+		if c.Query("dry_run") == "true" {
+			plan, err := cld.PlanApply(m)
+			if err != nil {
+				c.JSON(errorStatus(err), errorJSON("Unable to create plan", err))
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"message": "Dry run, nothing was changed",
+				"plan":    plan,
+			})
+			return
+		}
+		admin := authlib.Get(c).Role.Allows(authlib.RoleAdmin)
+		if m.Key == "" && !admin {
+			c.JSON(http.StatusForbidden, gin.H{
+				"message": "Creating a scope requires the admin role, provide the key of the scope",
+			})
+			return
+		}
+		if m.Key != "" {
+			cryptScope, _, _, _, _, err := cloud.Decrypt(m.Key, cld)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"message": "Unable to decrypt key",
+					"error":   err.Error(),
+				})
+				return
+			}
+			if cryptScope != m.Scope {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"message": "Scope in cryptodata and scope in manifest are different",
+				})
+				return
+			}
+		}
+		if !admin {
+			// A key can be for a scope that has been deleted, so only the plan tells if the apply creates the scope.
+			plan, err := cld.PlanApply(m)
+			if err != nil {
+				c.JSON(errorStatus(err), errorJSON("Unable to create plan", err))
+				return
+			}
+			if plan.CreatesScope() {
+				c.JSON(http.StatusForbidden, gin.H{
+					"message": "Creating a scope requires the admin role",
+				})
+				return
+			}
+		}
+		go slack.SendCommand(c.GetString(gin.AuthUserKey), c.Request.Method, fmt.Sprintf("apply/%s", m.Scope), string(body))
+		startNamedJob(c, fmt.Sprintf("%s %s/%s", c.Request.Method, c.Request.URL.Path, m.Scope), func(j *job.Job) (map[string]string, error) {
+			cryptData, _, err := cld.WithJob(j).Apply(m)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{
+				"key": cryptData,
+			}, nil
+		})
+	}
+}
+
+func newLoadbalancerHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		loadbalancers, err := loadbalancer.GetLoadbalancers(cld.GetELB())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "Something wend wrong while gettign loadbalancers",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":       "Success",
+			"loadbalancers": loadbalancers,
+		})
+	}
+}
+
+func scopesHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		scopes, err := cld.GetScopes()
+		if err != nil {
+			c.JSON(errorStatus(err), errorJSON("Something went wrong while getting scopes", err))
+			return
+		}
+		id := authlib.Get(c)
+		scopes = slices.DeleteFunc(scopes, func(scope string) bool {
+			return !id.AllowsScope(scope)
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Success",
+			"scopes":  scopes,
+		})
+	}
+}
+
+func staleServersHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		days := 90
+		if d := c.Query("days"); d != "" {
+			var err error
+			days, err = strconv.Atoi(d)
+			if err != nil || days < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"message": "days has to be a positive number",
+				})
+				return
+			}
+		}
+		scopes := []string{c.Query("scope")}
+		if scopes[0] == "" {
+			var err error
+			scopes, err = cld.GetScopes()
+			if err != nil {
+				c.JSON(errorStatus(err), errorJSON("Something went wrong while getting scopes", err))
+				return
+			}
+		}
+		id := authlib.Get(c)
+		scopes = slices.DeleteFunc(scopes, func(scope string) bool {
+			return !id.AllowsScope(scope)
+		})
+		servers, err := cld.GetStaleServers(scopes, time.Duration(days)*24*time.Hour)
+		if err != nil {
+			c.JSON(errorStatus(err), errorJSON("Something went wrong while looking for stale amis", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Success",
+			"days":    days,
+			"servers": servers,
+		})
+	}
+}
+
+func scopeHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		inventory, err := cld.GetInventory(c.Param("scope"))
+		if err != nil {
+			c.JSON(errorStatus(err), errorJSON("Unable to get scope", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Success",
+			"scope":   inventory,
+		})
+	}
+}
+
+func scopeServersHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		servers, err := cld.GetInventoryServers(c.Param("scope"))
+		if err != nil {
+			c.JSON(errorStatus(err), errorJSON("Something went wrong while getting servers", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Success",
+			"servers": servers,
+		})
+	}
+}
+
+func scopeServicesHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		services, err := cld.GetInventoryServices(c.Param("scope"))
+		if err != nil {
+			c.JSON(errorStatus(err), errorJSON("Something went wrong while getting services", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":  "Success",
+			"services": services,
+		})
+	}
+}
+
+func driftHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		if scope := c.Query("scope"); scope != "" {
+			audit.SetScope(c, scope)
+			if !authlib.AllowScope(c, scope) {
+				return
+			}
+			report, err := cld.CheckDrift(scope)
+			if err != nil {
+				c.JSON(errorStatus(err), errorJSON("Something went wrong while checking drift", err))
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"message": "Success",
+				"checked": report.Checked,
+				"reports": []cloud.DriftReport{report},
+			})
+			return
+		}
+		if c.Query("refresh") == "true" {
+			_, err := cld.CheckAllDrift()
+			if err != nil {
+				c.JSON(errorStatus(err), errorJSON("Something went wrong while checking drift", err))
+				return
+			}
+		}
+		reports, checked := cloud.LatestDrift()
+		id := authlib.Get(c)
+		reports = slices.DeleteFunc(slices.Clone(reports), func(r cloud.DriftReport) bool {
+			return !id.AllowsScope(r.Scope)
+		})
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Success",
+			"checked": checked,
+			"reports": reports,
+		})
+	}
+}
+
+func orphansHandler(cld *cloud.AWS, grace time.Duration) func(*gin.Context) {
+	return func(c *gin.Context) {
+		scopes, err := allowedOrphanScopes(c, cld)
+		if err != nil {
+			c.JSON(errorStatus(err), errorJSON("Something went wrong while getting scopes", err))
+			return
+		}
+		orphans, err := cld.FindOrphans(scopes, grace)
+		if err != nil {
+			c.JSON(errorStatus(err), errorJSON("Something went wrong while looking for orphaned resources", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":      "Success",
+			"grace_period": grace.String(),
+			"orphans":      orphans,
+		})
+	}
+}
+
+// allowedOrphanScopes returns the scopes to look for orphans in that the caller is allowed into.
+func allowedOrphanScopes(c *gin.Context, cld *cloud.AWS) (scopes []string, err error) {
+	scopes, err = cld.GetOrphanScopes()
+	if err != nil {
+		return
+	}
+	id := authlib.Get(c)
+	scopes = slices.DeleteFunc(scopes, func(scope string) bool {
+		return !id.AllowsScope(scope)
+	})
+	return
+}
+
+type deleteOrphansReq struct {
+	Ids []string `form:"ids" json:"ids" xml:"ids"`
+}
+
+func deleteOrphansHandler(cld *cloud.AWS, grace time.Duration) func(*gin.Context) {
+	return func(c *gin.Context) {
+		if c.Query("confirm") != "true" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Deleting orphaned resources has to be confirmed with confirm=true",
+			})
+			return
+		}
+		var req deleteOrphansReq
+		if c.Request.ContentLength > 0 {
+			err := c.ShouldBind(&req)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"message": "Unable to get requred data from request. Supported formats are: JSON, XML and HTML form",
+					"error":   err.Error(),
+				})
+				return
+			}
+		}
+		scopes, err := allowedOrphanScopes(c, cld)
+		if err != nil {
+			c.JSON(errorStatus(err), errorJSON("Something went wrong while getting scopes", err))
+			return
+		}
+		go slack.SendCommand(c.GetString(gin.AuthUserKey), c.Request.Method, "gc/delete", strings.Join(req.Ids, ","))
+		startJob(c, func(j *job.Job) (map[string]string, error) {
+			deleted, err := cld.WithJob(j).DeleteOrphans(scopes, grace, req.Ids)
+			return map[string]string{
+				"deleted": fmt.Sprint(len(deleted)),
+			}, err
+		})
+	}
+}
+
+func newScopeHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		scope := c.Param("scope")
+		if err := cloud.CheckNameLen(scope); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": fmt.Sprintf("Scope name is limited by length"),
+				"error":   err.Error(),
+			})
+			return
+		}
+		executor := c.Query("executor")
+		if err := securitylib.CheckExecutor(executor); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unknown executor",
+				"error":   err.Error(),
+			})
+			return
+		}
+		amiParameter := c.Query("ami_parameter")
+		if err := serverlib.CheckAMIParameter(amiParameter); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unknown ami parameter",
+				"error":   err.Error(),
+			})
+			return
+		}
+		sshSources := c.QueryArray("ssh_source")
+		for _, source := range sshSources {
+			if _, err := securitylib.NormalizeSource(source); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"message": "Invalid ssh source",
+					"error":   err.Error(),
+				})
+				return
+			}
+		}
+		zones := 0
+		if c.Query("zones") != "" {
+			var err error
+			zones, err = strconv.Atoi(c.Query("zones"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"message": "Zones is not a number",
+					"error":   err.Error(),
+				})
+				return
+			}
+		}
+		vpcCIDR := c.Query("vpc_cidr")
+		if vpcCIDR != "" {
+			if err := vpclib.CheckNetwork(vpcCIDR, zones); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"message": "Invalid vpc",
+					"error":   err.Error(),
+				})
+				return
+			}
+		}
+		o := cloud.ScopeOptions{
+			Executor:     executor,
+			SSHSources:   sshSources,
+			AMIParameter: amiParameter,
+			VPC:          c.Query("vpc"),
+			Subnets:      c.QueryArray("subnet"),
+			VPCCIDR:      vpcCIDR,
+			Zones:        zones,
+			NAT:          c.Query("nat") == "true",
+		}
+		if c.Query("dry_run") == "true" {
+			plan, err := cld.PlanScope(scope, o)
+			planResponse(c, plan, err)
+			return
+		}
+		go slack.SendCommand(c.GetString(gin.AuthUserKey), c.Request.Method, fmt.Sprintf("scope/%s", scope), "")
+		startJob(c, func(j *job.Job) (map[string]string, error) {
+			crypData, err := cld.WithJob(j).CreateScope(scope, o)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{
+				"key": crypData,
+			}, nil
+		})
+	}
+}
+
+func scopeSSHHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		access, err := cld.GetSSHAccess(c.Param("scope"))
+		if err != nil {
+			c.JSON(errorStatus(err), errorJSON("Unable to get ssh access", err))
+			return
+		}
+		c.JSON(http.StatusOK, access)
+	}
+}
+
+type sshAccessBody struct {
+	Add    []string `json:"add"`
+	Revoke []string `json:"revoke"`
+}
+
+// updateScopeSSHHandler adds and revokes the sources ssh is allowed from in a scope. The change is sent to the command
+// channel and every source added or revoked is reported as a status with the user that did it.
+func updateScopeSSHHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		scope := c.Param("scope")
+		var body sshAccessBody
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unable to parse body",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if len(body.Add) == 0 && len(body.Revoke) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Nothing to add or revoke",
+			})
+			return
+		}
+		for _, source := range append(append([]string{}, body.Add...), body.Revoke...) {
+			if _, err := securitylib.NormalizeSource(source); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"message": "Invalid ssh source",
+					"error":   err.Error(),
+				})
+				return
+			}
+		}
+		data, _ := json.Marshal(body)
+		go slack.SendCommand(c.GetString(gin.AuthUserKey), c.Request.Method, fmt.Sprintf("scope/%s/ssh", scope), string(data))
+		user := c.GetString(gin.AuthUserKey)
+		startJob(c, func(j *job.Job) (map[string]string, error) {
+			access, err := cld.WithJob(j).UpdateSSHAccess(scope, body.Add, body.Revoke, user)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{
+				"security_group": access.SecurityGroup,
+				"sources":        strings.Join(access.Sources, " "),
+			}, nil
+		})
+	}
+}
+
+func deleteScopeHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		scope := c.Param("scope")
+		if err := cloud.CheckNameLen(scope); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": fmt.Sprintf("Scope name is limited by length"),
+				"error":   err.Error(),
+			})
+			return
+		}
+		go slack.SendCommand(c.GetString(gin.AuthUserKey), c.Request.Method, fmt.Sprintf("scope/%s", scope), "")
+		startJob(c, func(j *job.Job) (map[string]string, error) {
+			return nil, cld.WithJob(j).DeleteScope(scope)
+		})
+	}
+}
+
+type serverReq struct {
+	Key string `form:"key" json:"key" xml:"key"`
+	serverlib.Sizing
+	serverlib.Placement
+}
+
+func newServerInScopeHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		scope := c.Param("scope")
+		server := c.Param("server") //[1:]
+		if err := cloud.CheckNameLen(scope); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": fmt.Sprintf("Scope name is limited by length"),
+				"error":   err.Error(),
+			})
+			return
+		}
+		var req serverReq
+		err := c.ShouldBind(&req)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unable to get requred data from request. Supported formats are: JSON, XML and HTML form",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if req.Key == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Body with key and service is required",
+			})
+			return
+		}
+		dryRun := c.Query("dry_run") == "true"
+		if !dryRun {
+			body, _ := json.Marshal(req)
+			go slack.SendCommand(c.GetString(gin.AuthUserKey), c.Request.Method, fmt.Sprintf("server/%s/%s", scope, server), string(body))
+		}
+		cryptScope, v, k, sg, ts, err := cloud.Decrypt(req.Key, cld)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unable to decrypt key",
+				"error":   err.Error(),
+			})
+			return
+		}
+		log.Println("Decrypted key")
+		if cryptScope != scope {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Scope in cryptodata and provided scope are different",
+			})
+			return
+		}
+		if dryRun {
+			plan, err := cld.PlanServer(scope, server, req.Sizing, req.Placement, v, k, sg)
+			planResponse(c, plan, err)
+			return
+		}
+		err = cld.ValidateServerSizing(req.Sizing, sg)
+		if err != nil {
+			c.JSON(errorStatus(err), errorJSON("Server sizing is not valid", err))
+			return
+		}
+		err = cld.ValidateServerPlacement(req.Placement, v)
+		if err != nil {
+			c.JSON(errorStatus(err), errorJSON("Server placement is not valid", err))
+			return
+		}
+		startJob(c, func(j *job.Job) (map[string]string, error) {
+			_, err := cld.WithJob(j).AddServerToScope(scope, server, req.Sizing, req.Placement, v, k, sg, ts)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{
+				"key": req.Key,
+			}, nil
+		})
+	}
+}
+
+func deleteServerInScopeHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		scope := c.Param("scope")
+		server := c.Param("server")
+		if err := cloud.CheckNameLen(scope); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": fmt.Sprintf("Scope name is limited by length"),
+				"error":   err.Error(),
+			})
+			return
+		}
+		var req serverReq
+		err := c.ShouldBind(&req)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unable to get requred data from request. Supported formats are: JSON, XML and HTML form",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if req.Key == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Body with key is required",
+			})
+			return
+		}
+		force := c.Query("force") == "true"
+		body, _ := json.Marshal(req)
+		go slack.SendCommand(c.GetString(gin.AuthUserKey), c.Request.Method, fmt.Sprintf("server/%s/%s?force=%t", scope, server, force), string(body))
+		cryptScope, _, _, _, _, err := cloud.Decrypt(req.Key, cld)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unable to decrypt key",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if cryptScope != scope {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Scope in cryptodata and provided scope are different",
+			})
+			return
+		}
+		if !force {
+			err := cld.CheckServerRemovable(scope, server)
+			if errors.Is(err, cloud.ErrLastTarget) {
+				c.JSON(http.StatusConflict, errorJSON("Server is the last healthy target of a live listener rule, use force=true to remove it anyway", err))
+				return
+			}
+			if err != nil {
+				c.JSON(errorStatus(err), errorJSON("Unable to check if server can be removed", err))
+				return
+			}
+		}
+		startJob(c, func(j *job.Job) (map[string]string, error) {
+			return nil, cld.WithJob(j).RemoveServerFromScope(scope, server, force)
+		})
+	}
+}
+
+func newDatabaseInScopeHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		scope := c.Param("scope")
+		artifactId := c.Param("artifactId") //[1:]
+		if err := cloud.CheckNameLen(scope); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": fmt.Sprintf("Scope name is limited by length"),
+				"error":   err.Error(),
+			})
+			return
+		}
+		var req serverReq
+		err := c.ShouldBind(&req)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unable to get requred data from request. Supported formats are: JSON, XML and HTML form",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if req.Key == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Body with key and service is required",
+			})
+			return
+		}
+		dryRun := c.Query("dry_run") == "true"
+		if !dryRun {
+			body, _ := json.Marshal(req)
+			go slack.SendCommand(c.GetString(gin.AuthUserKey), c.Request.Method, fmt.Sprintf("database/%s/%s", scope, artifactId), string(body))
+		}
+		cryptScope, v, _, sg, slackId, err := cloud.Decrypt(req.Key, cld)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unable to decrypt key",
+				"error":   err.Error(),
+			})
+			return
+		}
+		log.Println("Decrypted key")
+		if cryptScope != scope {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Scope in cryptodata and provided scope are different",
+			})
+			return
+		}
+		if dryRun {
+			plan, err := cld.PlanDatabase(scope, artifactId, v, sg)
+			planResponse(c, plan, err)
+			return
+		}
+		startJob(c, func(j *job.Job) (map[string]string, error) {
+			endpoint, err := cld.WithJob(j).CreateDatabase(scope, artifactId, v, sg, slackId)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{
+				"endpoint": endpoint,
+			}, nil
+		})
+	}
+}
+
+type serviceReq struct {
+	Key       string            `form:"key" json:"key" xml:"key"`
+	Service   cloud.Service     `form:"service" json:"service" xml:"service" binding:"required"`
+	ISpesProp map[string]string `form:"instance_specific_propperties" json:"instance_specific_propperties" xml:"instance_specific_propperties"`
+}
+
+func newServiceOnServerHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		scope := c.Param("scope")
+		server := c.Param("server")
+		service := c.Param("service")
+		if err := cloud.CheckNameLen(scope); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": fmt.Sprintf("Scope name is limited by length"),
+				"error":   err.Error(),
+			})
+			return
+		}
+		var req serviceReq
+		err := c.ShouldBind(&req)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unable to get requred data from request. Supported formats are: JSON, XML and HTML form",
+				"error":   err.Error(),
+			})
+			return
+		}
+		dryRun := c.Query("dry_run") == "true"
+		if !dryRun {
+			body, _ := json.Marshal(req)
+			go slack.SendCommand(c.GetString(gin.AuthUserKey), c.Request.Method, fmt.Sprintf("service/%s/%s/%s", scope, server, service), string(body))
+		}
+		cryptScope, v, k, sg, ts, err := cloud.Decrypt(req.Key, cld)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unable to decrypt key",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if cryptScope != scope {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Scope in cryptodata and provided scope are different",
+			})
+			return
+		}
+		if req.Service.ArtifactId != service {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Artifact id and provided service does not match",
+			})
+			return
+		}
+		if dryRun {
+			plan, err := cld.PlanService(scope, server, v, k, sg, req.Service)
+			planResponse(c, plan, err)
+			return
+		}
+		startJob(c, func(j *job.Job) (map[string]string, error) {
+			_, err := cld.WithJob(j).AddServiceToServer(scope, server, v, k, sg, ts, req.Service)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]string{
+				"key": req.Key,
+			}, nil
+		})
+	}
+}
+
+func deleteServiceOnServerHandler(cld *cloud.AWS) func(*gin.Context) {
+	return func(c *gin.Context) {
+		scope := c.Param("scope")
+		server := c.Param("server")
+		service := c.Param("service")
+		if err := cloud.CheckNameLen(scope); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": fmt.Sprintf("Scope name is limited by length"),
+				"error":   err.Error(),
+			})
+			return
+		}
+		var req serverReq
+		err := c.ShouldBind(&req)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unable to get requred data from request. Supported formats are: JSON, XML and HTML form",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if req.Key == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Body with key is required",
+			})
+			return
+		}
+		body, _ := json.Marshal(req)
+		go slack.SendCommand(c.GetString(gin.AuthUserKey), c.Request.Method, fmt.Sprintf("service/%s/%s/%s", scope, server, service), string(body))
+		cryptScope, _, k, sg, _, err := cloud.Decrypt(req.Key, cld)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Unable to decrypt key",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if cryptScope != scope {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "Scope in cryptodata and provided scope are different",
+			})
+			return
+		}
+		startJob(c, func(j *job.Job) (map[string]string, error) {
+			return nil, cld.WithJob(j).RemoveServiceFromServer(scope, server, service, k, sg)
 		})
 	}
 }
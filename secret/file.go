@@ -0,0 +1,95 @@
+package secret
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cantara/nerthus/crypto"
+)
+
+var _ Store = File{}
+
+// File keeps every secret encrypted with the crypt key in its own file in a directory. It is meant for development and
+// tests, where there is no secrets manager.
+type File struct {
+	dir string
+}
+
+func NewFile(dir string) (f File, err error) {
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+	f = File{
+		dir: dir,
+	}
+	return
+}
+
+func (f File) path(name string) string {
+	return filepath.Join(f.dir, url.PathEscape(name))
+}
+
+func (f File) Put(name, value string) (ref string, err error) {
+	data, err := crypto.Encrypt([]byte(value))
+	if err != nil {
+		return
+	}
+	path := f.path(name)
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, []byte(data), 0600)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return
+	}
+	ref = "file://" + path
+	return
+}
+
+func (f File) Get(name string) (value string, err error) {
+	data, err := os.ReadFile(f.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		err = errors.Join(ErrNotFound, err)
+		return
+	}
+	if err != nil {
+		return
+	}
+	b, err := crypto.Decrypt(string(data))
+	value = string(b)
+	return
+}
+
+func (f File) Delete(name string) (err error) {
+	err = os.Remove(f.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return
+}
+
+func (f File) List(prefix string) (names []string, err error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		name, err := url.PathUnescape(entry.Name())
+		if err != nil || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
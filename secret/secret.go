@@ -0,0 +1,67 @@
+package secret
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrNotFound = errors.New("secret not found")
+
+// Store keeps the secrets Nerthus creates, like the private keys of the scopes and the database passwords, so that only
+// references to them are sent to Slack.
+type Store interface {
+	// Put creates the secret or replaces its value, and returns a reference to where it is stored.
+	Put(name, value string) (ref string, err error)
+	Get(name string) (value string, err error)
+	// Delete removes the secret, a secret that does not exist is not an error.
+	Delete(name string) error
+	// List returns the names of the secrets starting with the prefix.
+	List(prefix string) (names []string, err error)
+}
+
+const namePrefix = "nerthus/"
+
+// ScopePrefix is the start of the names of all secrets in the scope.
+func ScopePrefix(scope string) string {
+	return fmt.Sprintf("%s%s/", namePrefix, scope)
+}
+
+// KeyName is the name of the secret with the private key of the scope.
+func KeyName(scope string) string {
+	return ScopePrefix(scope) + "ssh-key"
+}
+
+// DatabaseName is the name of the secret with the master password of a database in the scope.
+func DatabaseName(scope, database string) string {
+	return fmt.Sprintf("%sdatabase/%s", ScopePrefix(scope), database)
+}
+
+// Secret is a stored secret that can be removed again, like the other resources the sequences create.
+type Secret struct {
+	Name  string `json:"name"`
+	Ref   string `json:"ref"`
+	store Store
+}
+
+func New(name string, store Store) Secret {
+	return Secret{
+		Name:  name,
+		store: store,
+	}
+}
+
+// Put stores the value of the secret.
+func (s *Secret) Put(value string) (err error) {
+	if s.store == nil {
+		return errors.New("No secret store found")
+	}
+	s.Ref, err = s.store.Put(s.Name, value)
+	return
+}
+
+func (s *Secret) Delete() (err error) {
+	if s.store == nil {
+		return errors.New("No secret store found")
+	}
+	return s.store.Delete(s.Name)
+}
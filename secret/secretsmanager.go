@@ -0,0 +1,110 @@
+package secret
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/smithy-go"
+	"github.com/cantara/nerthus/aws/util"
+)
+
+var _ Store = SecretsManager{}
+
+// SecretsManager keeps the secrets in aws secrets manager.
+type SecretsManager struct {
+	client util.SecretsManager
+}
+
+func NewSecretsManager(client util.SecretsManager) SecretsManager {
+	return SecretsManager{
+		client: client,
+	}
+}
+
+func (s SecretsManager) Put(name, value string) (ref string, err error) {
+	created, err := s.client.CreateSecret(context.Background(), &secretsmanager.CreateSecretInput{
+		Name:         aws.String(name),
+		Description:  aws.String("Created by Nerthus"),
+		SecretString: aws.String(value),
+	})
+	if err == nil {
+		return aws.ToString(created.ARN), nil
+	}
+	if !isErrorCode(err, "ResourceExistsException") {
+		return "", fmt.Errorf("while creating secret %s: %w", name, err)
+	}
+	updated, err := s.client.PutSecretValue(context.Background(), &secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(name),
+		SecretString: aws.String(value),
+	})
+	if err != nil {
+		return "", fmt.Errorf("while updating secret %s: %w", name, err)
+	}
+	return aws.ToString(updated.ARN), nil
+}
+
+func (s SecretsManager) Get(name string) (value string, err error) {
+	result, err := s.client.GetSecretValue(context.Background(), &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	if isErrorCode(err, "ResourceNotFoundException") {
+		err = fmt.Errorf("%w: %s", ErrNotFound, name)
+		return
+	}
+	if err != nil {
+		return
+	}
+	value = aws.ToString(result.SecretString)
+	return
+}
+
+// Delete removes the secret without the recovery window, so that a sequence that is retried after a rollback can create
+// it again with the same name.
+func (s SecretsManager) Delete(name string) (err error) {
+	_, err = s.client.DeleteSecret(context.Background(), &secretsmanager.DeleteSecretInput{
+		SecretId:                   aws.String(name),
+		ForceDeleteWithoutRecovery: aws.Bool(true),
+	})
+	if isErrorCode(err, "ResourceNotFoundException") {
+		return nil
+	}
+	return
+}
+
+func (s SecretsManager) List(prefix string) (names []string, err error) {
+	var next *string
+	for {
+		result, err := s.client.ListSecrets(context.Background(), &secretsmanager.ListSecretsInput{
+			Filters: []smtypes.Filter{
+				{
+					Key:    smtypes.FilterNameStringTypeName,
+					Values: []string{prefix},
+				},
+			},
+			NextToken: next,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range result.SecretList {
+			// The name filter also matches words in the name that are not at the start
+			if strings.HasPrefix(aws.ToString(entry.Name), prefix) {
+				names = append(names, aws.ToString(entry.Name))
+			}
+		}
+		next = result.NextToken
+		if next == nil {
+			return names, nil
+		}
+	}
+}
+
+func isErrorCode(err error, code string) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == code
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"fmt"
+	"io"
+)
+
+// Executor runs scripts on a server.
+type Executor interface {
+	// Run runs the script with bash, streaming its output to stdout and stderr as it is written. When the script has
+	// run its exit code is returned with a nil error, the error is only for failing to run it at all.
+	Run(script string, stdout, stderr io.Writer) (exitCode int, err error)
+}
+
+// Dialer returns an Executor for the host that authenticates with the pem encoded private key.
+type Dialer func(host string, privateKey []byte) (Executor, error)
+
+// ExitError is returned when a script exits with another code than 0.
+type ExitError struct {
+	Code   int
+	Stderr string
+}
+
+func (e *ExitError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("script exited with code %d", e.Code)
+	}
+	return fmt.Sprintf("script exited with code %d: %s", e.Code, e.Stderr)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// FakeExecutor is an Executor that records the scripts it is given instead of running them, for use in tests. Scripts
+// exit with 0 and no output unless told otherwise with Fail or Output.
+type FakeExecutor struct {
+	mutex   sync.Mutex
+	hosts   []string
+	scripts []string
+	rules   []fakeRule
+}
+
+type fakeRule struct {
+	contains string
+	stdout   string
+	exitCode int
+	err      error
+}
+
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{}
+}
+
+// Dialer returns a Dialer that hands out the fake for every host.
+func (f *FakeExecutor) Dialer() Dialer {
+	return func(host string, privateKey []byte) (Executor, error) {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		f.hosts = append(f.hosts, host)
+		return f, nil
+	}
+}
+
+// Fail makes scripts containing the text exit with the exit code.
+func (f *FakeExecutor) Fail(contains string, exitCode int) {
+	f.add(fakeRule{contains: contains, exitCode: exitCode})
+}
+
+// FailToConnect makes scripts containing the text fail with err, like when the server can not be reached.
+func (f *FakeExecutor) FailToConnect(contains string, err error) {
+	f.add(fakeRule{contains: contains, err: err})
+}
+
+// Output makes scripts containing the text write stdout.
+func (f *FakeExecutor) Output(contains, stdout string) {
+	f.add(fakeRule{contains: contains, stdout: stdout})
+}
+
+// Reset removes everything added with Fail, FailToConnect and Output.
+func (f *FakeExecutor) Reset() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.rules = nil
+}
+
+// Hosts returns the hosts the fake has been dialed for, in order.
+func (f *FakeExecutor) Hosts() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return slices.Clone(f.hosts)
+}
+
+// Scripts returns the scripts the fake has been given, in order.
+func (f *FakeExecutor) Scripts() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return slices.Clone(f.scripts)
+}
+
+func (f *FakeExecutor) add(r fakeRule) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.rules = append(f.rules, r)
+}
+
+// Run applies the most recently added rule matching the script.
+func (f *FakeExecutor) Run(script string, stdout, stderr io.Writer) (exitCode int, err error) {
+	f.mutex.Lock()
+	f.scripts = append(f.scripts, script)
+	var rule fakeRule
+	for i := len(f.rules) - 1; i >= 0; i-- {
+		if strings.Contains(script, f.rules[i].contains) {
+			rule = f.rules[i]
+			break
+		}
+	}
+	f.mutex.Unlock()
+	if rule.err != nil {
+		return 0, rule.err
+	}
+	io.WriteString(stdout, rule.stdout)
+	if rule.exitCode != 0 {
+		fmt.Fprintf(stderr, "fake exit %d\n", rule.exitCode)
+	}
+	return rule.exitCode, nil
+}
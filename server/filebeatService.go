@@ -25,6 +25,13 @@ func NewFilebeatService(serverName, artifactId, userName string, serv Server) (f
 	return
 }
 
+// GetFilebeatService returns the filebeat input already added for the service, so that it can be removed.
+func GetFilebeatService(serverName, artifactId, userName string, serv Server) (f FilebeatService, err error) {
+	f, err = NewFilebeatService(serverName, artifactId, userName, serv)
+	f.added = true
+	return
+}
+
 //go:embed filebeat_service.sh
 var fsFBS embed.FS
 
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	log "github.com/cantara/bragi"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ErrHostKeyMismatch is returned when a server presents another host key than the one pinned for it.
+var ErrHostKeyMismatch = errors.New("host key does not match the pinned host key")
+
+// hostKeyStore pins the host key a server presents the first time Nerthus connects to it. When it is initialized with
+// a file the keys are kept in it in known_hosts format, so that they outlive a restart.
+type hostKeyStore struct {
+	mutex sync.Mutex
+	file  string
+	keys  map[string]ssh.PublicKey
+}
+
+var hostKeys = &hostKeyStore{
+	keys: make(map[string]ssh.PublicKey),
+}
+
+// InitHostKeys loads the pinned host keys from the file and stores new ones in it. Without it the keys are only kept in
+// memory.
+func InitHostKeys(file string) (err error) {
+	keys := make(map[string]ssh.PublicKey)
+	data, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	for len(data) > 0 {
+		var hosts []string
+		var key ssh.PublicKey
+		_, hosts, key, _, data, err = ssh.ParseKnownHosts(data)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("while parsing host keys in %s: %w", file, err)
+		}
+		for _, host := range hosts {
+			keys[host] = key
+		}
+	}
+	err = os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return
+	}
+	hostKeys.mutex.Lock()
+	defer hostKeys.mutex.Unlock()
+	hostKeys.file = file
+	hostKeys.keys = keys
+	return
+}
+
+// ForgetHostKey removes the pinned host key for the host. Aws reuses public dns names, so a new server has to be
+// forgotten before it is connected to the first time.
+func ForgetHostKey(host string) (err error) {
+	hostKeys.mutex.Lock()
+	defer hostKeys.mutex.Unlock()
+	address := knownhosts.Normalize(host)
+	if _, ok := hostKeys.keys[address]; !ok {
+		return
+	}
+	delete(hostKeys.keys, address)
+	return hostKeys.save()
+}
+
+// check is the ssh.HostKeyCallback for the store. The key is pinned if the host is not known.
+func (s *hostKeyStore) check(hostname string, remote net.Addr, key ssh.PublicKey) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	address := knownhosts.Normalize(hostname)
+	pinned, ok := s.keys[address]
+	if ok {
+		if !bytes.Equal(pinned.Marshal(), key.Marshal()) {
+			return fmt.Errorf("%w for %s, got %s expected %s", ErrHostKeyMismatch, address, ssh.FingerprintSHA256(key), ssh.FingerprintSHA256(pinned))
+		}
+		return
+	}
+	log.Info("Pinning host key ", ssh.FingerprintSHA256(key), " for ", address)
+	s.keys[address] = key
+	return s.save()
+}
+
+func (s *hostKeyStore) save() (err error) {
+	if s.file == "" {
+		return
+	}
+	addresses := make([]string, 0, len(s.keys))
+	for address := range s.keys {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	var data bytes.Buffer
+	for _, address := range addresses {
+		fmt.Fprintln(&data, knownhosts.Line([]string{address}, s.keys[address]))
+	}
+	tmp := s.file + ".tmp"
+	err = os.WriteFile(tmp, data.Bytes(), 0600)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp, s.file)
+}
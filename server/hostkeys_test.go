@@ -0,0 +1,75 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hostkeys", "known_hosts")
+	err := InitHostKeys(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := "ec2-203-0-113-10.eu-west-1.compute.amazonaws.com:22"
+	key := newHostKey(t)
+	changed := newHostKey(t)
+
+	err = hostKeys.check(host, nil, key)
+	if err != nil {
+		t.Fatalf("expected the first key to be pinned, got %v", err)
+	}
+	err = hostKeys.check(host, nil, key)
+	if err != nil {
+		t.Fatalf("expected the pinned key to be accepted, got %v", err)
+	}
+	err = hostKeys.check(host, nil, changed)
+	if !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("expected ErrHostKeyMismatch for a changed key, got %v", err)
+	}
+
+	// The pinned keys outlive a restart.
+	err = InitHostKeys(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hostKeys.check(host, nil, changed)
+	if !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("expected the key to still be pinned after loading the file, got %v", err)
+	}
+
+	err = ForgetHostKey(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hostKeys.check(host, nil, changed)
+	if err != nil {
+		t.Fatalf("expected the key of a forgotten host to be pinned, got %v", err)
+	}
+	err = InitHostKeys(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hostKeys.check(host, nil, key)
+	if !errors.Is(err, ErrHostKeyMismatch) {
+		t.Fatalf("expected the new key to be pinned in the file, got %v", err)
+	}
+}
@@ -25,6 +25,16 @@ func NewJava(version Version, serv Server) (j Java, err error) {
 	return
 }
 
+// GetJava returns the java version if it is installed on the server, so that it can be removed.
+func GetJava(version Version, serv Server) (j Java, err error) {
+	j, err = NewJava(version, serv)
+	if err != nil {
+		return
+	}
+	j.installed, err = j.isInstalled()
+	return
+}
+
 func (j Java) isInstalled() (installed bool, err error) {
 	script := ""
 	switch j.Version {
@@ -35,12 +45,7 @@ func (j Java) isInstalled() (installed bool, err error) {
 	default:
 		return
 	}
-	stdout, err := j.Server.RunScript(script)
-	if err != nil {
-		return
-	}
-	installed = stdout != ""
-	return
+	return j.Server.check(script)
 }
 
 func (j *Java) Create() (id string, err error) {
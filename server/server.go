@@ -1,10 +1,9 @@
 package server
 
 import (
+	"bytes"
 	"errors"
-	"fmt"
 	"io"
-	"os/exec"
 	"time"
 
 	log "github.com/cantara/bragi"
@@ -12,52 +11,84 @@ import (
 
 type Server struct {
 	publicDNS string
-	pemName   string
+	exec      Executor
 }
 
-func NewServer(publicDNS, pemName string) (s Server, err error) {
+// NewServer returns a server that runs its scripts over the executor dial returns for it. A nil dial is DialSSH.
+func NewServer(publicDNS string, privateKey []byte, dial Dialer) (s Server, err error) {
+	if dial == nil {
+		dial = DialSSH
+	}
+	exec, err := dial(publicDNS, privateKey)
+	if err != nil {
+		return
+	}
 	s = Server{
 		publicDNS: publicDNS,
-		pemName:   pemName,
+		exec:      exec,
 	}
 	return
 }
 
-func (s Server) RunScript(script string) (stdout string, err error) {
+// Stream runs the script, writing its output to stdout and stderr while it runs. A script exiting with another code than
+// 0 returns an *ExitError.
+func (s Server) Stream(script string, stdout, stderr io.Writer) (err error) {
+	if s.exec == nil {
+		return errors.New("No executor for server " + s.publicDNS)
+	}
 	script = script + `
+status=$?
 history -c
-exit
+exit $status
 `
-	cmd := exec.Command("ssh", "-o", "ConnectTimeout=5", "-o", "ConnectionAttempts=3", "-o", "UserKnownHostsFile=/dev/null", "-o", "StrictHostKeyChecking=no",
-		fmt.Sprintf("ec2-user@%s", s.publicDNS), "-i", "./"+s.pemName, "/bin/bash -s")
-	stdin, err := cmd.StdinPipe()
+	var stderrB bytes.Buffer
+	code, err := s.exec.Run(script, stdout, io.MultiWriter(stderr, &stderrB))
 	if err != nil {
-		log.AddError(err).Warning("While creating stdin pipe")
 		return
 	}
-	defer stdin.Close()
-	io.WriteString(stdin, script)
+	if code != 0 {
+		err = &ExitError{
+			Code:   code,
+			Stderr: stderrB.String(),
+		}
+	}
+	return
+}
 
-	stdoutB, err := cmd.Output()
+func (s Server) RunScript(script string) (stdout string, err error) {
+	var stdoutB bytes.Buffer
+	err = s.Stream(script, &stdoutB, io.Discard)
 	if err != nil {
-		var eerr *exec.ExitError
+		var eerr *ExitError
 		if errors.As(err, &eerr) {
-			log.AddError(errors.New(string(eerr.Stderr))).Warning("Exit error from ssh run command for host %s with pemName %s and command %s", s.publicDNS, s.pemName, cmd.String())
+			log.AddError(errors.New(eerr.Stderr)).Warning("Exit error ", eerr.Code, " from run command for host ", s.publicDNS)
 		}
-
 		return
 	}
-	stdout = string(stdoutB)
+	stdout = stdoutB.String()
 	return
 }
 
+// check runs a script that tests something on the server, like grep. Exit code 0 is true and 1 is false.
+func (s Server) check(script string) (ok bool, err error) {
+	err = s.Stream(script, io.Discard, io.Discard)
+	var eerr *ExitError
+	if errors.As(err, &eerr) && eerr.Code == 1 {
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+	return true, nil
+}
+
 func (s Server) WaitForConnection() (err error) {
 	for i := 0; i < 30; i++ {
 		_, err = s.RunScript(`echo "ping"`)
 		if err == nil {
 			return nil
 		}
-		log.AddError(err).Info("While waiting for connection to server %s", s.publicDNS)
+		log.AddError(err).Info("While waiting for connection to server ", s.publicDNS)
 		time.Sleep(10 * time.Second)
 	}
 	return errors.New("Unable to connect to server")
@@ -40,6 +40,16 @@ func NewService(name, updateProp, localOverride, healthReport, path, appIcon str
 	return
 }
 
+// GetService returns the service installed for the user, so that it can be stopped.
+func GetService(name string, user User, serv Server) (s Service, err error) {
+	s = Service{
+		Name: name,
+		user: user,
+		serv: serv,
+	}
+	return
+}
+
 //go:embed new_service.sh
 var f embed.FS
 
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sshUser    = "ec2-user"
+	sshPort    = "22"
+	sshTimeout = 5 * time.Second
+)
+
+// SSH runs scripts on a server over ssh. The private key is only kept in memory and the host key is pinned the first
+// time the server is connected to.
+type SSH struct {
+	host   string
+	config *ssh.ClientConfig
+}
+
+// DialSSH is the Dialer for SSH. It connects as ec2-user, a new connection is made for every script.
+func DialSSH(host string, privateKey []byte) (e Executor, err error) {
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	if err != nil {
+		return
+	}
+	e = SSH{
+		host: host,
+		config: &ssh.ClientConfig{
+			User:            sshUser,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeys.check,
+			Timeout:         sshTimeout,
+		},
+	}
+	return
+}
+
+func (s SSH) Run(script string, stdout, stderr io.Writer) (exitCode int, err error) {
+	client, err := ssh.Dial("tcp", net.JoinHostPort(s.host, sshPort), s.config)
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	session.Stdin = strings.NewReader(script)
+	session.Stdout = stdout
+	session.Stderr = stderr
+	err = session.Run("/bin/bash -s")
+	var eerr *ssh.ExitError
+	if errors.As(err, &eerr) {
+		return eerr.ExitStatus(), nil
+	}
+	return
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
+	"github.com/cantara/nerthus/aws/util"
+)
+
+// ssmPollInterval is how often the result of a command is fetched while it runs.
+var ssmPollInterval = 2 * time.Second
+
+// ssmTimeout is how long a script may run on the server before systems manager stops it.
+const ssmTimeout = time.Hour
+
+// SSM runs scripts on a server with systems manager Run Command, so that the server needs no inbound access. The
+// scripts are run as ec2-user from its home directory, like over ssh. Systems manager does not stream output, it is
+// written as it is fetched while the script runs.
+type SSM struct {
+	instanceId string
+	ssm        util.SSM
+}
+
+// DialSSM returns the Dialer for SSM. The host is the id of the instance, the private key is not used.
+func DialSSM(client util.SSM) Dialer {
+	return func(instanceId string, privateKey []byte) (Executor, error) {
+		if client == nil {
+			return nil, errors.New("No ssm session found")
+		}
+		return SSM{
+			instanceId: instanceId,
+			ssm:        client,
+		}, nil
+	}
+}
+
+func (s SSM) Run(script string, stdout, stderr io.Writer) (exitCode int, err error) {
+	command := fmt.Sprintf("sudo -u %s -i /bin/bash -s <<'NERTHUS_SCRIPT'\n%s\nNERTHUS_SCRIPT", sshUser, script)
+	result, err := s.ssm.SendCommand(context.Background(), &ssm.SendCommandInput{
+		DocumentName: aws.String("AWS-RunShellScript"),
+		InstanceIds:  []string{s.instanceId},
+		Parameters: map[string][]string{
+			"commands":         {command},
+			"executionTimeout": {fmt.Sprint(int(ssmTimeout.Seconds()))},
+		},
+	})
+	if err != nil {
+		return
+	}
+	commandId := aws.ToString(result.Command.CommandId)
+	var stdoutN, stderrN int
+	for {
+		time.Sleep(ssmPollInterval)
+		invocation, err := s.ssm.GetCommandInvocation(context.Background(), &ssm.GetCommandInvocationInput{
+			CommandId:  aws.String(commandId),
+			InstanceId: aws.String(s.instanceId),
+		})
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvocationDoesNotExist" {
+			// The invocation is not always available right after the command is sent
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		stdoutN = writeNew(stdout, aws.ToString(invocation.StandardOutputContent), stdoutN)
+		stderrN = writeNew(stderr, aws.ToString(invocation.StandardErrorContent), stderrN)
+		switch invocation.Status {
+		case ssmtypes.CommandInvocationStatusSuccess:
+			return 0, nil
+		case ssmtypes.CommandInvocationStatusFailed:
+			if invocation.ResponseCode < 0 {
+				return 0, fmt.Errorf("ssm command %s failed on %s: %s", commandId, s.instanceId, aws.ToString(invocation.StatusDetails))
+			}
+			return int(invocation.ResponseCode), nil
+		case ssmtypes.CommandInvocationStatusCancelled, ssmtypes.CommandInvocationStatusTimedOut:
+			return 0, fmt.Errorf("ssm command %s on %s ended with %s", commandId, s.instanceId, invocation.Status)
+		}
+	}
+}
+
+// writeNew writes the part of the content after the first n bytes, as systems manager returns all output so far.
+func writeNew(w io.Writer, content string, n int) int {
+	if len(content) <= n {
+		return n
+	}
+	io.WriteString(w, content[n:])
+	return len(content)
+}
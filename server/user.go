@@ -19,16 +19,29 @@ func NewUser(name string, serv Server) (u User, err error) {
 	return
 }
 
-func (u User) exist() (exist bool, err error) {
-	script := "cat /etc/passwd | grep " + u.Name
-	stdout, err := u.serv.RunScript(script)
+// GetUser returns the user if it exists on the server, so that it can be removed.
+func GetUser(name string, serv Server) (u User, err error) {
+	u, err = NewUser(name, serv)
 	if err != nil {
 		return
 	}
-	exist = stdout != ""
+	exist, err := u.exist()
+	if err != nil {
+		return
+	}
+	if !exist {
+		err = errors.New("User does not exist")
+		return
+	}
+	u.added = true
 	return
 }
 
+func (u User) exist() (exist bool, err error) {
+	script := "cat /etc/passwd | grep " + u.Name
+	return u.serv.check(script)
+}
+
 func (u *User) Create() (id string, err error) {
 	exist, err := u.exist()
 	if err != nil || exist {
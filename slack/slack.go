@@ -78,8 +78,13 @@ var c client
 var statusMessageChan chan string
 
 func NewClient(authToken, secretChannel, statusChennel, commandChannel string) (err error) {
+	return NewClientWithBaseurl("https://slack.com", authToken, secretChannel, statusChennel, commandChannel)
+}
+
+// NewClientWithBaseurl is NewClient against another url than https://slack.com, like a stand in for Slack in tests.
+func NewClientWithBaseurl(baseurl, authToken, secretChannel, statusChennel, commandChannel string) (err error) {
 	c = client{
-		baseurl:        "https://slack.com",
+		baseurl:        baseurl,
 		token:          authToken,
 		secretChannel:  secretChannel,
 		statusChennel:  statusChennel,
@@ -223,11 +228,14 @@ func PostFormAuth(uri string, file slackFile, out interface{}) (err error) {
 	return
 }
 
-func SendCommand(endpoint, body string) (err error) {
-	_, err = sendMessage(fmt.Sprintf(`%[1]scurl --header "Content-Type: application/json" \
-	--header "Authorization: Basic <base64 username and password>" \
-  --request POST \
-  --data '%s' \
-	baseurl/%s%[1]s`, "```", body, endpoint), c.commandChannel, "")
+// SendCommand sends the call to endpoint with the http method as a curl command, together with the user or token that
+// made it.
+func SendCommand(user, method, endpoint, body string) (err error) {
+	_, err = sendMessage(fmt.Sprintf(`Sent by %[2]s
+%[1]scurl --header "Content-Type: application/json" \
+	--header "Authorization: <basic auth or bearer token>" \
+  --request %[5]s \
+  --data '%[3]s' \
+	baseurl/%[4]s%[1]s`, "```", user, body, endpoint, method), c.commandChannel, "")
 	return
 }
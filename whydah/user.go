@@ -0,0 +1,127 @@
+package whydah
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrInvalidUserToken = errors.New("invalid whydah user token")
+
+// UserToken is a Whydah user token, who the user is and the roles the user has in every application.
+type UserToken struct {
+	Id           string        `xml:"id,attr"`
+	Uid          string        `xml:"uid"`
+	Username     string        `xml:"username"`
+	FirstName    string        `xml:"firstname"`
+	LastName     string        `xml:"lastname"`
+	Email        string        `xml:"email"`
+	Timestamp    int64         `xml:"timestamp"`
+	Lifespan     int64         `xml:"lifespan"`
+	Applications []Application `xml:"application"`
+}
+
+type Application struct {
+	Id    string `xml:"ID,attr"`
+	Name  string `xml:"applicationName"`
+	Roles []Role `xml:"role"`
+}
+
+type Role struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// Expires is when the user token is no longer valid, timestamp and lifespan are in milliseconds.
+func (t UserToken) Expires() time.Time {
+	return time.UnixMilli(t.Timestamp + t.Lifespan)
+}
+
+// Roles returns the roles the user has in the application.
+func (t UserToken) Roles(applicationId string) (roles []Role) {
+	for _, a := range t.Applications {
+		if a.Id == applicationId {
+			roles = append(roles, a.Roles...)
+		}
+	}
+	return
+}
+
+type appSession struct {
+	tokenId  string
+	tokenXML string
+	mutex    sync.Mutex
+}
+
+var app appSession
+
+// LoginURL is where users log in with Whydah SSO. After the login they are sent to redirect with a user ticket.
+func LoginURL(redirect string) string {
+	return os.Getenv("whydah_uri") + "/sso/login?redirectURI=" + url.QueryEscape(redirect)
+}
+
+// GetUserToken validates the user token id against the Whydah token service and returns the user token.
+func GetUserToken(userTokenId string) (UserToken, error) {
+	return userTokenCall("get_usertoken_by_usertokenid", url.Values{
+		"usertokenid": {userTokenId},
+	})
+}
+
+// GetUserTokenByTicket returns the user token of the user ticket Whydah SSO redirects back with after a login. A ticket
+// can only be used once.
+func GetUserTokenByTicket(ticket string) (UserToken, error) {
+	return userTokenCall("get_usertoken_by_userticket", url.Values{
+		"userticket": {ticket},
+	})
+}
+
+// userTokenCall calls the user token service as Nerthus. The application token is reused between calls and Nerthus logs
+// on again once if the call fails, in case the application token has expired.
+func userTokenCall(operation string, data url.Values) (t UserToken, err error) {
+	app.mutex.Lock()
+	defer app.mutex.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		if app.tokenId == "" || attempt > 0 {
+			app.tokenId, app.tokenXML, err = logon()
+			if err != nil {
+				return
+			}
+		}
+		data.Set("apptoken", app.tokenXML)
+		t, err = postUserToken(fmt.Sprintf("%s/tokenservice/user/%s/%s", os.Getenv("whydah_uri"), app.tokenId, operation), data)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+func postUserToken(uri string, data url.Values) (t UserToken, err error) {
+	resp, err := http.PostForm(uri, data)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%w: token service responded %d", ErrInvalidUserToken, resp.StatusCode)
+		return
+	}
+	err = xml.Unmarshal(body, &t)
+	if err != nil {
+		return
+	}
+	if t.Id == "" || t.Username == "" {
+		err = fmt.Errorf("%w: user token without id or username", ErrInvalidUserToken)
+	}
+	return
+}
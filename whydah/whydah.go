@@ -32,6 +32,13 @@ type applicationTokenParams struct {
 }
 
 func getWhydahAuthToken() (token string, err error) {
+	token, _, err = logon()
+	return
+}
+
+// logon logs Nerthus on to Whydah as an application and returns the application token id together with the application
+// token itself, the user token calls needs both.
+func logon() (tokenId, tokenXML string, err error) {
 	appCred := applicationcredential{
 		Params: applicationCredentialParams{
 			AppId:     os.Getenv("whydah_application_id"),
@@ -60,7 +67,8 @@ func getWhydahAuthToken() (token string, err error) {
 	if err != nil {
 		return
 	}
-	token = tokenData.Params.AppTokenId
+	tokenId = tokenData.Params.AppTokenId
+	tokenXML = string(body)
 	return
 }
 